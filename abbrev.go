@@ -0,0 +1,228 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+	"sort"
+	"sync"
+)
+
+// MinAbbrev is the fewest hexadecimal digits of an abbreviated object name,
+// as git accepts.
+const MinAbbrev = 4
+
+// Abbreviator is implemented by Stores that abbreviate object names without
+// visiting every object.
+type Abbreviator interface {
+	// ShortestUnique returns the shortest abbreviation of hash naming no
+	// other object.
+	ShortestUnique(hash Hash) (Prefix, error)
+}
+
+// ShortestUnique returns the shortest abbreviation of hash naming no other
+// object of st, of at least as many digits as git chooses for
+// core.abbrev=auto given the number of objects. Every object is visited
+// unless st implements Abbreviator. The object by hash need not exist.
+func ShortestUnique(st Store, hash Hash) (Prefix, error) {
+	if a, ok := st.(Abbreviator); ok {
+		return a.ShortestUnique(hash)
+	}
+	return NewAbbrevIndex(st).ShortestUnique(hash)
+}
+
+// autoAbbrev returns the length of abbreviations chosen by git for
+// core.abbrev=auto among count objects: enough digits that abbreviations
+// of about 2^n objects are unlikely to collide, at least 7.
+func autoAbbrev(count int) int {
+	n := (bits.Len(uint(count)) + 1) / 2
+	if n < 7 {
+		n = 7
+	}
+	return n
+}
+
+// checkAbbrev reports ErrAmbiguous if p has fewer digits than MinAbbrev.
+func checkAbbrev(p Prefix) error {
+	if p.Len() < MinAbbrev {
+		return fmt.Errorf("%w: %q has fewer than %v digits", ErrAmbiguous, p, MinAbbrev)
+	}
+	return nil
+}
+
+// resolveMatches returns the only object beginning with p of those passed
+// to fn by each, reporting AmbiguousError listing every match if there are
+// more.
+func resolveMatches(p Prefix, each func(fn func(Hash) error) error) (Hash, error) {
+	var matches []Hash
+	seen := make(map[Hash]bool)
+	err := each(func(h Hash) error {
+		if p.Match(h) && !seen[h] {
+			seen[h] = true
+			matches = append(matches, h)
+		}
+		return nil
+	})
+	if err != nil {
+		return Hash{}, err
+	}
+	switch len(matches) {
+	case 0:
+		return Hash{}, fmt.Errorf("%w: %s", ErrNotExist, p)
+	case 1:
+		return matches[0], nil
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Compare(matches[j]) < 0 })
+	return Hash{}, &AmbiguousError{Prefix: p, Candidates: matches}
+}
+
+// AbbrevIndex is a sorted index of the names of every object of a Store,
+// resolving and choosing abbreviations by binary search. The Store is
+// visited once, when the index is first used, and again when an
+// abbreviation matches no object, as objects may have been written since.
+// Objects written through the index's owner are added with Add.
+//
+// AbbrevIndex implements PrefixResolver and Abbreviator, and is safe for
+// concurrent use by multiple goroutines.
+type AbbrevIndex struct {
+	st Store
+
+	mu     sync.Mutex
+	names  []Hash // sorted
+	loaded bool
+}
+
+// NewAbbrevIndex returns an AbbrevIndex of objects of st.
+func NewAbbrevIndex(st Store) *AbbrevIndex { return &AbbrevIndex{st: st} }
+
+// Add adds names of objects written to the Store since the index was read.
+func (x *AbbrevIndex) Add(hashes ...Hash) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.loaded {
+		return
+	}
+	for _, h := range hashes {
+		i := search(x.names, h.Bytes())
+		if i < len(x.names) && x.names[i] == h {
+			continue
+		}
+		x.names = append(x.names, Hash{})
+		copy(x.names[i+1:], x.names[i:])
+		x.names[i] = h
+	}
+}
+
+// Reset discards the index, such that the Store is visited again when next
+// used.
+func (x *AbbrevIndex) Reset() {
+	x.mu.Lock()
+	x.names, x.loaded = nil, false
+	x.mu.Unlock()
+}
+
+// load returns the sorted names of all objects, visiting the Store unless
+// already loaded. The index must be locked.
+func (x *AbbrevIndex) load() ([]Hash, error) {
+	if x.loaded {
+		return x.names, nil
+	}
+	var names []Hash
+	if err := x.st.ForEach(func(h Hash) error {
+		names = append(names, h)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].Compare(names[j]) < 0 })
+	// stores such as PackStore may visit an object more than once
+	uniq := names[:0]
+	for i, h := range names {
+		if i == 0 || h != names[i-1] {
+			uniq = append(uniq, h)
+		}
+	}
+	x.names, x.loaded = uniq, true
+	return x.names, nil
+}
+
+// search returns the index of the first of sorted names not less than b.
+func search(names []Hash, b []byte) int {
+	return sort.Search(len(names), func(i int) bool {
+		return bytes.Compare(names[i].Bytes(), b) >= 0
+	})
+}
+
+// ResolvePrefix implements PrefixResolver. The returned error wraps
+// ErrNotExist if no object begins with p, and is an AmbiguousError if more
+// than one does.
+func (x *AbbrevIndex) ResolvePrefix(p Prefix) (Hash, error) {
+	if err := checkAbbrev(p); err != nil {
+		return Hash{}, err
+	}
+	h, err := x.resolve(p)
+	if isNotExist(err) {
+		x.Reset()
+		h, err = x.resolve(p)
+	}
+	return h, err
+}
+
+func (x *AbbrevIndex) resolve(p Prefix) (Hash, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	names, err := x.load()
+	if err != nil {
+		return Hash{}, err
+	}
+	return resolveMatches(p, func(fn func(Hash) error) error {
+		b := p.bytes()
+		for i := search(names, b); i < len(names) && bytes.HasPrefix(names[i].Bytes(), b); i++ {
+			fn(names[i])
+		}
+		return nil
+	})
+}
+
+// ShortestUnique implements Abbreviator, returning the shortest abbreviation
+// of hash naming no other object, of at least as many digits as git chooses
+// for core.abbrev=auto given the number of objects.
+func (x *AbbrevIndex) ShortestUnique(hash Hash) (Prefix, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	names, err := x.load()
+	if err != nil {
+		return Prefix{}, err
+	}
+	n := autoAbbrev(len(names))
+	// only the names sorted either side of hash share the longest prefix
+	i := search(names, hash.Bytes())
+	for _, j := range []int{i - 1, i, i + 1} {
+		if j < 0 || j >= len(names) || names[j] == hash {
+			continue
+		}
+		if d := commonDigits(hash, names[j]) + 1; d > n {
+			n = d
+		}
+		if j == i {
+			break
+		}
+	}
+	return hash.Abbrev(n), nil
+}
+
+// commonDigits returns the number of leading hexadecimal digits of a and b
+// that are equal.
+func commonDigits(a, b Hash) int {
+	ab, bb := a.Bytes(), b.Bytes()
+	i := 0
+	for ; i < len(ab) && i < len(bb); i++ {
+		if c := ab[i] ^ bb[i]; c != 0 {
+			if c&0xf0 == 0 {
+				return 2*i + 1
+			}
+			return 2 * i
+		}
+	}
+	return 2 * i
+}
@@ -0,0 +1,141 @@
+package git
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// CacheStore is a Store caching the content of small objects read from the
+// underlying Store, so that objects read repeatedly, such as the trees of a
+// walk, are only inflated once. Once content cached exceeds its limit, the
+// least recently used objects are evicted.
+//
+// Only Reader populates the cache, which Has and Stat also consult; other
+// methods are those of the underlying Store.
+type CacheStore struct {
+	Store
+	format ObjectFormat
+	cache  *lru
+}
+
+// NewCacheStore returns a CacheStore caching up to limit bytes of content
+// of objects of st. Objects larger than a sixteenth of limit are not
+// cached, so that reading them does not evict many smaller ones.
+func NewCacheStore(st Store, limit int64) *CacheStore {
+	return &CacheStore{Store: st, format: formatOf(st), cache: newLRU(limit)}
+}
+
+// Reader implements Store, reading cached content if available.
+func (st *CacheStore) Reader(hash Hash, options ...func(*Reader)) (*Reader, error) {
+	options = append([]func(*Reader){FormatReader(st.format)}, options...)
+	if t, data, ok := st.cache.get(hash); ok {
+		return newRawReader(t, int64(len(data)), bytes.NewReader(data), options...), nil
+	}
+
+	r, err := st.Store.Reader(hash)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() > st.cache.limit/16 {
+		return newRawReader(r.Type(), r.Len(), r, options...), nil
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != r.Len() {
+		return nil, fmt.Errorf("%w: %s has length %v, want %v", ErrCorrupt, hash, len(data), r.Len())
+	}
+	st.cache.add(hash, r.Type(), data)
+	return newRawReader(r.Type(), r.Len(), bytes.NewReader(data), options...), nil
+}
+
+// Has implements Store, reporting cached objects exist.
+func (st *CacheStore) Has(hash Hash) (bool, error) {
+	if _, _, ok := st.cache.get(hash); ok {
+		return true, nil
+	}
+	return st.Store.Has(hash)
+}
+
+// Stat implements Store, reading the type and length of cached objects.
+func (st *CacheStore) Stat(hash Hash) (Type, int64, error) {
+	if t, data, ok := st.cache.get(hash); ok {
+		return t, int64(len(data)), nil
+	}
+	return st.Store.Stat(hash)
+}
+
+// ResolvePrefix implements PrefixResolver with the underlying Store.
+func (st *CacheStore) ResolvePrefix(p Prefix) (Hash, error) { return ResolvePrefix(st.Store, p) }
+
+// ShortestUnique implements Abbreviator with the underlying Store.
+func (st *CacheStore) ShortestUnique(hash Hash) (Prefix, error) {
+	return ShortestUnique(st.Store, hash)
+}
+
+// ObjectFormat returns the object format of the underlying Store.
+func (st *CacheStore) ObjectFormat() ObjectFormat { return st.format }
+
+// lru caches types and content of objects up to a total length, evicting
+// the least recently used. A nil lru caches nothing. An lru is safe for
+// concurrent use by multiple goroutines.
+type lru struct {
+	limit int64
+
+	mu   sync.Mutex
+	size int64
+	ll   list.List
+	m    map[interface{}]*list.Element
+}
+
+type lruEntry struct {
+	key  interface{}
+	t    Type
+	data []byte
+}
+
+func newLRU(limit int64) *lru {
+	return &lru{limit: limit, m: make(map[interface{}]*list.Element)}
+}
+
+// get returns the type and content cached by key, marking it recently used.
+// Content returned must not be modified.
+func (c *lru) get(key interface{}) (Type, []byte, bool) {
+	if c == nil {
+		return 0, nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[key]
+	if !ok {
+		return 0, nil, false
+	}
+	c.ll.MoveToFront(e)
+	ent := e.Value.(*lruEntry)
+	return ent.t, ent.data, true
+}
+
+// add caches type t and content data by key, evicting entries until the
+// total length is within the limit.
+func (c *lru) add(key interface{}, t Type, data []byte) {
+	if c == nil || int64(len(data)) > c.limit {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.m[key]; ok {
+		return
+	}
+	c.m[key] = c.ll.PushFront(&lruEntry{key, t, data})
+	c.size += int64(len(data))
+	for c.size > c.limit {
+		ent := c.ll.Remove(c.ll.Back()).(*lruEntry)
+		delete(c.m, ent.key)
+		c.size -= int64(len(ent.data))
+	}
+}
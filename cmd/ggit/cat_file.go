@@ -30,10 +30,18 @@ func NewCatFile(args []string) Runner {
 
 func (cmd *CatFile) Run() {
 	log.SetPrefix("ggit cat-file: ")
-	hash := cmd.fset.Arg(0)
-	if hash == "" {
+	name := cmd.fset.Arg(0)
+	if name == "" {
 		log.Fatal("no hash given")
 	}
+	p, err := git.ParsePrefix(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hash, err := git.ResolvePrefix(store, p)
+	if err != nil {
+		log.Fatalf("ResolvePrefix(%s): %s", name, err)
+	}
 	r, err := store.Reader(hash, git.PrettyReader)
 	if err != nil {
 		log.Fatalf("Reader(%s): %s", hash, err)
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"dasa.cc/git"
+	"dasa.cc/git/transport"
+)
+
+type Fetch struct {
+	fset *flag.FlagSet
+
+	flagQuiet        *bool
+	flagDepth        *int
+	flagShallowSince *string
+	flagFilter       *string
+}
+
+func NewFetch(args []string) Runner {
+	r := &Fetch{}
+	r.fset = flag.NewFlagSet("fetch", flag.ContinueOnError)
+	r.flagQuiet = r.fset.Bool("q", false, "do not report progress")
+	r.flagDepth = r.fset.Int("depth", 0, "limit history to `n` commits")
+	r.flagShallowSince = r.fset.String("shallow-since", "", "limit history to commits after `date`")
+	r.flagFilter = r.fset.String("filter", "", "omit objects by `spec`: blob:none, blob:limit=n or tree:0")
+	r.fset.Parse(args)
+	return r
+}
+
+func (cmd *Fetch) Run() {
+	log.SetPrefix("ggit fetch: ")
+	url := cmd.fset.Arg(0)
+	if url == "" {
+		log.Fatal("no repository given")
+	}
+
+	// a configured remote names its url and default refspecs
+	refspecs := cmd.fset.Args()[1:]
+	if r, err := repo.Config.Remote(url); errors.Is(err, git.ErrInvalidConfig) {
+		log.Fatal(err)
+	} else if err == nil && len(r.URLs) > 0 {
+		url = r.URLs[0]
+		if len(refspecs) == 0 {
+			for _, rs := range r.Fetch {
+				refspecs = append(refspecs, rs.String())
+			}
+		}
+	}
+
+	opts := &transport.FetchOptions{}
+	if !*cmd.flagQuiet {
+		opts.Progress = os.Stderr
+	}
+	t, err := remoteTransport(url)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.Transport = t
+	opts.Depth = *cmd.flagDepth
+	if *cmd.flagShallowSince != "" {
+		if opts.ShallowSince, err = parseDate(*cmd.flagShallowSince); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if opts.Filter, err = git.ParseFilter(*cmd.flagFilter); err != nil {
+		log.Fatal(err)
+	}
+	if opts.Shallow, err = git.ReadShallow(repo.CommonDir); err != nil {
+		log.Fatal(err)
+	}
+
+	res, err := transport.Fetch(context.Background(), url, store, repo.Refs, refspecs, opts)
+	if res != nil {
+		if werr := git.WriteShallow(repo.CommonDir, res.Shallow); werr != nil {
+			log.Fatal(werr)
+		}
+		for _, u := range res.Updates {
+			fmt.Printf("%s..%s %s\n", short(u.Old), short(u.New), u.Name)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseDate parses a date as a unix timestamp, RFC 3339 time or day.
+func parseDate(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q", s)
+	}
+	return t, nil
+}
+
+// remoteTransport serves local repositories in process. Transport is nil for
+// http and https URLs.
+func remoteTransport(url string) (transport.Transport, error) {
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		return nil, nil
+	}
+	r, err := git.Open(strings.TrimPrefix(url, "file://"))
+	if err != nil {
+		return nil, err
+	}
+	return &transport.Local{Store: r.Store, Refs: r.Refs}, nil
+}
+
+// short abbreviates hash as git does with core.abbrev=auto.
+func short(hash git.Hash) string {
+	p, err := git.ShortestUnique(store, hash)
+	if err != nil {
+		return hash.Abbrev(7).String()
+	}
+	return p.String()
+}
@@ -45,39 +45,30 @@ func (cmd *HashObject) Run() {
 
 	var (
 		w git.Writer
-		n int
-		r io.Reader
+		n int64     = -1
+		r io.Reader = os.Stdin
 	)
 
 	if *cmd.flagWrite {
 		w = store.Writer()
 	} else {
-		tmp, err := ioutil.TempFile("", "ggithashobject")
-		defer os.Remove(tmp.Name())
-		check(err)
-		w = git.NewWriter(tmp)
-	}
-
-	if *cmd.flagStdin {
-		tmp, err := ioutil.TempFile("", "ggithashobjectstdin")
-		check(err)
-		defer os.Remove(tmp.Name())
-		_, err = io.Copy(tmp, os.Stdin)
-		check(err)
-		name = tmp.Name()
-		tmp.Close()
+		w = git.NewWriterFormat(ioutil.Discard, repo.ObjectFormat)
 	}
 
-	if name != "" {
+	// stdin is of unknown size and streamed through Writer
+	if name != "" && !*cmd.flagStdin {
 		f, err := os.Open(name)
 		check(err)
+		defer f.Close()
 		fi, err := f.Stat()
 		check(err)
-		n = int(fi.Size())
+		n = fi.Size()
 		r = f
 	}
 
-	_, err := w.WriteHeader(git.ParseType([]byte(*cmd.flagType)), n)
+	t, err := git.ParseType([]byte(*cmd.flagType))
+	check(err)
+	_, err = w.WriteHeader(t, n)
 	check(err)
 	_, err = io.Copy(w, r)
 	check(err)
@@ -9,32 +9,36 @@ import (
 	"dasa.cc/git"
 )
 
-var store git.Store
+var (
+	repo  *git.Repository
+	store git.Store
+)
 
 type Runner interface {
 	Run()
 }
 
 var commands = map[string]func([]string) Runner{
-	"cat-file":    NewCatFile,
-	"hash-object": NewHashObject,
+	"cat-file":         NewCatFile,
+	"fetch":            NewFetch,
+	"hash-object":      NewHashObject,
+	"multi-pack-index": NewMultiPackIndex,
+	"push":             NewPush,
 }
 
 func main() {
 	log.SetPrefix("ggit: ")
 	log.SetFlags(0)
 
-	defer func() {
-		if r := recover(); r != nil {
-			log.Fatal(r)
-		}
-	}()
-
 	wd, err := os.Getwd()
 	if err != nil {
 		log.Fatalf("Get working directory: %s", err)
 	}
-	store = git.DiskStore(git.Dir(wd))
+	repo, err = git.Open(wd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store = repo.Store
 
 	if len(os.Args) == 1 {
 		log.Fatal("no arguments")
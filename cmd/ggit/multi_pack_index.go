@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"dasa.cc/git"
+)
+
+type MultiPackIndex struct {
+	fset *flag.FlagSet
+}
+
+func NewMultiPackIndex(args []string) Runner {
+	r := &MultiPackIndex{}
+	r.fset = flag.NewFlagSet("multi-pack-index", flag.ContinueOnError)
+	r.fset.Parse(args)
+	return r
+}
+
+func (cmd *MultiPackIndex) Run() {
+	log.SetPrefix("ggit multi-pack-index: ")
+	switch sub := cmd.fset.Arg(0); sub {
+	case "write":
+		if err := git.WriteMultiPackIndex(repo.CommonDir); err != nil {
+			log.Fatal(err)
+		}
+	case "":
+		log.Fatal("no subcommand given")
+	default:
+		log.Fatalf("subcommand %q not found", sub)
+	}
+}
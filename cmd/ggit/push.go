@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"dasa.cc/git/transport"
+)
+
+type Push struct {
+	fset *flag.FlagSet
+
+	flagQuiet  *bool
+	flagAtomic *bool
+}
+
+func NewPush(args []string) Runner {
+	r := &Push{}
+	r.fset = flag.NewFlagSet("push", flag.ContinueOnError)
+	r.flagQuiet = r.fset.Bool("q", false, "do not report progress")
+	r.flagAtomic = r.fset.Bool("atomic", false, "update all references or none")
+	r.fset.Parse(args)
+	return r
+}
+
+func (cmd *Push) Run() {
+	log.SetPrefix("ggit push: ")
+	url := cmd.fset.Arg(0)
+	if url == "" {
+		log.Fatal("no repository given")
+	}
+	if cmd.fset.NArg() < 2 {
+		log.Fatal("no refspec given")
+	}
+
+	opts := &transport.PushOptions{Atomic: *cmd.flagAtomic}
+	if !*cmd.flagQuiet {
+		opts.Progress = os.Stderr
+	}
+	t, err := remoteTransport(url)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.Transport = t
+
+	statuses, err := transport.Push(context.Background(), url, store, repo.Refs, cmd.fset.Args()[1:], opts)
+	for _, s := range statuses {
+		if s.Err != nil {
+			fmt.Printf("! [rejected] %s (%v)\n", s.Name, s.Err)
+		} else {
+			fmt.Printf("%s..%s %s\n", short(s.Old), short(s.New), s.Name)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,1009 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ConfigFile is a git config file of variables in sections, such as
+//
+//	[core]
+//		bare = true
+//	[remote "origin"]
+//		url = https://example.com/repo.git
+//
+// whose variables are named by keys "core.bare" and "remote.origin.url".
+// Section and variable names are case-insensitive while subsection names,
+// such as origin, are not. Edits preserve the layout and comments of the
+// rest of the file.
+//
+// Include directives are not followed; see LoadConfig.
+type ConfigFile struct {
+	// Path is the file read by ReadConfigFile and written by Save.
+	Path string
+
+	items []*configItem
+}
+
+// configItem is a section header, variable, or blank and comment lines of a
+// config file, whose raw text is written back unchanged unless edited.
+type configItem struct {
+	raw string
+
+	// section and name are lower case; name is empty for other than
+	// variables.
+	section, subsection string
+	name                string
+	value               string
+	novalue             bool
+
+	// header is set for section headers, whose text is the first hlen
+	// bytes of raw.
+	header bool
+	hlen   int
+}
+
+// ParseConfig parses a config file read from r.
+func ParseConfig(r io.Reader) (*ConfigFile, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data, "")
+}
+
+func parseConfig(data []byte, path string) (*ConfigFile, error) {
+	p := &configParser{data: data, path: path, line: 1}
+	items, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	return &ConfigFile{Path: path, items: items}, nil
+}
+
+// ReadConfigFile reads the config file at path.
+func ReadConfigFile(path string) (*ConfigFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data, path)
+}
+
+// Get returns the last value of key, reporting whether key is set. A
+// variable without a value, meaning true, has an empty value.
+func (cf *ConfigFile) Get(key string) (string, bool) {
+	vs := cf.GetAll(key)
+	if len(vs) == 0 {
+		return "", false
+	}
+	return vs[len(vs)-1], true
+}
+
+// GetAll returns the values of key, in order.
+func (cf *ConfigFile) GetAll(key string) []string {
+	section, subsection, name, err := splitConfigKey(key)
+	if err != nil {
+		return nil
+	}
+	var vs []string
+	for _, it := range cf.items {
+		if it.name == name && it.section == section && it.subsection == subsection {
+			vs = append(vs, it.value)
+		}
+	}
+	return vs
+}
+
+// Entries returns the variables of the file, in order.
+func (cf *ConfigFile) Entries() []ConfigEntry {
+	var es []ConfigEntry
+	for _, it := range cf.items {
+		if it.name != "" {
+			es = append(es, ConfigEntry{Key: it.key(), Value: it.value, Path: cf.Path, novalue: it.novalue})
+		}
+	}
+	return es
+}
+
+// Set sets key to value, replacing every value of key. A new variable is
+// added to the end of the last section it belongs to, adding the section
+// if necessary.
+func (cf *ConfigFile) Set(key, value string) error {
+	section, subsection, name, err := splitConfigKey(key)
+	if err != nil {
+		return err
+	}
+	last := -1
+	for i := len(cf.items) - 1; i >= 0; i-- {
+		it := cf.items[i]
+		if it.name != name || it.section != section || it.subsection != subsection {
+			continue
+		}
+		if last == -1 {
+			last = i
+			continue
+		}
+		cf.remove(i)
+		last--
+	}
+	if last == -1 {
+		return cf.Add(key, value)
+	}
+	it := cf.items[last]
+	raw := configLine(key[strings.LastIndexByte(key, '.')+1:], value)
+	// a variable following its section header keeps the header's line
+	if last > 0 && !strings.HasSuffix(cf.items[last-1].raw, "\n") {
+		raw = " " + strings.TrimPrefix(raw, "\t")
+	}
+	*it = configItem{raw: raw, section: section, subsection: subsection, name: name, value: value}
+	return nil
+}
+
+// Add adds value to key, following any values it has, as for variables
+// of multiple values.
+func (cf *ConfigFile) Add(key, value string) error {
+	section, subsection, name, err := splitConfigKey(key)
+	if err != nil {
+		return err
+	}
+	it := &configItem{
+		raw:        configLine(key[strings.LastIndexByte(key, '.')+1:], value),
+		section:    section,
+		subsection: subsection,
+		name:       name,
+		value:      value,
+	}
+
+	// following the last value, or the last variable of the section
+	at, last := -1, -1
+	for i, x := range cf.items {
+		if x.section != section || x.subsection != subsection || !x.header && x.name == "" {
+			continue
+		}
+		if at = i; x.name == name {
+			last = i
+		}
+	}
+	if last != -1 {
+		at = last
+	}
+	if at == -1 {
+		h := configHeader(section, subsection)
+		cf.insert(len(cf.items), &configItem{
+			raw:        h,
+			section:    section,
+			subsection: subsection,
+			header:     true,
+			hlen:       len(h) - 1,
+		})
+		at = len(cf.items) - 1
+	}
+	cf.insert(at+1, it)
+	return nil
+}
+
+// Unset removes every value of key, reporting whether it was set.
+func (cf *ConfigFile) Unset(key string) bool {
+	section, subsection, name, err := splitConfigKey(key)
+	if err != nil {
+		return false
+	}
+	found := false
+	for i := len(cf.items) - 1; i >= 0; i-- {
+		it := cf.items[i]
+		if it.name == name && it.section == section && it.subsection == subsection {
+			cf.remove(i)
+			found = true
+		}
+	}
+	return found
+}
+
+// RemoveSection removes every section named by section and subsection,
+// with their variables, reporting whether one existed.
+func (cf *ConfigFile) RemoveSection(section, subsection string) bool {
+	section = strings.ToLower(section)
+	found := false
+	for i := len(cf.items) - 1; i >= 0; i-- {
+		it := cf.items[i]
+		if it.section == section && it.subsection == subsection && (it.header || it.name != "") {
+			cf.remove(i)
+			found = true
+		}
+	}
+	return found
+}
+
+// RenameSection renames every section named by section and subsection,
+// reporting whether one existed.
+func (cf *ConfigFile) RenameSection(section, subsection, newSection, newSubsection string) (bool, error) {
+	section, newSection = strings.ToLower(section), strings.ToLower(newSection)
+	if !validConfigSection(newSection) {
+		return false, fmt.Errorf("%w: invalid section name %q", ErrInvalidConfig, newSection)
+	}
+	found := false
+	for _, it := range cf.items {
+		if it.section != section || it.subsection != subsection {
+			continue
+		}
+		if it.header {
+			// comments or a variable may follow the header on its line
+			h := strings.TrimSuffix(configHeader(newSection, newSubsection), "\n")
+			it.raw, it.hlen = h+it.raw[it.hlen:], len(h)
+			found = true
+		}
+		it.section, it.subsection = newSection, newSubsection
+	}
+	return found, nil
+}
+
+// insert inserts it at index i, ending the preceding line if necessary.
+func (cf *ConfigFile) insert(i int, it *configItem) {
+	if i > 0 && !strings.HasSuffix(cf.items[i-1].raw, "\n") {
+		cf.items[i-1].raw += "\n"
+	}
+	cf.items = append(cf.items, nil)
+	copy(cf.items[i+1:], cf.items[i:])
+	cf.items[i] = it
+}
+
+// remove removes the item at index i. A variable sharing the line of its
+// section header leaves the header's line ended.
+func (cf *ConfigFile) remove(i int) {
+	if i > 0 && strings.HasSuffix(cf.items[i].raw, "\n") && !strings.HasSuffix(cf.items[i-1].raw, "\n") {
+		cf.items[i-1].raw += "\n"
+	}
+	cf.items = append(cf.items[:i], cf.items[i+1:]...)
+}
+
+// WriteTo writes the config file to w.
+func (cf *ConfigFile) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	for _, it := range cf.items {
+		buf.WriteString(it.raw)
+	}
+	return buf.WriteTo(w)
+}
+
+// Save replaces the file at Path by taking a lock file, written and renamed
+// into place.
+func (cf *ConfigFile) Save() error {
+	f, err := os.OpenFile(cf.Path+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("git: unable to lock %s: %w", cf.Path, err)
+	}
+	_, err = cf.WriteTo(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), cf.Path)
+}
+
+// key returns the variable's key with section and name in lower case.
+func (it *configItem) key() string {
+	if it.subsection == "" {
+		return it.section + "." + it.name
+	}
+	return it.section + "." + it.subsection + "." + it.name
+}
+
+// splitConfigKey splits key, as "section.subsection.name", returning the
+// section and name in lower case.
+func splitConfigKey(key string) (section, subsection, name string, err error) {
+	i, j := strings.IndexByte(key, '.'), strings.LastIndexByte(key, '.')
+	if i == -1 {
+		return "", "", "", fmt.Errorf("%w: key %q has no section", ErrInvalidConfig, key)
+	}
+	section, name = strings.ToLower(key[:i]), strings.ToLower(key[j+1:])
+	if i < j {
+		subsection = key[i+1 : j]
+	}
+	if !validConfigSection(section) || !validConfigName(name) {
+		return "", "", "", fmt.Errorf("%w: invalid key %q", ErrInvalidConfig, key)
+	}
+	return section, subsection, name, nil
+}
+
+// validConfigSection reports whether s is a section name of letters,
+// digits, '-' and '.'.
+func validConfigSection(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !isAlnum(c) && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// validConfigName reports whether s is a variable name of letters, digits
+// and '-', beginning with a letter.
+func validConfigName(s string) bool {
+	if s == "" || !isAlpha(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if c := s[i]; !isAlnum(c) && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlpha(c byte) bool { return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' }
+func isAlnum(c byte) bool { return isAlpha(c) || '0' <= c && c <= '9' }
+
+// configHeader returns a section header line.
+func configHeader(section, subsection string) string {
+	if subsection == "" {
+		return "[" + section + "]\n"
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return "[" + section + ` "` + r.Replace(subsection) + `"]` + "\n"
+}
+
+// configLine returns a variable's line, quoting and escaping value as
+// required to read it back.
+func configLine(name, value string) string {
+	var b strings.Builder
+	quote := strings.ContainsAny(value, "#;") || strings.TrimSpace(value) != value
+	b.WriteString("\t" + name + " = ")
+	if quote {
+		b.WriteByte('"')
+	}
+	for _, c := range []byte(value) {
+		switch c {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\b':
+			b.WriteString(`\b`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if quote {
+		b.WriteByte('"')
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// configParser splits config data into items.
+type configParser struct {
+	data []byte
+	path string
+	pos  int
+	line int
+
+	section, subsection string
+}
+
+func (p *configParser) errorf(format string, args ...interface{}) error {
+	path := p.path
+	if path == "" {
+		path = "line"
+	}
+	return fmt.Errorf("%w: %s:%d: %s", ErrInvalidConfig, path, p.line, fmt.Sprintf(format, args...))
+}
+
+// peek returns the next byte, or 0 at the end of data. parse first checks
+// data contains no NUL bytes, which would otherwise be taken for the end.
+func (p *configParser) peek() byte {
+	if p.pos < len(p.data) {
+		return p.data[p.pos]
+	}
+	return 0
+}
+
+func (p *configParser) next() byte {
+	c := p.peek()
+	if c != 0 {
+		p.pos++
+		if c == '\n' {
+			p.line++
+		}
+	}
+	return c
+}
+
+func (p *configParser) skipSpace() {
+	for c := p.peek(); c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v'; c = p.peek() {
+		p.pos++
+	}
+}
+
+// skipLine skips the remainder of the line, as of a comment.
+func (p *configParser) skipLine() {
+	for c := p.next(); c != 0 && c != '\n'; c = p.next() {
+	}
+}
+
+func (p *configParser) parse() ([]*configItem, error) {
+	if i := bytes.IndexByte(p.data, 0); i != -1 {
+		p.line += bytes.Count(p.data[:i], []byte("\n"))
+		return nil, p.errorf("NUL byte")
+	}
+	var items []*configItem
+	start := 0
+	if bytes.HasPrefix(p.data, []byte("\xef\xbb\xbf")) {
+		p.pos = 3
+	}
+	for {
+		p.skipSpace()
+		c := p.peek()
+		switch {
+		case c == 0:
+			if start < p.pos {
+				items = append(items, &configItem{raw: string(p.data[start:])})
+			}
+			return items, nil
+		case c == '\n' || c == '#' || c == ';':
+			p.skipLine()
+			items = append(items, &configItem{raw: string(p.data[start:p.pos])})
+		case c == '[':
+			if err := p.header(); err != nil {
+				return nil, err
+			}
+			hlen := p.pos - start
+			// the rest of the line is kept with the header unless a
+			// variable follows
+			end := p.pos
+			p.skipSpace()
+			if c := p.peek(); c == 0 || c == '\n' || c == '#' || c == ';' {
+				p.skipLine()
+				end = p.pos
+			}
+			p.pos = end
+			items = append(items, &configItem{raw: string(p.data[start:p.pos]), section: p.section, subsection: p.subsection, header: true, hlen: hlen})
+		case isAlpha(c):
+			it, err := p.variable()
+			if err != nil {
+				return nil, err
+			}
+			it.raw = string(p.data[start:p.pos])
+			items = append(items, it)
+		default:
+			return nil, p.errorf("unexpected %q", c)
+		}
+		start = p.pos
+	}
+}
+
+// header parses a section header, as [section "subsection"] or the
+// deprecated [section.subsection], whose subsection is case-insensitive.
+func (p *configParser) header() error {
+	p.next() // [
+	var name []byte
+	for {
+		c := p.next()
+		switch {
+		case c == ']':
+			s := strings.ToLower(string(name))
+			p.section, p.subsection = s, ""
+			if i := strings.IndexByte(s, '.'); i != -1 {
+				p.section, p.subsection = s[:i], s[i+1:]
+			}
+			if !validConfigSection(p.section) {
+				return p.errorf("invalid section %q", name)
+			}
+			return nil
+		case c == ' ' || c == '\t':
+			p.skipSpace()
+			if p.next() != '"' {
+				return p.errorf("invalid section header")
+			}
+			sub, err := p.subsectionName()
+			if err != nil {
+				return err
+			}
+			if p.next() != ']' {
+				return p.errorf("invalid section header")
+			}
+			p.section, p.subsection = strings.ToLower(string(name)), sub
+			if !validConfigSection(p.section) || strings.Contains(p.section, ".") {
+				return p.errorf("invalid section %q", name)
+			}
+			return nil
+		case isAlnum(c) || c == '-' || c == '.':
+			name = append(name, c)
+		default:
+			return p.errorf("invalid section header")
+		}
+	}
+}
+
+// subsectionName parses a quoted subsection name following its opening
+// quote. Backslashes escape the following character.
+func (p *configParser) subsectionName() (string, error) {
+	var b []byte
+	for {
+		c := p.next()
+		switch c {
+		case 0, '\n':
+			return "", p.errorf("unterminated subsection")
+		case '"':
+			return string(b), nil
+		case '\\':
+			if c = p.next(); c == 0 || c == '\n' {
+				return "", p.errorf("unterminated subsection")
+			}
+		}
+		b = append(b, c)
+	}
+}
+
+// variable parses a variable and its value to the end of the line.
+func (p *configParser) variable() (*configItem, error) {
+	if p.section == "" {
+		return nil, p.errorf("variable outside of section")
+	}
+	it := &configItem{section: p.section, subsection: p.subsection}
+	start := p.pos
+	for c := p.peek(); isAlnum(c) || c == '-'; c = p.peek() {
+		p.pos++
+	}
+	it.name = strings.ToLower(string(p.data[start:p.pos]))
+	p.skipSpace()
+	switch c := p.peek(); c {
+	case 0, '\n', '#', ';':
+		p.skipLine()
+		it.novalue = true
+		return it, nil
+	case '=':
+		p.next()
+	default:
+		return nil, p.errorf("invalid variable %q", it.name)
+	}
+
+	// whitespace is trimmed, and kept between words, outside of quotes
+	var (
+		b      []byte
+		spaces int
+		quote  bool
+	)
+	p.skipSpace()
+	for {
+		c := p.next()
+		switch {
+		case c == 0 || c == '\n':
+			if quote {
+				return nil, p.errorf("unterminated quote")
+			}
+			it.value = string(b)
+			return it, nil
+		case !quote && (c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v'):
+			spaces++
+			continue
+		case !quote && (c == '#' || c == ';'):
+			p.skipLine()
+			it.value = string(b)
+			return it, nil
+		}
+		for ; spaces > 0; spaces-- {
+			b = append(b, ' ')
+		}
+		switch c {
+		case '\\':
+			switch c = p.next(); c {
+			case '\n':
+				continue
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'n':
+				c = '\n'
+			case '\\', '"':
+			default:
+				return nil, p.errorf("invalid escape in value of %q", it.name)
+			}
+		case '"':
+			quote = !quote
+			continue
+		}
+		b = append(b, c)
+	}
+}
+
+// ConfigScope is the scope of a config file: the system, the user, or a
+// repository.
+type ConfigScope int
+
+const (
+	ScopeSystem ConfigScope = iota + 1
+	ScopeGlobal
+	ScopeLocal
+)
+
+func (s ConfigScope) String() string {
+	switch s {
+	case ScopeSystem:
+		return "system"
+	case ScopeGlobal:
+		return "global"
+	case ScopeLocal:
+		return "local"
+	}
+	return fmt.Sprintf("ConfigScope(%d)", int(s))
+}
+
+// ConfigEntry is a variable of a config file.
+type ConfigEntry struct {
+	// Key is the variable's key with its section and name in lower case.
+	Key   string
+	Value string
+
+	// Scope and Path are of the file setting the variable, which may be
+	// included by a file of the scope.
+	Scope ConfigScope
+	Path  string
+
+	novalue bool
+}
+
+// maxConfigIncludes limits the depth of included files, as of cycles.
+const maxConfigIncludes = 10
+
+// Config is the configuration of a repository, read from the config files
+// of each scope in order of increasing precedence. Later values of a key
+// override earlier ones.
+type Config struct {
+	entries []ConfigEntry
+}
+
+// LoadConfig reads the configuration of git directory dir from the system
+// config file, the user's global config files and the repository's config
+// file, following include.path and includeIf.<condition>.path directives.
+// Files that do not exist are skipped. If dir is empty, only system and
+// global files are read.
+//
+// The system file is /etc/gitconfig or GIT_CONFIG_SYSTEM, and is skipped if
+// GIT_CONFIG_NOSYSTEM is true. The global files are
+// $XDG_CONFIG_HOME/git/config and ~/.gitconfig, or GIT_CONFIG_GLOBAL.
+//
+// Included files are read relative to the file including them. The
+// conditions gitdir:, gitdir/i: and onbranch: are supported.
+func LoadConfig(dir string) (*Config, error) {
+	c := &Config{}
+	if dir != "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		dir = abs
+	}
+	var files []struct {
+		scope ConfigScope
+		path  string
+	}
+	add := func(scope ConfigScope, path string) {
+		files = append(files, struct {
+			scope ConfigScope
+			path  string
+		}{scope, path})
+	}
+
+	if nosys, _ := parseConfigBool(os.Getenv("GIT_CONFIG_NOSYSTEM"), false); !nosys {
+		p := os.Getenv("GIT_CONFIG_SYSTEM")
+		if p == "" {
+			p = "/etc/gitconfig"
+		}
+		add(ScopeSystem, p)
+	}
+	if p := os.Getenv("GIT_CONFIG_GLOBAL"); p != "" {
+		add(ScopeGlobal, p)
+	} else {
+		home := os.Getenv("HOME")
+		xdg := os.Getenv("XDG_CONFIG_HOME")
+		if xdg == "" && home != "" {
+			xdg = filepath.Join(home, ".config")
+		}
+		if xdg != "" {
+			add(ScopeGlobal, filepath.Join(xdg, "git", "config"))
+		}
+		if home != "" {
+			add(ScopeGlobal, filepath.Join(home, ".gitconfig"))
+		}
+	}
+	if dir != "" {
+		add(ScopeLocal, filepath.Join(commonDir(dir), "config"))
+	}
+
+	for _, f := range files {
+		if err := c.read(f.path, f.scope, dir, 0); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// read appends the variables of the file at path, and of files it includes,
+// to c.
+func (c *Config) read(path string, scope ConfigScope, dir string, depth int) error {
+	if depth > maxConfigIncludes {
+		return fmt.Errorf("%w: exceeded maximum include depth reading %s", ErrInvalidConfig, path)
+	}
+	cf, err := ReadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range cf.Entries() {
+		e.Scope = scope
+		c.entries = append(c.entries, e)
+
+		var include bool
+		switch {
+		case e.Key == "include.path":
+			include = true
+		case strings.HasPrefix(e.Key, "includeif.") && strings.HasSuffix(e.Key, ".path"):
+			cond := e.Key[len("includeif.") : len(e.Key)-len(".path")]
+			include = configCondition(cond, path, dir)
+		}
+		if !include || e.novalue || e.Value == "" {
+			continue
+		}
+		p := expandConfigPath(e.Value)
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(filepath.Dir(path), p)
+		}
+		if err := c.read(p, scope, dir, depth+1); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// configCondition reports whether the condition of an includeIf section is
+// met for git directory dir, as included by the file at path.
+func configCondition(cond, path, dir string) bool {
+	var (
+		pattern string
+		fold    bool
+	)
+	switch {
+	case strings.HasPrefix(cond, "gitdir:"):
+		pattern = cond[7:]
+	case strings.HasPrefix(cond, "gitdir/i:"):
+		pattern, fold = cond[9:], true
+	case strings.HasPrefix(cond, "onbranch:"):
+		if dir == "" {
+			return false
+		}
+		head, err := ioutil.ReadFile(filepath.Join(dir, "HEAD"))
+		if err != nil || !bytes.HasPrefix(head, []byte("ref: refs/heads/")) {
+			return false
+		}
+		pattern = cond[9:]
+		if strings.HasSuffix(pattern, "/") {
+			pattern += "**"
+		}
+		return matchConfigPattern(pattern, strings.TrimSpace(string(head[16:])), false)
+	default:
+		return false
+	}
+	if dir == "" || pattern == "" {
+		return false
+	}
+
+	// patterns relative to the including file begin with ./, and other
+	// relative patterns match at any depth
+	pattern = filepath.ToSlash(expandConfigPath(pattern))
+	if strings.HasPrefix(pattern, "./") {
+		pattern = filepath.ToSlash(filepath.Dir(path)) + pattern[1:]
+	} else if !strings.HasPrefix(pattern, "/") && !filepath.IsAbs(pattern) {
+		pattern = "**/" + pattern
+	}
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "**"
+	}
+	dirs := []string{dir}
+	if real, err := filepath.EvalSymlinks(dir); err == nil && real != dir {
+		dirs = append(dirs, real)
+	}
+	for _, d := range dirs {
+		if matchConfigPattern(pattern, filepath.ToSlash(d), fold) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchConfigPattern reports whether name matches the wildcard pattern,
+// whose * and ? do not match slashes and ** matches any number of
+// directories.
+func matchConfigPattern(pattern, name string, fold bool) bool {
+	var b strings.Builder
+	if fold {
+		b.WriteString("(?i)")
+	}
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			j := strings.IndexByte(pattern[i+1:], ']')
+			if j == -1 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += j + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	return err == nil && re.MatchString(name)
+}
+
+// expandConfigPath expands a leading ~/ of p to the user's home directory.
+func expandConfigPath(p string) string {
+	if strings.HasPrefix(p, "~/") {
+		if home := os.Getenv("HOME"); home != "" {
+			return strings.TrimSuffix(home, "/") + p[1:]
+		}
+	}
+	return p
+}
+
+// configKey returns key with its section and name in lower case.
+func configKey(key string) (string, error) {
+	section, subsection, name, err := splitConfigKey(key)
+	if err != nil {
+		return "", err
+	}
+	it := configItem{section: section, subsection: subsection, name: name}
+	return it.key(), nil
+}
+
+// lookup returns the entries of key, in order.
+func (c *Config) lookup(key string) []ConfigEntry {
+	key, err := configKey(key)
+	if err != nil {
+		return nil
+	}
+	var es []ConfigEntry
+	for _, e := range c.entries {
+		if e.Key == key {
+			es = append(es, e)
+		}
+	}
+	return es
+}
+
+// Get returns the value of key taking precedence, reporting whether key is
+// set.
+func (c *Config) Get(key string) (string, bool) {
+	es := c.lookup(key)
+	if len(es) == 0 {
+		return "", false
+	}
+	return es[len(es)-1].Value, true
+}
+
+// GetAll returns the values of key from every scope, in order.
+func (c *Config) GetAll(key string) []string {
+	var vs []string
+	for _, e := range c.lookup(key) {
+		vs = append(vs, e.Value)
+	}
+	return vs
+}
+
+// Bool returns the boolean value of key, or def if key is not set. True is
+// any of true, yes, on, a non-zero integer or no value at all, as of a
+// variable named without "="; false is any of false, no, off, 0 or an empty
+// value. Words are case-insensitive.
+func (c *Config) Bool(key string, def bool) (bool, error) {
+	es := c.lookup(key)
+	if len(es) == 0 {
+		return def, nil
+	}
+	e := es[len(es)-1]
+	b, err := parseConfigBool(e.Value, e.novalue)
+	if err != nil {
+		return false, fmt.Errorf("%w: bad boolean value %q for %s", ErrInvalidConfig, e.Value, e.Key)
+	}
+	return b, nil
+}
+
+// Int returns the integer value of key, or def if key is not set. Values
+// may have a suffix of k, m or g scaling them by 1024, 1024² or 1024³.
+func (c *Config) Int(key string, def int64) (int64, error) {
+	es := c.lookup(key)
+	if len(es) == 0 {
+		return def, nil
+	}
+	e := es[len(es)-1]
+	n, err := parseConfigInt(e.Value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad numeric value %q for %s", ErrInvalidConfig, e.Value, e.Key)
+	}
+	return n, nil
+}
+
+// Subsections returns the names of subsections of section, in order of
+// appearance.
+func (c *Config) Subsections(section string) []string {
+	prefix := strings.ToLower(section) + "."
+	seen := make(map[string]bool)
+	var subs []string
+	for _, e := range c.entries {
+		if !strings.HasPrefix(e.Key, prefix) {
+			continue
+		}
+		rest := e.Key[len(prefix):]
+		i := strings.LastIndexByte(rest, '.')
+		if i == -1 || seen[rest[:i]] {
+			continue
+		}
+		seen[rest[:i]] = true
+		subs = append(subs, rest[:i])
+	}
+	return subs
+}
+
+// Entries returns every variable, in order of increasing precedence.
+func (c *Config) Entries() []ConfigEntry {
+	return append([]ConfigEntry{}, c.entries...)
+}
+
+// parseConfigBool parses a boolean value as described by Config.Bool.
+func parseConfigBool(v string, novalue bool) (bool, error) {
+	if novalue {
+		return true, nil
+	}
+	switch strings.ToLower(v) {
+	case "true", "yes", "on":
+		return true, nil
+	case "false", "no", "off", "":
+		return false, nil
+	}
+	n, err := parseConfigInt(v)
+	if err != nil {
+		return false, err
+	}
+	return n != 0, nil
+}
+
+// parseConfigInt parses an integer with an optional k, m or g suffix.
+func parseConfigInt(v string) (int64, error) {
+	neg := strings.HasPrefix(v, "-")
+	n, err := parseSize(strings.TrimPrefix(v, "-"))
+	if neg {
+		n = -n
+	}
+	return n, err
+}
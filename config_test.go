@@ -0,0 +1,429 @@
+package git
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const testConfig = `# leading comment
+[core]
+	repositoryformatversion = 0
+	Bare = false ; trailing comment
+	quoted = "  a # b ; c  "
+	spaced =   one   two	three
+	escaped = tab\there \"q\" back\\slash
+	continued = first \
+second
+	empty =
+	novalue
+[Remote "origin"]
+	url = https://example.com/repo.git
+	fetch = +refs/heads/*:refs/remotes/origin/*
+	fetch = +refs/tags/*:refs/tags/*
+[Branch.Main]
+	remote = origin
+[section "sub \"q\" \\ dir"] key = value
+`
+
+func TestParseConfig(t *testing.T) {
+	cf, err := ParseConfig(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"core.repositoryformatversion": "0",
+		"core.bare":                    "false",
+		"CORE.BARE":                    "false",
+		"core.quoted":                  "  a # b ; c  ",
+		"core.spaced":                  "one   two three",
+		"core.escaped":                 "tab\there \"q\" back\\slash",
+		"core.continued":               "first second",
+		"core.empty":                   "",
+		"core.novalue":                 "",
+		"remote.origin.url":            "https://example.com/repo.git",
+		"branch.main.remote":           "origin",
+		`section.sub "q" \ dir.key`:    "value",
+	} {
+		if have, ok := cf.Get(key); !ok || have != want {
+			t.Errorf("Get(%q) => %q, %v, want %q", key, have, ok, want)
+		}
+	}
+	for _, key := range []string{"remote.Origin.url", "core.missing", "core"} {
+		if have, ok := cf.Get(key); ok {
+			t.Errorf("Get(%q) => %q, want unset", key, have)
+		}
+	}
+	fetch := cf.GetAll("remote.origin.fetch")
+	if len(fetch) != 2 || fetch[1] != "+refs/tags/*:refs/tags/*" {
+		t.Errorf("GetAll(remote.origin.fetch) => %q", fetch)
+	}
+
+	var buf strings.Builder
+	if _, err := cf.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != testConfig {
+		t.Fatalf("WriteTo => %q, want unchanged", buf.String())
+	}
+
+	for _, s := range []string{
+		"key = value\n",
+		"[core\n",
+		"[core]\n\t1key = value\n",
+		"[core]\n\tkey = \"open\n",
+		"[core]\n\tkey = \\q\n",
+		"[sec tion]\n",
+		"[section \"sub]\n",
+		"[section \"sub\" x]\n",
+		"[core]\n\tkey = value\x00\n[user]\n\tname = x\n",
+		"[core]\n# comment\x00\n",
+	} {
+		if _, err := ParseConfig(strings.NewReader(s)); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("ParseConfig(%q) => %v, want ErrInvalidConfig", s, err)
+		}
+	}
+}
+
+func TestConfigFileEdit(t *testing.T) {
+	cf, err := ParseConfig(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		cf.Set("core.bare", "true"),
+		cf.Set("core.filemode", "true"),
+		cf.Set("remote.origin.fetch", "+refs/heads/main:refs/remotes/origin/main"),
+		cf.Add("remote.origin.pushurl", "ssh://example.com/repo.git"),
+		cf.Add("remote.upstream.url", "a value; with \"quotes\"\n"),
+		cf.Set("user.Name", " Gopher "),
+		cf.Set("section.sub \"q\" \\ dir.key", "changed"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !cf.Unset("core.novalue") || cf.Unset("core.novalue") {
+		t.Fatal("Unset(core.novalue) did not report removal once")
+	}
+	if !cf.RemoveSection("branch", "main") {
+		t.Fatal("RemoveSection(branch main) => false")
+	}
+	if ok, err := cf.RenameSection("remote", "upstream", "remote", "fork"); !ok || err != nil {
+		t.Fatalf("RenameSection => %v, %v", ok, err)
+	}
+	if err := cf.Set("bogus", "x"); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("Set(bogus) => %v, want ErrInvalidConfig", err)
+	}
+
+	want := `# leading comment
+[core]
+	repositoryformatversion = 0
+	bare = true
+	quoted = "  a # b ; c  "
+	spaced =   one   two	three
+	escaped = tab\there \"q\" back\\slash
+	continued = first \
+second
+	empty =
+	filemode = true
+[Remote "origin"]
+	url = https://example.com/repo.git
+	fetch = +refs/heads/main:refs/remotes/origin/main
+	pushurl = ssh://example.com/repo.git
+[section "sub \"q\" \\ dir"] key = changed
+[remote "fork"]
+	url = "a value; with \"quotes\"\n"
+[user]
+	Name = " Gopher "
+`
+	var buf strings.Builder
+	cf.WriteTo(&buf)
+	if buf.String() != want {
+		t.Fatalf("edited config:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	// git reads back the values written
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cf.Path = filepath.Join(dir, "config")
+	if err := cf.Save(); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{
+		"core.bare":           "true",
+		"core.quoted":         "  a # b ; c  ",
+		"remote.fork.url":     "a value; with \"quotes\"\n",
+		"user.name":           " Gopher ",
+		"remote.origin.fetch": "+refs/heads/main:refs/remotes/origin/main",
+	} {
+		cmd := command("git", "config", "-f", cf.Path, "--get", key)
+		if have := strings.TrimSuffix(assertRun(t, cmd), "\n"); have != value {
+			t.Errorf("git config --get %s => %q, want %q", key, have, value)
+		}
+	}
+	cmd := command("git", "config", "-f", cf.Path, "--list")
+	have := strings.Split(strings.TrimSuffix(assertRun(t, cmd), "\n"), "\n")
+	cf, err = ReadConfigFile(cf.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []string
+	for _, e := range cf.Entries() {
+		if e.novalue {
+			entries = append(entries, e.Key)
+		} else if !strings.Contains(e.Value, "\n") {
+			entries = append(entries, e.Key+"="+e.Value)
+		}
+	}
+	for i := 0; i < len(have); i++ {
+		if strings.HasPrefix(have[i], "remote.fork.url=") {
+			have = append(have[:i], have[i+2:]...)
+		}
+	}
+	if !reflect.DeepEqual(entries, have) {
+		t.Fatalf("Entries => %q, git config --list => %q", entries, have)
+	}
+}
+
+func TestConfigValues(t *testing.T) {
+	cf, err := ParseConfig(strings.NewReader(`[values]
+	yes = Yes
+	on = on
+	one = 1
+	ten = 10
+	flag
+	no = NO
+	off = off
+	zero = 0
+	empty =
+	k = 1k
+	m = -2m
+	g = 1G
+	bad = maybe
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{entries: cf.Entries()}
+	for key, want := range map[string]bool{
+		"yes": true, "on": true, "one": true, "ten": true, "flag": true,
+		"no": false, "off": false, "zero": false, "empty": false,
+	} {
+		if have, err := c.Bool("values."+key, !want); err != nil || have != want {
+			t.Errorf("Bool(%s) => %v, %v, want %v", key, have, err, want)
+		}
+	}
+	for key, want := range map[string]int64{"ten": 10, "k": 1024, "m": -2 << 20, "g": 1 << 30, "missing": 7} {
+		if have, err := c.Int("values."+key, 7); err != nil || have != want {
+			t.Errorf("Int(%s) => %v, %v, want %v", key, have, err, want)
+		}
+	}
+	if _, err := c.Bool("values.bad", false); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Bool(bad) => %v, want ErrInvalidConfig", err)
+	}
+	if _, err := c.Int("values.yes", 0); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Int(yes) => %v, want ErrInvalidConfig", err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	home := filepath.Join(tmp, "home")
+	repo := filepath.Join(home, "work", "repo", ".git")
+	other := filepath.Join(tmp, "other", ".git")
+	write := func(name, data string) {
+		t.Helper()
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{repo, other} {
+		assertRun(t, command("git", "init", "-q", filepath.Dir(dir)))
+	}
+	write(filepath.Join(tmp, "system"), "[core]\n\teditor = ed\n[user]\n\tname = System\n")
+	write(filepath.Join(home, ".gitconfig"), `[user]
+	name = Global
+	email = global@example.com
+[include]
+	path = included
+[includeIf "gitdir:~/work/"]
+	path = ~/work.inc
+[includeIf "gitdir/i:**/OTHER/.git"]
+	path = other.inc
+[includeIf "onbranch:feature/"]
+	path = feature.inc
+[include]
+	path = missing
+`)
+	write(filepath.Join(home, "included"), "[alias]\n\tco = checkout\n")
+	write(filepath.Join(home, "work.inc"), "[user]\n\temail = work@example.com\n")
+	write(filepath.Join(home, "other.inc"), "[user]\n\temail = other@example.com\n")
+	write(filepath.Join(home, "feature.inc"), "[user]\n\tname = Feature\n")
+	write(filepath.Join(home, "loop"), "[include]\n\tpath = loop\n")
+	write(filepath.Join(repo, "config"), "[core]\n\trepositoryformatversion = 0\n\tbare = false\n[remote \"origin\"]\n\turl = a\n[remote \"fork\"]\n\turl = b\n")
+	write(filepath.Join(repo, "HEAD"), "ref: refs/heads/main\n")
+	write(filepath.Join(other, "config"), "[core]\n\trepositoryformatversion = 0\n[user]\n\tname = Local\n")
+	write(filepath.Join(other, "HEAD"), "ref: refs/heads/feature/x\n")
+
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(tmp, "xdg"))
+	t.Setenv("GIT_CONFIG_SYSTEM", filepath.Join(tmp, "system"))
+	for _, name := range []string{"GIT_CONFIG_GLOBAL", "GIT_CONFIG_NOSYSTEM"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+
+	for _, tc := range []struct {
+		dir  string
+		want map[string]string
+	}{
+		{repo, map[string]string{"user.name": "Global", "user.email": "work@example.com", "alias.co": "checkout", "core.editor": "ed"}},
+		{other, map[string]string{"user.name": "Local", "user.email": "other@example.com"}},
+		{"", map[string]string{"user.name": "Global", "user.email": "global@example.com"}},
+	} {
+		c, err := LoadConfig(tc.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range tc.want {
+			if have, _ := c.Get(key); have != want {
+				t.Errorf("%q: Get(%s) => %q, want %q", tc.dir, key, have, want)
+			}
+			if tc.dir == "" {
+				continue
+			}
+			cmd := command("git", "--git-dir", tc.dir, "config", "--get", key)
+			if have := strings.TrimSpace(assertRun(t, cmd)); have != want {
+				t.Errorf("%q: git config --get %s => %q, want %q", tc.dir, key, have, want)
+			}
+		}
+	}
+
+	c, err := LoadConfig(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := c.GetAll("user.name"); !reflect.DeepEqual(names, []string{"System", "Global"}) {
+		t.Errorf("GetAll(user.name) => %q", names)
+	}
+	scopes := make(map[string]ConfigScope)
+	for _, e := range c.Entries() {
+		scopes[e.Key] = e.Scope
+	}
+	if scopes["core.editor"] != ScopeSystem || scopes["alias.co"] != ScopeGlobal || scopes["core.bare"] != ScopeLocal {
+		t.Errorf("Entries scopes => %v", scopes)
+	}
+	remotes := c.Subsections("remote")
+	sort.Strings(remotes)
+	if !reflect.DeepEqual(remotes, []string{"fork", "origin"}) {
+		t.Errorf("Subsections(remote) => %q", remotes)
+	}
+
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "true")
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(home, "loop"))
+	if _, err := LoadConfig(repo); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("LoadConfig(include cycle) => %v, want ErrInvalidConfig", err)
+	}
+}
+
+func TestConfigRemote(t *testing.T) {
+	cf, err := ParseConfig(strings.NewReader(`[remote "origin"]
+	url = gh:gopher/repo.git
+	fetch = +refs/heads/*:refs/remotes/origin/*
+	fetch = ^refs/heads/wip/*
+	push = refs/heads/main:refs/heads/main
+	tagOpt = --no-tags
+[remote "mirror"]
+	url = https://example.com/a.git
+	url = https://mirror.example.com/a.git
+	pushurl = gh:gopher/a.git
+[remote "bad"]
+	fetch = refs/*/*:refs/*
+[url "https://github.com/"]
+	insteadOf = gh:
+[url "git@github.com:"]
+	pushInsteadOf = gh:
+[branch "main"]
+	remote = origin
+	merge = refs/heads/main
+	rebase = merges
+[branch "local"]
+	remote = .
+	merge = refs/heads/main
+[branch "wip"]
+	remote = origin
+	merge = refs/heads/wip/x
+[pull]
+	rebase
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{entries: cf.Entries()}
+
+	r, err := c.Remote("origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Remote{
+		Name:     "origin",
+		URLs:     []string{"https://github.com/gopher/repo.git"},
+		PushURLs: []string{"git@github.com:gopher/repo.git"},
+		Fetch: []RefSpec{
+			{Force: true, Src: "refs/heads/*", Dst: "refs/remotes/origin/*"},
+			{Negative: true, Src: "refs/heads/wip/*"},
+		},
+		Push:   []RefSpec{{Src: "refs/heads/main", Dst: "refs/heads/main"}},
+		TagOpt: "--no-tags",
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Fatalf("Remote(origin) => %+v, want %+v", r, want)
+	}
+	r, err = c.Remote("mirror")
+	if err != nil || len(r.URLs) != 2 || !reflect.DeepEqual(r.PushURLs, []string{"https://github.com/gopher/a.git"}) {
+		t.Fatalf("Remote(mirror) => %+v, %v", r, err)
+	}
+	if _, err := c.Remote("bad"); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("Remote(bad) => %v, want ErrInvalidConfig", err)
+	}
+	if _, err := c.Remote("missing"); err == nil {
+		t.Fatal("Remote(missing) => nil error")
+	}
+	if _, err := c.Remotes(); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("Remotes => %v, want ErrInvalidConfig", err)
+	}
+
+	for _, tc := range []struct {
+		name, upstream, rebase string
+	}{
+		{"main", "refs/remotes/origin/main", "merges"},
+		{"local", "refs/heads/main", "true"},
+		{"wip", "", "true"},
+		{"none", "", "true"},
+	} {
+		b, err := c.Branch(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Rebase != tc.rebase {
+			t.Errorf("Branch(%s).Rebase => %q, want %q", tc.name, b.Rebase, tc.rebase)
+		}
+		if up, err := c.Upstream(tc.name); err != nil || up != tc.upstream {
+			t.Errorf("Upstream(%s) => %q, %v, want %q", tc.name, up, err, tc.upstream)
+		}
+	}
+}
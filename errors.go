@@ -0,0 +1,86 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors returned by Stores, Readers and Writers. Returned errors may wrap
+// these with additional context; test with errors.Is.
+var (
+	// ErrNotExist is returned when an object can not be found.
+	ErrNotExist = errors.New("git: object does not exist")
+
+	// ErrAmbiguous is returned when an abbreviated hash matches more than one object.
+	ErrAmbiguous = errors.New("git: ambiguous object name")
+
+	// ErrCorrupt is returned when data does not conform to git object format.
+	ErrCorrupt = errors.New("git: corrupt object")
+
+	// ErrCollision is returned when an object contains data crafted by a
+	// SHA-1 collision attack, as detected for repositories setting
+	// dasa-git.checkCollisions.
+	ErrCollision = errors.New("git: SHA-1 collision attack detected")
+
+	// ErrNotRepository is returned when a git directory can not be located.
+	ErrNotRepository = errors.New("git: not a git repository")
+
+	// ErrUnsafeRepository is returned when opening a repository owned by
+	// another user that is not listed as a safe.directory.
+	ErrUnsafeRepository = errors.New("git: unsafe repository")
+
+	// ErrInvalidConfig is returned when a config file or variable is
+	// malformed.
+	ErrInvalidConfig = errors.New("git: invalid config")
+
+	// ErrNotImplemented is returned by operations not yet supported.
+	ErrNotImplemented = errors.New("git: not implemented")
+
+	// ErrPromised is returned when an object is missing from a partial
+	// clone, expected to be provided by the promisor remote it was cloned
+	// from. ErrPromised also matches ErrNotExist.
+	ErrPromised error = promisedError{}
+)
+
+// AmbiguousError is returned when an abbreviated object name matches more
+// than one object. AmbiguousError matches ErrAmbiguous.
+type AmbiguousError struct {
+	Prefix Prefix
+
+	// Candidates are the names of every object matched, sorted.
+	Candidates []Hash
+}
+
+func (e *AmbiguousError) Error() string {
+	cs := make([]string, len(e.Candidates))
+	for i, h := range e.Candidates {
+		cs[i] = h.String()
+	}
+	return fmt.Sprintf("%v: %s; candidates are %s", ErrAmbiguous, e.Prefix, strings.Join(cs, ", "))
+}
+
+func (e *AmbiguousError) Is(target error) bool { return target == ErrAmbiguous }
+
+type promisedError struct{}
+
+func (promisedError) Error() string        { return "git: object missing from partial clone" }
+func (promisedError) Is(target error) bool { return target == ErrNotExist }
+
+// errClosed is reported by reads of a closed Reader.
+var errClosed = errors.New("git: read of closed Reader")
+
+// errReader implements io.Reader by reporting err for every call.
+type errReader struct{ err error }
+
+func (r errReader) Read(p []byte) (int, error) { return 0, r.err }
+
+// errWriter implements Writer by reporting err for every call. Stores return
+// an errWriter when a Writer can not be initialized.
+type errWriter struct{ err error }
+
+func (w errWriter) Write(p []byte) (int, error)                    { return 0, w.err }
+func (w errWriter) WriteHeader(t Type, size int64) (int, error)    { return 0, w.err }
+func (w errWriter) WriteRawHeader(t Type, size int64) (int, error) { return 0, w.err }
+func (w errWriter) Close() error                                   { return w.err }
+func (w errWriter) Hash() Hash                                     { return Hash{} }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"strings"
 
@@ -11,7 +12,10 @@ import (
 )
 
 func Example() {
-	store := git.TempStore()
+	store, err := git.TempStore()
+	if err != nil {
+		log.Fatal(err)
+	}
 	defer os.RemoveAll(string(store))
 
 	buf := new(bytes.Buffer)
@@ -20,7 +24,7 @@ func Example() {
 	bdata := []byte("hello, world")
 
 	bw := store.Writer()
-	bw.WriteHeader(git.Blob, len(bdata))
+	bw.WriteHeader(git.Blob, int64(len(bdata)))
 	bw.Write(bdata)
 	bw.Close()
 
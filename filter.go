@@ -0,0 +1,97 @@
+package git
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Filter omits objects from a walk, as requested by partial clones. The zero
+// Filter omits nothing.
+type Filter struct {
+	spec string
+
+	// blobs of at least blobLimit bytes are omitted if blobs is set
+	blobs     bool
+	blobLimit int64
+
+	// trees and blobs at treeDepth or deeper are omitted if trees is set
+	trees     bool
+	treeDepth int
+}
+
+// ParseFilter parses a filter specification: "blob:none", "blob:limit=n"
+// with an optional k, m or g suffix, or "tree:n".
+func ParseFilter(spec string) (Filter, error) {
+	f := Filter{spec: spec}
+	invalid := fmt.Errorf("git: invalid filter %q", spec)
+	switch {
+	case spec == "":
+	case spec == "blob:none":
+		f.blobs = true
+	case strings.HasPrefix(spec, "blob:limit="):
+		n, err := parseSize(spec[11:])
+		if err != nil {
+			return Filter{}, invalid
+		}
+		f.blobs, f.blobLimit = true, n
+	case strings.HasPrefix(spec, "tree:"):
+		n, err := strconv.Atoi(spec[5:])
+		if err != nil || n < 0 {
+			return Filter{}, invalid
+		}
+		f.trees, f.treeDepth = true, n
+	default:
+		return Filter{}, invalid
+	}
+	return f, nil
+}
+
+// parseSize parses a non-negative integer with an optional k, m or g suffix.
+func parseSize(s string) (int64, error) {
+	shift := uint(0)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k', 'K':
+			shift = 10
+		case 'm', 'M':
+			shift = 20
+		case 'g', 'G':
+			shift = 30
+		}
+		if shift != 0 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > 1<<(63-shift)-1 {
+		return 0, fmt.Errorf("git: invalid size %q", s)
+	}
+	return n << shift, nil
+}
+
+// String returns the filter's specification.
+func (f Filter) String() string { return f.spec }
+
+// IsZero reports whether f omits nothing.
+func (f Filter) IsZero() bool { return !f.blobs && !f.trees }
+
+// omitTree reports whether a tree at depth, the root tree being at 0, is
+// omitted along with its entries.
+func (f Filter) omitTree(depth int) bool { return f.trees && depth >= f.treeDepth }
+
+// omitBlob reports whether a blob at depth is omitted, calling size only if
+// its length is needed.
+func (f Filter) omitBlob(depth int, size func() (int64, error)) (bool, error) {
+	if f.trees && depth >= f.treeDepth {
+		return true, nil
+	}
+	if !f.blobs {
+		return false, nil
+	}
+	if f.blobLimit == 0 {
+		return true, nil
+	}
+	n, err := size()
+	return err == nil && n >= f.blobLimit, err
+}
@@ -0,0 +1,187 @@
+package git
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"dasa.cc/git/sha1dc"
+)
+
+// ObjectFormat is the hash algorithm naming objects of a repository, as
+// configured by extensions.objectFormat.
+type ObjectFormat int
+
+// Object formats.
+const (
+	SHA1 ObjectFormat = iota
+	SHA256
+)
+
+// ParseObjectFormat parses the name of an object format, sha1 or sha256.
+func ParseObjectFormat(s string) (ObjectFormat, error) {
+	switch strings.ToLower(s) {
+	case "sha1":
+		return SHA1, nil
+	case "sha256":
+		return SHA256, nil
+	}
+	return 0, fmt.Errorf("git: unknown object format %q", s)
+}
+
+func (f ObjectFormat) String() string {
+	if f == SHA256 {
+		return "sha256"
+	}
+	return "sha1"
+}
+
+// Size returns the length in bytes of binary object names.
+func (f ObjectFormat) Size() int {
+	if f == SHA256 {
+		return sha256.Size
+	}
+	return sha1.Size
+}
+
+// HexSize returns the length of hexadecimal object names.
+func (f ObjectFormat) HexSize() int { return 2 * f.Size() }
+
+// New returns a new hash.Hash computing object names.
+func (f ObjectFormat) New() hash.Hash {
+	if f == SHA256 {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+// id returns the identifier of f in binary files such as pack .mtimes.
+func (f ObjectFormat) id() uint32 {
+	if f == SHA256 {
+		return 2
+	}
+	return 1
+}
+
+// newObjectHash returns a new hash.Hash computing object names, detecting
+// SHA-1 collision attacks if detect is set.
+func (f ObjectFormat) newObjectHash(detect bool) hash.Hash {
+	if f == SHA1 && detect {
+		return sha1dc.New()
+	}
+	return f.New()
+}
+
+// checkCollision returns ErrCollision if hh detected a collision attack in
+// data hashed.
+func checkCollision(hh hash.Hash) error {
+	if d, ok := hh.(*sha1dc.Digest); ok {
+		if sum := d.Sum(nil); d.Collision() {
+			return fmt.Errorf("%w: %x", ErrCollision, sum)
+		}
+	}
+	return nil
+}
+
+// ZeroHash returns the name of all zeros denoting a missing object, as
+// ZeroHash does for SHA-1.
+func (f ObjectFormat) ZeroHash() Hash { return Hash{size: uint8(f.Size())} }
+
+// ObjectFormatter is implemented by Stores whose objects may be named by an
+// object format other than SHA-1.
+type ObjectFormatter interface {
+	ObjectFormat() ObjectFormat
+}
+
+// formatOf returns the object format of st, SHA-1 unless st implements
+// ObjectFormatter.
+func formatOf(st Store) ObjectFormat {
+	if f, ok := st.(ObjectFormatter); ok {
+		return f.ObjectFormat()
+	}
+	return SHA1
+}
+
+// repoFormat is how objects of a repository are named.
+type repoFormat struct {
+	format ObjectFormat
+
+	// checkCollisions enables SHA-1 collision detection when naming objects
+	// written or indexed, as set by dasa-git.checkCollisions, a setting of
+	// this package rather than of git. Objects containing a block crafted
+	// by a collision attack, such as those of SHAttered, are then rejected
+	// with ErrCollision. Detection slows hashing considerably, and so is
+	// only worthwhile for repositories receiving objects from untrusted
+	// sources.
+	checkCollisions bool
+}
+
+// repoFormats caches formats of git directories, so that config is parsed
+// once per repository rather than for every object written. Entries are
+// revalidated by the size and modification time of the config file.
+var repoFormats = struct {
+	sync.Mutex
+	m map[string]cachedFormat
+}{m: make(map[string]cachedFormat)}
+
+type cachedFormat struct {
+	repoFormat
+	config string
+	size   int64
+	mtime  time.Time
+}
+
+// repositoryFormat returns the object format of git directory dir, as set
+// by extensions.objectformat of its config. A missing config is SHA-1.
+func repositoryFormat(dir string) (ObjectFormat, error) {
+	f, err := loadRepoFormat(dir)
+	return f.format, err
+}
+
+// loadRepoFormat returns the format of git directory dir, as set by its
+// config.
+func loadRepoFormat(dir string) (repoFormat, error) {
+	repoFormats.Lock()
+	c, ok := repoFormats.m[dir]
+	repoFormats.Unlock()
+	if !ok {
+		c.config = filepath.Join(commonDir(dir), "config")
+	}
+	fi, err := os.Stat(c.config)
+	if os.IsNotExist(err) {
+		return repoFormat{}, nil
+	} else if err != nil {
+		return repoFormat{}, err
+	}
+	if ok && c.size == fi.Size() && c.mtime.Equal(fi.ModTime()) {
+		return c.repoFormat, nil
+	}
+
+	cf, err := ReadConfigFile(c.config)
+	if err != nil {
+		return repoFormat{}, err
+	}
+	c.repoFormat = repoFormat{}
+	for _, e := range cf.Entries() {
+		switch e.Key {
+		case "extensions.objectformat":
+			c.format, err = ParseObjectFormat(e.Value)
+		case "dasa-git.checkcollisions":
+			c.checkCollisions, err = parseConfigBool(e.Value, e.novalue)
+		}
+		if err != nil {
+			return repoFormat{}, fmt.Errorf("%w: %s: %v", ErrInvalidConfig, e.Key, err)
+		}
+	}
+	c.size, c.mtime = fi.Size(), fi.ModTime()
+	repoFormats.Lock()
+	repoFormats.m[dir] = c
+	repoFormats.Unlock()
+	return c.repoFormat, nil
+}
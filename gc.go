@@ -0,0 +1,543 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultGrace is the age below which GC keeps unreachable objects, two
+// weeks as by gc.pruneExpire of git.
+const DefaultGrace = 14 * 24 * time.Hour
+
+// GCOptions configure GC.
+type GCOptions struct {
+	// Grace is the age below which unreachable loose objects are kept,
+	// as objects just written may not yet be referenced. Objects
+	// referenced by those kept are kept as well. If zero, DefaultGrace is
+	// used; a negative Grace prunes every unreachable object.
+	Grace time.Duration
+
+	// Cruft writes unreachable objects kept to a cruft pack, recording
+	// their modification times in a .mtimes file as git does, rather
+	// than leaving them loose.
+	Cruft bool
+}
+
+// GC collects garbage among the loose objects of repo, as git gc does.
+// Objects are reachable from references, HEAD of each worktree, reflogs
+// and the index of each worktree, including its cached trees. Objects
+// missing from a partial clone, as promised by its promisor remote, bound
+// the walk. Reachable loose objects are written to a new pack, unless
+// already packed, and removed. Unreachable loose objects older than the
+// grace period are pruned, along with temporary files as old. Packs,
+// including earlier cruft packs, are kept whole. A multi-pack-index is
+// rewritten to name every pack.
+//
+// Objects written to the repository refresh the modification time of
+// those that exist, so that GC does not prune objects about to be
+// referenced. The Store of repo must implement PackIndexer.
+func GC(repo *Repository, opts GCOptions) error {
+	x, ok := repo.Store.(PackIndexer)
+	if !ok {
+		return fmt.Errorf("%w: GC of %T", ErrNotImplemented, repo.Store)
+	}
+	grace := opts.Grace
+	if grace == 0 {
+		grace = DefaultGrace
+	}
+	cutoff := time.Now().Add(-grace)
+
+	roots, err := gcRoots(repo)
+	if err != nil {
+		return err
+	}
+	shallow, err := ReadShallow(repo.CommonDir)
+	if err != nil {
+		return err
+	}
+	hashes, err := ReachableWith(repo.Store, roots, nil, ReachableOptions{Shallow: shallow, Promised: true})
+	if err != nil {
+		return err
+	}
+	reachable := make(map[Hash]bool, len(hashes))
+	for _, h := range hashes {
+		reachable[h] = true
+	}
+
+	// loose objects are reachable, and packed unless listed, or not
+	loose := DiskStore(repo.CommonDir)
+	packs := PackStore(repo.CommonDir)
+	var packed, unpacked, unreachable []Hash
+	mtimes := make(map[Hash]time.Time)
+	err = loose.ForEach(func(h Hash) error {
+		if !reachable[h] {
+			fi, err := os.Stat(loose.path(h))
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			mtimes[h] = fi.ModTime()
+			unreachable = append(unreachable, h)
+			return nil
+		}
+		ok, err := packs.Has(h)
+		if err != nil {
+			return err
+		}
+		if ok {
+			packed = append(packed, h)
+		} else {
+			unpacked = append(unpacked, h)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	kept, err := keepRecent(repo.Store, unreachable, mtimes, cutoff)
+	if err != nil {
+		return err
+	}
+
+	if len(unpacked) > 0 {
+		if err := packObjects(x, repo.Store, repo.CommonDir, unpacked, nil); err != nil {
+			return err
+		}
+	}
+	var cruft []Hash
+	if opts.Cruft {
+		for _, h := range unreachable {
+			if kept[h] {
+				cruft = append(cruft, h)
+			}
+		}
+	}
+	if len(cruft) > 0 {
+		err := packObjects(x, repo.Store, repo.CommonDir, cruft, func(name string, sum []byte) error {
+			return writeMtimes(name, cruft, mtimes, sum, formatOf(repo.Store))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// a multi-pack-index is rewritten to name every pack, as those written
+	// and any since removed
+	if _, err := os.Stat(filepath.Join(repo.CommonDir, "objects", "pack", "multi-pack-index")); err == nil {
+		if err := WriteMultiPackIndex(repo.CommonDir); err != nil {
+			return err
+		}
+	}
+
+	prune := append(packed, unpacked...)
+	for _, h := range unreachable {
+		if !kept[h] || opts.Cruft {
+			prune = append(prune, h)
+		}
+	}
+	dirs := make(map[string]bool)
+	for _, h := range prune {
+		p := loose.path(h)
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		dirs[filepath.Dir(p)] = true
+	}
+	for d := range dirs {
+		os.Remove(d) // unless other objects remain
+	}
+	if st, ok := repo.Store.(repoStore); ok {
+		st.abbrev.Reset()
+	}
+	return pruneTemp(repo.CommonDir, cutoff)
+}
+
+// gcRoots returns names of the objects GC keeps along with those they
+// reference: of references, HEAD of each worktree, reflog entries and
+// index entries. Objects of reflogs and indexes that do not exist, as
+// since pruned by git, are omitted.
+func gcRoots(repo *Repository) ([]Hash, error) {
+	var roots []Hash
+	refs, err := repo.Refs.Refs()
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		if !ref.Hash.IsZero() {
+			roots = append(roots, ref.Hash)
+		}
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(repo.CommonDir, "worktrees", "*"))
+	if err != nil {
+		return nil, err
+	}
+	format := formatOf(repo.Store)
+	var logged []Hash
+	for _, dir := range append([]string{repo.CommonDir}, dirs...) {
+		head, err := DiskRefs(dir).Ref("HEAD")
+		if err != nil && !errors.Is(err, ErrRefNotExist) {
+			return nil, err
+		}
+		if !head.Hash.IsZero() {
+			roots = append(roots, head.Hash)
+		}
+
+		logs := filepath.Join(dir, "logs")
+		err = filepath.Walk(logs, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && p == logs {
+					return nil
+				}
+				return err
+			}
+			if fi.IsDir() || strings.HasSuffix(p, ".lock") {
+				return nil
+			}
+			hashes, err := readReflog(p)
+			logged = append(logged, hashes...)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		hashes, err := readIndex(filepath.Join(dir, "index"), format)
+		if err != nil {
+			return nil, err
+		}
+		logged = append(logged, hashes...)
+	}
+	for _, h := range logged {
+		ok, err := repo.Store.Has(h)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			roots = append(roots, h)
+		}
+	}
+	return roots, nil
+}
+
+// readReflog returns the old and new names of each entry of the reflog
+// file at path, but for zero names of created and deleted references.
+func readReflog(path string) ([]Hash, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hashes []Hash
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.SplitN(sc.Text(), " ", 3)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%w: invalid reflog line %q", ErrCorrupt, sc.Text())
+		}
+		for _, s := range fields[:2] {
+			h, err := ParseHash(s)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid reflog line %q", ErrCorrupt, sc.Text())
+			}
+			if !h.IsZero() {
+				hashes = append(hashes, h)
+			}
+		}
+	}
+	return hashes, sc.Err()
+}
+
+// readIndex returns names of the objects of the index file at path, of
+// entries other than submodules and of cached trees. A missing file has
+// none. Indexes of version 2 through 4 are read; split indexes are not.
+func readIndex(path string, format ObjectFormat) ([]Hash, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	corrupt := fmt.Errorf("%w: invalid index %s", ErrCorrupt, path)
+	hs := format.Size()
+	if len(b) < 12+hs || string(b[:4]) != "DIRC" {
+		return nil, corrupt
+	}
+	version := binary.BigEndian.Uint32(b[4:])
+	if version < 2 || version > 4 {
+		return nil, fmt.Errorf("%w: index version %v", ErrNotImplemented, version)
+	}
+	count := binary.BigEndian.Uint32(b[8:])
+	end := len(b) - hs
+
+	// entries are stat data, mode, name, flags and path
+	var hashes []Hash
+	p := 12
+	for i := uint32(0); i < count; i++ {
+		n := 40 + hs + 2
+		if p+n > end {
+			return nil, corrupt
+		}
+		mode := binary.BigEndian.Uint32(b[p+24:])
+		if mode&0170000 != 0160000 {
+			hashes = append(hashes, NewHash(b[p+40:p+40+hs]))
+		}
+		if flags := binary.BigEndian.Uint16(b[p+40+hs:]); flags&0x4000 != 0 && version >= 3 {
+			n += 2
+		}
+		if version == 4 {
+			// paths are prefix compressed, following a varint
+			for p+n < end && b[p+n]&0x80 != 0 {
+				n++
+			}
+			n++
+		}
+		if p+n > end {
+			return nil, corrupt
+		}
+		nul := bytes.IndexByte(b[p+n:end], 0)
+		if nul == -1 {
+			return nil, corrupt
+		}
+		if version == 4 {
+			p += n + nul + 1
+		} else {
+			p += (n + nul + 8) &^ 7
+		}
+	}
+
+	for p+8 <= end {
+		sig, size := string(b[p:p+4]), int(binary.BigEndian.Uint32(b[p+4:]))
+		p += 8
+		if size > end-p {
+			return nil, corrupt
+		}
+		data := b[p : p+size]
+		p += size
+		switch sig {
+		case "TREE":
+			trees, err := readCacheTree(data, hs)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid index %s: %v", ErrCorrupt, path, err)
+			}
+			hashes = append(hashes, trees...)
+		case "link":
+			return nil, fmt.Errorf("%w: split index %s", ErrNotImplemented, path)
+		}
+	}
+	return hashes, nil
+}
+
+// readCacheTree returns names of the valid trees of the cache tree index
+// extension data, of names of length hs.
+func readCacheTree(data []byte, hs int) ([]Hash, error) {
+	var hashes []Hash
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, 0)
+		if i == -1 {
+			return nil, errors.New("unterminated path")
+		}
+		data = data[i+1:]
+		j := bytes.IndexByte(data, '\n')
+		if j == -1 {
+			return nil, errors.New("unterminated counts")
+		}
+		fields := strings.Fields(string(data[:j]))
+		data = data[j+1:]
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid counts %q", fields)
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			continue // invalidated
+		}
+		if len(data) < hs {
+			return nil, errors.New("truncated")
+		}
+		hashes = append(hashes, NewHash(data[:hs]))
+		data = data[hs:]
+	}
+	return hashes, nil
+}
+
+// keepRecent returns those of unreachable objects modified after cutoff,
+// and those of unreachable they reference, recursively, so that a recent
+// commit is kept along with its tree.
+func keepRecent(st Store, unreachable []Hash, mtimes map[Hash]time.Time, cutoff time.Time) (map[Hash]bool, error) {
+	kept := make(map[Hash]bool)
+	var queue []Hash
+	for _, h := range unreachable {
+		if mtimes[h].After(cutoff) {
+			kept[h] = true
+			queue = append(queue, h)
+		}
+	}
+	for len(queue) > 0 {
+		h := queue[0]
+		queue = queue[1:]
+		refs, err := references(st, h)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range refs {
+			if _, ok := mtimes[r]; ok && !kept[r] {
+				kept[r] = true
+				queue = append(queue, r)
+			}
+		}
+	}
+	return kept, nil
+}
+
+// references returns names of the objects referenced by the object by
+// hash, other than commits of submodules.
+func references(st Store, hash Hash) ([]Hash, error) {
+	t, _, err := st.Stat(hash)
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case Commit:
+		c, err := LoadCommit(st, hash)
+		if err != nil {
+			return nil, err
+		}
+		return append([]Hash{c.Tree}, c.Parents...), nil
+	case Tree:
+		entries, err := LoadTree(st, hash)
+		if err != nil {
+			return nil, err
+		}
+		var hashes []Hash
+		for _, e := range entries {
+			if e.Type() != Commit {
+				hashes = append(hashes, e.Hash)
+			}
+		}
+		return hashes, nil
+	case Tag:
+		tag, err := LoadTag(st, hash)
+		if err != nil {
+			return nil, err
+		}
+		return []Hash{tag.Object}, nil
+	}
+	return nil, nil
+}
+
+// packObjects writes a pack of objects by hashes of st, indexed by x into
+// the objects/pack directory of git directory dir. If before is not nil,
+// it is called with the path the pack is indexed by, without suffix, and
+// its checksum before the pack is indexed.
+func packObjects(x PackIndexer, st Store, dir string, hashes []Hash, before func(name string, sum []byte) error) error {
+	pdir := filepath.Join(dir, "objects", "pack")
+	if err := os.MkdirAll(pdir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(pdir, "tmp_pack_")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	bw := bufio.NewWriter(f)
+	if err := WritePack(bw, st, hashes); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	sum := make([]byte, formatOf(st).Size())
+	if _, err := f.ReadAt(sum, size-int64(len(sum))); err != nil {
+		return err
+	}
+	if before != nil {
+		if err := before(filepath.Join(pdir, "pack-"+hex.EncodeToString(sum)), sum); err != nil {
+			return err
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return x.IndexPack(bufio.NewReader(f), false)
+}
+
+// writeMtimes writes the .mtimes file of the cruft pack at name, without
+// suffix, with checksum sum, recording modification times of its objects
+// by hashes in index order.
+func writeMtimes(name string, hashes []Hash, mtimes map[Hash]time.Time, sum []byte, format ObjectFormat) error {
+	hashes = append([]Hash{}, hashes...)
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i].Compare(hashes[j]) < 0 })
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("MTME")
+	put32 := func(v uint32) {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], v)
+		buf.Write(b[:])
+	}
+	put32(1)
+	put32(format.id())
+	for _, h := range hashes {
+		put32(uint32(mtimes[h].Unix()))
+	}
+	buf.Write(sum)
+	hh := format.New()
+	hh.Write(buf.Bytes())
+	buf.Write(hh.Sum(nil))
+
+	if err := ioutil.WriteFile(name+".mtimes.lock", buf.Bytes(), 0444); err != nil {
+		return err
+	}
+	return os.Rename(name+".mtimes.lock", name+".mtimes")
+}
+
+// pruneTemp removes temporary files of objects and packs of git directory
+// dir, as left by interrupted writes, last modified before cutoff.
+func pruneTemp(dir string, cutoff time.Time) error {
+	var ns []string
+	for _, pattern := range []string{
+		filepath.Join(dir, "objects", "tmp_obj_*"),
+		filepath.Join(dir, "objects", "pack", "tmp_pack_*"),
+	} {
+		m, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		ns = append(ns, m...)
+	}
+	for _, n := range ns {
+		fi, err := os.Stat(n)
+		if err != nil || !fi.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(n); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
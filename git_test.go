@@ -3,6 +3,8 @@ package git
 
 import (
 	"bytes"
+	"compress/zlib"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,8 +12,13 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"dasa.cc/git/sha1dc"
 )
 
 var (
@@ -101,7 +108,11 @@ func TestMain(m *testing.M) {
 		fatal(err)
 	}
 
-	store = DiskStore(Dir(cmdDir))
+	dir, err := FindDir(cmdDir)
+	if err != nil {
+		fatal(err)
+	}
+	store = DiskStore(dir)
 
 	exit(m.Run())
 }
@@ -110,11 +121,11 @@ func TestWriter(t *testing.T) {
 	data := []byte("hello,\nworld")
 
 	w := store.Writer()
-	w.WriteHeader(Blob, len(data))
+	w.WriteHeader(Blob, int64(len(data)))
 	w.Write(data)
 	w.Close()
 
-	hash := w.Hash()
+	hash := w.Hash().String()
 
 	out := assertRun(t, command("git", "cat-file", "-t", hash))
 	out = strings.TrimSpace(out)
@@ -129,12 +140,141 @@ func TestWriter(t *testing.T) {
 	}
 }
 
+func TestWriterSize(t *testing.T) {
+	data := bytes.Repeat([]byte("hello, world\n"), 100)
+	want := parseHash(t, assertWrite(t, command("git", "hash-object", "--stdin"), bytes.NewReader(data)))
+
+	defer func(n int) { SpoolSize = n }(SpoolSize)
+	for _, n := range []int{len(data) * 2, 64} {
+		SpoolSize = n
+		w := NewWriter(ioutil.Discard)
+		if _, err := w.WriteHeader(Blob, -1); err != nil {
+			t.Fatal(err)
+		}
+		for p := data; len(p) > 0; p = p[13:] {
+			if _, err := w.Write(p[:13]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if w.Hash() != want {
+			t.Fatalf("SpoolSize %v: Writer.Hash() => %s, want %s", n, w.Hash(), want)
+		}
+	}
+
+	w := NewWriter(ioutil.Discard)
+	w.WriteHeader(Blob, 4)
+	if _, err := w.Write(data[:5]); err == nil {
+		t.Fatal("Write beyond declared size succeeded")
+	}
+	w.Write(data[:3])
+	if err := w.Close(); err == nil {
+		t.Fatal("Close short of declared size succeeded")
+	}
+}
+
+func TestDetectCollisions(t *testing.T) {
+	st, err := TempStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(string(st))
+
+	// detection is set for each repository
+	if _, ok := st.Writer().(*diskCloser).Writer.(*writer).hh.(*sha1dc.Digest); ok {
+		t.Fatal("Writer detects collisions without dasa-git.checkCollisions")
+	}
+	cmd := command("git", "config", "dasa-git.checkCollisions", "true")
+	cmd.Dir = string(st)
+	assertRun(t, cmd)
+	if _, ok := st.Writer().(*diskCloser).Writer.(*writer).hh.(*sha1dc.Digest); !ok {
+		t.Fatal("Writer does not detect collisions with dasa-git.checkCollisions")
+	}
+
+	data := bytes.Repeat([]byte("hello, world\n"), 100)
+	want := parseHash(t, assertWrite(t, command("git", "hash-object", "--stdin"), bytes.NewReader(data)))
+	w := st.Writer()
+	w.WriteHeader(Blob, int64(len(data)))
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.Hash() != want {
+		t.Fatalf("Writer.Hash() => %s, want %s", w.Hash(), want)
+	}
+
+	// colliding blocks can not be aligned past an object header, so test
+	// hashes of the raw SHAttered prefix
+	shattered, err := ioutil.ReadFile(filepath.Join("sha1dc", "testdata", "shattered-1.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hh := SHA1.newObjectHash(true)
+	hh.Write(shattered)
+	if err := checkCollision(hh); !errors.Is(err, ErrCollision) {
+		t.Fatalf("checkCollision(shattered) => %v, want ErrCollision", err)
+	}
+	hh = SHA256.newObjectHash(true)
+	hh.Write(shattered)
+	if err := checkCollision(hh); err != nil {
+		t.Fatalf("checkCollision(shattered) in SHA-256 => %v", err)
+	}
+}
+
+func TestDiskWriterExists(t *testing.T) {
+	st, err := TempStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(string(st))
+
+	data := []byte("hello, world")
+	var ws []Writer
+	for i := 0; i < 3; i++ {
+		w := st.Writer()
+		if _, err := w.WriteHeader(Blob, int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		ws = append(ws, w)
+	}
+	for _, w := range ws {
+		if err := w.Close(); err != nil {
+			t.Fatalf("Writer.Close() failed: %s", err)
+		}
+	}
+
+	ns, err := filepath.Glob(filepath.Join(string(st), "objects", "tmp_obj_*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ns) != 0 {
+		t.Fatalf("temporary files remain: %q", ns)
+	}
+
+	r, err := st.Reader(ws[0].Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("have %q, want %q", b, data)
+	}
+}
+
 func TestReader(t *testing.T) {
 	data := []byte("hello, world\n")
 
 	cmd := command("git", "hash-object", "-t", "blob", "-w", "--stdin")
-	hash := assertWrite(t, cmd, bytes.NewReader(data))
-	hash = strings.TrimSpace(hash)
+	hash := parseHash(t, assertWrite(t, cmd, bytes.NewReader(data)))
 
 	r, err := store.Reader(hash)
 	if err != nil {
@@ -144,7 +284,7 @@ func TestReader(t *testing.T) {
 	if r.Type() != Blob {
 		t.Fatalf("Reader.Type() => %#v, want Blob", r.Type())
 	}
-	if r.Len() != len(data) {
+	if r.Len() != int64(len(data)) {
 		t.Fatalf("Reader.Len() => %v, want %v", r.Len(), len(data))
 	}
 
@@ -155,6 +295,30 @@ func TestReader(t *testing.T) {
 	if !bytes.Equal(b.Bytes(), data) {
 		t.Fatalf("Buffer.Bytes() => %q, want %q", string(b.Bytes()), string(data))
 	}
+	if _, err := r.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Read after Close succeeded")
+	}
+
+	// closed Reader reset to read again
+	f, err := store.Object(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.(io.Closer).Close()
+	if err := r.Reset(f); err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	io.Copy(b, r)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("second Close => %v", err)
+	}
+	if !bytes.Equal(b.Bytes(), data) {
+		t.Fatalf("Reset: Buffer.Bytes() => %q, want %q", string(b.Bytes()), string(data))
+	}
 }
 
 func TestTree(t *testing.T) {
@@ -173,7 +337,7 @@ func TestTree(t *testing.T) {
 	want := assertRun(t, command("git", "cat-file", "-p", tree))
 
 	// test reader
-	r, err := store.Reader(tree, PrettyReader)
+	r, err := store.Reader(parseHash(t, tree), PrettyReader)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -225,8 +389,32 @@ func TestTree(t *testing.T) {
 		t.Fatalf("bytes.Equal have %v want %v", dat.Bytes(), orig)
 	}
 
-	if w.Hash() != tree {
-		t.Fatalf("Writer.Hash() => %q, want %q", w.Hash(), tree)
+	if w.Hash().String() != tree {
+		t.Fatalf("Writer.Hash() => %s, want %s", w.Hash(), tree)
+	}
+
+	// size is ignored for trees unless written raw
+	for _, tc := range []struct {
+		raw  bool
+		data []byte
+	}{
+		{false, b.Bytes()},
+		{true, orig},
+	} {
+		w := NewWriter(ioutil.Discard)
+		header := w.WriteHeader
+		if tc.raw {
+			header = w.WriteRawHeader
+		}
+		if _, err := header(Tree, int64(len(tc.data))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(tc.data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil || w.Hash().String() != tree {
+			t.Fatalf("raw %v: Writer.Hash() => %s, %v, want %s", tc.raw, w.Hash(), err, tree)
+		}
 	}
 }
 
@@ -236,7 +424,7 @@ func TestMemStore(t *testing.T) {
 
 	data := []byte("hello, world")
 
-	if _, err := w.WriteHeader(Blob, len(data)); err != nil {
+	if _, err := w.WriteHeader(Blob, int64(len(data))); err != nil {
 		t.Fatalf("WriteHeader(%s, %v) failed: %s", Blob, len(data), err)
 	}
 	if _, err := w.Write(data); err != nil {
@@ -262,115 +450,1417 @@ func TestMemStore(t *testing.T) {
 	}
 }
 
-func BenchmarkMemReader(b *testing.B) {
-	st := MemStore()
-	data := []byte("hello, world")
-	w := st.Writer()
-	if _, err := w.WriteHeader(Blob, len(data)); err != nil {
-		b.Fatal(err)
+func TestStoreConcurrent(t *testing.T) {
+	st, err := TempStore()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if _, err := w.Write(data); err != nil {
-		b.Fatal(err)
+	defer os.RemoveAll(string(st))
+
+	for _, s := range []Store{MemStore(), st, NewCacheStore(MemStore(), 1<<10)} {
+		var wg sync.WaitGroup
+		errc := make(chan error, 64)
+		for i := 0; i < 64; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				// half the goroutines write duplicate objects
+				data := []byte(fmt.Sprintf("object %v", i%32))
+				w := s.Writer()
+				if _, err := w.WriteHeader(Blob, int64(len(data))); err != nil {
+					errc <- err
+					return
+				}
+				if _, err := w.Write(data); err != nil {
+					errc <- err
+					return
+				}
+				if err := w.Close(); err != nil {
+					errc <- err
+					return
+				}
+				r, err := s.Reader(w.Hash())
+				if err != nil {
+					errc <- err
+					return
+				}
+				defer r.Close()
+				b, err := ioutil.ReadAll(r)
+				if err != nil {
+					errc <- err
+					return
+				}
+				if !bytes.Equal(b, data) {
+					errc <- fmt.Errorf("have %q, want %q", b, data)
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errc)
+		for err := range errc {
+			t.Errorf("%T: %s", s, err)
+		}
 	}
-	if err := w.Close(); err != nil {
-		b.Fatal(err)
+}
+
+func TestStoreStat(t *testing.T) {
+	st, err := TempStore()
+	if err != nil {
+		t.Fatal(err)
 	}
-	hash := w.Hash()
+	defer os.RemoveAll(string(st))
 
-	b.ResetTimer()
-	for n := 0; n < b.N; n++ {
-		buf := new(bytes.Buffer)
-		r, err := st.Reader(hash)
-		if err != nil {
-			b.Fatal(err)
+	for _, s := range []Store{MemStore(), st, NewCacheStore(MemStore(), 1<<10)} {
+		var want []Hash
+		for _, data := range []string{"foo", "bar", "hello, world"} {
+			w := s.Writer()
+			w.WriteHeader(Blob, int64(len(data)))
+			w.Write([]byte(data))
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, w.Hash())
+
+			typ, n, err := s.Stat(w.Hash())
+			if err != nil {
+				t.Fatalf("%T: Stat(%s) failed: %s", s, w.Hash(), err)
+			}
+			if typ != Blob || n != int64(len(data)) {
+				t.Fatalf("%T: Stat(%s) => %s %v, want %s %v", s, w.Hash(), typ, n, Blob, len(data))
+			}
+			if ok, err := s.Has(w.Hash()); !ok || err != nil {
+				t.Fatalf("%T: Has(%s) => %v, %v, want true", s, w.Hash(), ok, err)
+			}
+			if h, err := ResolvePrefix(s, w.Hash().Abbrev(7)); h != w.Hash() || err != nil {
+				t.Fatalf("%T: ResolvePrefix(%s) => %s, %v, want %s", s, w.Hash().Abbrev(7), h, err, w.Hash())
+			}
 		}
-		if _, err := io.Copy(buf, r); err != nil {
-			b.Fatal(err)
+		if ok, err := s.Has(ZeroHash); ok || err != nil {
+			t.Fatalf("%T: Has(zero hash) => %v, %v, want false", s, ok, err)
+		}
+
+		var have []Hash
+		if err := s.ForEach(func(hash Hash) error {
+			have = append(have, hash)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(want, func(i, j int) bool { return want[i].Compare(want[j]) < 0 })
+		if fmt.Sprint(have) != fmt.Sprint(want) {
+			t.Fatalf("%T: ForEach => %s, want %s", s, have, want)
+		}
+
+		stop := errors.New("stop")
+		if err := s.ForEach(func(Hash) error { return stop }); err != stop {
+			t.Fatalf("%T: ForEach => %v, want %v", s, err, stop)
 		}
-		r.Close()
 	}
 }
 
-func BenchmarkMemWriter(b *testing.B) {
+func TestStoreErrors(t *testing.T) {
 	st := MemStore()
-	data := []byte("hello, world")
-	r := bytes.NewReader(data)
-	b.ResetTimer()
-	for n := 0; n < b.N; n++ {
-		r.Seek(0, 0)
-		data = append(data, byte('!'))
-
+	for _, data := range []string{"foo", "bar"} {
 		w := st.Writer()
-		if _, err := w.WriteHeader(Blob, len(data)); err != nil {
-			b.Fatal(err)
+		w.WriteHeader(Blob, int64(len(data)))
+		w.Write([]byte(data))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
 		}
-		if _, err := w.Write(data); err != nil {
-			b.Fatal(err)
+	}
+
+	p, err := ParsePrefix("0000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []Store{st, store} {
+		if _, err := s.Reader(ZeroHash); !errors.Is(err, ErrNotExist) {
+			t.Fatalf("Reader(zero hash) => %v, want ErrNotExist", err)
 		}
-		if err := w.Close(); err != nil {
-			b.Fatal(n, err)
+		if _, err := ResolvePrefix(s, p); !errors.Is(err, ErrNotExist) {
+			t.Fatalf("ResolvePrefix(%s) => %v, want ErrNotExist", p, err)
+		}
+		if _, err := ResolvePrefix(s, Prefix{}); !errors.Is(err, ErrAmbiguous) {
+			t.Fatalf("ResolvePrefix(%q) => %v, want ErrAmbiguous", "", err)
+		}
+	}
+	for _, s := range []string{"", "xyz", strings.Repeat("0", 65)} {
+		if _, err := ParsePrefix(s); err == nil {
+			t.Fatalf("ParsePrefix(%q) succeeded", s)
 		}
 	}
+
+	if _, err := NewReader(zdata(t, "blob 12x\x00")); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("NewReader(invalid size) => %v, want ErrCorrupt", err)
+	}
+	if _, err := NewReader(zdata(t, "bogus 0\x00")); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("NewReader(invalid type) => %v, want ErrCorrupt", err)
+	}
+	r, err := NewReader(zdata(t, "tree 8\x0077 name\x00"), PrettyReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("ReadAll(invalid tree) => %v, want ErrCorrupt", err)
+	}
+
+	if _, err := FindDir(os.TempDir()); !errors.Is(err, ErrNotRepository) {
+		t.Fatalf("FindDir(%q) => %v, want ErrNotRepository", os.TempDir(), err)
+	}
 }
 
-func BenchmarkDiskReader(b *testing.B) {
-	st := TempStore()
-	defer os.RemoveAll(string(st))
+// abbrevStore is a Store resolving and choosing abbreviations by an
+// AbbrevIndex.
+type abbrevStore struct {
+	Store
+	*AbbrevIndex
+}
 
-	data := []byte("hello, world")
+func TestAbbrevIndex(t *testing.T) {
+	st := MemStore()
+	var hashes []Hash
+	for i := 0; i < 1000; i++ {
+		data := fmt.Sprint(i)
+		w := st.Writer()
+		w.WriteHeader(Blob, int64(len(data)))
+		w.Write([]byte(data))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, w.Hash())
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i].Compare(hashes[j]) < 0 })
+
+	// among 1000 objects, some pair shares at least 4 digits
+	var a, b Hash
+	common := 0
+	for i := 1; i < len(hashes); i++ {
+		if n := commonDigits(hashes[i-1], hashes[i]); n > common {
+			a, b, common = hashes[i-1], hashes[i], n
+		}
+	}
+	if common < MinAbbrev {
+		t.Fatalf("no pair shares %v digits", MinAbbrev)
+	}
+
+	x := NewAbbrevIndex(st)
+	for _, s := range []Store{st, abbrevStore{st, x}} {
+		_, err := ResolvePrefix(s, a.Abbrev(common))
+		var amb *AmbiguousError
+		if !errors.As(err, &amb) || !errors.Is(err, ErrAmbiguous) {
+			t.Fatalf("%T: ResolvePrefix(%s) => %v, want AmbiguousError", s, a.Abbrev(common), err)
+		}
+		if want := []Hash{a, b}; fmt.Sprint(amb.Candidates) != fmt.Sprint(want) {
+			t.Fatalf("%T: candidates %s, want %s", s, amb.Candidates, want)
+		}
+		for _, h := range []Hash{a, b} {
+			if have, err := ResolvePrefix(s, h.Abbrev(common+1)); err != nil || have != h {
+				t.Fatalf("%T: ResolvePrefix(%s) => %s, %v, want %s", s, h.Abbrev(common+1), have, err, h)
+			}
+		}
+		if _, err := ResolvePrefix(s, a.Abbrev(MinAbbrev-1)); !errors.Is(err, ErrAmbiguous) {
+			t.Fatalf("%T: ResolvePrefix(%s) => %v, want ErrAmbiguous", s, a.Abbrev(MinAbbrev-1), err)
+		}
+
+		want := common + 1
+		if want < 7 {
+			want = 7
+		}
+		for _, h := range []Hash{a, b} {
+			if p, err := ShortestUnique(s, h); err != nil || p != h.Abbrev(want) {
+				t.Fatalf("%T: ShortestUnique(%s) => %s, %v, want %s", s, h, p, err, h.Abbrev(want))
+			}
+		}
+		for _, h := range hashes {
+			p, err := ShortestUnique(s, h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have, err := ResolvePrefix(s, p); err != nil || have != h {
+				t.Fatalf("%T: ResolvePrefix(%s) => %s, %v, want %s", s, p, have, err, h)
+			}
+		}
+	}
 
+	// objects written since the index was read are found by reading it again
+	data := "written later"
 	w := st.Writer()
-	if _, err := w.WriteHeader(Blob, len(data)); err != nil {
-		b.Fatal(err)
+	w.WriteHeader(Blob, int64(len(data)))
+	w.Write([]byte(data))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
 	}
-	if _, err := w.Write(data); err != nil {
-		b.Fatal(err)
+	if have, err := x.ResolvePrefix(w.Hash().Abbrev(7)); err != nil || have != w.Hash() {
+		t.Fatalf("ResolvePrefix(%s) => %s, %v, want %s", w.Hash().Abbrev(7), have, err, w.Hash())
 	}
-	if err := w.Close(); err != nil && err != io.EOF {
-		b.Fatal(err)
+
+	// or once added, without
+	x = NewAbbrevIndex(MemStore())
+	if _, err := x.ShortestUnique(a); err != nil {
+		t.Fatal(err)
+	}
+	x.Add(b, a, b)
+	if fmt.Sprint(x.names) != fmt.Sprint([]Hash{a, b}) {
+		t.Fatalf("Add(%s, %s, %s) => %s", b, a, b, x.names)
+	}
+	if have, err := x.ResolvePrefix(a.Abbrev(common + 1)); err != nil || have != a {
+		t.Fatalf("ResolvePrefix(%s) => %s, %v, want %s", a.Abbrev(common+1), have, err, a)
 	}
-	hash := w.Hash()
 
-	b.ResetTimer()
-	for n := 0; n < b.N; n++ {
-		buf := new(bytes.Buffer)
-		r, err := st.Reader(hash)
+	for _, tc := range []struct{ count, want int }{{0, 7}, {1 << 12, 7}, {1 << 16, 9}, {1 << 20, 11}} {
+		if n := autoAbbrev(tc.count); n != tc.want {
+			t.Fatalf("autoAbbrev(%v) => %v, want %v", tc.count, n, tc.want)
+		}
+	}
+}
+
+func TestMultiStore(t *testing.T) {
+	a, b := MemStore(), MemStore()
+	write := func(st Store, data string) Hash {
+		t.Helper()
+		w := st.Writer()
+		w.WriteHeader(Blob, int64(len(data)))
+		w.Write([]byte(data))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return w.Hash()
+	}
+	foo, bar := write(b, "foo"), write(b, "bar")
+
+	st := NewMultiStore(a, b)
+	baz := write(st, "baz")
+	if ok, _ := a.Has(baz); !ok {
+		t.Fatalf("MultiStore wrote %s elsewhere", baz)
+	}
+	for _, h := range []Hash{foo, bar, baz} {
+		if ok, err := st.Has(h); !ok || err != nil {
+			t.Fatalf("Has(%s) => %v, %v", h, ok, err)
+		}
+		r, err := st.Reader(h)
 		if err != nil {
-			b.Fatal(err)
+			t.Fatal(err)
 		}
-		if _, err := io.Copy(buf, r); err != nil {
-			b.Fatal(err)
+		r.Close()
+		if typ, _, err := st.Stat(h); err != nil || typ != Blob {
+			t.Fatalf("Stat(%s) => %v, %v", h, typ, err)
+		}
+		if have, err := ResolvePrefix(st, h.Abbrev(40)); err != nil || have != h {
+			t.Fatalf("ResolvePrefix(%s) => %s, %v", h.Abbrev(40), have, err)
 		}
+	}
+	var have []Hash
+	st.ForEach(func(h Hash) error {
+		have = append(have, h)
+		return nil
+	})
+	if len(have) != 3 {
+		t.Fatalf("ForEach => %s, want 3 objects", have)
+	}
+
+	// an object of both Stores is one candidate
+	write(a, "foo")
+	if have, err := ResolvePrefix(st, foo.Abbrev(7)); err != nil || have != foo {
+		t.Fatalf("ResolvePrefix(%s) => %s, %v", foo.Abbrev(7), have, err)
+	}
+
+	missing := parseHash(t, "01"+strings.Repeat("0", 38))
+	if _, err := st.Reader(missing); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("Reader(%s) => %v, want ErrNotExist", missing, err)
+	}
+	if _, err := NewMultiStore(nil).Reader(missing); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("empty MultiStore: Reader(%s) => %v, want ErrNotExist", missing, err)
+	}
+	ro := NewMultiStore(nil, a, b)
+	if _, err := ro.Writer().WriteHeader(Blob, 0); !errors.Is(err, ErrNotImplemented) {
+		t.Fatalf("read-only MultiStore: WriteHeader => %v, want ErrNotImplemented", err)
+	}
+	if r, err := ro.Reader(foo); err != nil {
+		t.Fatal(err)
+	} else {
 		r.Close()
 	}
 }
 
-func BenchmarkDiskWriter(b *testing.B) {
-	st := TempStore()
-	defer os.RemoveAll(string(st))
-
-	data := []byte("hello, world")
-	r := bytes.NewReader(data)
-	b.ResetTimer()
-	for n := 0; n < b.N; n++ {
-		r.Seek(0, 0)
-		data = append(data, byte('!'))
+// copyFetcher fetches objects from a Store, recording each batch.
+type copyFetcher struct {
+	src     Store
+	mu      sync.Mutex
+	batches [][]Hash
+	block   chan struct{}
+}
 
+func (f *copyFetcher) FetchObjects(st Store, hashes []Hash) error {
+	f.mu.Lock()
+	f.batches = append(f.batches, hashes)
+	block := f.block
+	f.block = nil
+	f.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	for _, h := range hashes {
+		r, err := f.src.Reader(h)
+		if err != nil {
+			return err
+		}
 		w := st.Writer()
-		if _, err := w.WriteHeader(Blob, len(data)); err != nil {
-			b.Fatal(err)
+		if _, err := w.WriteHeader(r.Type(), r.Len()); err != nil {
+			return err
 		}
-		if _, err := w.Write(data); err != nil {
-			b.Fatal(err)
+		if _, err := io.Copy(w, r); err != nil {
+			return err
 		}
+		r.Close()
 		if err := w.Close(); err != nil {
-			b.Fatal(n, err)
+			return err
 		}
 	}
+	return nil
 }
 
-// func BenchmarkTree(b *testing.B) {
-// for n := 0; n < b.N; n++ {
+func TestLazyStore(t *testing.T) {
+	src := MemStore()
+	var hashes []Hash
+	for i := 0; i < 8; i++ {
+		data := fmt.Sprintf("object %v", i)
+		w := src.Writer()
+		w.WriteHeader(Blob, int64(len(data)))
+		w.Write([]byte(data))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, w.Hash())
+	}
+
+	block := make(chan struct{})
+	f := &copyFetcher{src: src, block: block}
+	st := NewLazyStore(MemStore(), f)
 
-// }
-// }
+	// misses during the first fetch are fetched together in the next
+	errc := make(chan error, len(hashes))
+	go func() {
+		_, _, err := st.Stat(hashes[0])
+		errc <- err
+	}()
+	for {
+		f.mu.Lock()
+		n := len(f.batches)
+		f.mu.Unlock()
+		if n == 1 {
+			break
+		}
+	}
+	var wg sync.WaitGroup
+	for _, h := range hashes[1:4] {
+		wg.Add(1)
+		go func(h Hash) {
+			defer wg.Done()
+			r, err := st.Reader(h)
+			if err == nil {
+				_, err = ioutil.ReadAll(r)
+			}
+			errc <- err
+		}(h)
+	}
+	for {
+		st.mu.Lock()
+		n := 0
+		if st.next != nil {
+			n = len(st.next.hashes)
+		}
+		st.mu.Unlock()
+		if n == 3 {
+			break
+		}
+	}
+	close(block)
+	wg.Wait()
+	for i := 0; i < 4; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(f.batches) != 2 || len(f.batches[0]) != 1 || len(f.batches[1]) != 3 {
+		t.Fatalf("batches => %s, want 1 then 3 hashes", f.batches)
+	}
+
+	// fetched objects are cached
+	if _, err := st.Object(hashes[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Prefetch(hashes...); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.batches) != 3 || len(f.batches[2]) != 4 {
+		t.Fatalf("batches => %s, want prefetch of 4 hashes", f.batches)
+	}
+	for _, h := range hashes {
+		if ok, err := st.Store.Has(h); !ok || err != nil {
+			t.Fatalf("Has(%s) => %v, %v, want true", h, ok, err)
+		}
+	}
+
+	// abbreviated names and the zero Hash are not fetched
+	p, err := ParsePrefix("0123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolvePrefix(st, p); !errors.Is(err, ErrNotExist) || len(f.batches) != 3 {
+		t.Fatalf("ResolvePrefix(%s) => %v after %d batches", p, err, len(f.batches))
+	}
+	if _, err := st.Reader(Hash{}); !errors.Is(err, ErrNotExist) || len(f.batches) != 3 {
+		t.Fatalf("Reader(zero Hash) => %v after %d batches", err, len(f.batches))
+	}
+}
+
+// countStore counts Readers of the underlying Store.
+type countStore struct {
+	Store
+	n int
+}
+
+func (st *countStore) Reader(hash Hash, options ...func(*Reader)) (*Reader, error) {
+	st.n++
+	return st.Store.Reader(hash, options...)
+}
+
+func TestCacheStore(t *testing.T) {
+	mem := MemStore()
+	write := func(typ Type, data string) Hash {
+		w := mem.Writer()
+		w.WriteHeader(typ, -1)
+		w.Write([]byte(data))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return w.Hash()
+	}
+	read := func(st Store, hash Hash, options ...func(*Reader)) string {
+		r, err := st.Reader(hash, options...)
+		if err != nil {
+			t.Fatalf("Reader(%s) failed: %s", hash, err)
+		}
+		defer r.Close()
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("ReadAll(%s) failed: %s", hash, err)
+		}
+		if len(options) == 0 && int64(len(b)) != r.Len() {
+			t.Fatalf("Reader(%s).Len() => %v, read %v", hash, r.Len(), len(b))
+		}
+		return string(b)
+	}
+
+	under := &countStore{Store: mem}
+	st := NewCacheStore(under, 16<<10)
+
+	blob := write(Blob, "hello, world\n")
+	tree := write(Tree, fmt.Sprintf("100644 blob %s\thello.txt\n", blob))
+	for _, h := range []Hash{blob, tree} {
+		for i := 0; i < 2; i++ {
+			if have, want := read(st, h), read(mem, h); have != want {
+				t.Fatalf("Reader(%s) => %q, want %q", h, have, want)
+			}
+			if have, want := read(st, h, PrettyReader), read(mem, h, PrettyReader); have != want {
+				t.Fatalf("Reader(%s, PrettyReader) => %q, want %q", h, have, want)
+			}
+		}
+	}
+	if under.n != 2 {
+		t.Fatalf("underlying Store read %v times, want 2", under.n)
+	}
+	if typ, n, err := st.Stat(tree); typ != Tree || n != 37 || err != nil {
+		t.Fatalf("Stat(tree) => %v, %v, %v", typ, n, err)
+	}
+	if ok, err := st.Has(blob); !ok || err != nil {
+		t.Fatalf("Has(blob) => %v, %v", ok, err)
+	}
+
+	// large objects are not cached
+	large := write(Blob, strings.Repeat("x", 2<<10))
+	read(st, large)
+	if read(st, large); under.n != 4 {
+		t.Fatalf("large object read %v times, want 2", under.n-2)
+	}
+
+	// least recently used are evicted
+	var hs []Hash
+	for i := 0; i < 20; i++ {
+		h := write(Blob, fmt.Sprintf("%01000d", i))
+		read(st, h)
+		hs = append(hs, h)
+	}
+	if st.cache.size > 16<<10 {
+		t.Fatalf("cache size %v exceeds limit", st.cache.size)
+	}
+	n := under.n
+	if read(st, hs[19]); under.n != n {
+		t.Fatal("recently used object evicted")
+	}
+	if read(st, blob); under.n != n+1 {
+		t.Fatal("least recently used object not evicted")
+	}
+
+	if _, err := st.Reader(ZeroHash); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("Reader(zero hash) => %v, want ErrNotExist", err)
+	}
+}
+
+func TestInitRepository(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	global := filepath.Join(tmp, "gitconfig")
+	if err := ioutil.WriteFile(global, []byte("[init]\n\tdefaultBranch = trunk\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", global)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	for _, name := range []string{"GIT_TEMPLATE_DIR", "GIT_DEFAULT_HASH"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+
+	template := filepath.Join(tmp, "template")
+	os.MkdirAll(filepath.Join(template, "hooks"), 0755)
+	ioutil.WriteFile(filepath.Join(template, "hooks", "pre-commit"), []byte("#!/bin/sh\n"), 0755)
+	ioutil.WriteFile(filepath.Join(template, "description"), []byte("templated\n"), 0644)
+
+	git := func(dir string, args ...string) string {
+		t.Helper()
+		cmd := command("git", append([]string{"-c", "user.name=Gopher", "-c", "user.email=gopher@example.com"}, args...)...)
+		cmd.Dir = dir
+		return strings.TrimSpace(assertRun(t, cmd))
+	}
+	for _, tc := range []struct {
+		name   string
+		opts   InitOptions
+		gitdir string
+		head   string
+	}{
+		{"default", InitOptions{}, ".git", "trunk"},
+		{"bare", InitOptions{Bare: true, InitialBranch: "main", Shared: "group"}, ".", "main"},
+		{"separate", InitOptions{SeparateGitDir: filepath.Join(tmp, "separate.git"), Shared: "0640"}, filepath.Join(tmp, "separate.git"), "trunk"},
+		{"sha256", InitOptions{ObjectFormat: "sha256", Template: template}, ".git", "trunk"},
+	} {
+		path := filepath.Join(tmp, tc.name)
+		if err := InitRepository(path, tc.opts); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		gitdir := tc.gitdir
+		if !filepath.IsAbs(gitdir) {
+			gitdir = filepath.Join(path, gitdir)
+		}
+		if have := git(path, "rev-parse", "--absolute-git-dir"); have != gitdir {
+			t.Errorf("%s: git dir => %s, want %s", tc.name, have, gitdir)
+		}
+		if have := git(path, "symbolic-ref", "HEAD"); have != "refs/heads/"+tc.head {
+			t.Errorf("%s: HEAD => %s, want %s", tc.name, have, tc.head)
+		}
+		if have := git(path, "rev-parse", "--is-bare-repository"); have != fmt.Sprint(tc.opts.Bare) {
+			t.Errorf("%s: bare => %s", tc.name, have)
+		}
+		if !tc.opts.Bare {
+			git(path, "commit", "-q", "--allow-empty", "-m", "initial")
+		}
+		git(path, "fsck", "--strict")
+	}
+
+	if have := git(filepath.Join(tmp, "sha256"), "rev-parse", "--show-object-format"); have != "sha256" {
+		t.Errorf("object format => %s, want sha256", have)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(tmp, "sha256", ".git", "description")); string(b) != "templated\n" {
+		t.Errorf("template description => %q", b)
+	}
+	if fi, err := os.Stat(filepath.Join(tmp, "sha256", ".git", "hooks", "pre-commit")); err != nil || fi.Mode()&0100 == 0 {
+		t.Errorf("template hook => %v, %v, want executable", fi.Mode(), err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(tmp, "default", ".git", "info", "exclude")); !strings.HasPrefix(string(b), "# git ls-files") {
+		t.Errorf("info/exclude => %q", b)
+	}
+	for name, want := range map[string]os.FileMode{
+		filepath.Join("bare", "objects"):      os.ModeDir | os.ModeSetgid | 0775,
+		filepath.Join("bare", "config"):       0664,
+		filepath.Join("separate.git", "refs"): os.ModeDir | os.ModeSetgid | 0750,
+		filepath.Join("separate.git", "HEAD"): 0640,
+	} {
+		if fi, err := os.Stat(filepath.Join(tmp, name)); err != nil || fi.Mode() != want {
+			t.Errorf("mode of %s => %v, %v, want %v", name, fi.Mode(), err, want)
+		}
+	}
+	if have := git(filepath.Join(tmp, "bare"), "config", "core.sharedRepository"); have != "1" {
+		t.Errorf("core.sharedRepository => %s, want 1", have)
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts InitOptions
+	}{
+		{"default", InitOptions{}},
+		{"invalid", InitOptions{InitialBranch: "a..b"}},
+		{"invalid", InitOptions{ObjectFormat: "md5"}},
+		{"invalid", InitOptions{Shared: "0777"}},
+		{"invalid", InitOptions{Bare: true, SeparateGitDir: filepath.Join(tmp, "x")}},
+	} {
+		if err := InitRepository(filepath.Join(tmp, tc.name), tc.opts); err == nil {
+			t.Errorf("InitRepository(%s, %+v) => nil error", tc.name, tc.opts)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "open")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if tmp, err = filepath.EvalSymlinks(tmp); err != nil {
+		t.Fatal(err)
+	}
+	global := filepath.Join(tmp, "gitconfig")
+	ioutil.WriteFile(global, nil, 0644)
+	t.Setenv("GIT_CONFIG_GLOBAL", global)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	for _, name := range []string{"GIT_DIR", "GIT_WORK_TREE", "GIT_CEILING_DIRECTORIES"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+
+	git := func(dir string, args ...string) string {
+		t.Helper()
+		cmd := command("git", append([]string{"-c", "user.name=Gopher", "-c", "user.email=gopher@example.com"}, args...)...)
+		cmd.Dir = dir
+		return strings.TrimSpace(assertRun(t, cmd))
+	}
+	work := filepath.Join(tmp, "work")
+	if err := InitRepository(work, InitOptions{InitialBranch: "main"}); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(work, "a", "b"), 0755)
+	git(work, "commit", "-q", "--allow-empty", "-m", "initial")
+	git(work, "worktree", "add", "-q", "-b", "feature", filepath.Join(tmp, "linked"))
+	git(filepath.Join(tmp, "linked"), "commit", "-q", "--allow-empty", "-m", "feature")
+	if err := InitRepository(filepath.Join(tmp, "bare.git"), InitOptions{Bare: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitRepository(filepath.Join(tmp, "separate"), InitOptions{SeparateGitDir: filepath.Join(tmp, "separate.git")}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path, gitdir, common, worktree string
+	}{
+		{"work", "work/.git", "work/.git", "work"},
+		{"work/a/b", "work/.git", "work/.git", "work"},
+		{"work/.git/refs", "work/.git", "work/.git", ""},
+		{"bare.git/objects", "bare.git", "bare.git", ""},
+		{"separate", "separate.git", "separate.git", "separate"},
+		{"linked", "work/.git/worktrees/linked", "work/.git", "linked"},
+	} {
+		path := filepath.Join(tmp, tc.path)
+		r, err := Open(path)
+		if err != nil {
+			t.Fatalf("Open(%s) => %v", tc.path, err)
+		}
+		abs := func(p string) string {
+			if p == "" {
+				return ""
+			}
+			return filepath.Join(tmp, p)
+		}
+		if r.GitDir != abs(tc.gitdir) || r.CommonDir != abs(tc.common) || r.WorkTree != abs(tc.worktree) {
+			t.Errorf("Open(%s) => %s, %s, %s, want %s, %s, %s", tc.path, r.GitDir, r.CommonDir, r.WorkTree, tc.gitdir, tc.common, tc.worktree)
+		}
+		if have := git(path, "rev-parse", "--absolute-git-dir"); have != r.GitDir {
+			t.Errorf("Open(%s) git dir => %s, git has %s", tc.path, r.GitDir, have)
+		}
+		if !r.Bare() {
+			if have := git(path, "rev-parse", "--show-toplevel"); have != r.WorkTree {
+				t.Errorf("Open(%s) work tree => %s, git has %s", tc.path, r.WorkTree, have)
+			}
+		}
+	}
+
+	// the linked worktree has its own HEAD and shares branches and objects
+	r, err := Open(filepath.Join(tmp, "linked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := r.Refs.Ref("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := git(filepath.Join(tmp, "linked"), "rev-parse", "HEAD"); head.Target != "refs/heads/feature" || head.Hash.String() != want {
+		t.Errorf("linked HEAD => %+v, want refs/heads/feature at %s", head, want)
+	}
+	main, err := r.Refs.Ref("refs/heads/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := r.Store.Has(main.Hash); !ok || err != nil {
+		t.Errorf("Has(%s) => %v, %v", main.Hash, ok, err)
+	}
+	short := git(work, "rev-parse", "--short", "main")
+	if p, err := ShortestUnique(r.Store, main.Hash); err != nil || p.String() != short {
+		t.Errorf("ShortestUnique(%s) => %s, %v, git has %s", main.Hash, p, err, short)
+	}
+	// objects written through the Repository are resolved by the index read
+	w := r.Store.Writer()
+	w.WriteHeader(Blob, 3)
+	w.Write([]byte("foo"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if h, err := ResolvePrefix(r.Store, w.Hash().Abbrev(7)); err != nil || h != w.Hash() {
+		t.Errorf("ResolvePrefix(%s) => %s, %v", w.Hash().Abbrev(7), h, err)
+	}
+	// shared clones read objects of alternates, and of theirs
+	git(tmp, "clone", "-q", "--shared", work, "shared")
+	git(tmp, "clone", "-q", "--shared", filepath.Join(tmp, "shared"), "shared2")
+	git(filepath.Join(tmp, "shared"), "commit", "-q", "--allow-empty", "-m", "shared")
+	shared := parseHash(t, git(filepath.Join(tmp, "shared"), "rev-parse", "HEAD"))
+	r2, err := Open(filepath.Join(tmp, "shared2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []Hash{main.Hash, shared} {
+		if rd, err := r2.Store.Reader(h); err != nil {
+			t.Errorf("shared2: Reader(%s) => %v", h, err)
+		} else {
+			rd.Close()
+		}
+	}
+	if ok, _ := DiskStore(r2.GitDir).Has(shared); ok {
+		t.Errorf("shared2 has %s loose, want only in alternate", shared)
+	}
+	if h, err := ResolvePrefix(r2.Store, main.Hash.Abbrev(7)); err != nil || h != main.Hash {
+		t.Errorf("shared2: ResolvePrefix(%s) => %s, %v", main.Hash.Abbrev(7), h, err)
+	}
+
+	if v, ok := r.Config.Get("core.logallrefupdates"); !ok || v != "true" {
+		t.Errorf("core.logallrefupdates => %q, %v", v, ok)
+	}
+
+	t.Setenv("GIT_DIR", filepath.Join(tmp, "work", ".git"))
+	if r, err := Open(tmp); err != nil || r.WorkTree != tmp {
+		t.Errorf("Open with GIT_DIR => %+v, %v, want work tree %s", r, err, tmp)
+	}
+	t.Setenv("GIT_WORK_TREE", filepath.Join(tmp, "separate"))
+	if r, err := Open(tmp); err != nil || r.WorkTree != filepath.Join(tmp, "separate") {
+		t.Errorf("Open with GIT_WORK_TREE => %+v, %v", r, err)
+	}
+	t.Setenv("GIT_DIR", filepath.Join(tmp, "work"))
+	if _, err := Open(tmp); !errors.Is(err, ErrNotRepository) {
+		t.Errorf("Open with invalid GIT_DIR => %v, want ErrNotRepository", err)
+	}
+	os.Unsetenv("GIT_DIR")
+	os.Unsetenv("GIT_WORK_TREE")
+
+	t.Setenv("GIT_CEILING_DIRECTORIES", filepath.Join(tmp, "work"))
+	if _, err := Open(filepath.Join(tmp, "work", "a")); !errors.Is(err, ErrNotRepository) {
+		t.Errorf("Open below ceiling => %v, want ErrNotRepository", err)
+	}
+	if _, err := Open(filepath.Join(tmp, "work")); err != nil {
+		t.Errorf("Open at ceiling => %v", err)
+	}
+	os.Unsetenv("GIT_CEILING_DIRECTORIES")
+
+	// repositories appear to be owned by someone else
+	uid := getuid()
+	getuid = func() int { return uid + 1 }
+	defer func() { getuid = os.Getuid }()
+	for _, tc := range []struct {
+		config string
+		err    error
+	}{
+		{"", ErrUnsafeRepository},
+		{"[safe]\n\tdirectory = " + filepath.Join(tmp, "separate"), ErrUnsafeRepository},
+		{"[safe]\n\tdirectory = " + filepath.Join(tmp, "work"), nil},
+		{"[safe]\n\tdirectory = *", nil},
+		{"[safe]\n\tdirectory = *\n\tdirectory =", ErrUnsafeRepository},
+	} {
+		ioutil.WriteFile(global, []byte(tc.config), 0644)
+		if _, err := Open(filepath.Join(tmp, "work", "a")); !errors.Is(err, tc.err) || (err != nil) != (tc.err != nil) {
+			t.Errorf("Open with %q => %v, want %v", tc.config, err, tc.err)
+		}
+	}
+	// local config may not mark the repository safe
+	ioutil.WriteFile(global, nil, 0644)
+	git(work, "config", "safe.directory", "*")
+	if _, err := Open(work); !errors.Is(err, ErrUnsafeRepository) {
+		t.Errorf("Open with local safe.directory => %v, want ErrUnsafeRepository", err)
+	}
+	// nor is it read before the repository is found safe
+	cfg, _ := ioutil.ReadFile(filepath.Join(work, ".git", "config"))
+	ioutil.WriteFile(filepath.Join(work, ".git", "config"), []byte("[bogus"), 0644)
+	if _, err := Open(work); !errors.Is(err, ErrUnsafeRepository) {
+		t.Errorf("Open with invalid local config => %v, want ErrUnsafeRepository", err)
+	}
+	ioutil.WriteFile(filepath.Join(work, ".git", "config"), cfg, 0644)
+	getuid = os.Getuid
+
+	git(work, "config", "core.repositoryformatversion", "1")
+	git(work, "config", "extensions.bogus", "true")
+	if _, err := Open(work); !errors.Is(err, ErrNotImplemented) {
+		t.Errorf("Open with unknown extension => %v, want ErrNotImplemented", err)
+	}
+}
+
+func TestGC(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	global := filepath.Join(tmp, "gitconfig")
+	ioutil.WriteFile(global, []byte("[gc]\n\tauto = 0\n"), 0644)
+	t.Setenv("GIT_CONFIG_GLOBAL", global)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+
+	work := filepath.Join(tmp, "work")
+	git := func(dir string, args ...string) string {
+		t.Helper()
+		cmd := command("git", append([]string{"-c", "user.name=Gopher", "-c", "user.email=gopher@example.com"}, args...)...)
+		cmd.Dir = dir
+		return strings.TrimSpace(assertRun(t, cmd))
+	}
+	if err := InitRepository(work, InitOptions{InitialBranch: "main"}); err != nil {
+		t.Fatal(err)
+	}
+	blob := func(dir, name, data string) Hash {
+		t.Helper()
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		return parseHash(t, git(dir, "hash-object", "-w", name))
+	}
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	age := func(hashes ...Hash) {
+		for _, h := range hashes {
+			os.Chtimes(DiskStore(filepath.Join(work, ".git")).path(h), old, old)
+		}
+	}
+
+	committed := blob(work, "a.txt", "committed")
+	git(work, "add", "a.txt")
+	git(work, "commit", "-q", "-m", "initial")
+	head := parseHash(t, git(work, "rev-parse", "HEAD"))
+
+	// a commit of a deleted branch is reachable from the reflog of HEAD
+	git(work, "checkout", "-q", "-b", "topic")
+	blob(work, "b.txt", "logged")
+	git(work, "add", "b.txt")
+	git(work, "commit", "-q", "-m", "topic")
+	logged := parseHash(t, git(work, "rev-parse", "HEAD"))
+	git(work, "checkout", "-q", "main")
+	git(work, "branch", "-q", "-D", "topic")
+
+	staged := blob(work, "c.txt", "staged")
+	git(work, "add", "c.txt")
+	git(work, "worktree", "add", "-q", filepath.Join(tmp, "linked"))
+	linked := blob(filepath.Join(tmp, "linked"), "d.txt", "staged in linked worktree")
+	git(filepath.Join(tmp, "linked"), "add", "d.txt")
+
+	// a recent dangling commit keeps its old tree
+	expired := blob(work, "e.txt", "expired")
+	recent := blob(work, "f.txt", "recent")
+	oldTree := parseHash(t, git(work, "mktree"))
+	dangling := parseHash(t, git(work, "commit-tree", "-m", "dangling", oldTree.String()))
+	age(expired, oldTree)
+
+	// indexes list entries and cached trees in each version
+	cached := parseHash(t, git(work, "write-tree"))
+	for _, v := range []string{"2", "3", "4"} {
+		git(work, "update-index", "--index-version", v)
+		hashes, err := readIndex(filepath.Join(work, ".git", "index"), SHA1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []Hash{committed, staged, cached}; fmt.Sprint(hashes) != fmt.Sprint(want) {
+			t.Errorf("index version %s: readIndex => %s, want %s", v, hashes, want)
+		}
+	}
+
+	r, err := Open(work)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := GC(r, GCOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	loose := DiskStore(r.CommonDir)
+	for _, tc := range []struct {
+		name        string
+		hash        Hash
+		exist, pack bool
+	}{
+		{"committed", committed, true, true},
+		{"head", head, true, true},
+		{"logged", logged, true, true},
+		{"staged", staged, true, true},
+		{"linked", linked, true, true},
+		{"expired", expired, false, false},
+		{"recent", recent, true, false},
+		{"dangling", dangling, true, false},
+		{"old tree", oldTree, true, false},
+	} {
+		if ok, err := r.Store.Has(tc.hash); ok != tc.exist || err != nil {
+			t.Errorf("%s: Has(%s) => %v, %v, want %v", tc.name, tc.hash, ok, err, tc.exist)
+		}
+		if ok, _ := loose.Has(tc.hash); ok == tc.pack && tc.exist {
+			t.Errorf("%s: loose %v, want %v", tc.name, ok, !tc.pack)
+		}
+	}
+	git(work, "fsck", "--no-dangling")
+
+	// kept objects are written to a cruft pack, and expire with Grace; the
+	// multi-pack-index is rewritten to name it
+	git(work, "multi-pack-index", "write")
+	if err := GC(r, GCOptions{Cruft: true}); err != nil {
+		t.Fatal(err)
+	}
+	git(work, "multi-pack-index", "verify")
+	idx, _ := filepath.Glob(filepath.Join(r.CommonDir, "objects", "pack", "pack-*.idx"))
+	midx, err := readMultiPackIndex(filepath.Join(r.CommonDir, "objects", "pack", "multi-pack-index"), SHA1)
+	if err != nil || midx == nil {
+		t.Fatalf("readMultiPackIndex => %v, %v", midx, err)
+	}
+	if len(midx.packs) != len(idx) {
+		t.Fatalf("multi-pack-index names %q, want %v packs", midx.packs, len(idx))
+	}
+	n := 0
+	loose.ForEach(func(Hash) error { n++; return nil })
+	if n != 0 {
+		t.Errorf("%v loose objects remain, want none", n)
+	}
+	mtimes, _ := filepath.Glob(filepath.Join(r.CommonDir, "objects", "pack", "pack-*.mtimes"))
+	if len(mtimes) != 1 {
+		t.Fatalf("cruft packs %q, want one", mtimes)
+	}
+	for _, h := range []Hash{recent, dangling, oldTree} {
+		git(work, "cat-file", "-e", h.String())
+	}
+	git(work, "repack", "-q", "-a", "-d", "--cruft")
+
+	blob(work, "g.txt", "pruned")
+	if err := GC(r, GCOptions{Grace: -1}); err != nil {
+		t.Fatal(err)
+	}
+	loose.ForEach(func(Hash) error { n++; return nil })
+	if n != 0 {
+		t.Errorf("%v loose objects remain, want none", n)
+	}
+	git(work, "fsck", "--no-dangling")
+
+	// objects missing from a partial clone bound the walk
+	src := filepath.Join(tmp, "src")
+	git(tmp, "init", "-q", src)
+	git(src, "config", "uploadpack.allowFilter", "true")
+	os.Mkdir(filepath.Join(src, "dir"), 0755)
+	for _, data := range []string{"first", "second"} {
+		blob(src, filepath.Join("dir", "a.txt"), data)
+		git(src, "add", "dir")
+		git(src, "commit", "-q", "-m", data)
+	}
+	for _, filter := range []string{"blob:none", "tree:0"} {
+		partial := filepath.Join(tmp, "partial-"+strings.Replace(filter, ":", "-", 1))
+		git(tmp, "clone", "-q", "--no-checkout", "--filter="+filter, "file://"+src, partial)
+		git(partial, "commit-tree", "-m", "local", "-p", "HEAD", "HEAD^{tree}")
+		r, err = Open(partial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := GC(r, GCOptions{}); err != nil {
+			t.Fatalf("GC(%s clone) => %v", filter, err)
+		}
+		git(partial, "fsck", "--no-dangling")
+	}
+}
+
+func TestObjectFormat(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(tmp, "gitconfig"))
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+
+	git := func(dir string, args ...string) string {
+		t.Helper()
+		cmd := command("git", append([]string{"-c", "user.name=Gopher", "-c", "user.email=gopher@example.com"}, args...)...)
+		cmd.Dir = dir
+		return strings.TrimSpace(assertRun(t, cmd))
+	}
+	work := filepath.Join(tmp, "work")
+	if err := InitRepository(work, InitOptions{ObjectFormat: "sha256"}); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(work, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(work, "dir", "file"), []byte("hello, world\n"), 0644)
+	git(work, "add", ".")
+	git(work, "commit", "-q", "-m", "initial")
+
+	repo, err := Open(work)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.ObjectFormat != SHA256 || formatOf(repo.Store) != SHA256 {
+		t.Fatalf("object format => %s, store %s, want sha256", repo.ObjectFormat, formatOf(repo.Store))
+	}
+
+	// objects are read from loose objects and then from a pack
+	check := func() {
+		t.Helper()
+		head, err := repo.Refs.Ref("HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head.Hash.ObjectFormat() != SHA256 {
+			t.Fatalf("HEAD => %s, want sha256 name", head.Hash)
+		}
+		c, err := LoadCommit(repo.Store, head.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := LoadTree(repo.Store, c.Tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Name != "dir" || entries[0].Hash.String() != git(work, "rev-parse", "HEAD:dir") {
+			t.Fatalf("LoadTree(%s) => %+v", c.Tree, entries)
+		}
+		r, err := repo.Store.Reader(entries[0].Hash, PrettyReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := git(work, "cat-file", "-p", entries[0].Hash.String()); strings.TrimSpace(string(b)) != want {
+			t.Fatalf("pretty tree => %q, want %q", b, want)
+		}
+	}
+	check()
+	git(work, "repack", "-adq")
+	repo, err = Open(work)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// objects are written with sha256 names
+	w := repo.Store.Writer()
+	w.WriteHeader(Blob, 5)
+	w.Write([]byte("blob\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	blob := w.Hash()
+	cmd := command("git", "hash-object", "--stdin")
+	cmd.Dir = work
+	if want := parseHash(t, assertWrite(t, cmd, strings.NewReader("blob\n"))); blob != want {
+		t.Fatalf("blob => %s, want %s", blob, want)
+	}
+	w = repo.Store.Writer()
+	w.WriteHeader(Tree, -1)
+	fmt.Fprintf(w, "100644 blob %s\tname\n", blob)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if have := git(work, "cat-file", "-p", w.Hash().String()); have != "100644 blob "+blob.String()+"\tname" {
+		t.Fatalf("cat-file -p %s => %q", w.Hash(), have)
+	}
+	if err := repo.Refs.UpdateRefs(RefUpdate{Name: "refs/tags/blob", Old: SHA256.ZeroHash(), New: blob}); err != nil {
+		t.Fatal(err)
+	}
+	git(work, "fsck", "--strict", "--no-dangling")
+
+	// packs are indexed and unpacked as sha256
+	pack := command("git", "pack-objects", "--all", "--stdout", "-q")
+	pack.Dir = work
+	data, err := pack.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"indexed", "unpacked"} {
+		dir := filepath.Join(tmp, name)
+		if err := InitRepository(dir, InitOptions{Bare: true, ObjectFormat: "sha256"}); err != nil {
+			t.Fatal(err)
+		}
+		if name == "indexed" {
+			if _, err := IndexPack(dir, bytes.NewReader(data), false); err != nil {
+				t.Fatal(err)
+			}
+			idx, _ := filepath.Glob(filepath.Join(dir, "objects", "pack", "*.idx"))
+			git(dir, append([]string{"verify-pack"}, idx...)...)
+		} else if _, err := UnpackObjects(bytes.NewReader(data), DiskStore(dir)); err != nil {
+			t.Fatal(err)
+		}
+		if have := git(dir, "cat-file", "-p", blob.String()); have != "blob" {
+			t.Errorf("%s: cat-file -p %s => %q", name, blob, have)
+		}
+	}
+	var buf bytes.Buffer
+	if err := WritePack(&buf, repo.Store, []Hash{blob}); err != nil {
+		t.Fatal(err)
+	}
+	cmd = command("git", "index-pack", "--stdin")
+	cmd.Dir = filepath.Join(tmp, "unpacked")
+	assertWrite(t, cmd, &buf)
+
+	// the object format is read again once config changes, and errors of
+	// reading it are reported
+	st := DiskStore(filepath.Join(tmp, "unpacked"))
+	config := filepath.Join(string(st), "config")
+	b, err := ioutil.ReadFile(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(config, append(b, "[extensions]\n\tobjectformat = bogus\n"...), 0644)
+	if _, err := st.Reader(blob, PrettyReader); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Reader with invalid config => %v, want ErrInvalidConfig", err)
+	}
+	if _, err := st.Writer().WriteHeader(Blob, 0); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Writer with invalid config => %v, want ErrInvalidConfig", err)
+	}
+	ioutil.WriteFile(config, b, 0644)
+	if f := st.ObjectFormat(); f != SHA256 {
+		t.Errorf("ObjectFormat => %s, want sha256", f)
+	}
+}
+
+// parseHash parses the object name output by git.
+func parseHash(t *testing.T, s string) Hash {
+	t.Helper()
+	h, err := ParseHash(strings.TrimSpace(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// zdata returns zlib compressed s.
+func zdata(t *testing.T, s string) io.Reader {
+	buf := new(bytes.Buffer)
+	zw := zlib.NewWriter(buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func BenchmarkMemReader(b *testing.B) {
+	st := MemStore()
+	data := []byte("hello, world")
+	w := st.Writer()
+	if _, err := w.WriteHeader(Blob, int64(len(data))); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		b.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+	hash := w.Hash()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		buf := new(bytes.Buffer)
+		r, err := st.Reader(hash)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(buf, r); err != nil {
+			b.Fatal(err)
+		}
+		r.Close()
+	}
+}
+
+func BenchmarkMemWriter(b *testing.B) {
+	st := MemStore()
+	data := []byte("hello, world")
+	r := bytes.NewReader(data)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		r.Seek(0, 0)
+		data = append(data, byte('!'))
+
+		w := st.Writer()
+		if _, err := w.WriteHeader(Blob, int64(len(data))); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			b.Fatal(n, err)
+		}
+	}
+}
+
+func BenchmarkDiskReader(b *testing.B) {
+	st, err := TempStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(string(st))
+
+	data := []byte("hello, world")
+
+	w := st.Writer()
+	if _, err := w.WriteHeader(Blob, int64(len(data))); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		b.Fatal(err)
+	}
+	if err := w.Close(); err != nil && err != io.EOF {
+		b.Fatal(err)
+	}
+	hash := w.Hash()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		buf := new(bytes.Buffer)
+		r, err := st.Reader(hash)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(buf, r); err != nil {
+			b.Fatal(err)
+		}
+		r.Close()
+	}
+}
+
+func BenchmarkDiskWriter(b *testing.B) {
+	st, err := TempStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(string(st))
+
+	data := []byte("hello, world")
+	r := bytes.NewReader(data)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		r.Seek(0, 0)
+		data = append(data, byte('!'))
+
+		w := st.Writer()
+		if _, err := w.WriteHeader(Blob, int64(len(data))); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			b.Fatal(n, err)
+		}
+	}
+}
+
+// benchTree writes a tree of dirs subtrees of files blobs each to st,
+// returning its hash.
+func benchTree(b *testing.B, st Store, dirs, files int) Hash {
+	write := func(t Type, data []byte) Hash {
+		w := st.Writer()
+		if _, err := w.WriteHeader(t, -1); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+		return w.Hash()
+	}
+	root := new(bytes.Buffer)
+	for i := 0; i < dirs; i++ {
+		tree := new(bytes.Buffer)
+		for j := 0; j < files; j++ {
+			h := write(Blob, []byte(fmt.Sprintf("file %v of dir %v\n", j, i)))
+			fmt.Fprintf(tree, "100644 blob %s\tfile%v\n", h, j)
+		}
+		fmt.Fprintf(root, "040000 tree %s\tdir%v\n", write(Tree, tree.Bytes()), i)
+	}
+	return write(Tree, root.Bytes())
+}
+
+// walkTree reads every object of the tree by hash.
+func walkTree(st Store, hash Hash) error {
+	es, err := LoadTree(st, hash)
+	if err != nil {
+		return err
+	}
+	for _, e := range es {
+		if e.Type() == Tree {
+			if err := walkTree(st, e.Hash); err != nil {
+				return err
+			}
+			continue
+		}
+		r, err := st.Reader(e.Hash)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(ioutil.Discard, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func BenchmarkTree(b *testing.B) {
+	st, err := TempStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(string(st))
+	tree := benchTree(b, st, 10, 50)
+
+	// pack every object
+	var names bytes.Buffer
+	st.ForEach(func(h Hash) error {
+		fmt.Fprintln(&names, h)
+		return nil
+	})
+	cmd := exec.Command("git", "pack-objects", "-q", filepath.Join("objects", "pack", "pack"))
+	cmd.Dir = string(st)
+	cmd.Stdin = &names
+	if out, err := cmd.CombinedOutput(); err != nil {
+		b.Fatalf("git pack-objects: %s", out)
+	}
+	pst := PackStore(string(st))
+
+	for _, bb := range []struct {
+		name string
+		st   Store
+	}{
+		{"DiskStore", st},
+		{"DiskStore/CacheStore", NewCacheStore(st, 1<<20)},
+		{"PackStore", pst},
+		{"PackStore/CacheStore", NewCacheStore(pst, 1<<20)},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				if err := walkTree(bb.st, tree); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
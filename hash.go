@@ -0,0 +1,159 @@
+package git
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+)
+
+// Hash is the binary name of an object, of either object format. Hash is
+// comparable and may be used as a map key. The zero value names no object.
+type Hash struct {
+	sum  [32]byte
+	size uint8
+}
+
+// ZeroHash is the SHA-1 name of all zeros, denoting a missing object in
+// reference updates. See ObjectFormat.ZeroHash for SHA-256.
+var ZeroHash = Hash{size: 20}
+
+// ParseHash parses a full hexadecimal object name of either object format.
+func ParseHash(s string) (Hash, error) {
+	var h Hash
+	if (len(s) != SHA1.HexSize() && len(s) != SHA256.HexSize()) || !isHex(s) {
+		return Hash{}, fmt.Errorf("git: invalid object name %q", s)
+	}
+	h.size = uint8(len(s) / 2)
+	hex.Decode(h.sum[:], []byte(s))
+	return h, nil
+}
+
+// NewHash returns the Hash of binary name b, a sum of either object format.
+// NewHash panics if b is of another length.
+func NewHash(b []byte) Hash {
+	if len(b) != SHA1.Size() && len(b) != SHA256.Size() {
+		panic(fmt.Sprintf("git: invalid object name length %d", len(b)))
+	}
+	h := Hash{size: uint8(len(b))}
+	copy(h.sum[:], b)
+	return h
+}
+
+// Bytes returns the binary name of h.
+func (h Hash) Bytes() []byte { return h.sum[:h.size:h.size] }
+
+// String returns the hexadecimal name of h, or the empty string for the
+// zero value.
+func (h Hash) String() string { return hex.EncodeToString(h.Bytes()) }
+
+// IsZero reports whether h is the zero value or a name of all zeros, such as
+// ZeroHash.
+func (h Hash) IsZero() bool { return h.sum == [32]byte{} }
+
+// ObjectFormat returns the object format of h, SHA-1 for the zero value.
+func (h Hash) ObjectFormat() ObjectFormat {
+	if h.size == 32 {
+		return SHA256
+	}
+	return SHA1
+}
+
+// Compare returns -1, 0 or +1 as h sorts before, equal to, or after o.
+func (h Hash) Compare(o Hash) int { return bytes.Compare(h.Bytes(), o.Bytes()) }
+
+// MarshalText implements encoding.TextMarshaler, as used for JSON.
+func (h Hash) MarshalText() ([]byte, error) { return []byte(h.String()), nil }
+
+// UnmarshalText implements encoding.TextUnmarshaler. An empty name is the
+// zero value.
+func (h *Hash) UnmarshalText(b []byte) error {
+	if len(b) == 0 {
+		*h = Hash{}
+		return nil
+	}
+	v, err := ParseHash(string(b))
+	if err != nil {
+		return err
+	}
+	*h = v
+	return nil
+}
+
+// Prefix is an object name, possibly abbreviated to its leading hexadecimal
+// digits. Prefix is comparable and the zero value matches every object.
+type Prefix struct {
+	h Hash
+	n int
+}
+
+// ParsePrefix parses the leading hexadecimal digits of an object name, at
+// most as many as of a full SHA-256 name.
+func ParsePrefix(s string) (Prefix, error) {
+	if len(s) == 0 || len(s) > SHA256.HexSize() || !isHex(s) {
+		return Prefix{}, fmt.Errorf("git: invalid object name %q", s)
+	}
+	p := Prefix{n: len(s)}
+	p.h.size = uint8((len(s) + 1) / 2)
+	if len(s)%2 == 1 {
+		s += "0"
+	}
+	hex.Decode(p.h.sum[:], []byte(s))
+	return p, nil
+}
+
+// Abbrev returns the prefix of h of n hexadecimal digits, or all of h if
+// it has fewer.
+func (h Hash) Abbrev(n int) Prefix {
+	if n < 0 || n > 2*int(h.size) {
+		n = 2 * int(h.size)
+	}
+	p := Prefix{n: n}
+	p.h.size = uint8((n + 1) / 2)
+	copy(p.h.sum[:p.h.size], h.sum[:])
+	if n%2 == 1 {
+		p.h.sum[n/2] &= 0xf0
+	}
+	return p
+}
+
+// Len returns the number of hexadecimal digits of p.
+func (p Prefix) Len() int { return p.n }
+
+func (p Prefix) String() string { return p.h.String()[:p.n] }
+
+// Hash returns the object name of p, reporting whether p is not
+// abbreviated.
+func (p Prefix) Hash() (Hash, bool) {
+	if p.n != SHA1.HexSize() && p.n != SHA256.HexSize() {
+		return Hash{}, false
+	}
+	return p.h, true
+}
+
+// Match reports whether h begins with p.
+func (p Prefix) Match(h Hash) bool {
+	if int(h.size) < int(p.h.size) {
+		return false
+	}
+	n := p.n / 2
+	if !bytes.Equal(h.sum[:n], p.h.sum[:n]) {
+		return false
+	}
+	return p.n%2 == 0 || h.sum[n]&0xf0 == p.h.sum[n]
+}
+
+// bytes returns the leading bytes of p whose digits are all given.
+func (p Prefix) bytes() []byte { return p.h.sum[:p.n/2] }
+
+// MarshalText implements encoding.TextMarshaler.
+func (p Prefix) MarshalText() ([]byte, error) { return []byte(p.String()), nil }
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (p *Prefix) UnmarshalText(b []byte) error {
+	v, err := ParsePrefix(string(b))
+	if err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
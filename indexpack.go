@@ -0,0 +1,333 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// PackIndexer is implemented by Stores that keep received packs whole rather
+// than unpacking them into loose objects.
+type PackIndexer interface {
+	// IndexPack reads a packfile from r and adds its objects to the
+	// Store. If promisor is set, the pack is marked as received from the
+	// promisor remote of a partial clone.
+	IndexPack(r io.Reader, promisor bool) error
+}
+
+// IndexPack reads a packfile from r into the objects/pack directory of git
+// directory dir with a version 2 index, returning the pack's path without
+// suffix. Deltas must have their bases within the pack; thin packs are not
+// completed. If promisor is set, the pack is marked as received from the
+// promisor remote of a partial clone by a .promisor file. The pack is of
+// the object format of the repository.
+func IndexPack(dir string, r io.Reader, promisor bool) (string, error) {
+	rf, err := loadRepoFormat(dir)
+	if err != nil {
+		return "", err
+	}
+	format := rf.format
+	pdir := filepath.Join(dir, "objects", "pack")
+	if err := os.MkdirAll(pdir, 0755); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(pdir, "tmp_pack_")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	entries, sum, err := indexEntries(f, r, rf)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Join(pdir, "pack-"+hex.EncodeToString(sum))
+	if _, err := os.Stat(name + ".idx"); err == nil {
+		return name, nil // already have this pack
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(f.Name(), name+".pack"); err != nil {
+		return "", err
+	}
+	f = nil
+	if promisor {
+		if err := ioutil.WriteFile(name+".promisor", nil, 0644); err != nil {
+			return "", err
+		}
+	}
+
+	idx := new(bytes.Buffer)
+	writePackIndex(idx, entries, sum, format)
+	if err := ioutil.WriteFile(name+".idx.lock", idx.Bytes(), 0444); err != nil {
+		return "", err
+	}
+	return name, os.Rename(name+".idx.lock", name+".idx")
+}
+
+// packEntry locates an object within a pack.
+type packEntry struct {
+	hash []byte
+	ofs  int64
+	crc  uint32
+}
+
+// indexEntries copies a pack of repository format rf from r to f,
+// returning entries of its objects and the pack's checksum. Commits, trees
+// and tags are checked to be well formed.
+func indexEntries(f *os.File, r io.Reader, rf repoFormat) ([]packEntry, []byte, error) {
+	format := rf.format
+	cr := &countReader{br: bufio.NewReader(io.TeeReader(r, f)), hh: format.New()}
+	hdr := make([]byte, 12)
+	if _, err := io.ReadFull(cr, hdr); err != nil {
+		return nil, nil, corrupt(err)
+	}
+	if string(hdr[:4]) != "PACK" {
+		return nil, nil, fmt.Errorf("%w: not a packfile", ErrCorrupt)
+	}
+	if v := binary.BigEndian.Uint32(hdr[4:]); v != 2 && v != 3 {
+		return nil, nil, fmt.Errorf("%w: unsupported pack version %v", ErrCorrupt, v)
+	}
+	count := binary.BigEndian.Uint32(hdr[8:])
+
+	// hashes of deltas are computed once the pack is complete
+	var (
+		entries = make([]packEntry, 0, prealloc(count))
+		ndeltas int
+		byOfs   = make(map[int64][]int) // base offset to indexes of dependent deltas
+		byHash  = make(map[Hash][]int)  // base hash to indexes of dependent deltas
+	)
+	for i := uint32(0); i < count; i++ {
+		ofs := cr.n
+		typ, size, err := cr.objectHeader()
+		if err != nil {
+			return nil, nil, err
+		}
+		e := packEntry{ofs: ofs}
+		switch typ {
+		case packCommit, packTree, packBlob, packTag:
+			if e.hash, err = hashObject(packTypes[typ], size, cr, rf); err != nil {
+				return nil, nil, err
+			}
+		case packOfsDelta, packRefDelta:
+			if typ == packOfsDelta {
+				rel, err := cr.offset()
+				if err != nil {
+					return nil, nil, err
+				}
+				if rel <= 0 || rel > ofs {
+					return nil, nil, fmt.Errorf("%w: invalid delta base offset", ErrCorrupt)
+				}
+				byOfs[ofs-rel] = append(byOfs[ofs-rel], len(entries))
+			} else {
+				sum := make([]byte, format.Size())
+				if _, err := io.ReadFull(cr, sum); err != nil {
+					return nil, nil, corrupt(err)
+				}
+				base := NewHash(sum)
+				byHash[base] = append(byHash[base], len(entries))
+			}
+			if err := skipN(cr, size); err != nil {
+				return nil, nil, err
+			}
+			ndeltas++
+		default:
+			return nil, nil, fmt.Errorf("%w: unknown pack object type %v", ErrCorrupt, typ)
+		}
+		entries = append(entries, e)
+	}
+
+	end := cr.n
+	sum := cr.hh.Sum(nil)
+	trailer := make([]byte, format.Size())
+	if _, err := io.ReadFull(cr.br, trailer); err != nil {
+		return nil, nil, corrupt(err)
+	}
+	if !bytes.Equal(sum, trailer) {
+		return nil, nil, fmt.Errorf("%w: pack checksum mismatch", ErrCorrupt)
+	}
+	// content following the pack is not kept
+	if err := f.Truncate(end + int64(format.Size())); err != nil {
+		return nil, nil, err
+	}
+
+	for i := range entries {
+		next := end
+		if i+1 < len(entries) {
+			next = entries[i+1].ofs
+		}
+		crc := crc32.NewIEEE()
+		if _, err := io.Copy(crc, io.NewSectionReader(f, entries[i].ofs, next-entries[i].ofs)); err != nil {
+			return nil, nil, err
+		}
+		entries[i].crc = crc.Sum32()
+	}
+
+	// resolve the dependents of each base as it becomes available, starting
+	// from non-delta objects
+	p := &packFile{f: f, format: format}
+	var stack []deltaBase
+	for _, e := range entries {
+		if e.hash != nil {
+			stack = append(stack, deltaBase{hash: NewHash(e.hash), ofs: e.ofs})
+		}
+	}
+	resolved := 0
+	for len(stack) > 0 {
+		b := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		deps := append(byOfs[b.ofs], byHash[b.hash]...)
+		delete(byOfs, b.ofs)
+		delete(byHash, b.hash)
+		if len(deps) == 0 {
+			continue
+		}
+		if b.data == nil {
+			typ, size, _, br, err := p.header(b.ofs)
+			if err != nil {
+				return nil, nil, err
+			}
+			b.t = packTypes[typ]
+			if b.data, err = inflateN(br, size); err != nil {
+				return nil, nil, err
+			}
+		}
+		for _, i := range deps {
+			_, size, _, br, err := p.header(entries[i].ofs)
+			if err != nil {
+				return nil, nil, err
+			}
+			patch, err := inflateN(br, size)
+			if err != nil {
+				return nil, nil, err
+			}
+			data, err := applyDelta(b.data, patch)
+			if err != nil {
+				return nil, nil, err
+			}
+			if entries[i].hash, err = hashObject(b.t, int64(len(data)), bytes.NewReader(data), rf); err != nil {
+				return nil, nil, err
+			}
+			resolved++
+			h := NewHash(entries[i].hash)
+			if len(byOfs[entries[i].ofs]) > 0 || len(byHash[h]) > 0 {
+				stack = append(stack, deltaBase{hash: h, ofs: entries[i].ofs, t: b.t, data: data})
+			}
+		}
+	}
+	if resolved < ndeltas {
+		return nil, nil, fmt.Errorf("%w: %v deltas with missing base", ErrCorrupt, ndeltas-resolved)
+	}
+	return entries, sum, nil
+}
+
+// hashObject returns the hash in repository format rf of an object of type
+// t and length size read from r, checking non-blob content is well formed.
+// If r is the pack's countReader, content is inflated.
+func hashObject(t Type, size int64, r io.Reader, rf repoFormat) ([]byte, error) {
+	f := rf.format
+	var pr *packReader
+	if cr, ok := r.(*countReader); ok {
+		zr, err := zlib.NewReader(cr)
+		if err != nil {
+			return nil, corrupt(err)
+		}
+		defer zr.Close()
+		pr = &packReader{io.LimitReader(zr, size), zr, size}
+		r = pr
+	}
+	if t != Blob {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, corrupt(err)
+		}
+		if err := checkObject(t, b, f); err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	hh := f.newObjectHash(rf.checkCollisions)
+	hh.Write(t.Header(size))
+	if n, err := io.Copy(hh, r); err != nil {
+		return nil, corrupt(err)
+	} else if n != size {
+		return nil, corrupt(io.EOF)
+	}
+	if pr != nil {
+		if err := drain(pr.zr); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkCollision(hh); err != nil {
+		return nil, err
+	}
+	return hh.Sum(nil), nil
+}
+
+// writePackIndex writes a version 2 index of entries of the pack with
+// checksum sum, whose objects are named in object format f.
+func writePackIndex(w io.Writer, entries []packEntry, sum []byte, f ObjectFormat) error {
+	entries = append([]packEntry{}, entries...)
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].hash, entries[j].hash) < 0
+	})
+
+	hh := f.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, hh))
+	bw.WriteString("\377tOc")
+	put32 := func(v uint32) {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], v)
+		bw.Write(b[:])
+	}
+	put32(2)
+	var fanout [256]uint32
+	for _, e := range entries {
+		fanout[e.hash[0]]++
+	}
+	for i, n := uint32(0), 0; i < 256; i++ {
+		n += int(fanout[i])
+		put32(uint32(n))
+	}
+	for _, e := range entries {
+		bw.Write(e.hash)
+	}
+	for _, e := range entries {
+		put32(e.crc)
+	}
+	var large []int64
+	for _, e := range entries {
+		if e.ofs < 0x80000000 {
+			put32(uint32(e.ofs))
+		} else {
+			put32(0x80000000 | uint32(len(large)))
+			large = append(large, e.ofs)
+		}
+	}
+	for _, ofs := range large {
+		put32(uint32(ofs >> 32))
+		put32(uint32(ofs))
+	}
+	bw.Write(sum)
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(hh.Sum(nil))
+	return err
+}
@@ -0,0 +1,321 @@
+package git
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// InitOptions configures InitRepository. The zero value initializes a
+// repository with a working tree, as git init does by default.
+type InitOptions struct {
+	// Bare initializes a repository without a working tree, whose git
+	// directory is the path given.
+	Bare bool
+
+	// InitialBranch is the branch HEAD refers to, defaulting to the
+	// init.defaultBranch config variable or master.
+	InitialBranch string
+
+	// Shared makes the repository shared by a group of users, as
+	// core.sharedRepository: false or umask, group or true, all, world
+	// or everybody, or an octal file mode such as 0640. Files and
+	// directories are made group writable, or readable by everyone, and
+	// directories set group id.
+	Shared string
+
+	// SeparateGitDir is the git directory of a repository with a working
+	// tree, whose .git is then a file referring to it.
+	SeparateGitDir string
+
+	// ObjectFormat is the hash algorithm of object names, sha1 or sha256,
+	// defaulting to GIT_DEFAULT_HASH or sha1.
+	ObjectFormat string
+
+	// Template is a directory whose files are copied to the git directory,
+	// such as hooks and info/exclude, defaulting to GIT_TEMPLATE_DIR or
+	// the init.templateDir config variable. Without one, a description,
+	// info/exclude and empty hooks directory are written as by git's
+	// default template.
+	Template string
+}
+
+// InitRepository initializes a new git repository at path. An error is
+// returned if the git directory exists and is not empty.
+func InitRepository(path string, opts InitOptions) error {
+	if opts.Bare && opts.SeparateGitDir != "" {
+		return fmt.Errorf("git: a bare repository can not have a separate git directory")
+	}
+	config, err := LoadConfig("")
+	if err != nil {
+		return err
+	}
+	branch := opts.InitialBranch
+	if branch == "" {
+		branch, _ = config.Get("init.defaultbranch")
+	}
+	if branch == "" {
+		branch = "master"
+	}
+	if !ValidRefName("refs/heads/" + branch) {
+		return fmt.Errorf("git: invalid initial branch name %q", branch)
+	}
+	name := opts.ObjectFormat
+	if name == "" {
+		name = os.Getenv("GIT_DEFAULT_HASH")
+	}
+	if name == "" {
+		name = "sha1"
+	}
+	format, err := ParseObjectFormat(name)
+	if err != nil {
+		return err
+	}
+	sh, err := parseShared(opts.Shared)
+	if err != nil {
+		return err
+	}
+	template := opts.Template
+	if template == "" {
+		template = os.Getenv("GIT_TEMPLATE_DIR")
+	}
+	if template == "" {
+		if v, ok := config.Get("init.templatedir"); ok {
+			template = expandConfigPath(v)
+		}
+	}
+
+	dir := path
+	switch {
+	case opts.SeparateGitDir != "":
+		if dir, err = filepath.Abs(opts.SeparateGitDir); err != nil {
+			return err
+		}
+	case !opts.Bare:
+		dir = filepath.Join(path, ".git")
+	}
+	if err := emptyDir(dir); err != nil {
+		return err
+	}
+	sh.root = dir
+	if err := sh.chmod(dir, true); err != nil {
+		return err
+	}
+
+	if template != "" {
+		if err := copyTemplate(template, dir, sh); err != nil {
+			return err
+		}
+	} else {
+		for _, x := range []struct {
+			name, data string
+		}{
+			{"description", "Unnamed repository; edit this file 'description' to name the repository.\n"},
+			{filepath.Join("info", "exclude"), defaultExclude},
+		} {
+			if err := sh.writeFile(filepath.Join(dir, x.name), []byte(x.data)); err != nil {
+				return err
+			}
+		}
+		for _, d := range []string{"branches", "hooks"} {
+			if err := sh.mkdir(filepath.Join(dir, d)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, d := range []string{
+		filepath.Join("objects", "info"),
+		filepath.Join("objects", "pack"),
+		filepath.Join("refs", "heads"),
+		filepath.Join("refs", "tags"),
+	} {
+		if err := sh.mkdir(filepath.Join(dir, d)); err != nil {
+			return err
+		}
+	}
+	if err := sh.writeFile(filepath.Join(dir, "HEAD"), []byte("ref: refs/heads/"+branch+"\n")); err != nil {
+		return err
+	}
+
+	cf := &ConfigFile{Path: filepath.Join(dir, "config")}
+	version := "0"
+	if format != SHA1 {
+		version = "1"
+	}
+	vars := [][2]string{
+		{"core.repositoryformatversion", version},
+		{"core.filemode", strconv.FormatBool(runtime.GOOS != "windows")},
+		{"core.bare", strconv.FormatBool(opts.Bare)},
+	}
+	if !opts.Bare {
+		vars = append(vars, [2]string{"core.logallrefupdates", "true"})
+	}
+	if sh.config != "" {
+		vars = append(vars, [2]string{"core.sharedrepository", sh.config}, [2]string{"receive.denyNonFastforwards", "true"})
+	}
+	if format != SHA1 {
+		vars = append(vars, [2]string{"extensions.objectformat", format.String()})
+	}
+	for _, v := range vars {
+		if err := cf.Set(v[0], v[1]); err != nil {
+			return err
+		}
+	}
+	if err := cf.Save(); err != nil {
+		return err
+	}
+	if err := sh.chmod(cf.Path, false); err != nil {
+		return err
+	}
+
+	if opts.SeparateGitDir != "" {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(filepath.Join(path, ".git"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(f, "gitdir: %s\n", dir)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	return nil
+}
+
+// defaultExclude is the info/exclude file of git's default template.
+const defaultExclude = `# git ls-files --others --exclude-from=.git/info/exclude
+# Lines that start with '#' are comments.
+# For a project mostly in C, the following would be a good set of
+# exclude patterns (uncomment them if you want to use them):
+# *.[oa]
+# *~
+`
+
+// emptyDir creates dir unless it exists, returning an error if it is not
+// empty.
+func emptyDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	_, err = f.Readdirnames(1)
+	f.Close()
+	if err != io.EOF {
+		if err == nil {
+			err = fmt.Errorf("directory not empty: %s", dir)
+		}
+		return err
+	}
+	return nil
+}
+
+// sharedPerm is the permissions of files of a shared repository.
+type sharedPerm struct {
+	// mode is of files, or zero if the repository is not shared.
+	mode   os.FileMode
+	config string
+
+	// root is the git directory, whose subdirectories are shared.
+	root string
+}
+
+// parseShared parses the value of core.sharedRepository.
+func parseShared(s string) (sharedPerm, error) {
+	switch strings.ToLower(s) {
+	case "", "false", "umask", "0":
+		return sharedPerm{}, nil
+	case "true", "group", "1":
+		return sharedPerm{mode: 0664, config: "1"}, nil
+	case "all", "world", "everybody", "2":
+		return sharedPerm{mode: 0664, config: "2"}, nil
+	}
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || !strings.HasPrefix(s, "0") || n&^0666 != 0 || n&0600 != 0600 {
+		return sharedPerm{}, fmt.Errorf("git: invalid shared repository mode %q", s)
+	}
+	return sharedPerm{mode: os.FileMode(n), config: fmt.Sprintf("0%o", n)}, nil
+}
+
+// chmod sets permissions of the file or directory at name if shared.
+// Directories are searchable by those who may read them and set group id
+// so files created in them belong to the group.
+func (sh sharedPerm) chmod(name string, dir bool) error {
+	if sh.mode == 0 {
+		return nil
+	}
+	mode := sh.mode
+	if dir {
+		mode |= (mode & 0444) >> 2
+		mode |= os.ModeSetgid
+	}
+	return os.Chmod(name, mode)
+}
+
+func (sh sharedPerm) mkdir(name string) error {
+	if err := os.MkdirAll(name, 0755); err != nil {
+		return err
+	}
+	// parents within the git directory are shared as well
+	for d := name; d != sh.root && d != filepath.Dir(d); d = filepath.Dir(d) {
+		if err := sh.chmod(d, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sh sharedPerm) writeFile(name string, data []byte) error {
+	if err := sh.mkdir(filepath.Dir(name)); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		return err
+	}
+	return sh.chmod(name, false)
+}
+
+// copyTemplate copies files and directories of template to dir, other than
+// a config file.
+func copyTemplate(template, dir string, sh sharedPerm) error {
+	return filepath.Walk(template, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(template, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		dst := filepath.Join(dir, rel)
+		switch {
+		case rel == "config":
+			return nil
+		case fi.IsDir():
+			return sh.mkdir(dst)
+		case !fi.Mode().IsRegular():
+			return nil
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		// executable hooks remain executable
+		if err := ioutil.WriteFile(dst, data, fi.Mode().Perm()); err != nil {
+			return err
+		}
+		if sh.mode != 0 {
+			return os.Chmod(dst, sh.mode|fi.Mode().Perm()&0111)
+		}
+		return nil
+	})
+}
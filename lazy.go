@@ -0,0 +1,149 @@
+package git
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// Fetcher fetches objects missing from a partial clone, as from its promisor
+// remote.
+type Fetcher interface {
+	// FetchObjects writes objects by hashes, and any objects they
+	// reference that the Fetcher chooses to include, to st.
+	FetchObjects(st Store, hashes []Hash) error
+}
+
+// LazyStore is a Store of a partial clone that fetches objects missing from
+// the underlying Store, writing them to it. Misses that occur while a fetch
+// is in progress are fetched together in the next.
+//
+// Only Object, Reader and Stat fetch missing objects; Has, ForEach,
+// ResolvePrefix and ShortestUnique report objects present in the
+// underlying Store.
+type LazyStore struct {
+	Store
+	fetcher Fetcher
+
+	mu   sync.Mutex
+	busy bool
+	next *lazyBatch
+}
+
+// lazyBatch is a set of hashes fetched together.
+type lazyBatch struct {
+	hashes []Hash
+	seen   map[Hash]bool
+	done   chan struct{}
+	err    error
+}
+
+// NewLazyStore returns a LazyStore fetching objects missing from st with f.
+func NewLazyStore(st Store, f Fetcher) *LazyStore {
+	return &LazyStore{Store: st, fetcher: f}
+}
+
+// Object implements Store, fetching the object if missing.
+func (st *LazyStore) Object(hash Hash) (io.Reader, error) {
+	r, err := st.Store.Object(hash)
+	if st.missing(hash, err) {
+		if err := st.fetch([]Hash{hash}); err != nil {
+			return nil, err
+		}
+		r, err = st.Store.Object(hash)
+	}
+	return r, err
+}
+
+// Reader implements Store, fetching the object if missing.
+func (st *LazyStore) Reader(hash Hash, options ...func(*Reader)) (*Reader, error) {
+	r, err := st.Store.Reader(hash, options...)
+	if st.missing(hash, err) {
+		if err := st.fetch([]Hash{hash}); err != nil {
+			return nil, err
+		}
+		r, err = st.Store.Reader(hash, options...)
+	}
+	return r, err
+}
+
+// Stat implements Store, fetching the object if missing.
+func (st *LazyStore) Stat(hash Hash) (Type, int64, error) {
+	t, n, err := st.Store.Stat(hash)
+	if st.missing(hash, err) {
+		if err := st.fetch([]Hash{hash}); err != nil {
+			return 0, 0, err
+		}
+		t, n, err = st.Store.Stat(hash)
+	}
+	return t, n, err
+}
+
+// Prefetch fetches those of hashes missing from the underlying Store in a
+// single batch, as before reading many objects.
+func (st *LazyStore) Prefetch(hashes ...Hash) error {
+	var missing []Hash
+	for _, h := range hashes {
+		ok, err := st.Store.Has(h)
+		if err != nil {
+			return err
+		}
+		if !ok && h != (Hash{}) {
+			missing = append(missing, h)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return st.fetch(missing)
+}
+
+// ResolvePrefix implements PrefixResolver with the underlying Store.
+func (st *LazyStore) ResolvePrefix(p Prefix) (Hash, error) { return ResolvePrefix(st.Store, p) }
+
+// ShortestUnique implements Abbreviator with the underlying Store.
+func (st *LazyStore) ShortestUnique(hash Hash) (Prefix, error) { return ShortestUnique(st.Store, hash) }
+
+// ObjectFormat returns the object format of the underlying Store.
+func (st *LazyStore) ObjectFormat() ObjectFormat { return formatOf(st.Store) }
+
+// missing reports whether err is of a hash that may be fetched.
+func (st *LazyStore) missing(hash Hash, err error) bool {
+	return err != nil && errors.Is(err, ErrNotExist) && hash != (Hash{})
+}
+
+// fetch adds hashes to the next batch and waits for it to be fetched. The
+// first caller to find no fetch in progress fetches batches until none
+// remain.
+func (st *LazyStore) fetch(hashes []Hash) error {
+	st.mu.Lock()
+	b := st.next
+	if b == nil {
+		b = &lazyBatch{seen: make(map[Hash]bool), done: make(chan struct{})}
+		st.next = b
+	}
+	for _, h := range hashes {
+		if !b.seen[h] {
+			b.seen[h] = true
+			b.hashes = append(b.hashes, h)
+		}
+	}
+	if st.busy {
+		st.mu.Unlock()
+		<-b.done
+		return b.err
+	}
+
+	st.busy = true
+	for st.next != nil {
+		next := st.next
+		st.next = nil
+		st.mu.Unlock()
+		next.err = st.fetcher.FetchObjects(st.Store, next.hashes)
+		close(next.done)
+		st.mu.Lock()
+	}
+	st.busy = false
+	st.mu.Unlock()
+	return b.err
+}
@@ -0,0 +1,299 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Chunks of a multi-pack-index.
+const (
+	chunkPackNames = "PNAM"
+	chunkFanout    = "OIDF"
+	chunkNames     = "OIDL"
+	chunkOffsets   = "OOFF"
+	chunkLarge     = "LOFF"
+)
+
+// multiPackIndex is the multi-pack-index of the objects/pack directory of a
+// repository, locating objects of every pack it names by a single binary
+// search of its table of names.
+type multiPackIndex struct {
+	sortedNames
+
+	// packs are the file names of indexes of packs, by pack id.
+	packs []string
+
+	// offsets and large are the object offsets and large offsets chunks.
+	offsets, large []byte
+}
+
+// readMultiPackIndex reads the multi-pack-index file at path of object
+// format f, returning nil if there is none.
+func readMultiPackIndex(path string, f ObjectFormat) (*multiPackIndex, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	m, err := parseMultiPackIndex(b, f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+// parseMultiPackIndex validates the multi-pack-index b, of object format
+// f, and locates its chunks.
+func parseMultiPackIndex(b []byte, f ObjectFormat) (*multiPackIndex, error) {
+	hs := f.Size()
+	if len(b) < 12+hs || string(b[:4]) != "MIDX" {
+		return nil, fmt.Errorf("%w: invalid multi-pack-index", ErrCorrupt)
+	}
+	if b[4] != 1 {
+		return nil, fmt.Errorf("%w: unsupported multi-pack-index version %v", ErrCorrupt, b[4])
+	}
+	if uint32(b[5]) != f.id() {
+		return nil, fmt.Errorf("%w: multi-pack-index is not of object format %s", ErrCorrupt, f)
+	}
+	if b[7] != 0 {
+		return nil, fmt.Errorf("%w: multi-pack-index with base files", ErrNotImplemented)
+	}
+
+	// table of contents lists chunks and the offset following the last
+	nchunks, end := int(b[6]), uint64(len(b)-hs)
+	if 12+(nchunks+1)*12 > len(b)-hs {
+		return nil, fmt.Errorf("%w: multi-pack-index truncated", ErrCorrupt)
+	}
+	chunks := make(map[string][]byte)
+	for i := 0; i < nchunks; i++ {
+		row := b[12+i*12:]
+		ofs, next := binary.BigEndian.Uint64(row[4:]), binary.BigEndian.Uint64(row[16:])
+		if ofs > next || next > end {
+			return nil, fmt.Errorf("%w: invalid multi-pack-index chunk offset", ErrCorrupt)
+		}
+		chunks[string(row[:4])] = b[ofs:next]
+	}
+	for _, id := range []string{chunkPackNames, chunkFanout, chunkNames, chunkOffsets} {
+		if _, ok := chunks[id]; !ok {
+			return nil, fmt.Errorf("%w: multi-pack-index lacks %s chunk", ErrCorrupt, id)
+		}
+	}
+
+	m := &multiPackIndex{offsets: chunks[chunkOffsets], large: chunks[chunkLarge]}
+	if len(chunks[chunkFanout]) != 256*4 {
+		return nil, fmt.Errorf("%w: invalid fanout table", ErrCorrupt)
+	}
+	if err := m.readFanout(chunks[chunkFanout]); err != nil {
+		return nil, err
+	}
+	n := m.count()
+	if len(chunks[chunkNames]) != n*hs || len(m.offsets) != n*8 || len(m.large)%8 != 0 {
+		return nil, fmt.Errorf("%w: multi-pack-index truncated", ErrCorrupt)
+	}
+	m.names, m.size = chunks[chunkNames], hs
+
+	// pack names are terminated by NUL and padded to a multiple of four
+	for _, name := range strings.Split(string(chunks[chunkPackNames]), "\x00") {
+		if name != "" {
+			m.packs = append(m.packs, name)
+		}
+	}
+	if len(m.packs) != int(binary.BigEndian.Uint32(b[8:])) || !sort.StringsAreSorted(m.packs) {
+		return nil, fmt.Errorf("%w: invalid multi-pack-index pack names", ErrCorrupt)
+	}
+	return m, nil
+}
+
+// entry returns the pack id and offset within it of the i'th object.
+// Offsets with the high bit set index large offsets, if any.
+func (m *multiPackIndex) entry(i int) (int, int64, error) {
+	id := binary.BigEndian.Uint32(m.offsets[i*8:])
+	ofs := binary.BigEndian.Uint32(m.offsets[i*8+4:])
+	if int(id) >= len(m.packs) {
+		return 0, 0, fmt.Errorf("%w: invalid multi-pack-index pack id", ErrCorrupt)
+	}
+	if ofs&0x80000000 == 0 || m.large == nil {
+		return int(id), int64(ofs), nil
+	}
+	j := int(ofs&0x7fffffff) * 8
+	if j+8 > len(m.large) {
+		return 0, 0, fmt.Errorf("%w: invalid large offset", ErrCorrupt)
+	}
+	return int(id), int64(binary.BigEndian.Uint64(m.large[j:])), nil
+}
+
+// pack returns the id of the pack of index file name, or -1 if m does not
+// index it.
+func (m *multiPackIndex) pack(name string) int {
+	if m == nil {
+		return -1
+	}
+	i := sort.SearchStrings(m.packs, name)
+	if i < len(m.packs) && m.packs[i] == name {
+		return i
+	}
+	return -1
+}
+
+// WriteMultiPackIndex writes the multi-pack-index of every pack of the
+// objects/pack directory of git directory dir, replacing any, such that a
+// PackStore locates objects by a single binary search however many packs
+// there are. Objects of more than one pack are located in the most recently
+// modified, as by git.
+func WriteMultiPackIndex(dir string) error {
+	format, err := repositoryFormat(dir)
+	if err != nil {
+		return err
+	}
+	pdir := filepath.Join(dir, "objects", "pack")
+	ns, err := filepath.Glob(filepath.Join(pdir, "pack-*.idx"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(ns)
+
+	type entry struct {
+		name  []byte
+		pack  int
+		ofs   int64
+		mtime int64
+	}
+	var entries []entry
+	packs := make([]string, len(ns))
+	for id, n := range ns {
+		packs[id] = filepath.Base(n)
+		p, err := openPack(strings.TrimSuffix(n, ".idx"), format)
+		if err != nil {
+			return err
+		}
+		fi, err := p.f.Stat()
+		p.f.Close()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < p.count(); i++ {
+			ofs, err := p.offset(i)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry{p.name(i), id, ofs, fi.ModTime().Unix()})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if c := bytes.Compare(entries[i].name, entries[j].name); c != 0 {
+			return c < 0
+		}
+		// of packs modified in the same second, the first is preferred
+		return entries[i].mtime > entries[j].mtime
+	})
+	uniq := entries[:0]
+	for i, e := range entries {
+		if i == 0 || !bytes.Equal(e.name, entries[i-1].name) {
+			uniq = append(uniq, e)
+		}
+	}
+	entries = uniq
+
+	// chunks are written in the order git writes them
+	var pnam, oidf, oidl, ooff, loff bytes.Buffer
+	put32 := func(buf *bytes.Buffer, v uint32) {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], v)
+		buf.Write(b[:])
+	}
+	for _, name := range packs {
+		pnam.WriteString(name)
+		pnam.WriteByte(0)
+	}
+	for pnam.Len()%4 != 0 {
+		pnam.WriteByte(0)
+	}
+	var fanout [256]uint32
+	for _, e := range entries {
+		fanout[e.name[0]]++
+	}
+	for i, n := 0, uint32(0); i < 256; i++ {
+		n += fanout[i]
+		put32(&oidf, n)
+	}
+	large := false
+	for _, e := range entries {
+		large = large || e.ofs > 0xffffffff
+	}
+	for _, e := range entries {
+		oidl.Write(e.name)
+		put32(&ooff, uint32(e.pack))
+		if large && e.ofs >= 0x80000000 {
+			put32(&ooff, 0x80000000|uint32(loff.Len()/8))
+			put32(&loff, uint32(e.ofs>>32))
+			put32(&loff, uint32(e.ofs))
+		} else {
+			put32(&ooff, uint32(e.ofs))
+		}
+	}
+	type chunk struct {
+		id   string
+		data *bytes.Buffer
+	}
+	chunks := []chunk{
+		{chunkPackNames, &pnam},
+		{chunkFanout, &oidf},
+		{chunkNames, &oidl},
+		{chunkOffsets, &ooff},
+	}
+	if large {
+		chunks = append(chunks, chunk{chunkLarge, &loff})
+	}
+
+	lock := filepath.Join(pdir, "multi-pack-index.lock")
+	f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(lock)
+		}
+	}()
+	hh := format.New()
+	bw := bufio.NewWriter(io.MultiWriter(f, hh))
+	bw.WriteString("MIDX")
+	bw.Write([]byte{1, byte(format.id()), byte(len(chunks)), 0})
+	var b [8]byte
+	binary.BigEndian.PutUint32(b[:4], uint32(len(packs)))
+	bw.Write(b[:4])
+	ofs := uint64(12 + (len(chunks)+1)*12)
+	for _, c := range chunks {
+		bw.WriteString(c.id)
+		binary.BigEndian.PutUint64(b[:], ofs)
+		bw.Write(b[:])
+		ofs += uint64(c.data.Len())
+	}
+	bw.Write([]byte{0, 0, 0, 0})
+	binary.BigEndian.PutUint64(b[:], ofs)
+	bw.Write(b[:])
+	for _, c := range chunks {
+		bw.Write(c.data.Bytes())
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if _, err := f.Write(hh.Sum(nil)); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	f = nil
+	return os.Rename(lock, filepath.Join(pdir, "multi-pack-index"))
+}
@@ -0,0 +1,258 @@
+package git
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// MultiStore is a Store searching each of several Stores in turn, such as
+// the loose objects, packs and alternates of a repository, and writing
+// objects to one of them. An object is read from the first Store having it;
+// a Store missing an object, as by ErrNotExist, is passed over, while other
+// errors are returned.
+//
+// ForEach visits objects of every Store, and so may visit an object more
+// than once. MultiStore implements PrefixResolver with those of its Stores,
+// and PackIndexer with the first of its Stores that does.
+type MultiStore struct {
+	w      Store
+	stores []Store
+}
+
+// NewMultiStore returns a MultiStore searching w and then each of stores,
+// writing objects to w. If w is nil, objects are only read from stores and
+// Writer reports ErrNotImplemented.
+//
+//	st := git.NewMultiStore(git.DiskStore(dir), git.PackStore(dir))
+func NewMultiStore(w Store, stores ...Store) *MultiStore {
+	if w != nil {
+		stores = append([]Store{w}, stores...)
+	}
+	return &MultiStore{w: w, stores: stores}
+}
+
+// Stores returns the Stores searched, in order.
+func (st *MultiStore) Stores() []Store { return st.stores }
+
+func (st *MultiStore) Object(hash Hash) (io.Reader, error) {
+	var miss error
+	for _, s := range st.stores {
+		r, err := s.Object(hash)
+		if !isNotExist(err) {
+			return r, err
+		}
+		miss = firstMiss(miss, err)
+	}
+	return nil, notExist(hash, miss)
+}
+
+func (st *MultiStore) Reader(hash Hash, options ...func(*Reader)) (*Reader, error) {
+	var miss error
+	for _, s := range st.stores {
+		r, err := s.Reader(hash, options...)
+		if !isNotExist(err) {
+			return r, err
+		}
+		miss = firstMiss(miss, err)
+	}
+	return nil, notExist(hash, miss)
+}
+
+func (st *MultiStore) Has(hash Hash) (bool, error) {
+	for _, s := range st.stores {
+		if ok, err := s.Has(hash); ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func (st *MultiStore) Stat(hash Hash) (Type, int64, error) {
+	var miss error
+	for _, s := range st.stores {
+		t, n, err := s.Stat(hash)
+		if !isNotExist(err) {
+			return t, n, err
+		}
+		miss = firstMiss(miss, err)
+	}
+	return 0, 0, notExist(hash, miss)
+}
+
+func (st *MultiStore) ForEach(fn func(hash Hash) error) error {
+	for _, s := range st.stores {
+		if err := s.ForEach(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writer returns a Writer of the Store written to.
+func (st *MultiStore) Writer() Writer {
+	if st.w == nil {
+		return errWriter{fmt.Errorf("%w: MultiStore has no Store to write", ErrNotImplemented)}
+	}
+	return st.w.Writer()
+}
+
+// ResolvePrefix implements PrefixResolver, resolving p in each Store and
+// reporting AmbiguousError if the Stores together have more than one match.
+func (st *MultiStore) ResolvePrefix(p Prefix) (Hash, error) {
+	return resolveMatches(p, func(fn func(Hash) error) error {
+		for _, s := range st.stores {
+			h, err := ResolvePrefix(s, p)
+			if amb, ok := err.(*AmbiguousError); ok {
+				for _, h := range amb.Candidates {
+					fn(h)
+				}
+				continue
+			}
+			if isNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			fn(h)
+		}
+		return nil
+	})
+}
+
+// IndexPack implements PackIndexer with the first Store that does.
+func (st *MultiStore) IndexPack(r io.Reader, promisor bool) error {
+	for _, s := range st.stores {
+		if x, ok := s.(PackIndexer); ok {
+			return x.IndexPack(r, promisor)
+		}
+	}
+	return fmt.Errorf("%w: MultiStore has no PackIndexer", ErrNotImplemented)
+}
+
+// ObjectFormat returns the object format of the Store written to, or else
+// of the first Store.
+func (st *MultiStore) ObjectFormat() ObjectFormat {
+	switch {
+	case st.w != nil:
+		return formatOf(st.w)
+	case len(st.stores) > 0:
+		return formatOf(st.stores[0])
+	}
+	return SHA1
+}
+
+// firstMiss returns the first error reporting an object missing, unless a
+// later one reports it ErrPromised, as by a pack of a partial clone.
+func firstMiss(miss, err error) error {
+	if miss == nil || errors.Is(err, ErrPromised) && !errors.Is(miss, ErrPromised) {
+		return err
+	}
+	return miss
+}
+
+// notExist returns miss, or ErrNotExist of hash if nil, as of no Stores.
+func notExist(hash Hash, miss error) error {
+	if miss == nil {
+		return fmt.Errorf("%w: %s", ErrNotExist, hash)
+	}
+	return miss
+}
+
+// maxAlternateDepth is the depth of alternates of alternates searched, as
+// by git.
+const maxAlternateDepth = 5
+
+// openObjects returns a MultiStore of the objects of git directory dir,
+// writing loose objects. Loose objects and packs of dir are searched
+// first, then those of each object directory listed by
+// objects/info/alternates, or by GIT_ALTERNATE_OBJECT_DIRECTORIES, and
+// then those of its own alternates, recursively. Alternates that do not
+// exist are ignored, as by git.
+func openObjects(dir string) (*MultiStore, error) {
+	var stores []Store
+	seen := map[string]bool{filepath.Join(dir, "objects"): true}
+	var link func(objects string, alts []string, depth int) error
+	link = func(objects string, alts []string, depth int) error {
+		for _, alt := range alts {
+			if !filepath.IsAbs(alt) {
+				alt = filepath.Join(objects, alt)
+			}
+			alt = filepath.Clean(alt)
+			if seen[alt] {
+				continue
+			}
+			seen[alt] = true
+			if fi, err := os.Stat(alt); err != nil || !fi.IsDir() {
+				continue
+			}
+			// Stores name git directories of an objects directory
+			if filepath.Base(alt) != "objects" {
+				return fmt.Errorf("%w: alternate object directory %s is not named objects", ErrNotImplemented, alt)
+			}
+			d := filepath.Dir(alt)
+			stores = append(stores, DiskStore(d), PackStore(d))
+			if depth == maxAlternateDepth {
+				continue
+			}
+			next, err := readAlternates(alt)
+			if err != nil {
+				return err
+			}
+			if err := link(alt, next, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	objects := filepath.Join(dir, "objects")
+	alts, err := readAlternates(objects)
+	if err != nil {
+		return nil, err
+	}
+	for _, alt := range filepath.SplitList(os.Getenv("GIT_ALTERNATE_OBJECT_DIRECTORIES")) {
+		if alt, err = filepath.Abs(alt); err != nil {
+			return nil, err
+		}
+		alts = append(alts, alt)
+	}
+	if err := link(objects, alts, 1); err != nil {
+		return nil, err
+	}
+	return NewMultiStore(DiskStore(dir), append([]Store{PackStore(dir)}, stores...)...), nil
+}
+
+// readAlternates returns the object directories listed by the info/alternates
+// file of object directory objects, one to a line. Blank lines and those
+// beginning with # are ignored; lines beginning with a quote are unquoted.
+func readAlternates(objects string) ([]string, error) {
+	f, err := os.Open(filepath.Join(objects, "info", "alternates"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var alts []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '"' {
+			if s, err := strconv.Unquote(line); err == nil {
+				line = s
+			}
+		}
+		alts = append(alts, line)
+	}
+	return alts, sc.Err()
+}
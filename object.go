@@ -0,0 +1,291 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// TreeEntry is a single entry of a tree object.
+type TreeEntry struct {
+	Mode string
+	Name string
+	Hash Hash
+}
+
+// Type returns the type of object referenced by the entry. Submodule
+// entries, of mode 160000, reference commits.
+func (e TreeEntry) Type() Type {
+	switch {
+	case e.Mode == "40000" || e.Mode == "040000":
+		return Tree
+	case e.Mode == "160000":
+		return Commit
+	}
+	return Blob
+}
+
+// ReadTree reads entries of a tree object in git's binary format, such as
+// read by Reader without PrettyReader.
+func ReadTree(r io.Reader) ([]TreeEntry, error) { return ReadTreeFormat(r, SHA1) }
+
+// ReadTreeFormat reads entries of a tree object whose references are named
+// in object format f.
+func ReadTreeFormat(r io.Reader, f ObjectFormat) ([]TreeEntry, error) {
+	br := bufio.NewReader(r)
+	var entries []TreeEntry
+	sum := make([]byte, f.Size())
+	for {
+		mode, err := br.ReadString(' ')
+		if err == io.EOF && mode == "" {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, corrupt(err)
+		}
+		name, err := br.ReadString('\x00')
+		if err != nil {
+			return nil, corrupt(err)
+		}
+		if _, err := io.ReadFull(br, sum); err != nil {
+			return nil, corrupt(err)
+		}
+		entries = append(entries, TreeEntry{
+			Mode: mode[:len(mode)-1],
+			Name: name[:len(name)-1],
+			Hash: NewHash(sum),
+		})
+	}
+}
+
+// CommitObject holds the fields of a commit object.
+type CommitObject struct {
+	Tree      Hash
+	Parents   []Hash
+	Author    string
+	Committer string
+
+	// Headers holds additional headers, such as gpgsig, in order.
+	Headers []Header
+
+	Message string
+}
+
+// TagObject holds the fields of an annotated tag object.
+type TagObject struct {
+	Object  Hash
+	Type    Type
+	Tag     string
+	Tagger  string
+	Headers []Header
+	Message string
+}
+
+// Header is a single header of a commit or tag object. Continuation lines
+// of multi-line values are joined by newline.
+type Header struct {
+	Key, Value string
+}
+
+// readHeaders parses headers and message of commits and tags.
+func readHeaders(r io.Reader) ([]Header, string, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	var hs []Header
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i == -1 {
+			return nil, "", fmt.Errorf("%w: unterminated header", ErrCorrupt)
+		}
+		line := string(b[:i])
+		b = b[i+1:]
+		if line == "" {
+			return hs, string(b), nil
+		}
+		if line[0] == ' ' && len(hs) > 0 {
+			hs[len(hs)-1].Value += "\n" + line[1:]
+			continue
+		}
+		j := strings.IndexByte(line, ' ')
+		if j == -1 {
+			return nil, "", fmt.Errorf("%w: invalid header %q", ErrCorrupt, line)
+		}
+		hs = append(hs, Header{line[:j], line[j+1:]})
+	}
+	return hs, "", nil
+}
+
+// ReadCommit reads a commit object.
+func ReadCommit(r io.Reader) (*CommitObject, error) {
+	hs, msg, err := readHeaders(r)
+	if err != nil {
+		return nil, err
+	}
+	c := &CommitObject{Message: msg}
+	var tree bool
+	for _, h := range hs {
+		switch h.Key {
+		case "tree":
+			if c.Tree, err = ParseHash(h.Value); err != nil {
+				return nil, fmt.Errorf("%w: invalid tree %q", ErrCorrupt, h.Value)
+			}
+			tree = true
+		case "parent":
+			p, err := ParseHash(h.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid parent %q", ErrCorrupt, h.Value)
+			}
+			c.Parents = append(c.Parents, p)
+		case "author":
+			c.Author = h.Value
+		case "committer":
+			c.Committer = h.Value
+		default:
+			c.Headers = append(c.Headers, h)
+		}
+	}
+	if !tree {
+		return nil, fmt.Errorf("%w: commit without tree", ErrCorrupt)
+	}
+	return c, nil
+}
+
+// ReadTag reads an annotated tag object.
+func ReadTag(r io.Reader) (*TagObject, error) {
+	hs, msg, err := readHeaders(r)
+	if err != nil {
+		return nil, err
+	}
+	t := &TagObject{Message: msg}
+	var typ string
+	var object bool
+	for _, h := range hs {
+		switch h.Key {
+		case "object":
+			if t.Object, err = ParseHash(h.Value); err != nil {
+				return nil, fmt.Errorf("%w: invalid object %q", ErrCorrupt, h.Value)
+			}
+			object = true
+		case "type":
+			typ = h.Value
+		case "tag":
+			t.Tag = h.Value
+		case "tagger":
+			t.Tagger = h.Value
+		default:
+			t.Headers = append(t.Headers, h)
+		}
+	}
+	if !object {
+		return nil, fmt.Errorf("%w: tag without object", ErrCorrupt)
+	}
+	if t.Type, err = ParseType([]byte(typ)); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Bytes returns the commit in git object format.
+func (c *CommitObject) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	writeHeader(buf, "tree", c.Tree.String())
+	for _, p := range c.Parents {
+		writeHeader(buf, "parent", p.String())
+	}
+	writeHeader(buf, "author", c.Author)
+	writeHeader(buf, "committer", c.Committer)
+	for _, h := range c.Headers {
+		writeHeader(buf, h.Key, h.Value)
+	}
+	buf.WriteByte('\n')
+	buf.WriteString(c.Message)
+	return buf.Bytes()
+}
+
+// Bytes returns the tag in git object format.
+func (t *TagObject) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	writeHeader(buf, "object", t.Object.String())
+	writeHeader(buf, "type", t.Type.String())
+	writeHeader(buf, "tag", t.Tag)
+	if t.Tagger != "" {
+		writeHeader(buf, "tagger", t.Tagger)
+	}
+	for _, h := range t.Headers {
+		writeHeader(buf, h.Key, h.Value)
+	}
+	buf.WriteByte('\n')
+	buf.WriteString(t.Message)
+	return buf.Bytes()
+}
+
+func writeHeader(buf *bytes.Buffer, key, value string) {
+	buf.WriteString(key)
+	buf.WriteByte(' ')
+	buf.WriteString(strings.Replace(value, "\n", "\n ", -1))
+	buf.WriteByte('\n')
+}
+
+// readObject reads the object by hash, checking it is of type t.
+func readObject(st Store, hash Hash, t Type) ([]byte, error) {
+	r, err := st.Reader(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if r.Type() != t {
+		return nil, fmt.Errorf("%w: %s is a %s, not a %s", ErrCorrupt, hash, r.Type(), t)
+	}
+	return ioutil.ReadAll(r)
+}
+
+// LoadCommit reads and parses the commit by hash from st.
+func LoadCommit(st Store, hash Hash) (*CommitObject, error) {
+	b, err := readObject(st, hash, Commit)
+	if err != nil {
+		return nil, err
+	}
+	return ReadCommit(bytes.NewReader(b))
+}
+
+// LoadTree reads and parses the tree by hash from st.
+func LoadTree(st Store, hash Hash) ([]TreeEntry, error) {
+	b, err := readObject(st, hash, Tree)
+	if err != nil {
+		return nil, err
+	}
+	return ReadTreeFormat(bytes.NewReader(b), formatOf(st))
+}
+
+// LoadTag reads and parses the annotated tag by hash from st.
+func LoadTag(st Store, hash Hash) (*TagObject, error) {
+	b, err := readObject(st, hash, Tag)
+	if err != nil {
+		return nil, err
+	}
+	return ReadTag(bytes.NewReader(b))
+}
+
+// Peel follows annotated tags from hash until reaching an object that is
+// not a tag, returning its hash and type.
+func Peel(st Store, hash Hash) (Hash, Type, error) {
+	for i := 0; ; i++ {
+		t, _, err := st.Stat(hash)
+		if err != nil || t != Tag {
+			return hash, t, err
+		}
+		if i >= 16 {
+			return Hash{}, 0, fmt.Errorf("%w: tag chain too deep at %s", ErrCorrupt, hash)
+		}
+		tag, err := LoadTag(st, hash)
+		if err != nil {
+			return Hash{}, 0, err
+		}
+		hash = tag.Object
+	}
+}
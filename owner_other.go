@@ -0,0 +1,8 @@
+//go:build !unix
+
+package git
+
+import "os"
+
+// fileOwner reports false as owners of files are not known.
+func fileOwner(fi os.FileInfo) (int, bool) { return 0, false }
@@ -1,26 +1,786 @@
 package git
 
-import "io"
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
 
-// PackStore implements Store for packfiles in git repositories.
-func PackStore() Store { return &packStore{} }
+// Packfile object types.
+const (
+	packCommit   = 1
+	packTree     = 2
+	packBlob     = 3
+	packTag      = 4
+	packOfsDelta = 6
+	packRefDelta = 7
+)
 
-type packStore struct{}
+// packTypes maps packfile object types to Type.
+var packTypes = map[byte]Type{
+	packCommit: Commit,
+	packTree:   Tree,
+	packBlob:   Blob,
+	packTag:    Tag,
+}
+
+// PackStore implements Store for packfiles in git repositories. Packs are
+// located in the objects/pack directory of git directory dir and are indexed
+// the first time the Store is accessed. The Store implements PackIndexer and
+// ObjectFormatter, naming objects in the object format of the repository.
+//
+// Objects of packs named by the multi-pack-index of the directory, as
+// written by WriteMultiPackIndex, are located by it alone. A
+// multi-pack-index that is invalid or names packs since removed is ignored.
+//
+// If any pack was received from the promisor remote of a partial clone,
+// missing objects are reported as ErrPromised.
+//
+//  store := git.PackStore(dir)
+func PackStore(dir string) Store { return &packStore{dir: dir} }
+
+// DeltaBaseCacheLimit is the total length of delta bases each PackStore
+// keeps inflated, so that objects deltified against a common base do not
+// inflate it again, as core.deltaBaseCacheLimit does for git.
+var DeltaBaseCacheLimit int64 = 96 << 20
+
+type packStore struct {
+	dir string
+
+	once   sync.Once
+	mu     sync.RWMutex
+	packs  []*packFile
+	format ObjectFormat
+	err    error
+
+	// midx locates objects of midxPacks, by pack id, if not nil.
+	midx      *multiPackIndex
+	midxPacks []*packFile
+
+	// bases caches delta bases of all packs.
+	bases *lru
+}
+
+// load opens all packs with an index found in the objects/pack directory,
+// returning them.
+func (st *packStore) load() ([]*packFile, error) {
+	st.once.Do(func() {
+		if st.format, st.err = repositoryFormat(st.dir); st.err != nil {
+			return
+		}
+		ns, err := filepath.Glob(filepath.Join(st.dir, "objects", "pack", "pack-*.idx"))
+		if err != nil {
+			st.err = err
+			return
+		}
+		sort.Strings(ns)
+		if DeltaBaseCacheLimit > 0 {
+			st.bases = newLRU(DeltaBaseCacheLimit)
+		}
+		st.loadMultiPackIndex(ns)
+		for _, n := range ns {
+			name := strings.TrimSuffix(n, ".idx")
+			var p *packFile
+			if id := st.midx.pack(filepath.Base(n)); id != -1 {
+				p = &packFile{format: st.format}
+				err = p.open(name)
+				st.midxPacks[id] = p
+			} else {
+				p, err = openPack(name, st.format)
+			}
+			if err != nil {
+				st.err = err
+				return
+			}
+			p.bases = st.bases
+			st.packs = append(st.packs, p)
+		}
+	})
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.packs, st.err
+}
+
+// loadMultiPackIndex reads the multi-pack-index of the objects/pack
+// directory, unless invalid or naming packs other than of index files ns.
+func (st *packStore) loadMultiPackIndex(ns []string) {
+	m, err := readMultiPackIndex(filepath.Join(st.dir, "objects", "pack", "multi-pack-index"), st.format)
+	if err != nil || m == nil {
+		return
+	}
+	have := make(map[string]bool)
+	for _, n := range ns {
+		have[filepath.Base(n)] = true
+	}
+	for _, name := range m.packs {
+		if !have[name] {
+			return
+		}
+	}
+	st.midx, st.midxPacks = m, make([]*packFile, len(m.packs))
+}
+
+// IndexPack implements PackIndexer, keeping the pack read from r in the
+// objects/pack directory.
+func (st *packStore) IndexPack(r io.Reader, promisor bool) error {
+	if _, err := st.load(); err != nil {
+		return err
+	}
+	name, err := IndexPack(st.dir, r, promisor)
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, p := range st.packs {
+		if p.f.Name() == name+".pack" {
+			return nil
+		}
+	}
+	p, err := openPack(name, st.format)
+	if err != nil {
+		return err
+	}
+	p.bases = st.bases
+	st.packs = append(st.packs, p)
+	return nil
+}
 
-func (st *packStore) Object(hash string) (io.Reader, error) {
-	panic("Not implemented")
+// find locates hash, returning the pack and offset of the object.
+func (st *packStore) find(hash Hash) (*packFile, int64, error) {
+	packs, err := st.load()
+	if err != nil {
+		return nil, 0, err
+	}
+	if st.midx != nil {
+		if i, ok := st.midx.find(hash); ok {
+			id, ofs, err := st.midx.entry(i)
+			if err != nil {
+				return nil, 0, err
+			}
+			return st.midxPacks[id], ofs, nil
+		}
+	}
+	var promisor bool
+	for _, p := range packs {
+		promisor = promisor || p.promisor
+		if i, ok := p.find(hash); ok {
+			ofs, err := p.offset(i)
+			return p, ofs, err
+		}
+	}
+	if promisor {
+		return nil, 0, fmt.Errorf("%w: %s", ErrPromised, hash)
+	}
+	return nil, 0, fmt.Errorf("%w: %s", ErrNotExist, hash)
 }
 
-func (st *packStore) Reader(hash string, options ...func(*Reader)) (*Reader, error) {
-	panic("Not implemented")
+// ResolvePrefix implements PrefixResolver, searching the index of every
+// pack.
+func (st *packStore) ResolvePrefix(prefix Prefix) (Hash, error) {
+	packs, err := st.load()
+	if err != nil {
+		return Hash{}, err
+	}
+	return resolveMatches(prefix, func(fn func(Hash) error) error {
+		if st.midx != nil {
+			if err := st.midx.matches(prefix, fn); err != nil {
+				return err
+			}
+		}
+		for _, p := range packs {
+			if err := p.matches(prefix, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
+// Object resolves hash to a reader of the object's inflated content.
+func (st *packStore) Object(hash Hash) (io.Reader, error) {
+	p, ofs, err := st.find(hash)
+	if err != nil {
+		return nil, err
+	}
+	_, _, r, err := p.object(ofs, st.find)
+	return r, err
+}
+
+func (st *packStore) Reader(hash Hash, options ...func(*Reader)) (*Reader, error) {
+	p, ofs, err := st.find(hash)
+	if err != nil {
+		return nil, err
+	}
+	t, n, r, err := p.object(ofs, st.find)
+	if err != nil {
+		return nil, err
+	}
+	options = append([]func(*Reader){FormatReader(st.format)}, options...)
+	return newRawReader(t, n, r, options...), nil
+}
+
+// Writer is not implemented and reports ErrNotImplemented.
 func (st *packStore) Writer() Writer {
-	panic("Not implemented")
+	return errWriter{ErrNotImplemented}
+}
+
+func (st *packStore) Has(hash Hash) (bool, error) {
+	_, _, err := st.find(hash)
+	if isNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Stat returns the object's type and length. Only the headers of a delta
+// chain are inflated.
+func (st *packStore) Stat(hash Hash) (Type, int64, error) {
+	p, ofs, err := st.find(hash)
+	if err != nil {
+		return 0, 0, err
+	}
+	return p.stat(ofs, st.find)
 }
 
-type packCloser struct{}
+// ForEach calls fn with the hash of every object in every pack. An object
+// contained in more than one pack is visited more than once, unless the
+// packs are named by the multi-pack-index.
+func (st *packStore) ForEach(fn func(hash Hash) error) error {
+	packs, err := st.load()
+	if err != nil {
+		return err
+	}
+	for i := 0; st.midx != nil && i < st.midx.count(); i++ {
+		if err := fn(NewHash(st.midx.name(i))); err != nil {
+			return err
+		}
+	}
+	for _, p := range packs {
+		for i := 0; i < p.count(); i++ {
+			if err := fn(NewHash(p.name(i))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ObjectFormat returns the object format of the repository. If it can not
+// be determined, SHA-1 is returned and the error is reported by other
+// methods.
+func (st *packStore) ObjectFormat() ObjectFormat {
+	st.load()
+	return st.format
+}
+
+// isNotExist reports whether err is ErrNotExist.
+func isNotExist(err error) bool { return err != nil && errors.Is(err, ErrNotExist) }
+
+// packFile provides access to a packfile and its version 2 index. Packs
+// indexed by a multi-pack-index are opened without their own index, and
+// appear empty to lookups of it.
+type packFile struct {
+	f *os.File
+
+	// promisor is set for packs received from a promisor remote.
+	promisor bool
+
+	// format names objects of the pack and its index.
+	format ObjectFormat
+
+	// idx is the entire content of the index file, and sortedNames its
+	// table of names.
+	idx []byte
+	sortedNames
+
+	// offsets of tables within idx
+	offsets, large int
+
+	// bases caches inflated delta bases, if not nil.
+	bases *lru
+}
+
+// baseKey identifies a delta base cached by offset in a pack.
+type baseKey struct {
+	p   *packFile
+	ofs int64
+}
+
+// openPack opens pack with basename name, that is without .idx or .pack
+// suffix, of object format f.
+func openPack(name string, f ObjectFormat) (*packFile, error) {
+	idx, err := ioutil.ReadFile(name + ".idx")
+	if err != nil {
+		return nil, err
+	}
+	p := &packFile{idx: idx, format: f}
+	if err := p.parseIndex(); err != nil {
+		return nil, fmt.Errorf("%s.idx: %w", name, err)
+	}
+	if err := p.open(name); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// open opens the packfile of basename name.
+func (p *packFile) open(name string) (err error) {
+	if p.f, err = os.Open(name + ".pack"); err != nil {
+		return err
+	}
+	if _, err := os.Stat(name + ".promisor"); err == nil {
+		p.promisor = true
+	}
+	return nil
+}
+
+// parseIndex validates idx and locates its tables.
+func (p *packFile) parseIndex() error {
+	b := p.idx
+	if len(b) < 8+256*4 || !bytes.Equal(b[:4], []byte("\377tOc")) {
+		return fmt.Errorf("%w: unsupported index version", ErrCorrupt)
+	}
+	if v := binary.BigEndian.Uint32(b[4:]); v != 2 {
+		return fmt.Errorf("%w: unsupported index version %v", ErrCorrupt, v)
+	}
+	if err := p.readFanout(b[8:]); err != nil {
+		return err
+	}
+	n, hs := p.count(), p.format.Size()
+	names := 8 + 256*4
+	p.offsets = names + n*hs + n*4
+	p.large = p.offsets + n*4
+	if len(b) < p.large+2*hs {
+		return fmt.Errorf("%w: index truncated", ErrCorrupt)
+	}
+	p.sortedNames.names = b[names : names+n*hs]
+	p.sortedNames.size = hs
+	return nil
+}
+
+// offset returns the offset of the i'th object within the pack.
+func (p *packFile) offset(i int) (int64, error) {
+	ofs := binary.BigEndian.Uint32(p.idx[p.offsets+i*4:])
+	if ofs&0x80000000 == 0 {
+		return int64(ofs), nil
+	}
+	j := p.large + int(ofs&0x7fffffff)*8
+	if j+8 > len(p.idx)-2*p.format.Size() {
+		return 0, fmt.Errorf("%w: invalid large offset", ErrCorrupt)
+	}
+	return int64(binary.BigEndian.Uint64(p.idx[j:])), nil
+}
+
+// sortedNames is a table of sorted binary object names, as of pack and
+// multi-pack indexes, with a fanout table counting names by first byte.
+type sortedNames struct {
+	fanout [256]uint32
+	names  []byte
+	size   int // of each name
+}
+
+// readFanout reads the fanout table from b, validating it is sorted.
+func (t *sortedNames) readFanout(b []byte) error {
+	for i := range t.fanout {
+		t.fanout[i] = binary.BigEndian.Uint32(b[i*4:])
+		if i > 0 && t.fanout[i] < t.fanout[i-1] {
+			return fmt.Errorf("%w: invalid fanout table", ErrCorrupt)
+		}
+	}
+	return nil
+}
+
+// count returns the number of names.
+func (t *sortedNames) count() int { return int(t.fanout[255]) }
+
+// name returns the i'th binary name in sorted order.
+func (t *sortedNames) name(i int) []byte {
+	return t.names[i*t.size : (i+1)*t.size]
+}
+
+// find returns the index of hash in sorted order, reporting whether the
+// table contains it.
+func (t *sortedNames) find(hash Hash) (int, bool) {
+	b := hash.Bytes()
+	if len(b) != t.size {
+		return 0, false
+	}
+	lo, hi := t.bucket(b[0])
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(t.name(lo+i), b) >= 0
+	})
+	return i, i < hi && bytes.Equal(t.name(i), b)
+}
+
+// bucket returns the range of indexes of names beginning with byte c.
+func (t *sortedNames) bucket(c byte) (lo, hi int) {
+	if c > 0 {
+		lo = int(t.fanout[c-1])
+	}
+	return lo, int(t.fanout[c])
+}
+
+// matches calls fn with every name beginning with prefix, in sorted order.
+func (t *sortedNames) matches(prefix Prefix, fn func(Hash) error) error {
+	lo, hi := 0, t.count()
+	b := prefix.bytes()
+	if len(b) > 0 {
+		lo, hi = t.bucket(b[0])
+		lo += sort.Search(hi-lo, func(i int) bool {
+			return bytes.Compare(t.name(lo+i), b) >= 0
+		})
+	}
+	for i := lo; i < hi && bytes.HasPrefix(t.name(i), b); i++ {
+		if h := NewHash(t.name(i)); prefix.Match(h) {
+			if err := fn(h); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// header reads the object header at ofs, returning the packfile type, the
+// size of the inflated data, and a reader positioned after the header. For
+// delta types, base is the base offset or Hash.
+func (p *packFile) header(ofs int64) (typ byte, size int64, base interface{}, br *bufio.Reader, err error) {
+	br = bufio.NewReader(io.NewSectionReader(p.f, ofs, 1<<62))
+	c, err := br.ReadByte()
+	if err != nil {
+		return 0, 0, nil, nil, corrupt(err)
+	}
+	typ = (c >> 4) & 7
+	size = int64(c & 15)
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if c, err = br.ReadByte(); err != nil {
+			return 0, 0, nil, nil, corrupt(err)
+		}
+		if shift > 56 {
+			return 0, 0, nil, nil, fmt.Errorf("%w: object size overflow", ErrCorrupt)
+		}
+		size |= int64(c&0x7f) << shift
+	}
+
+	switch typ {
+	case packCommit, packTree, packBlob, packTag:
+	case packOfsDelta:
+		c, err := br.ReadByte()
+		if err != nil {
+			return 0, 0, nil, nil, corrupt(err)
+		}
+		rel := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			if c, err = br.ReadByte(); err != nil {
+				return 0, 0, nil, nil, corrupt(err)
+			}
+			rel = ((rel + 1) << 7) | int64(c&0x7f)
+		}
+		if rel <= 0 || rel > ofs {
+			return 0, 0, nil, nil, fmt.Errorf("%w: invalid delta base offset", ErrCorrupt)
+		}
+		base = ofs - rel
+	case packRefDelta:
+		sum := make([]byte, p.format.Size())
+		if _, err := io.ReadFull(br, sum); err != nil {
+			return 0, 0, nil, nil, corrupt(err)
+		}
+		base = NewHash(sum)
+	default:
+		return 0, 0, nil, nil, fmt.Errorf("%w: unknown pack object type %v", ErrCorrupt, typ)
+	}
+	return typ, size, base, br, nil
+}
+
+// maxDeltaDepth bounds the length of delta chains resolved, as of chains
+// crafted to exhaust resources or of ref deltas forming a cycle. git writes
+// chains of at most 4095 deltas.
+const maxDeltaDepth = 10000
+
+// object returns type, length and content of object at ofs. Deltified
+// objects are resolved in memory; other objects are streamed. The function
+// find locates ref delta bases.
+func (p *packFile) object(ofs int64, find func(Hash) (*packFile, int64, error)) (Type, int64, io.Reader, error) {
+	typ, size, _, br, err := p.header(ofs)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if t, ok := packTypes[typ]; ok {
+		zr, err := newZlibReader(br)
+		if err != nil {
+			return 0, 0, nil, corrupt(err)
+		}
+		return t, size, &packReader{io.LimitReader(zr, size), zr, size}, nil
+	}
+	t, data, err := p.inflate(ofs, find)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return t, int64(len(data)), bytes.NewReader(data), nil
+}
+
+// inflate returns type and content of object at ofs, applying deltas. The
+// delta chain is followed to its base, or to a cached base, and deltas
+// are then applied in turn, caching the bases resolved.
+func (p *packFile) inflate(ofs int64, find func(Hash) (*packFile, int64, error)) (Type, []byte, error) {
+	type link struct {
+		p     *packFile
+		ofs   int64
+		delta []byte
+	}
+	var (
+		chain []link
+		t     Type
+		data  []byte
+	)
+	for {
+		if len(chain) > maxDeltaDepth {
+			return 0, nil, fmt.Errorf("%w: delta chain exceeds %v deltas", ErrCorrupt, maxDeltaDepth)
+		}
+		if len(chain) > 0 {
+			if bt, b, ok := p.bases.get(baseKey{p, ofs}); ok {
+				t, data = bt, b
+				break
+			}
+		}
+		typ, size, base, br, err := p.header(ofs)
+		if err != nil {
+			return 0, nil, err
+		}
+		b, err := inflateN(br, size)
+		if err != nil {
+			return 0, nil, err
+		}
+		if bt, ok := packTypes[typ]; ok {
+			t, data = bt, b
+			if len(chain) > 0 {
+				p.bases.add(baseKey{p, ofs}, t, data)
+			}
+			break
+		}
+		chain = append(chain, link{p, ofs, b})
+		switch b := base.(type) {
+		case int64:
+			ofs = b
+		case Hash:
+			if p, ofs, err = find(b); err != nil {
+				return 0, nil, err
+			}
+		}
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		var err error
+		if data, err = applyDelta(data, chain[i].delta); err != nil {
+			return 0, nil, err
+		}
+		if l := chain[i]; i > 0 {
+			l.p.bases.add(baseKey{l.p, l.ofs}, t, data)
+		}
+	}
+	return t, data, nil
+}
+
+// stat returns type and length of object at ofs. The function find locates
+// ref delta bases.
+func (p *packFile) stat(ofs int64, find func(Hash) (*packFile, int64, error)) (Type, int64, error) {
+	n := int64(-1)
+	for depth := 0; ; depth++ {
+		if depth > maxDeltaDepth {
+			return 0, 0, fmt.Errorf("%w: delta chain exceeds %v deltas", ErrCorrupt, maxDeltaDepth)
+		}
+		typ, size, base, br, err := p.header(ofs)
+		if err != nil {
+			return 0, 0, err
+		}
+		// type is that of the delta chain's base
+		if t, ok := packTypes[typ]; ok {
+			if n == -1 {
+				n = size
+			}
+			return t, n, nil
+		}
+		if n == -1 {
+			if n, err = deltaSize(br); err != nil {
+				return 0, 0, err
+			}
+		}
+		switch b := base.(type) {
+		case int64:
+			ofs = b
+		case Hash:
+			if p, ofs, err = find(b); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+}
+
+// deltaSize returns the length of the target of the delta read from br.
+func deltaSize(br *bufio.Reader) (int64, error) {
+	zr, err := newZlibReader(br)
+	if err != nil {
+		return 0, corrupt(err)
+	}
+	defer freeZlibReader(zr)
+
+	// delta data begins with source and target size
+	dr := bufio.NewReader(zr)
+	if _, err := binary.ReadUvarint(dr); err != nil {
+		return 0, corrupt(err)
+	}
+	n, err := binary.ReadUvarint(dr)
+	if err != nil {
+		return 0, corrupt(err)
+	}
+	return int64(n), nil
+}
+
+// packReader reads inflated content of a packed object, verifying its length.
+type packReader struct {
+	io.Reader
+	zr io.ReadCloser
+	n  int64
+}
+
+func (r *packReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n -= int64(n)
+	if err == io.EOF && r.n > 0 {
+		err = corrupt(io.EOF)
+	}
+	return n, err
+}
+
+func (r *packReader) Close() error { return freeZlibReader(r.zr) }
+
+// inflateN inflates exactly n bytes from r, consuming the end of the
+// zlib stream.
+func inflateN(r io.Reader, n int64) ([]byte, error) {
+	zr, err := newZlibReader(r)
+	if err != nil {
+		return nil, corrupt(err)
+	}
+	defer freeZlibReader(zr)
+	// declared length is not trusted for preallocation
+	data, err := ioutil.ReadAll(io.LimitReader(zr, n))
+	if err != nil {
+		return nil, corrupt(err)
+	}
+	if int64(len(data)) != n {
+		return nil, corrupt(io.EOF)
+	}
+	if err := drain(zr); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// skipN reads a zlib stream inflating to n bytes from r, discarding it.
+func skipN(r io.Reader, n int64) error {
+	zr, err := newZlibReader(r)
+	if err != nil {
+		return corrupt(err)
+	}
+	defer freeZlibReader(zr)
+	m, err := io.Copy(ioutil.Discard, io.LimitReader(zr, n))
+	if err != nil {
+		return corrupt(err)
+	}
+	if m != n {
+		return corrupt(io.EOF)
+	}
+	return drain(zr)
+}
+
+// drain reads zr to the end of the zlib stream, reporting ErrCorrupt if
+// more content remains.
+func drain(zr io.Reader) error {
+	n, err := io.Copy(ioutil.Discard, zr)
+	if err != nil {
+		return corrupt(err)
+	}
+	if n != 0 {
+		return fmt.Errorf("%w: object exceeds declared size", ErrCorrupt)
+	}
+	return nil
+}
+
+// applyDelta returns the result of applying git delta to src.
+func applyDelta(src, delta []byte) ([]byte, error) {
+	invalid := fmt.Errorf("%w: invalid delta", ErrCorrupt)
+
+	srclen, n := binary.Uvarint(delta)
+	if n <= 0 || srclen != uint64(len(src)) {
+		return nil, invalid
+	}
+	delta = delta[n:]
+	dstlen, n := binary.Uvarint(delta)
+	if n <= 0 {
+		return nil, invalid
+	}
+	delta = delta[n:]
+
+	// trust declared length only so far for preallocation, and reject
+	// deltas as soon as they would exceed it
+	dst := make([]byte, 0, min64(dstlen, maxPrealloc))
+	for len(delta) > 0 {
+		c := delta[0]
+		delta = delta[1:]
+		switch {
+		case c&0x80 != 0:
+			// copy from src
+			var ofs, size uint64
+			for i := uint(0); i < 7; i++ {
+				if c&(1<<i) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return nil, invalid
+				}
+				if i < 4 {
+					ofs |= uint64(delta[0]) << (8 * i)
+				} else {
+					size |= uint64(delta[0]) << (8 * (i - 4))
+				}
+				delta = delta[1:]
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if ofs+size > uint64(len(src)) || uint64(len(dst))+size > dstlen {
+				return nil, invalid
+			}
+			dst = append(dst, src[ofs:ofs+size]...)
+		case c != 0:
+			// insert literal
+			if int(c) > len(delta) || uint64(len(dst))+uint64(c) > dstlen {
+				return nil, invalid
+			}
+			dst = append(dst, delta[:c]...)
+			delta = delta[c:]
+		default:
+			return nil, invalid
+		}
+	}
+	if uint64(len(dst)) != dstlen {
+		return nil, invalid
+	}
+	return dst, nil
+}
 
-func (g *packCloser) Close() error {
-	panic("Not implemented")
+func min64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
 }
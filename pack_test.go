@@ -0,0 +1,435 @@
+package git
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// packRepo returns a new repository with history packed by git. Callers
+// are responsible for removing the returned directory.
+func packRepo(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gitpacktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	git := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		assertRun(t, cmd)
+	}
+	git("init", "-q")
+	data := bytes.Repeat([]byte("hello, world\n"), 200)
+	for i := 0; i < 5; i++ {
+		data = append(data, fmt.Sprintf("line %v\n", i)...)
+		if err := ioutil.WriteFile(filepath.Join(dir, "hello.txt"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		git("add", "hello.txt")
+		git("commit", "-q", "-m", fmt.Sprintf("commit %v", i))
+	}
+	git("tag", "-a", "-m", "tagged", "v1")
+	git("repack", "-a", "-d", "-f", "-q")
+	return dir
+}
+
+func TestPackStore(t *testing.T) {
+	dir := packRepo(t)
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		return assertRun(t, cmd)
+	}
+
+	st := PackStore(filepath.Join(dir, ".git"))
+
+	// cat-file batch lines are formatted as: [hash] [type] [size]
+	out := strings.TrimSpace(git("cat-file", "--batch-all-objects", "--batch-check"))
+	var want []Hash
+	for _, line := range strings.Split(out, "\n") {
+		fs := strings.Fields(line)
+		hash := parseHash(t, fs[0])
+		want = append(want, hash)
+
+		typ, n, err := st.Stat(hash)
+		if err != nil {
+			t.Fatalf("Stat(%s) failed: %s", hash, err)
+		}
+		if typ.String() != fs[1] || strconv.FormatInt(n, 10) != fs[2] {
+			t.Fatalf("Stat(%s) => %s %v, want %s %s", hash, typ, n, fs[1], fs[2])
+		}
+
+		ok, err := st.Has(hash)
+		if err != nil || !ok {
+			t.Fatalf("Has(%s) => %v, %v, want true", hash, ok, err)
+		}
+		if h, err := ResolvePrefix(st, hash.Abbrev(8)); h != hash || err != nil {
+			t.Fatalf("ResolvePrefix(%s) => %s, %v, want %s", hash.Abbrev(8), h, err, hash)
+		}
+
+		r, err := st.Reader(hash)
+		if err != nil {
+			t.Fatalf("Reader(%s) failed: %s", hash, err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("ReadAll(%s) failed: %s", hash, err)
+		}
+		if orig := git("cat-file", fs[1], fs[0]); string(b) != orig {
+			t.Fatalf("Reader(%s) => %q, want %q", hash, b, orig)
+		}
+	}
+
+	var have []Hash
+	if err := st.ForEach(func(hash Hash) error {
+		have = append(have, hash)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i].Compare(want[j]) < 0 })
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Fatalf("ForEach => %s, want %s", have, want)
+	}
+
+	if ok, err := st.Has(ZeroHash); ok || err != nil {
+		t.Fatalf("Has(zero hash) => %v, %v, want false", ok, err)
+	}
+
+	// ref deltas forming a cycle are reported corrupt
+	h1, h2 := parseHash(t, "01"+strings.Repeat("0", 38)), parseHash(t, "02"+strings.Repeat("0", 38))
+	pack := bytes.NewBufferString("PACK\x00\x00\x00\x02\x00\x00\x00\x02")
+	var entries []packEntry
+	for _, hs := range [][2]Hash{{h1, h2}, {h2, h1}} {
+		entries = append(entries, packEntry{hash: hs[0].Bytes(), ofs: int64(pack.Len())})
+		pack.WriteByte(packRefDelta<<4 | 2)
+		pack.Write(hs[1].Bytes())
+		io.Copy(pack, zdata(t, "\x00\x00"))
+	}
+	hh := SHA1.New()
+	hh.Write(pack.Bytes())
+	sum := hh.Sum(nil)
+	pack.Write(sum)
+	cycle, err := ioutil.TempDir("", "gitpacktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cycle)
+	name := filepath.Join(cycle, "objects", "pack", fmt.Sprintf("pack-%x", sum))
+	os.MkdirAll(filepath.Dir(name), 0755)
+	ioutil.WriteFile(name+".pack", pack.Bytes(), 0644)
+	var idx bytes.Buffer
+	if err := writePackIndex(&idx, entries, sum, SHA1); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(name+".idx", idx.Bytes(), 0644)
+	st = PackStore(cycle)
+	if _, err := st.Reader(h1); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Reader(delta cycle) => %v, want ErrCorrupt", err)
+	}
+	if _, _, err := st.Stat(h1); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Stat(delta cycle) => %v, want ErrCorrupt", err)
+	}
+}
+
+func TestApplyDelta(t *testing.T) {
+	src := bytes.Repeat([]byte("hello, world\n"), 1<<13)
+	// deltas begin with the source and result lengths
+	delta := func(n int, ops ...byte) []byte {
+		b := make([]byte, 2*binary.MaxVarintLen64)
+		m := binary.PutUvarint(b, uint64(len(src)))
+		m += binary.PutUvarint(b[m:], uint64(n))
+		return append(b[:m], ops...)
+	}
+	for _, tc := range []struct {
+		name  string
+		delta []byte
+		want  string
+	}{
+		{"copy and insert", delta(8, 0x91, 7, 5, 3, 'i', 'n', '\n'), "worldin\n"},
+		{"copy past source", delta(8, 0x97, 0xff, 0xff, 0xff, 8), ""},
+		{"insert past result", delta(2, 3, 'a', 'b', 'c'), ""},
+		// each op copies 64 KiB, rejected before it is appended
+		{"copy past result", delta(10, bytes.Repeat([]byte{0x80}, 20000)...), ""},
+	} {
+		have, err := applyDelta(src, tc.delta)
+		if tc.want == "" {
+			if !errors.Is(err, ErrCorrupt) {
+				t.Errorf("%s: applyDelta => %q, %v, want ErrCorrupt", tc.name, have, err)
+			}
+		} else if err != nil || string(have) != tc.want {
+			t.Errorf("%s: applyDelta => %q, %v, want %q", tc.name, have, err, tc.want)
+		}
+	}
+}
+
+func TestUnpackObjects(t *testing.T) {
+	dir := packRepo(t)
+	defer os.RemoveAll(dir)
+
+	git := func(stdin string, args ...string) []byte {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Stdin = strings.NewReader(stdin)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("git %s: %s", strings.Join(args, " "), err)
+		}
+		return out
+	}
+
+	// full pack with deltas
+	pack := git("", "pack-objects", "--revs", "--all", "--stdout", "-q")
+	st := MemStore()
+	hashes, err := UnpackObjects(bytes.NewReader(pack), st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Fields(string(git("", "cat-file", "--batch-all-objects", "--batch-check=%(objectname)")))
+	if len(hashes) != len(want) {
+		t.Fatalf("unpacked %v objects, want %v", len(hashes), len(want))
+	}
+	for _, h := range want {
+		if ok, err := st.Has(parseHash(t, h)); !ok || err != nil {
+			t.Fatalf("Has(%s) => %v, %v", h, ok, err)
+		}
+	}
+
+	// thin pack with ref delta bases in store
+	head := strings.TrimSpace(string(git("", "rev-parse", "HEAD")))
+	thin := git(head+"\n^"+head+"~1\n", "pack-objects", "--revs", "--thin", "--no-reuse-delta", "--stdout", "-q")
+	partial := MemStore()
+	if _, err := UnpackObjects(bytes.NewReader(thin), partial); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("UnpackObjects(thin) without bases => %v, want ErrCorrupt", err)
+	}
+	if _, err := UnpackObjects(bytes.NewReader(thin), st); err != nil {
+		t.Fatalf("UnpackObjects(thin) => %v", err)
+	}
+
+	// corrupt checksum
+	pack[len(pack)-1] ^= 0xff
+	if _, err := UnpackObjects(bytes.NewReader(pack), MemStore()); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("UnpackObjects(bad checksum) => %v, want ErrCorrupt", err)
+	}
+
+	// object count of the header is not trusted
+	hdr := []byte("PACK\x00\x00\x00\x02\xff\xff\xff\xff")
+	if _, err := UnpackObjects(bytes.NewReader(hdr), MemStore()); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("UnpackObjects(truncated) => %v, want ErrCorrupt", err)
+	}
+}
+
+func TestIndexPack(t *testing.T) {
+	dir := packRepo(t)
+	defer os.RemoveAll(dir)
+
+	git := func(dir string, args ...string) []byte {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("git %s: %s", strings.Join(args, " "), err)
+		}
+		return out
+	}
+	want := strings.Fields(string(git(dir, "cat-file", "--batch-all-objects", "--batch-check=%(objectname)")))
+
+	for _, args := range [][]string{
+		{"pack-objects", "--revs", "--all", "--stdout", "-q"},
+		{"pack-objects", "--revs", "--all", "--stdout", "-q", "--no-delta-base-offset"},
+	} {
+		pack := git(dir, args...)
+		bare, err := ioutil.TempDir("", "gitpacktest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(bare)
+		git(bare, "init", "-q", "--bare")
+
+		// content following the pack is not kept
+		name, err := IndexPack(bare, io.MultiReader(bytes.NewReader(pack), strings.NewReader("trailing")), true)
+		if err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		have, err := ioutil.ReadFile(name + ".idx")
+		if err != nil {
+			t.Fatal(err)
+		}
+		git(bare, "index-pack", "-o", "git.idx", name+".pack")
+		if idx, _ := ioutil.ReadFile(filepath.Join(bare, "git.idx")); !bytes.Equal(have, idx) {
+			t.Fatalf("%v: index differs from git index-pack", args)
+		}
+
+		st := PackStore(bare)
+		for _, h := range want {
+			if ok, err := st.Has(parseHash(t, h)); !ok || err != nil {
+				t.Fatalf("%v: Has(%s) => %v, %v", args, h, ok, err)
+			}
+		}
+		if _, err := st.Reader(parseHash(t, strings.Repeat("1", 40))); !errors.Is(err, ErrPromised) {
+			t.Fatalf("%v: Reader(missing) of promisor pack => %v, want ErrPromised", args, err)
+		}
+	}
+
+	// thin packs are not completed
+	head := strings.TrimSpace(string(git(dir, "rev-parse", "HEAD")))
+	cmd := exec.Command("git", "pack-objects", "--revs", "--thin", "--no-reuse-delta", "--stdout", "-q")
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(head + "\n^" + head + "~1\n")
+	thin, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bare, err := ioutil.TempDir("", "gitpacktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bare)
+	if _, err := IndexPack(bare, bytes.NewReader(thin), false); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("IndexPack(thin) => %v, want ErrCorrupt", err)
+	}
+	if ns, _ := filepath.Glob(filepath.Join(bare, "objects", "pack", "*")); len(ns) != 0 {
+		t.Fatalf("IndexPack(thin) left %v", ns)
+	}
+
+	// object count of the header is not trusted
+	hdr := []byte("PACK\x00\x00\x00\x02\xff\xff\xff\xff")
+	if _, err := IndexPack(bare, bytes.NewReader(hdr), false); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("IndexPack(truncated) => %v, want ErrCorrupt", err)
+	}
+
+	// index written to the store is used without reloading
+	st := PackStore(bare)
+	if err := st.(PackIndexer).IndexPack(bytes.NewReader(git(dir, "pack-objects", "--revs", "--all", "--stdout", "-q")), false); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := st.Has(parseHash(t, head)); !ok || err != nil {
+		t.Fatalf("Has(%s) after IndexPack => %v, %v", head, ok, err)
+	}
+	if _, err := st.Reader(parseHash(t, strings.Repeat("1", 40))); errors.Is(err, ErrPromised) || !errors.Is(err, ErrNotExist) {
+		t.Fatalf("Reader(missing) => %v, want ErrNotExist", err)
+	}
+}
+
+func TestMultiPackIndex(t *testing.T) {
+	dir := packRepo(t)
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		return assertRun(t, cmd)
+	}
+	gitdir := filepath.Join(dir, ".git")
+	pdir := filepath.Join(gitdir, "objects", "pack")
+
+	// packs of later commits, and one duplicating objects of another
+	for i := 0; i < 2; i++ {
+		ioutil.WriteFile(filepath.Join(dir, "more.txt"), []byte(fmt.Sprintf("more %v\n", i)), 0644)
+		git("add", "more.txt")
+		git("commit", "-q", "-m", "more")
+		git("repack", "-d", "-q")
+	}
+	cmd := exec.Command("git", "pack-objects", "-q", "--revs", filepath.Join(pdir, "pack"))
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader("HEAD~1\n")
+	assertRun(t, cmd)
+	ns, _ := filepath.Glob(filepath.Join(pdir, "*.pack"))
+	if len(ns) != 4 {
+		t.Fatalf("packs %q, want 4", ns)
+	}
+	// git breaks ties of packs modified in the same second by directory order
+	for i, n := range ns {
+		mtime := time.Now().Add(time.Duration(i-len(ns)) * time.Minute)
+		os.Chtimes(n, mtime, mtime)
+	}
+
+	if err := WriteMultiPackIndex(gitdir); err != nil {
+		t.Fatal(err)
+	}
+	git("multi-pack-index", "verify")
+	have, err := ioutil.ReadFile(filepath.Join(pdir, "multi-pack-index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(pdir, "multi-pack-index"))
+	git("multi-pack-index", "write")
+	if want, _ := ioutil.ReadFile(filepath.Join(pdir, "multi-pack-index")); !bytes.Equal(have, want) {
+		t.Fatal("multi-pack-index differs from git multi-pack-index write")
+	}
+
+	// packs since indexed are searched as well
+	ns, _ = filepath.Glob(filepath.Join(pdir, "*.idx"))
+	ioutil.WriteFile(filepath.Join(dir, "more.txt"), []byte("unindexed\n"), 0644)
+	git("add", "more.txt")
+	git("commit", "-q", "-m", "unindexed")
+	git("repack", "-d", "-q")
+	head := parseHash(t, git("rev-parse", "HEAD"))
+	out := strings.TrimSpace(git("cat-file", "--batch-all-objects", "--batch-check"))
+	content := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		fs := strings.Fields(line)
+		content[fs[0]] = git("cat-file", fs[1], fs[0])
+	}
+
+	// indexes of packs named are not read
+	for _, n := range ns {
+		os.Chmod(n, 0644)
+		ioutil.WriteFile(n, []byte("bogus"), 0644)
+	}
+	st := PackStore(gitdir)
+	var want []Hash
+	for _, line := range strings.Split(out, "\n") {
+		fs := strings.Fields(line)
+		hash := parseHash(t, fs[0])
+		want = append(want, hash)
+		typ, n, err := st.Stat(hash)
+		if err != nil || typ.String() != fs[1] || strconv.FormatInt(n, 10) != fs[2] {
+			t.Fatalf("Stat(%s) => %s %v, %v, want %s %s", hash, typ, n, err, fs[1], fs[2])
+		}
+		if h, err := ResolvePrefix(st, hash.Abbrev(8)); h != hash || err != nil {
+			t.Fatalf("ResolvePrefix(%s) => %s, %v, want %s", hash.Abbrev(8), h, err, hash)
+		}
+		r, err := st.Reader(hash)
+		if err != nil {
+			t.Fatalf("Reader(%s) failed: %s", hash, err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(b) != content[fs[0]] {
+			t.Fatalf("Reader(%s) => %q, %v, want %q", hash, b, err, content[fs[0]])
+		}
+	}
+	var each []Hash
+	st.ForEach(func(h Hash) error {
+		each = append(each, h)
+		return nil
+	})
+	sort.Slice(each, func(i, j int) bool { return each[i].Compare(each[j]) < 0 })
+	if fmt.Sprint(each) != fmt.Sprint(want) {
+		t.Fatalf("ForEach => %s, want %s", each, want)
+	}
+
+	// a multi-pack-index naming packs since removed is ignored
+	for _, n := range ns {
+		os.Remove(n)
+		os.Remove(strings.TrimSuffix(n, ".idx") + ".pack")
+	}
+	if ok, err := PackStore(gitdir).Has(head); !ok || err != nil {
+		t.Fatalf("Has(%s) with stale multi-pack-index => %v, %v", head, ok, err)
+	}
+}
@@ -0,0 +1,123 @@
+package git
+
+import (
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// PackWriter writes version 2 packfiles of undeltified objects.
+type PackWriter struct {
+	w  io.Writer
+	hh hash.Hash
+	zw *zlib.Writer
+
+	count, n uint32
+	err      error
+}
+
+// NewPackWriter returns a PackWriter that writes a pack of count objects to w.
+// The pack header is written immediately.
+func NewPackWriter(w io.Writer, count uint32) (*PackWriter, error) {
+	return NewPackWriterFormat(w, count, SHA1)
+}
+
+// NewPackWriterFormat returns a PackWriter as NewPackWriter does, whose
+// checksum is of object format f.
+func NewPackWriterFormat(w io.Writer, count uint32, f ObjectFormat) (*PackWriter, error) {
+	pw := &PackWriter{hh: f.New(), count: count}
+	pw.w = io.MultiWriter(w, pw.hh)
+	hdr := make([]byte, 12)
+	copy(hdr, "PACK")
+	binary.BigEndian.PutUint32(hdr[4:], 2)
+	binary.BigEndian.PutUint32(hdr[8:], count)
+	if _, err := pw.w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// WriteObject writes an object of type t whose content of length size is
+// read from r.
+func (pw *PackWriter) WriteObject(t Type, size int64, r io.Reader) error {
+	if pw.err != nil {
+		return pw.err
+	}
+	if pw.n == pw.count {
+		return fmt.Errorf("git: pack exceeds declared count %v", pw.count)
+	}
+	pw.n++
+	var typ byte
+	for k, v := range packTypes {
+		if v == t {
+			typ = k
+		}
+	}
+	if typ == 0 {
+		return fmt.Errorf("git: can not pack object of type %s", t)
+	}
+
+	// header is type and size encoded as variable length integer
+	hdr := make([]byte, 0, 10)
+	c := typ<<4 | byte(size&15)
+	for s := size >> 4; s > 0; s >>= 7 {
+		hdr = append(hdr, c|0x80)
+		c = byte(s & 0x7f)
+	}
+	hdr = append(hdr, c)
+	if _, pw.err = pw.w.Write(hdr); pw.err != nil {
+		return pw.err
+	}
+
+	if pw.zw == nil {
+		pw.zw = zlib.NewWriter(pw.w)
+	} else {
+		pw.zw.Reset(pw.w)
+	}
+	var n int64
+	if n, pw.err = io.Copy(pw.zw, r); pw.err != nil {
+		return pw.err
+	}
+	if n != size {
+		pw.err = fmt.Errorf("git: object length %v does not match declared size %v", n, size)
+		return pw.err
+	}
+	pw.err = pw.zw.Close()
+	return pw.err
+}
+
+// Close writes the pack's trailing checksum. Close returns an error if fewer
+// objects were written than declared.
+func (pw *PackWriter) Close() error {
+	if pw.err != nil {
+		return pw.err
+	}
+	if pw.n != pw.count {
+		return fmt.Errorf("git: wrote %v of declared %v objects", pw.n, pw.count)
+	}
+	_, err := pw.w.Write(pw.hh.Sum(nil))
+	return err
+}
+
+// WritePack writes a pack of objects by hashes from st to w, in the object
+// format of st.
+func WritePack(w io.Writer, st Store, hashes []Hash) error {
+	pw, err := NewPackWriterFormat(w, uint32(len(hashes)), formatOf(st))
+	if err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		r, err := st.Reader(h)
+		if err != nil {
+			return err
+		}
+		err = pw.WriteObject(r.Type(), r.Len(), r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return pw.Close()
+}
@@ -0,0 +1,157 @@
+// Package pktline implements the pkt-line framing used by git wire protocols.
+//
+// Each packet is prefixed by four hexadecimal digits giving the length of the
+// packet, including the prefix itself. Special packets of length 0000 (flush),
+// 0001 (delim) and 0002 (response-end) carry no payload.
+package pktline // import "dasa.cc/git/pktline"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxPacketLen is the maximum length of a packet including its length prefix.
+const MaxPacketLen = 65520
+
+// MaxPayload is the maximum length of a packet's payload.
+const MaxPayload = MaxPacketLen - 4
+
+// Kind identifies the kind of packet read.
+type Kind int
+
+// Packet kinds
+const (
+	Data Kind = iota
+	Flush
+	Delim
+	ResponseEnd
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Data:
+		return "data"
+	case Flush:
+		return "flush"
+	case Delim:
+		return "delim"
+	case ResponseEnd:
+		return "response-end"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// ErrInvalidLength is returned when a length prefix is malformed or out of range.
+var ErrInvalidLength = errors.New("pktline: invalid packet length")
+
+// ErrTooLarge is returned when encoding a payload larger than MaxPayload.
+var ErrTooLarge = errors.New("pktline: payload too large")
+
+// Encoder writes packets to an underlying writer. Each call results in a
+// single write to the underlying writer.
+type Encoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewEncoder returns a new Encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder { return &Encoder{w: w} }
+
+// Encode writes p as a single data packet. An empty payload is encoded as
+// 0004 which, while valid, is discouraged by git.
+func (e *Encoder) Encode(p []byte) error {
+	if len(p) > MaxPayload {
+		return ErrTooLarge
+	}
+	e.buf = appendLen(e.buf[:0], len(p)+4)
+	e.buf = append(e.buf, p...)
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+// Encodef formats according to format specifier and writes the result as a
+// single data packet.
+func (e *Encoder) Encodef(format string, a ...interface{}) error {
+	return e.Encode([]byte(fmt.Sprintf(format, a...)))
+}
+
+// Flush writes a flush packet, 0000.
+func (e *Encoder) Flush() error { return e.special("0000") }
+
+// Delim writes a delim packet, 0001.
+func (e *Encoder) Delim() error { return e.special("0001") }
+
+// ResponseEnd writes a response-end packet, 0002.
+func (e *Encoder) ResponseEnd() error { return e.special("0002") }
+
+func (e *Encoder) special(s string) error {
+	_, err := io.WriteString(e.w, s)
+	return err
+}
+
+const hexdigits = "0123456789abcdef"
+
+func appendLen(b []byte, n int) []byte {
+	return append(b, hexdigits[n>>12&15], hexdigits[n>>8&15], hexdigits[n>>4&15], hexdigits[n&15])
+}
+
+// Decoder reads packets from an underlying reader.
+type Decoder struct {
+	r   io.Reader
+	buf [MaxPacketLen]byte
+}
+
+// NewDecoder returns a new Decoder that reads from r. The Decoder only
+// reads as much data from r as each packet requires.
+func NewDecoder(r io.Reader) *Decoder { return &Decoder{r: r} }
+
+// Decode reads the next packet. For Data packets, the returned payload is
+// only valid until the next call to Decode. Decode returns io.EOF only if no
+// data is available before the start of a packet; an incomplete packet
+// results in io.ErrUnexpectedEOF.
+func (d *Decoder) Decode() (Kind, []byte, error) {
+	if _, err := io.ReadFull(d.r, d.buf[:4]); err != nil {
+		return 0, nil, err
+	}
+	n, err := parseLen(d.buf[:4])
+	if err != nil {
+		return 0, nil, err
+	}
+	switch n {
+	case 0:
+		return Flush, nil, nil
+	case 1:
+		return Delim, nil, nil
+	case 2:
+		return ResponseEnd, nil, nil
+	}
+	if n < 4 || n > MaxPacketLen {
+		return 0, nil, fmt.Errorf("%w: %q", ErrInvalidLength, d.buf[:4])
+	}
+	if _, err := io.ReadFull(d.r, d.buf[4:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return Data, d.buf[4:n], nil
+}
+
+func parseLen(b []byte) (int, error) {
+	var n int
+	for _, c := range b {
+		n <<= 4
+		switch {
+		case '0' <= c && c <= '9':
+			n |= int(c - '0')
+		case 'a' <= c && c <= 'f':
+			n |= int(c - 'a' + 10)
+		case 'A' <= c && c <= 'F':
+			n |= int(c - 'A' + 10)
+		default:
+			return 0, fmt.Errorf("%w: %q", ErrInvalidLength, b)
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,117 @@
+package pktline
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestEncoder(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	enc.Encode([]byte("a\n"))
+	enc.Encodef("want %s\n", "hash")
+	enc.Delim()
+	enc.Encode(nil)
+	enc.ResponseEnd()
+	enc.Flush()
+
+	want := "0006a\n000ewant hash\n0001000400020000"
+	if buf.String() != want {
+		t.Fatalf("have %q, want %q", buf, want)
+	}
+
+	if err := enc.Encode(make([]byte, MaxPayload+1)); err != ErrTooLarge {
+		t.Fatalf("Encode(MaxPayload+1) => %v, want ErrTooLarge", err)
+	}
+	if err := enc.Encode(make([]byte, MaxPayload)); err != nil {
+		t.Fatalf("Encode(MaxPayload) failed: %s", err)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("0006a\n0001000400020000"))
+	for _, want := range []struct {
+		kind Kind
+		data string
+	}{
+		{Data, "a\n"},
+		{Delim, ""},
+		{Data, ""},
+		{ResponseEnd, ""},
+		{Flush, ""},
+	} {
+		kind, data, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind != want.kind || string(data) != want.data {
+			t.Fatalf("Decode() => %s %q, want %s %q", kind, data, want.kind, want.data)
+		}
+	}
+	if _, _, err := dec.Decode(); err != io.EOF {
+		t.Fatalf("Decode() => %v, want EOF", err)
+	}
+
+	for _, s := range []string{"0003", "000x", "fff1", "-001"} {
+		if _, _, err := NewDecoder(strings.NewReader(s)).Decode(); !errors.Is(err, ErrInvalidLength) {
+			t.Fatalf("Decode(%q) => %v, want ErrInvalidLength", s, err)
+		}
+	}
+	for _, s := range []string{"00", "0008abc"} {
+		if _, _, err := NewDecoder(strings.NewReader(s)).Decode(); err != io.ErrUnexpectedEOF {
+			t.Fatalf("Decode(%q) => %v, want ErrUnexpectedEOF", s, err)
+		}
+	}
+}
+
+func TestSideband(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 300)
+
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	NewSidebandWriter(enc, BandProgress, SidebandMax).Write([]byte("counting objects\n"))
+	if n, err := NewSidebandWriter(enc, BandData, SidebandMax).Write(data); n != len(data) || err != nil {
+		t.Fatalf("Write(data) => %v, %v", n, err)
+	}
+	enc.Flush()
+
+	progress := new(bytes.Buffer)
+	dec := NewDecoder(bytes.NewReader(buf.Bytes()))
+	b, err := ioutil.ReadAll(NewDemuxer(dec, progress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("demuxed %v bytes, want %v", len(b), len(data))
+	}
+	if progress.String() != "counting objects\n" {
+		t.Fatalf("progress => %q", progress)
+	}
+
+	// every packet is within limits
+	dec = NewDecoder(bytes.NewReader(buf.Bytes()))
+	for {
+		kind, pkt, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind == Flush {
+			break
+		}
+		if len(pkt) > SidebandMax+1 {
+			t.Fatalf("packet length %v exceeds %v", len(pkt), SidebandMax+1)
+		}
+	}
+
+	buf.Reset()
+	NewSidebandWriter(enc, BandError, Sideband64Max).Write([]byte("access denied\n"))
+	_, err = ioutil.ReadAll(NewDemuxer(NewDecoder(buf), nil))
+	var rerr *RemoteError
+	if !errors.As(err, &rerr) || rerr.Message != "access denied" {
+		t.Fatalf("ReadAll => %v, want RemoteError", err)
+	}
+}
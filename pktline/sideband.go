@@ -0,0 +1,124 @@
+package pktline
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Band identifies a side-band channel.
+type Band byte
+
+// Side-band channels
+const (
+	BandData     Band = 1
+	BandProgress Band = 2
+	BandError    Band = 3
+)
+
+// Maximum payload, excluding band byte, of side-band and side-band-64k packets.
+const (
+	SidebandMax   = 1000 - 5
+	Sideband64Max = MaxPacketLen - 5
+)
+
+// SidebandWriter multiplexes writes onto a band, splitting data into
+// packets no larger than a negotiated maximum.
+type SidebandWriter struct {
+	enc  *Encoder
+	band Band
+	max  int
+	buf  []byte
+}
+
+// NewSidebandWriter returns a writer of packets on band with at most max
+// bytes of data each, typically SidebandMax or Sideband64Max.
+func NewSidebandWriter(enc *Encoder, band Band, max int) *SidebandWriter {
+	if max <= 0 || max > Sideband64Max {
+		max = Sideband64Max
+	}
+	return &SidebandWriter{enc: enc, band: band, max: max}
+}
+
+func (w *SidebandWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		m := len(p)
+		if m > w.max {
+			m = w.max
+		}
+		w.buf = append(append(w.buf[:0], byte(w.band)), p[:m]...)
+		if err := w.enc.Encode(w.buf); err != nil {
+			return n, err
+		}
+		n += m
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// RemoteError is reported by Demuxer for messages on the error band.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string { return "remote error: " + e.Message }
+
+// Demuxer reads data multiplexed onto side-band channels. Data on the data
+// band is returned by Read, progress messages are copied to a writer, and
+// messages on the error band are returned as *RemoteError. Read returns
+// io.EOF once a flush packet is read.
+type Demuxer struct {
+	dec      *Decoder
+	progress io.Writer
+	buf      []byte
+	err      error
+}
+
+// NewDemuxer returns a new Demuxer reading packets from dec. If progress
+// is nil, progress messages are discarded.
+func NewDemuxer(dec *Decoder, progress io.Writer) *Demuxer {
+	if progress == nil {
+		progress = ioutil.Discard
+	}
+	return &Demuxer{dec: dec, progress: progress}
+}
+
+func (d *Demuxer) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		kind, pkt, err := d.dec.Decode()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			d.err = err
+			continue
+		}
+		if kind == Flush {
+			d.err = io.EOF
+			continue
+		}
+		if kind != Data || len(pkt) == 0 {
+			d.err = fmt.Errorf("pktline: unexpected %s packet in side-band", kind)
+			continue
+		}
+		switch Band(pkt[0]) {
+		case BandData:
+			d.buf = pkt[1:]
+		case BandProgress:
+			if _, err := d.progress.Write(pkt[1:]); err != nil {
+				d.err = err
+			}
+		case BandError:
+			d.err = &RemoteError{string(bytes.TrimSpace(pkt[1:]))}
+		default:
+			d.err = fmt.Errorf("pktline: invalid side-band %d", pkt[0])
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
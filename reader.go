@@ -6,16 +6,26 @@ import (
 	"compress/flate"
 	"compress/zlib"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"strconv"
+	"sync"
 )
 
-// PrettyReader decodes sha1 sum of references in tree objects
+// PrettyReader decodes object names of references in tree objects
 // and parses reference types. This has no effect on other types.
 //
 //  NewReader(r, PrettyReader)
 func PrettyReader(g *Reader) { g.pretty = true }
 
+// FormatReader returns an option decoding tree objects whose references
+// are named in object format f, rather than SHA-1.
+//
+//  NewReader(r, PrettyReader, FormatReader(git.SHA256))
+func FormatReader(f ObjectFormat) func(*Reader) {
+	return func(g *Reader) { g.format = f }
+}
+
 // Reader reads git object format for blobs, trees, and commits.
 //
 // TODO short reads on tree objects are likely to fail.
@@ -23,11 +33,19 @@ type Reader struct {
 	io.Reader
 
 	pretty bool
+	format ObjectFormat
 
 	zr  io.ReadCloser
 	t   Type
-	n   int
+	n   int64
 	err error
+
+	// hdr buffers the header, reading at most lr.N bytes from zr.
+	hdr *bufio.Reader
+	lr  io.LimitedReader
+
+	// rc is closed by Close when set by a Store.
+	rc io.Closer
 }
 
 // NewReader returns Reader for r. Most users will want to call store.Reader(r).
@@ -46,18 +64,50 @@ func NewReader(r io.Reader, options ...func(*Reader)) (*Reader, error) {
 func (g *Reader) Type() Type { return g.t }
 
 // Len returns the length of object's content to be read.
-func (g *Reader) Len() int { return g.n }
+func (g *Reader) Len() int64 { return g.n }
 
-// Close does not close the original reader passed in.
-func (g *Reader) Close() error { return g.zr.Close() }
+// Close does not close the original reader passed in. Buffers are released
+// for reuse by other Readers, and the Reader must not be read once closed,
+// unless Reset.
+func (g *Reader) Close() error {
+	var err error
+	if g.zr != nil {
+		err = freeZlibReader(g.zr)
+		g.zr = nil
+	}
+	g.Reader = errReader{errClosed}
+	if g.rc != nil {
+		if cerr := g.rc.Close(); err == nil {
+			err = cerr
+		}
+		g.rc = nil
+	}
+	return err
+}
+
+// newRawReader returns Reader for the inflated content r of an object of
+// type t and length n, such as found in packfiles. The returned Reader closes
+// r if r implements io.Closer.
+func newRawReader(t Type, n int64, r io.Reader, options ...func(*Reader)) *Reader {
+	g := new(Reader)
+	for _, opt := range options {
+		opt(g)
+	}
+	g.t, g.n = t, n
+	g.Reader = r
+	g.rc, _ = r.(io.Closer)
+	g.wrap()
+	return g
+}
 
 // Reset clears the state of the Reader g such that it is equivalent to its
 // initial state from NewReader, but instead reading from r. Any options
 // previously set are retained.
 func (g *Reader) Reset(r io.Reader) error {
 	var err error
+	g.rc = nil
 	if g.zr == nil {
-		if g.zr, err = zlib.NewReader(r); err != nil {
+		if g.zr, err = newZlibReader(r); err != nil {
 			return err
 		}
 	} else if err = g.zr.(flate.Resetter).Reset(r, nil); err != nil {
@@ -65,40 +115,88 @@ func (g *Reader) Reset(r io.Reader) error {
 	}
 
 	// 28 byte limit means reader can't support content larger than 18,500 petabytes.
-	b := bufio.NewReader(io.LimitReader(g.zr, 28))
-	g.Reader = io.MultiReader(b, g.zr)
+	g.lr = io.LimitedReader{R: g.zr, N: 28}
+	if g.hdr == nil {
+		g.hdr = bufio.NewReaderSize(&g.lr, 32)
+	} else {
+		g.hdr.Reset(&g.lr)
+	}
+	g.Reader = io.MultiReader(g.hdr, g.zr)
 
 	// read header
-	t, err := b.ReadBytes(' ')
+	t, err := g.hdr.ReadBytes(' ')
 	if err != nil {
+		return corrupt(err)
+	}
+	if g.t, err = ParseType(t[:len(t)-1]); err != nil {
 		return err
 	}
-	g.t = ParseType(t[:len(t)-1])
 
-	n, err := b.ReadBytes('\x00')
+	n, err := g.hdr.ReadBytes('\x00')
 	if err != nil {
-		return err
+		return corrupt(err)
+	}
+	if g.n, err = strconv.ParseInt(string(n[:len(n)-1]), 10, 64); err != nil || g.n < 0 {
+		return fmt.Errorf("%w: invalid size %q", ErrCorrupt, n[:len(n)-1])
 	}
-	g.n, err = strconv.Atoi(string(n[:len(n)-1]))
 
+	g.wrap()
+	return nil
+}
+
+// wrap wraps content reader based on options and type.
+func (g *Reader) wrap() {
 	// trees are different
 	if g.pretty && g.t == Tree {
 		g.Reader = &treeReader{
-			Reader: bufio.NewReaderSize(g.Reader, 20),
-			hash:   make([]byte, 40),
+			Reader: bufio.NewReaderSize(g.Reader, g.format.Size()),
+			hash:   make([]byte, g.format.HexSize()),
 		}
 	}
+}
+
+// zlibReaders pools zlib readers, whose allocation otherwise dominates
+// reading small objects.
+var zlibReaders sync.Pool
+
+// newZlibReader returns a zlib reader of r, reusing one released by
+// freeZlibReader if any.
+func newZlibReader(r io.Reader) (io.ReadCloser, error) {
+	zr, ok := zlibReaders.Get().(io.ReadCloser)
+	if !ok {
+		return zlib.NewReader(r)
+	}
+	if err := zr.(flate.Resetter).Reset(r, nil); err != nil {
+		zlibReaders.Put(zr)
+		return nil, err
+	}
+	return zr, nil
+}
 
+// freeZlibReader closes zr, releasing it for reuse. It must not be used
+// afterwards.
+func freeZlibReader(zr io.ReadCloser) error {
+	err := zr.Close()
+	zlibReaders.Put(zr)
 	return err
 }
 
+// corrupt wraps err with ErrCorrupt, reporting unexpected EOF if
+// data ended before err was encountered.
+func corrupt(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("%w: %v", ErrCorrupt, err)
+}
+
 type treeReader struct {
-	// init with min size 20 to peek sha1
+	// init with min size of binary object names to peek them
 	*bufio.Reader
 
 	buf bytes.Buffer
 
-	// init with length 40
+	// init with length of hexadecimal object names
 	hash []byte
 }
 
@@ -106,7 +204,7 @@ func (g *treeReader) Read(p []byte) (n int, err error) {
 	var mode, name, sum []byte
 
 	// each iteration reads a single line as follows:
-	// [mode] [name]\x00[[20]byte]
+	// [mode] [name]\x00[[20 or 32]byte]
 	//
 	// output is as follows (where type is determined by mode[0]):
 	// [mode] [type] [hexenc]\t[name]
@@ -125,22 +223,25 @@ func (g *treeReader) Read(p []byte) (n int, err error) {
 			g.buf.Write(mode)
 			g.buf.Write([]byte("tree "))
 		default:
-			panic("unrecognized mode")
+			err = fmt.Errorf("%w: unrecognized mode %q", ErrCorrupt, mode[:len(mode)-1])
+		}
+		if err != nil {
+			break
 		}
-
-		// TODO custom error about malformed tree for below
 
 		name, err = g.Reader.ReadBytes('\x00')
 		if err != nil {
+			err = corrupt(err)
 			break
 		}
 		name = name[:len(name)-1]
 
-		sum, err = g.Reader.Peek(20)
+		sum, err = g.Reader.Peek(len(g.hash) / 2)
 		if err != nil {
+			err = corrupt(err)
 			break
 		}
-		g.Reader.Discard(20)
+		g.Reader.Discard(len(sum))
 
 		hex.Encode(g.hash, sum)
 		g.buf.Write(g.hash)
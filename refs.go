@@ -0,0 +1,480 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrRefNotExist is returned when a reference can not be found.
+var ErrRefNotExist = errors.New("git: reference does not exist")
+
+// ErrRefConflict is returned when a reference update fails verification of
+// the reference's current value.
+var ErrRefConflict = errors.New("git: reference changed concurrently")
+
+// Ref is a named reference to an object. If Target is set, the reference is
+// symbolic and Hash is the resolved hash of Target, if any.
+type Ref struct {
+	Name   string
+	Hash   Hash
+	Target string
+}
+
+// RefUpdate describes a change of reference Name from Old to New. Old set to
+// ZeroHash requires the reference to not exist and the zero value Old skips
+// verification. New set to ZeroHash deletes the reference. The zero hash of
+// SHA-256 repositories may be used as well.
+type RefUpdate struct {
+	Name string
+	Old  Hash
+	New  Hash
+}
+
+// RefStore represents a collection of references.
+type RefStore interface {
+	// Refs returns all references under refs/ sorted by name.
+	Refs() ([]Ref, error)
+
+	// Ref returns the reference by the given name, following symbolic
+	// references. The returned error wraps ErrRefNotExist if the reference
+	// or its target does not exist.
+	Ref(name string) (Ref, error)
+
+	// UpdateRefs applies all updates or none at all. The returned error
+	// wraps ErrRefConflict if verification of any update fails.
+	UpdateRefs(updates ...RefUpdate) error
+}
+
+// ValidRefName reports whether name is a well formed reference name, as
+// with git check-ref-format. HEAD is valid.
+func ValidRefName(name string) bool {
+	if name == "HEAD" {
+		return true
+	}
+	if !strings.HasPrefix(name, "refs/") || strings.HasSuffix(name, "/") || strings.HasSuffix(name, ".") {
+		return false
+	}
+	if strings.Contains(name, "..") || strings.Contains(name, "@{") || strings.Contains(name, "//") {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if c < 0x20 || c == 0x7f || strings.IndexByte(" ~^:?*[\\", c) != -1 {
+			return false
+		}
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part[0] == '.' || strings.HasSuffix(part, ".lock") {
+			return false
+		}
+	}
+	return true
+}
+
+// checkUpdates validates names and hashes of updates.
+func checkUpdates(updates []RefUpdate) error {
+	seen := make(map[string]bool)
+	for _, u := range updates {
+		if !ValidRefName(u.Name) || u.Name == "HEAD" {
+			return fmt.Errorf("git: invalid reference name %q", u.Name)
+		}
+		if seen[u.Name] {
+			return fmt.Errorf("git: multiple updates for reference %s", u.Name)
+		}
+		seen[u.Name] = true
+		if u.New == (Hash{}) {
+			return fmt.Errorf("git: invalid hash in update of %s", u.Name)
+		}
+	}
+	return nil
+}
+
+// verify reports ErrRefConflict unless the current hash of ref, the zero
+// value if it does not exist, matches u.Old.
+func (u RefUpdate) verify(current Hash) error {
+	switch {
+	case u.Old == (Hash{}):
+		return nil
+	case u.Old.IsZero() && current == (Hash{}):
+		return nil
+	case u.Old != current:
+		if current == (Hash{}) {
+			current = u.Old.ObjectFormat().ZeroHash()
+		}
+		return fmt.Errorf("%w: %s is at %s but expected %s", ErrRefConflict, u.Name, current, u.Old)
+	}
+	return nil
+}
+
+// resolve follows symbolic references using lookup, which returns the hash
+// or symbolic target of a single reference.
+func resolve(name string, lookup func(string) (hash Hash, target string, err error)) (Ref, error) {
+	ref := Ref{Name: name}
+	for i := 0; i < 5; i++ {
+		hash, target, err := lookup(name)
+		if err != nil {
+			return ref, err
+		}
+		if target == "" {
+			ref.Hash = hash
+			return ref, nil
+		}
+		if ref.Target == "" {
+			ref.Target = target
+		}
+		name = target
+	}
+	return ref, fmt.Errorf("git: symbolic reference %s too deep", ref.Name)
+}
+
+// DiskRefs implements RefStore for git repositories on disk, reading
+// loose references and packed-refs.
+//
+//  refs := git.DiskRefs(dir)
+type DiskRefs string
+
+// path returns the file of reference name, or of packed-refs. References
+// other than those of a worktree, such as HEAD, are of the common
+// directory of linked worktrees.
+func (rs DiskRefs) path(name string) string {
+	dir := string(rs)
+	if !worktreeRef(name) {
+		dir = commonDir(dir)
+	}
+	return filepath.Join(dir, filepath.FromSlash(name))
+}
+
+// worktreeRef reports whether reference name belongs to a worktree rather
+// than the repository.
+func worktreeRef(name string) bool {
+	for _, prefix := range []string{"refs/bisect/", "refs/worktree/", "refs/rewritten/"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return !strings.HasPrefix(name, "refs/") && name != "packed-refs"
+}
+
+// packed returns references from packed-refs and their peeled values.
+func (rs DiskRefs) packed() (map[string]Hash, error) {
+	m := make(map[string]Hash)
+	b, err := ioutil.ReadFile(rs.path("packed-refs"))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		i := strings.IndexByte(line, ' ')
+		if i == -1 {
+			return nil, fmt.Errorf("git: invalid packed-refs line %q", line)
+		}
+		h, err := ParseHash(line[:i])
+		if err != nil {
+			return nil, fmt.Errorf("git: invalid packed-refs line %q", line)
+		}
+		m[line[i+1:]] = h
+	}
+	return m, sc.Err()
+}
+
+// lookup reads the hash or symbolic target of a single reference.
+func (rs DiskRefs) lookup(name string) (hash Hash, target string, err error) {
+	if !ValidRefName(name) {
+		return Hash{}, "", fmt.Errorf("git: invalid reference name %q", name)
+	}
+	b, err := ioutil.ReadFile(rs.path(name))
+	if err == nil {
+		s := strings.TrimSpace(string(b))
+		if strings.HasPrefix(s, "ref: ") {
+			return Hash{}, strings.TrimSpace(s[5:]), nil
+		}
+		h, err := ParseHash(s)
+		if err != nil {
+			return Hash{}, "", fmt.Errorf("git: invalid reference %s", name)
+		}
+		return h, "", nil
+	}
+	if !os.IsNotExist(err) && !isDirErr(rs.path(name)) {
+		return Hash{}, "", err
+	}
+	m, err := rs.packed()
+	if err != nil {
+		return Hash{}, "", err
+	}
+	if h, ok := m[name]; ok {
+		return h, "", nil
+	}
+	return Hash{}, "", fmt.Errorf("%w: %s", ErrRefNotExist, name)
+}
+
+// isDirErr reports whether name is a directory, such as when looking up
+// reference refs/heads while refs/heads/master exists.
+func isDirErr(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && fi.IsDir()
+}
+
+// Ref returns the reference by the given name.
+func (rs DiskRefs) Ref(name string) (Ref, error) { return resolve(name, rs.lookup) }
+
+// Refs returns all loose and packed references under refs/.
+func (rs DiskRefs) Refs() ([]Ref, error) {
+	m, err := rs.packed()
+	if err != nil {
+		return nil, err
+	}
+	root := rs.path("refs")
+	err = filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == root {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || strings.HasSuffix(p, ".lock") {
+			return nil
+		}
+		rel, err := filepath.Rel(filepath.Dir(root), p)
+		if err != nil {
+			return err
+		}
+		m[filepath.ToSlash(rel)] = Hash{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]Ref, 0, len(m))
+	for name := range m {
+		ref, err := rs.Ref(name)
+		if errors.Is(err, ErrRefNotExist) {
+			continue // dangling symbolic reference
+		}
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name < refs[j].Name })
+	return refs, nil
+}
+
+// UpdateRefs applies updates by taking a lock file for every reference,
+// verifying current values and renaming lock files into place. References
+// to be deleted are also removed from packed-refs.
+func (rs DiskRefs) UpdateRefs(updates ...RefUpdate) (err error) {
+	if err := checkUpdates(updates); err != nil {
+		return err
+	}
+	updates = append([]RefUpdate(nil), updates...)
+	sort.Slice(updates, func(i, j int) bool { return updates[i].Name < updates[j].Name })
+
+	var locks []*os.File
+	defer func() {
+		for _, f := range locks {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	lock := func(p string) (*os.File, error) {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(p+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("%w: unable to lock %s", ErrRefConflict, p)
+		}
+		if err != nil {
+			return nil, err
+		}
+		locks = append(locks, f)
+		return f, nil
+	}
+
+	var deletes bool
+	for _, u := range updates {
+		f, err := lock(rs.path(u.Name))
+		if err != nil {
+			return err
+		}
+		cur, err := rs.Ref(u.Name)
+		if err != nil && !errors.Is(err, ErrRefNotExist) {
+			return err
+		}
+		if err := u.verify(cur.Hash); err != nil {
+			return err
+		}
+		if u.New.IsZero() {
+			deletes = true
+			continue
+		}
+		if _, err := f.WriteString(u.New.String() + "\n"); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if deletes {
+		if err := rs.prunePacked(lock, updates); err != nil {
+			return err
+		}
+	}
+
+	// all verified, commit
+	for i, u := range updates {
+		f := locks[i]
+		f.Close()
+		if u.New.IsZero() {
+			os.Remove(f.Name())
+			if err := os.Remove(rs.path(u.Name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := os.Rename(f.Name(), rs.path(u.Name)); err != nil {
+			return err
+		}
+	}
+	if len(locks) > len(updates) {
+		f := locks[len(updates)]
+		if err := os.Rename(f.Name(), rs.path("packed-refs")); err != nil {
+			return err
+		}
+	}
+	locks = nil
+	return nil
+}
+
+// prunePacked writes a locked copy of packed-refs without deleted references.
+func (rs DiskRefs) prunePacked(lock func(string) (*os.File, error), updates []RefUpdate) error {
+	b, err := ioutil.ReadFile(rs.path("packed-refs"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	del := make(map[string]bool)
+	for _, u := range updates {
+		if u.New.IsZero() {
+			del[u.Name] = true
+		}
+	}
+	var (
+		buf  bytes.Buffer
+		skip bool
+	)
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] == '^' && skip {
+			continue
+		}
+		skip = false
+		if i := strings.IndexByte(line, ' '); line[0] != '#' && line[0] != '^' && i != -1 {
+			skip = del[strings.TrimSpace(line[i+1:])]
+		}
+		if !skip {
+			buf.WriteString(line)
+		}
+	}
+	f, err := lock(rs.path("packed-refs"))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// MemRefs implements RefStore in-memory. MemRefs is safe for concurrent use
+// by multiple goroutines. HEAD is a symbolic reference to refs/heads/master.
+func MemRefs() RefStore {
+	return &memRefs{m: map[string]Ref{
+		"HEAD": {Name: "HEAD", Target: "refs/heads/master"},
+	}}
+}
+
+type memRefs struct {
+	mu sync.RWMutex
+	m  map[string]Ref
+}
+
+func (rs *memRefs) lookup(name string) (Hash, string, error) {
+	ref, ok := rs.m[name]
+	if !ok {
+		return Hash{}, "", fmt.Errorf("%w: %s", ErrRefNotExist, name)
+	}
+	return ref.Hash, ref.Target, nil
+}
+
+func (rs *memRefs) Ref(name string) (Ref, error) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return resolve(name, rs.lookup)
+}
+
+func (rs *memRefs) Refs() ([]Ref, error) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	var refs []Ref
+	for name := range rs.m {
+		if !strings.HasPrefix(name, "refs/") {
+			continue
+		}
+		ref, err := resolve(name, rs.lookup)
+		if errors.Is(err, ErrRefNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name < refs[j].Name })
+	return refs, nil
+}
+
+func (rs *memRefs) UpdateRefs(updates ...RefUpdate) error {
+	if err := checkUpdates(updates); err != nil {
+		return err
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, u := range updates {
+		cur, err := resolve(u.Name, rs.lookup)
+		if err != nil && !errors.Is(err, ErrRefNotExist) {
+			return err
+		}
+		if err := u.verify(cur.Hash); err != nil {
+			return err
+		}
+	}
+	for _, u := range updates {
+		if u.New.IsZero() {
+			delete(rs.m, u.Name)
+		} else {
+			rs.m[u.Name] = Ref{Name: u.Name, Hash: u.New}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package git
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidRefName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"HEAD":                   true,
+		"refs/heads/master":      true,
+		"refs/tags/v1.0":         true,
+		"refs/heads/feature/foo": true,
+		"master":                 false,
+		"refs/heads/../config":   false,
+		"refs/heads/foo.lock":    false,
+		"refs/heads/.hidden":     false,
+		"refs/heads/a b":         false,
+		"refs/heads/a@{1}":       false,
+		"refs/heads/":            false,
+		"refs//heads":            false,
+		"refs/heads/a\x00":       false,
+	} {
+		if have := ValidRefName(name); have != want {
+			t.Errorf("ValidRefName(%q) => %v, want %v", name, have, want)
+		}
+	}
+}
+
+func TestDiskRefs(t *testing.T) {
+	dir := packRepo(t)
+	defer os.RemoveAll(dir)
+	gitdir := filepath.Join(dir, ".git")
+
+	git := func(args ...string) string {
+		cmd := command("git", args...)
+		cmd.Dir = dir
+		return strings.TrimSpace(assertRun(t, cmd))
+	}
+	git("branch", "loose")
+	git("pack-refs", "--all")
+	git("branch", "other", "HEAD~1")
+	head := parseHash(t, git("rev-parse", "HEAD"))
+
+	rs := DiskRefs(gitdir)
+	ref, err := rs.Ref("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Hash != head || ref.Target != "refs/heads/master" {
+		t.Fatalf("Ref(HEAD) => %+v", ref)
+	}
+
+	refs, err := rs.Refs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, ref := range refs {
+		names = append(names, ref.Name)
+	}
+	if have, want := strings.Join(names, " "), "refs/heads/loose refs/heads/master refs/heads/other refs/tags/v1"; have != want {
+		t.Fatalf("Refs() => %q, want %q", have, want)
+	}
+
+	// packed ref is deleted, loose ref created and updated
+	err = rs.UpdateRefs(
+		RefUpdate{Name: "refs/heads/loose", Old: head, New: ZeroHash},
+		RefUpdate{Name: "refs/heads/new", Old: ZeroHash, New: head},
+		RefUpdate{Name: "refs/heads/other", New: head},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.Ref("refs/heads/loose"); !errors.Is(err, ErrRefNotExist) {
+		t.Fatalf("Ref(loose) => %v, want ErrRefNotExist", err)
+	}
+	if have := git("for-each-ref", "--format=%(refname)", "refs/heads/"); have != "refs/heads/master\nrefs/heads/new\nrefs/heads/other" {
+		t.Fatalf("git for-each-ref => %q", have)
+	}
+	if have := git("rev-parse", "other"); have != head.String() {
+		t.Fatalf("other => %s, want %s", have, head)
+	}
+
+	// failed verification applies no updates
+	err = rs.UpdateRefs(
+		RefUpdate{Name: "refs/heads/new", Old: head, New: ZeroHash},
+		RefUpdate{Name: "refs/heads/master", Old: ZeroHash, New: head},
+	)
+	if !errors.Is(err, ErrRefConflict) {
+		t.Fatalf("UpdateRefs => %v, want ErrRefConflict", err)
+	}
+	if _, err := rs.Ref("refs/heads/new"); err != nil {
+		t.Fatalf("Ref(new) => %v", err)
+	}
+	if ms, _ := filepath.Glob(filepath.Join(gitdir, "refs", "heads", "*.lock")); len(ms) != 0 {
+		t.Fatalf("lock files remain: %q", ms)
+	}
+
+	if err := rs.UpdateRefs(RefUpdate{Name: "refs/heads/../../config", New: head}); err == nil {
+		t.Fatal("UpdateRefs with invalid name succeeded")
+	}
+}
+
+func TestMemRefs(t *testing.T) {
+	rs := MemRefs()
+	if _, err := rs.Ref("HEAD"); !errors.Is(err, ErrRefNotExist) {
+		t.Fatalf("Ref(HEAD) => %v, want ErrRefNotExist", err)
+	}
+	h := parseHash(t, strings.Repeat("1", 40))
+	if err := rs.UpdateRefs(RefUpdate{Name: "refs/heads/master", Old: ZeroHash, New: h}); err != nil {
+		t.Fatal(err)
+	}
+	ref, err := rs.Ref("HEAD")
+	if err != nil || ref.Hash != h || ref.Target != "refs/heads/master" {
+		t.Fatalf("Ref(HEAD) => %+v, %v", ref, err)
+	}
+	if err := rs.UpdateRefs(RefUpdate{Name: "refs/heads/master", Old: ZeroHash, New: h}); !errors.Is(err, ErrRefConflict) {
+		t.Fatalf("UpdateRefs => %v, want ErrRefConflict", err)
+	}
+}
+
+func TestRefSpec(t *testing.T) {
+	for _, tc := range []struct {
+		spec, name, dst string
+		ok              bool
+	}{
+		{"+refs/heads/*:refs/remotes/origin/*", "refs/heads/master", "refs/remotes/origin/master", true},
+		{"+refs/heads/*:refs/remotes/origin/*", "refs/tags/v1", "", false},
+		{"refs/heads/feature/*-wip:refs/wip/*", "refs/heads/feature/x-wip", "refs/wip/x", true},
+		{"refs/heads/master:refs/heads/other", "refs/heads/master", "refs/heads/other", true},
+		{"refs/tags/*", "refs/tags/v1", "", true},
+		{"^refs/heads/wip/*", "refs/heads/wip/x", "", true},
+		{"^refs/heads/master", "refs/heads/main", "", false},
+	} {
+		rs, err := ParseRefSpec(tc.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rs.String() != tc.spec {
+			t.Errorf("%q.String() => %q", tc.spec, rs.String())
+		}
+		if dst, ok := rs.Match(tc.name); dst != tc.dst || ok != tc.ok {
+			t.Errorf("%q.Match(%q) => %q, %v, want %q, %v", tc.spec, tc.name, dst, ok, tc.dst, tc.ok)
+		}
+	}
+	for _, s := range []string{"refs/*/*:refs/*", "refs/heads/*:refs/heads/master", "^refs/heads/a:refs/heads/b", "^", "+^refs/heads/a"} {
+		if _, err := ParseRefSpec(s); err == nil {
+			t.Errorf("ParseRefSpec(%q) succeeded", s)
+		}
+	}
+
+	specs, err := ParseRefSpecs([]string{
+		"+refs/heads/*:refs/remotes/origin/*",
+		"refs/heads/main:refs/heads/upstream",
+		"^refs/heads/wip/*",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string][]RefSpec{
+		"refs/heads/main": {
+			{Force: true, Src: "refs/heads/main", Dst: "refs/remotes/origin/main"},
+			{Src: "refs/heads/main", Dst: "refs/heads/upstream"},
+		},
+		"refs/heads/topic": {{Force: true, Src: "refs/heads/topic", Dst: "refs/remotes/origin/topic"}},
+		"refs/heads/wip/x": nil,
+		"refs/tags/v1":     nil,
+	} {
+		if have := MapRef(specs, name); !reflect.DeepEqual(have, want) {
+			t.Errorf("MapRef(%q) => %+v, want %+v", name, have, want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RefSpec maps references of a remote repository to local references, such
+// as "+refs/heads/*:refs/remotes/origin/*". A negative refspec, such as
+// "^refs/heads/wip/*", excludes references matched by other refspecs.
+type RefSpec struct {
+	// Force allows non-fast-forward updates.
+	Force bool
+	Src   string
+	Dst   string
+
+	// Negative is set for refspecs excluding references matching Src.
+	Negative bool
+}
+
+// ParseRefSpec parses s. Src and Dst must both contain a single wildcard
+// or none at all. Negative refspecs have neither a destination nor force.
+func ParseRefSpec(s string) (RefSpec, error) {
+	var rs RefSpec
+	spec := s
+	switch {
+	case strings.HasPrefix(s, "+"):
+		rs.Force = true
+		s = s[1:]
+	case strings.HasPrefix(s, "^"):
+		rs.Negative = true
+		s = s[1:]
+	}
+	rs.Src = s
+	if i := strings.IndexByte(s, ':'); i != -1 {
+		rs.Src, rs.Dst = s[:i], s[i+1:]
+	}
+	if strings.Count(rs.Src, "*") > 1 || strings.Count(rs.Dst, "*") > 1 ||
+		(rs.Dst != "" && strings.Contains(rs.Src, "*") != strings.Contains(rs.Dst, "*")) ||
+		(rs.Negative && (rs.Src == "" || strings.Contains(s, ":"))) || strings.HasPrefix(rs.Src, "^") {
+		return RefSpec{}, fmt.Errorf("git: invalid refspec %q", spec)
+	}
+	return rs, nil
+}
+
+// Match reports whether name matches Src, returning the corresponding
+// local name according to Dst. The returned name is empty if Dst is. A
+// negative refspec matching name excludes it.
+func (rs RefSpec) Match(name string) (string, bool) {
+	i := strings.IndexByte(rs.Src, '*')
+	if i == -1 {
+		if name != rs.Src {
+			return "", false
+		}
+		return rs.Dst, true
+	}
+	prefix, suffix := rs.Src[:i], rs.Src[i+1:]
+	if len(name) < len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	if rs.Dst == "" {
+		return "", true
+	}
+	return strings.Replace(rs.Dst, "*", name[len(prefix):len(name)-len(suffix)], 1), true
+}
+
+func (rs RefSpec) String() string {
+	s := rs.Src
+	if rs.Dst != "" {
+		s += ":" + rs.Dst
+	}
+	switch {
+	case rs.Force:
+		s = "+" + s
+	case rs.Negative:
+		s = "^" + s
+	}
+	return s
+}
+
+// ParseRefSpecs parses each of specs.
+func ParseRefSpecs(specs []string) ([]RefSpec, error) {
+	rss := make([]RefSpec, len(specs))
+	for i, s := range specs {
+		var err error
+		if rss[i], err = ParseRefSpec(s); err != nil {
+			return nil, err
+		}
+	}
+	return rss, nil
+}
+
+// ExcludedRef reports whether name matches a negative refspec of specs.
+func ExcludedRef(specs []RefSpec, name string) bool {
+	for _, rs := range specs {
+		if _, ok := rs.Match(name); ok && rs.Negative {
+			return true
+		}
+	}
+	return false
+}
+
+// MapRef maps name by specs, returning a refspec from name to its local
+// name for every refspec matching it, in order. None are returned if name
+// is excluded by a negative refspec.
+func MapRef(specs []RefSpec, name string) []RefSpec {
+	if ExcludedRef(specs, name) {
+		return nil
+	}
+	var mapped []RefSpec
+	for _, rs := range specs {
+		if dst, ok := rs.Match(name); ok && !rs.Negative {
+			mapped = append(mapped, RefSpec{Force: rs.Force, Src: name, Dst: dst})
+		}
+	}
+	return mapped
+}
@@ -0,0 +1,196 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Remote is a remote repository configured in a remote section, such as
+//
+//	[remote "origin"]
+//		url = https://example.com/repo.git
+//		fetch = +refs/heads/*:refs/remotes/origin/*
+type Remote struct {
+	Name string
+
+	// URLs are fetched from and PushURLs pushed to, rewritten by any
+	// url.<base>.insteadOf and, for pushing to URLs, pushInsteadOf
+	// variables. Without pushurl variables, PushURLs are of URLs.
+	URLs     []string
+	PushURLs []string
+
+	Fetch []RefSpec
+	Push  []RefSpec
+
+	// TagOpt is --tags to fetch every tag, --no-tags to fetch none, or
+	// empty to fetch tags pointing to objects fetched.
+	TagOpt string
+}
+
+// Branch is the upstream configuration of a local branch, such as
+//
+//	[branch "main"]
+//		remote = origin
+//		merge = refs/heads/main
+type Branch struct {
+	Name string
+
+	// Remote is the name of the remote the branch tracks, or "." for the
+	// local repository.
+	Remote string
+
+	// Merge are the names of references of Remote the branch tracks.
+	Merge []string
+
+	// Rebase is how the branch is pulled: false to merge, true to rebase,
+	// merges to rebase with merge commits, or interactive. Without
+	// branch.<name>.rebase, pull.rebase applies.
+	Rebase string
+}
+
+// Remote returns the remote named name. An error is returned if it is not
+// configured or has invalid refspecs.
+func (c *Config) Remote(name string) (*Remote, error) {
+	key := func(name, v string) string { return "remote." + name + "." + v }
+	if !c.hasSubsection("remote", name) {
+		return nil, fmt.Errorf("git: no such remote %q", name)
+	}
+	r := &Remote{Name: name}
+	for _, u := range c.GetAll(key(name, "url")) {
+		r.URLs = append(r.URLs, c.rewriteURL(u, false))
+	}
+	for _, u := range c.GetAll(key(name, "pushurl")) {
+		r.PushURLs = append(r.PushURLs, c.rewriteURL(u, false))
+	}
+	if r.PushURLs == nil {
+		for _, u := range c.GetAll(key(name, "url")) {
+			r.PushURLs = append(r.PushURLs, c.rewriteURL(u, true))
+		}
+	}
+	var err error
+	if r.Fetch, err = c.refSpecs(key(name, "fetch")); err != nil {
+		return nil, err
+	}
+	if r.Push, err = c.refSpecs(key(name, "push")); err != nil {
+		return nil, err
+	}
+	r.TagOpt, _ = c.Get(key(name, "tagopt"))
+	return r, nil
+}
+
+// Remotes returns every configured remote, in order of appearance.
+func (c *Config) Remotes() ([]*Remote, error) {
+	var remotes []*Remote
+	for _, name := range c.Subsections("remote") {
+		r, err := c.Remote(name)
+		if err != nil {
+			return nil, err
+		}
+		remotes = append(remotes, r)
+	}
+	return remotes, nil
+}
+
+// Branch returns the configuration of the local branch named name, as in
+// refs/heads/name. A branch without configuration has none.
+func (c *Config) Branch(name string) (*Branch, error) {
+	b := &Branch{Name: name, Rebase: "false"}
+	b.Remote, _ = c.Get("branch." + name + ".remote")
+	b.Merge = c.GetAll("branch." + name + ".merge")
+
+	es := c.lookup("branch." + name + ".rebase")
+	if len(es) == 0 {
+		es = c.lookup("pull.rebase")
+	}
+	if len(es) > 0 {
+		e := es[len(es)-1]
+		switch strings.ToLower(e.Value) {
+		case "merges", "m":
+			b.Rebase = "merges"
+		case "interactive", "i":
+			b.Rebase = "interactive"
+		default:
+			ok, err := parseConfigBool(e.Value, e.novalue)
+			if err != nil {
+				return nil, fmt.Errorf("%w: bad rebase value %q for %s", ErrInvalidConfig, e.Value, e.Key)
+			}
+			if ok {
+				b.Rebase = "true"
+			}
+		}
+	}
+	return b, nil
+}
+
+// Upstream returns the remote-tracking reference of the branch named name,
+// as refs/remotes/origin/main for a branch merging refs/heads/main of
+// origin, mapped by the remote's fetch refspecs. A branch tracking a local
+// branch has it as upstream. An empty name is returned if the branch has
+// no upstream.
+func (c *Config) Upstream(name string) (string, error) {
+	b, err := c.Branch(name)
+	if err != nil || b.Remote == "" || len(b.Merge) == 0 {
+		return "", err
+	}
+	if b.Remote == "." {
+		return b.Merge[0], nil
+	}
+	r, err := c.Remote(b.Remote)
+	if err != nil {
+		return "", err
+	}
+	for _, rs := range MapRef(r.Fetch, b.Merge[0]) {
+		if rs.Dst != "" {
+			return rs.Dst, nil
+		}
+	}
+	return "", nil
+}
+
+// hasSubsection reports whether any variable is set in the subsection of
+// section.
+func (c *Config) hasSubsection(section, subsection string) bool {
+	for _, s := range c.Subsections(section) {
+		if s == subsection {
+			return true
+		}
+	}
+	return false
+}
+
+// refSpecs parses the refspecs of key.
+func (c *Config) refSpecs(key string) ([]RefSpec, error) {
+	specs, err := ParseRefSpecs(c.GetAll(key))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidConfig, key, err)
+	}
+	return specs, nil
+}
+
+// rewriteURL rewrites u by the longest matching url.<base>.insteadOf, or
+// url.<base>.pushInsteadOf if push is set, replacing the match with base.
+// For pushing, insteadOf applies only without any pushInsteadOf match.
+func (c *Config) rewriteURL(u string, push bool) string {
+	best := func(suffix string) (string, bool) {
+		var base, prefix string
+		for _, e := range c.entries {
+			if !strings.HasPrefix(e.Key, "url.") || !strings.HasSuffix(e.Key, suffix) {
+				continue
+			}
+			if strings.HasPrefix(u, e.Value) && len(e.Value) > len(prefix) {
+				base, prefix = e.Key[4:len(e.Key)-len(suffix)], e.Value
+			}
+		}
+		if prefix == "" {
+			return u, false
+		}
+		return base + u[len(prefix):], true
+	}
+	if push {
+		if v, ok := best(".pushinsteadof"); ok {
+			return v
+		}
+	}
+	v, _ := best(".insteadof")
+	return v
+}
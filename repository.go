@@ -0,0 +1,333 @@
+package git
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Repository is a git repository on disk, tying together its objects,
+// references and configuration with the root of its working tree.
+type Repository struct {
+	// GitDir is the git directory, such as .git of the working tree.
+	// The git directory of a linked worktree, or of a submodule, may be
+	// elsewhere, as named by a .git file.
+	GitDir string
+
+	// CommonDir is the git directory whose objects, references and config
+	// are shared by linked worktrees. It is GitDir for other repositories.
+	CommonDir string
+
+	// WorkTree is the root of the working tree, or empty if the
+	// repository is bare.
+	WorkTree string
+
+	// ObjectFormat names objects of the repository, as configured by
+	// extensions.objectFormat.
+	ObjectFormat ObjectFormat
+
+	Store  Store
+	Refs   RefStore
+	Config *Config
+}
+
+// Open opens the repository containing path, searching path and its
+// parents for a git directory, as a .git directory or file or a bare
+// repository, as git does:
+//
+// GIT_DIR names the git directory instead, whose working tree is path
+// unless the repository is bare. GIT_WORK_TREE or core.worktree names the
+// working tree. The search does not continue into any directory listed in
+// GIT_CEILING_DIRECTORIES.
+//
+// Repositories owned by other users are refused unless listed by a
+// safe.directory variable of system or global config, or if it is "*". The
+// returned error wraps ErrNotRepository if no repository is found and
+// ErrUnsafeRepository if it is refused.
+func Open(path string) (*Repository, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Repository{}
+	var gitfile string
+	if dir := os.Getenv("GIT_DIR"); dir != "" {
+		if r.GitDir, err = filepath.Abs(dir); err != nil {
+			return nil, err
+		}
+		if !isGitDir(r.GitDir) {
+			return nil, fmt.Errorf("%w: %s", ErrNotRepository, dir)
+		}
+		r.WorkTree = path
+	} else if r.GitDir, r.WorkTree, gitfile, err = discover(path); err != nil {
+		return nil, err
+	}
+	r.CommonDir = commonDir(r.GitDir)
+
+	// the repository's config is not read until it is known to be safe
+	if err := r.checkOwner(gitfile); err != nil {
+		return nil, err
+	}
+	if r.Config, err = LoadConfig(r.GitDir); err != nil {
+		return nil, err
+	}
+	if err := r.checkFormat(); err != nil {
+		return nil, err
+	}
+
+	// only the repository's config may set its working tree
+	var local Config
+	for _, e := range r.Config.entries {
+		if e.Scope == ScopeLocal {
+			local.entries = append(local.entries, e)
+		}
+	}
+	bare, err := local.Bool("core.bare", false)
+	if err != nil {
+		return nil, err
+	}
+	if bare {
+		r.WorkTree = ""
+	}
+	if wt, ok := local.Get("core.worktree"); ok && gitfile == "" {
+		r.WorkTree = absFrom(r.GitDir, wt)
+	}
+	if wt := os.Getenv("GIT_WORK_TREE"); wt != "" {
+		if r.WorkTree, err = filepath.Abs(wt); err != nil {
+			return nil, err
+		}
+	}
+
+	ms, err := openObjects(r.CommonDir)
+	if err != nil {
+		return nil, err
+	}
+	st := repoStore{MultiStore: ms}
+	st.abbrev = NewAbbrevIndex(st)
+	r.Store = st
+	r.Refs = DiskRefs(r.GitDir)
+	return r, nil
+}
+
+// Bare reports whether the repository has no working tree.
+func (r *Repository) Bare() bool { return r.WorkTree == "" }
+
+// discover searches path and its parents for a git directory, returning it
+// with the working tree it belongs to, if any, and the .git file naming it.
+func discover(path string) (gitdir, worktree, gitfile string, err error) {
+	var ceilings []string
+	for _, c := range filepath.SplitList(os.Getenv("GIT_CEILING_DIRECTORIES")) {
+		if filepath.IsAbs(c) {
+			ceilings = append(ceilings, filepath.Clean(c))
+		}
+	}
+	for d := path; ; {
+		dotgit := filepath.Join(d, ".git")
+		fi, err := os.Stat(dotgit)
+		switch {
+		case err == nil && fi.IsDir() && isGitDir(dotgit):
+			return dotgit, d, "", nil
+		case err == nil && fi.Mode().IsRegular():
+			gitdir, err := readGitFile(dotgit)
+			if err != nil {
+				return "", "", "", err
+			}
+			return gitdir, d, dotgit, nil
+		case isGitDir(d):
+			return d, "", "", nil
+		}
+
+		parent := filepath.Dir(d)
+		if parent == d {
+			break
+		}
+		for _, c := range ceilings {
+			if parent == c {
+				return "", "", "", fmt.Errorf("%w: %s (stopped at %s)", ErrNotRepository, path, c)
+			}
+		}
+		d = parent
+	}
+	return "", "", "", fmt.Errorf("%w: %s", ErrNotRepository, path)
+}
+
+// readGitFile reads the git directory named by a .git file, as of linked
+// worktrees and submodules.
+func readGitFile(name string) (string, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	s := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(s, "gitdir: ") {
+		return "", fmt.Errorf("%w: invalid gitfile format: %s", ErrNotRepository, name)
+	}
+	dir := absFrom(filepath.Dir(name), s[8:])
+	if !isGitDir(dir) {
+		return "", fmt.Errorf("%w: %s named by %s", ErrNotRepository, dir, name)
+	}
+	return dir, nil
+}
+
+// isGitDir reports whether dir is a git directory, having HEAD, objects
+// and refs, or HEAD and a common directory.
+func isGitDir(dir string) bool {
+	if fi, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	common := commonDir(dir)
+	for _, d := range []string{"objects", "refs"} {
+		if fi, err := os.Stat(filepath.Join(common, d)); err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// commonDir returns the directory named by the commondir file of git
+// directory dir, as of linked worktrees, or dir itself.
+func commonDir(dir string) string {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "commondir"))
+	if err != nil {
+		return dir
+	}
+	return absFrom(dir, strings.TrimSpace(string(b)))
+}
+
+// absFrom returns p, if relative, joined to dir.
+func absFrom(dir, p string) string {
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p)
+	}
+	return filepath.Join(dir, p)
+}
+
+// checkFormat reports an error unless the repository format version and
+// extensions are supported, setting the object format.
+func (r *Repository) checkFormat() error {
+	version, err := r.Config.Int("core.repositoryformatversion", 0)
+	if err != nil {
+		return err
+	}
+	switch version {
+	case 0:
+		return nil
+	case 1:
+	default:
+		return fmt.Errorf("%w: repository format version %d", ErrNotImplemented, version)
+	}
+	for _, e := range r.Config.entries {
+		if e.Scope != ScopeLocal || !strings.HasPrefix(e.Key, "extensions.") {
+			continue
+		}
+		switch ext := e.Key[len("extensions."):]; ext {
+		case "noop", "partialclone", "preciousobjects", "worktreeconfig":
+		case "objectformat":
+			if r.ObjectFormat, err = ParseObjectFormat(e.Value); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+			}
+		default:
+			return fmt.Errorf("%w: repository extension %s", ErrNotImplemented, ext)
+		}
+	}
+	return nil
+}
+
+// getuid returns the user id the owner of repositories is checked against.
+var getuid = os.Getuid
+
+// checkOwner reports ErrUnsafeRepository if the working tree, git
+// directory or .git file is owned by another user, unless allowed by
+// safe.directory of system or global config. The repository's config is
+// not read, as it is not yet trusted.
+func (r *Repository) checkOwner(gitfile string) error {
+	uid := getuid()
+	if uid == -1 {
+		return nil
+	}
+	path := r.WorkTree
+	if path == "" {
+		path = r.GitDir
+	}
+	owned := true
+	for _, p := range []string{r.WorkTree, gitfile, r.GitDir} {
+		if p == "" {
+			continue
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if owner, ok := fileOwner(fi); ok && owner != uid {
+			owned = false
+		}
+	}
+	if owned {
+		return nil
+	}
+
+	// an empty value resets the list of safe directories
+	c, err := LoadConfig("")
+	if err != nil {
+		return err
+	}
+	safe := false
+	for _, e := range c.entries {
+		if e.Key != "safe.directory" {
+			continue
+		}
+		switch v := expandConfigPath(e.Value); {
+		case v == "":
+			safe = false
+		case v == "*" || filepath.Clean(v) == path:
+			safe = true
+		}
+	}
+	if !safe {
+		return fmt.Errorf("%w: %s is owned by someone else; add it to safe.directory to allow it", ErrUnsafeRepository, path)
+	}
+	return nil
+}
+
+// repoStore reads objects of a git directory from loose objects, packfiles
+// and alternates, writing loose objects. Indexed packs are kept whole.
+// Objects are of the object format of the repository. Abbreviations are
+// resolved by an index of objects of every Store.
+type repoStore struct {
+	*MultiStore
+	abbrev *AbbrevIndex
+}
+
+// Writer adds objects written to the abbreviation index.
+func (st repoStore) Writer() Writer {
+	return &abbrevCloser{st.MultiStore.Writer(), st.abbrev}
+}
+
+func (st repoStore) ResolvePrefix(p Prefix) (Hash, error) { return st.abbrev.ResolvePrefix(p) }
+
+func (st repoStore) ShortestUnique(hash Hash) (Prefix, error) { return st.abbrev.ShortestUnique(hash) }
+
+// IndexPack resets the abbreviation index once the pack is indexed.
+func (st repoStore) IndexPack(r io.Reader, promisor bool) error {
+	err := st.MultiStore.IndexPack(r, promisor)
+	st.abbrev.Reset()
+	return err
+}
+
+// abbrevCloser wraps a Writer to add the object written to an AbbrevIndex
+// once Writer.Close() succeeds.
+type abbrevCloser struct {
+	Writer
+	x *AbbrevIndex
+}
+
+func (g *abbrevCloser) Close() error {
+	if err := g.Writer.Close(); err != nil {
+		return err
+	}
+	g.x.Add(g.Writer.Hash())
+	return nil
+}
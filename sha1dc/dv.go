@@ -0,0 +1,71 @@
+package sha1dc
+
+import "math/bits"
+
+// disturbance describes a disturbance vector I(k,b) or II(k,b) and the
+// message differences of blocks colliding along it.
+type disturbance struct {
+	typ, k, b int
+
+	// testt is the step recompression starts from.
+	testt int
+
+	// dm are the differences of expanded message words.
+	dm [80]uint32
+}
+
+// dvs are the disturbance vectors of known practical attacks, as tested by
+// git's sha1collisiondetection.
+var dvs = []disturbance{
+	{typ: 1, k: 43, b: 0}, {typ: 1, k: 44, b: 0}, {typ: 1, k: 45, b: 0},
+	{typ: 1, k: 46, b: 0}, {typ: 1, k: 46, b: 2}, {typ: 1, k: 47, b: 0},
+	{typ: 1, k: 47, b: 2}, {typ: 1, k: 48, b: 0}, {typ: 1, k: 48, b: 2},
+	{typ: 1, k: 49, b: 0}, {typ: 1, k: 49, b: 2}, {typ: 1, k: 50, b: 0},
+	{typ: 1, k: 50, b: 2}, {typ: 1, k: 51, b: 0}, {typ: 1, k: 51, b: 2},
+	{typ: 1, k: 52, b: 0},
+	{typ: 2, k: 45, b: 0}, {typ: 2, k: 46, b: 0}, {typ: 2, k: 46, b: 2},
+	{typ: 2, k: 47, b: 0}, {typ: 2, k: 48, b: 0}, {typ: 2, k: 49, b: 0},
+	{typ: 2, k: 49, b: 2}, {typ: 2, k: 50, b: 0}, {typ: 2, k: 50, b: 2},
+	{typ: 2, k: 51, b: 0}, {typ: 2, k: 51, b: 2}, {typ: 2, k: 52, b: 0},
+	{typ: 2, k: 53, b: 0}, {typ: 2, k: 54, b: 0}, {typ: 2, k: 55, b: 0},
+	{typ: 2, k: 56, b: 0},
+}
+
+func init() {
+	for i := range dvs {
+		dvs[i].init()
+	}
+}
+
+// init derives message differences from the disturbance vector, whose
+// perturbations are each corrected by a local collision over the following
+// five steps.
+func (dv *disturbance) init() {
+	// vector words -5 through 79, offset by o
+	const o = 5
+	var v [o + 80]uint32
+
+	// the 16 words from k determine the rest by message expansion
+	v[o+dv.k+15] = 1 << uint(dv.b)
+	if dv.typ == 2 {
+		v[o+dv.k+1] = bits.RotateLeft32(1<<uint(dv.b), -1)
+		v[o+dv.k+3] = v[o+dv.k+1]
+	}
+	for t := o + dv.k + 16; t < len(v); t++ {
+		v[t] = bits.RotateLeft32(v[t-3]^v[t-8]^v[t-14]^v[t-16], 1)
+	}
+	for t := o + dv.k - 1; t >= 0; t-- {
+		v[t] = bits.RotateLeft32(v[t+16], -1) ^ v[t+13] ^ v[t+8] ^ v[t+2]
+	}
+
+	for t := range dv.dm {
+		dv.dm[t] = v[o+t] ^ bits.RotateLeft32(v[o+t-1], 5) ^ v[o+t-2] ^
+			bits.RotateLeft32(v[o+t-3]^v[o+t-4]^v[o+t-5], 30)
+	}
+
+	// attacks along vectors from step 50 have conditions up to step 65
+	dv.testt = 58
+	if dv.k >= 50 {
+		dv.testt = 65
+	}
+}
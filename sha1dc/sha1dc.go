@@ -0,0 +1,217 @@
+// Package sha1dc implements SHA-1 with detection of collision attacks, as
+// used by git to reject objects crafted like those of SHAttered.
+//
+// Every block hashed is tested for being one of a near-collision pair by
+// counter-cryptanalysis (Stevens, "Counter-cryptanalysis", CRYPTO 2013).
+// For each disturbance vector used by known attacks, the message
+// differences it implies are applied to the block and the compression is
+// recomputed from an intermediate step, backwards for the input state and
+// forwards for the output. An output equal to that of the original block
+// reveals a collision. Sums are those of SHA-1 whether or not a collision
+// is detected.
+package sha1dc // import "dasa.cc/git/sha1dc"
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// Size is the size of a SHA-1 checksum in bytes.
+const Size = 20
+
+// BlockSize is the block size of SHA-1 in bytes.
+const BlockSize = 64
+
+const (
+	k0 = 0x5A827999
+	k1 = 0x6ED9EBA1
+	k2 = 0x8F1BBCDC
+	k3 = 0xCA62C1D6
+)
+
+var iv = [5]uint32{0x67452301, 0xEFCDAB89, 0x98BADCFE, 0x10325476, 0xC3D2E1F0}
+
+// Digest computes SHA-1 checksums, recording whether any block hashed was
+// crafted by a collision attack.
+type Digest struct {
+	h         [5]uint32
+	x         [BlockSize]byte
+	nx        int
+	len       uint64
+	collision bool
+}
+
+var _ hash.Hash = (*Digest)(nil)
+
+// New returns a new Digest computing the SHA-1 checksum.
+func New() *Digest {
+	d := new(Digest)
+	d.Reset()
+	return d
+}
+
+// Sum returns the SHA-1 checksum of data and whether data contains a block
+// crafted by a collision attack.
+func Sum(data []byte) ([Size]byte, bool) {
+	d := New()
+	d.Write(data)
+	sum := d.checkSum()
+	return sum, d.collision
+}
+
+func (d *Digest) Reset() {
+	d.h = iv
+	d.nx = 0
+	d.len = 0
+	d.collision = false
+}
+
+func (d *Digest) Size() int { return Size }
+
+func (d *Digest) BlockSize() int { return BlockSize }
+
+func (d *Digest) Write(p []byte) (int, error) {
+	n := len(p)
+	d.len += uint64(n)
+	if d.nx > 0 {
+		c := copy(d.x[d.nx:], p)
+		d.nx += c
+		if d.nx == BlockSize {
+			d.block(d.x[:])
+			d.nx = 0
+		}
+		p = p[c:]
+	}
+	for len(p) >= BlockSize {
+		d.block(p[:BlockSize])
+		p = p[BlockSize:]
+	}
+	if len(p) > 0 {
+		d.nx = copy(d.x[:], p)
+	}
+	return n, nil
+}
+
+// Sum appends the current checksum to b. The state of d is unchanged, except
+// that a collision detected while padding is recorded.
+func (d *Digest) Sum(b []byte) []byte {
+	d0 := *d
+	sum := d0.checkSum()
+	d.collision = d0.collision
+	return append(b, sum[:]...)
+}
+
+// Collision reports whether a block of data written, or of padding by Sum,
+// was crafted by a collision attack. The checksum is then shared with
+// other data.
+func (d *Digest) Collision() bool { return d.collision }
+
+func (d *Digest) checkSum() [Size]byte {
+	n := d.len
+	var pad [BlockSize + 8]byte
+	pad[0] = 0x80
+	t := 56 - n%BlockSize
+	if n%BlockSize >= 56 {
+		t += BlockSize
+	}
+	binary.BigEndian.PutUint64(pad[t:], n<<3)
+	d.Write(pad[:t+8])
+
+	var sum [Size]byte
+	for i, v := range d.h {
+		binary.BigEndian.PutUint32(sum[4*i:], v)
+	}
+	return sum
+}
+
+// block compresses a single block p into d, retaining the states preceding
+// steps 58 and 65 from which disturbance vectors are tested.
+func (d *Digest) block(p []byte) {
+	var w [80]uint32
+	for i := 0; i < 16; i++ {
+		w[i] = binary.BigEndian.Uint32(p[4*i:])
+	}
+	for i := 16; i < 80; i++ {
+		w[i] = bits.RotateLeft32(w[i-3]^w[i-8]^w[i-14]^w[i-16], 1)
+	}
+
+	s58 := forward(&w, d.h, 0, 58)
+	s65 := forward(&w, s58, 58, 65)
+	s := forward(&w, s65, 65, 80)
+	for i := range d.h {
+		d.h[i] += s[i]
+	}
+
+	if !d.collision {
+		d.collision = detect(&w, &d.h, &s58, &s65)
+	}
+}
+
+// detect reports whether the block of expanded message w, compressing to
+// state ihv, collides with a block differing by the message differences of
+// any disturbance vector.
+func detect(w *[80]uint32, ihv, s58, s65 *[5]uint32) bool {
+	var w2 [80]uint32
+	for i := range dvs {
+		dv := &dvs[i]
+		for t := range w2 {
+			w2[t] = w[t] ^ dv.dm[t]
+		}
+		s := *s58
+		if dv.testt == 65 {
+			s = *s65
+		}
+		in := backward(&w2, s, dv.testt)
+		out := forward(&w2, s, dv.testt, 80)
+		if in[0]+out[0] == ihv[0] && in[1]+out[1] == ihv[1] && in[2]+out[2] == ihv[2] &&
+			in[3]+out[3] == ihv[3] && in[4]+out[4] == ihv[4] {
+			return true
+		}
+	}
+	return false
+}
+
+// forward returns the state following steps from through to-1 of the
+// compression of expanded message w, from state s preceding step from.
+func forward(w *[80]uint32, s [5]uint32, from, to int) [5]uint32 {
+	a, b, c, d, e := s[0], s[1], s[2], s[3], s[4]
+	t := from
+	for ; t < to && t < 20; t++ {
+		a, b, c, d, e = bits.RotateLeft32(a, 5)+(b&c|^b&d)+e+k0+w[t], a, bits.RotateLeft32(b, 30), c, d
+	}
+	for ; t < to && t < 40; t++ {
+		a, b, c, d, e = bits.RotateLeft32(a, 5)+(b^c^d)+e+k1+w[t], a, bits.RotateLeft32(b, 30), c, d
+	}
+	for ; t < to && t < 60; t++ {
+		a, b, c, d, e = bits.RotateLeft32(a, 5)+(b&c|b&d|c&d)+e+k2+w[t], a, bits.RotateLeft32(b, 30), c, d
+	}
+	for ; t < to; t++ {
+		a, b, c, d, e = bits.RotateLeft32(a, 5)+(b^c^d)+e+k3+w[t], a, bits.RotateLeft32(b, 30), c, d
+	}
+	return [5]uint32{a, b, c, d, e}
+}
+
+// backward returns the state preceding step 0 of the compression of
+// expanded message w, from state s preceding step from, inverting forward.
+func backward(w *[80]uint32, s [5]uint32, from int) [5]uint32 {
+	a, b, c, d, e := s[0], s[1], s[2], s[3], s[4]
+	t := from - 1
+	for ; t >= 60; t-- {
+		a, b, c, d, e = b, bits.RotateLeft32(c, 2), d, e, a
+		e -= bits.RotateLeft32(a, 5) + (b ^ c ^ d) + k3 + w[t]
+	}
+	for ; t >= 40; t-- {
+		a, b, c, d, e = b, bits.RotateLeft32(c, 2), d, e, a
+		e -= bits.RotateLeft32(a, 5) + (b&c | b&d | c&d) + k2 + w[t]
+	}
+	for ; t >= 20; t-- {
+		a, b, c, d, e = b, bits.RotateLeft32(c, 2), d, e, a
+		e -= bits.RotateLeft32(a, 5) + (b ^ c ^ d) + k1 + w[t]
+	}
+	for ; t >= 0; t-- {
+		a, b, c, d, e = b, bits.RotateLeft32(c, 2), d, e, a
+		e -= bits.RotateLeft32(a, 5) + (b&c | ^b&d) + k0 + w[t]
+	}
+	return [5]uint32{a, b, c, d, e}
+}
@@ -0,0 +1,85 @@
+package sha1dc
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"hash"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestSum(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 55, 56, 63, 64, 65, 119, 120, 1000, 4096} {
+		data := make([]byte, n)
+		rnd.Read(data)
+		sum, collision := Sum(data)
+		if want := sha1.Sum(data); sum != want || collision {
+			t.Fatalf("Sum(%v bytes) => %x, %v, want %x, false", n, sum, collision, want)
+		}
+
+		// written in pieces
+		d := New()
+		for p := data; len(p) > 0; {
+			k := rnd.Intn(len(p)) + 1
+			d.Write(p[:k])
+			p = p[k:]
+		}
+		if have := d.Sum(nil); !bytes.Equal(have, sum[:]) || d.Collision() {
+			t.Fatalf("Digest.Sum(%v bytes) => %x, %v, want %x, false", n, have, d.Collision(), sum)
+		}
+	}
+}
+
+func TestCollision(t *testing.T) {
+	for _, pair := range [][2]string{
+		{"shattered-1.bin", "shattered-2.bin"}, // identical-prefix
+		{"sha-mbles-1.bin", "sha-mbles-2.bin"}, // chosen-prefix
+	} {
+		var sums [2][Size]byte
+		for i, name := range pair {
+			data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var collision bool
+			if sums[i], collision = Sum(data); !collision {
+				t.Fatalf("Sum(%s) reported no collision", name)
+			}
+			if sums[i] != sha1.Sum(data) {
+				t.Fatalf("Sum(%s) => %x, want %x", name, sums[i], sha1.Sum(data))
+			}
+
+			d := New()
+			d.Write(data)
+			d.Write([]byte("trailing"))
+			if d.Sum(nil); !d.Collision() {
+				t.Fatalf("Collision() after %s => false", name)
+			}
+			if d.Reset(); d.Collision() {
+				t.Fatalf("Collision() after Reset => true")
+			}
+		}
+		if sums[0] != sums[1] {
+			t.Fatalf("%s and %s sums differ", pair[0], pair[1])
+		}
+	}
+}
+
+func benchmarkSize(b *testing.B, n int, h func() hash.Hash) {
+	data := make([]byte, n)
+	b.SetBytes(int64(n))
+	for i := 0; i < b.N; i++ {
+		h().Write(data)
+	}
+}
+
+func BenchmarkSHA1(b *testing.B) {
+	benchmarkSize(b, 8192, func() hash.Hash { return sha1.New() })
+}
+
+func BenchmarkSHA1DC(b *testing.B) {
+	benchmarkSize(b, 8192, func() hash.Hash { return New() })
+}
@@ -0,0 +1,70 @@
+package git
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ReadShallow returns the shallow commits of git directory dir, whose
+// parents are absent from a shallow clone, as listed in its shallow file.
+// A repository that is not shallow has none.
+func ReadShallow(dir string) ([]Hash, error) {
+	f, err := os.Open(filepath.Join(dir, "shallow"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hashes []Hash
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		h, err := ParseHash(strings.TrimSpace(sc.Text()))
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid shallow line %q", ErrCorrupt, sc.Text())
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, sc.Err()
+}
+
+// WriteShallow replaces the shallow file of git directory dir with hashes
+// of shallow commits, removing the file if there are none.
+func WriteShallow(dir string, hashes []Hash) error {
+	p := filepath.Join(dir, "shallow")
+	if len(hashes) == 0 {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	hashes = append([]Hash{}, hashes...)
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i].Compare(hashes[j]) < 0 })
+
+	var b strings.Builder
+	for i, h := range hashes {
+		if i == 0 || h != hashes[i-1] {
+			b.WriteString(h.String() + "\n")
+		}
+	}
+
+	f, err := os.OpenFile(p+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("git: unable to lock %s: %w", p, err)
+	}
+	_, err = f.WriteString(b.String())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
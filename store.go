@@ -2,29 +2,84 @@ package git
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
+	"sort"
+	"sync"
+	"time"
 )
 
 // Store represents a collection of git objects that can be managed. This may
 // be loose objects, a packfile, or even a superset of Stores.
 type Store interface {
-	// Object resolves hash to reader of underlying data. Implemenations must
-	// resolve abbreviated hashes.
-	Object(hash string) (io.Reader, error)
+	// Object resolves hash to reader of underlying data.
+	Object(hash Hash) (io.Reader, error)
 
 	// Reader initializes a new Reader by the given hash. Implementations need
-	// to resolve abbreviated hashes and provide a proper io.Reader to Reader.
-	Reader(hash string, options ...func(*Reader)) (*Reader, error)
+	// to provide a proper io.Reader to Reader.
+	Reader(hash Hash, options ...func(*Reader)) (*Reader, error)
 
 	// Writer initializes a new Writer. Implementations must wrap Writer
 	// so that Writer.Close() flushes content to storage.
 	Writer() Writer
+
+	// Has reports whether the object exists without reading it.
+	Has(hash Hash) (bool, error)
+
+	// Stat returns the object's type and length, only inflating as much
+	// data as required to read the header.
+	Stat(hash Hash) (Type, int64, error)
+
+	// ForEach calls fn with the hash of every object in the Store. If fn
+	// returns an error, iteration stops and the error is returned.
+	ForEach(fn func(hash Hash) error) error
+}
+
+// PrefixResolver is implemented by Stores that resolve abbreviated object
+// names without visiting every object.
+type PrefixResolver interface {
+	// ResolvePrefix returns the name of the only object beginning with p.
+	ResolvePrefix(p Prefix) (Hash, error)
+}
+
+// ResolvePrefix returns the name of the only object of st beginning with p,
+// visiting every object unless st implements PrefixResolver. The returned
+// error wraps ErrNotExist if there is none, and is an AmbiguousError if
+// there are more. Prefixes of fewer than MinAbbrev digits are reported
+// as ErrAmbiguous.
+func ResolvePrefix(st Store, p Prefix) (Hash, error) {
+	if err := checkAbbrev(p); err != nil {
+		return Hash{}, err
+	}
+	if r, ok := st.(PrefixResolver); ok {
+		return r.ResolvePrefix(p)
+	}
+	if h, ok := p.Hash(); ok {
+		return h, exists(st, h)
+	}
+	return resolveMatches(p, st.ForEach)
+}
+
+// exists reports ErrNotExist unless st has the object by hash.
+func exists(st Store, hash Hash) error {
+	ok, err := st.Has(hash)
+	if err == nil && !ok {
+		err = fmt.Errorf("%w: %s", ErrNotExist, hash)
+	}
+	return err
+}
+
+// stat implements Store.Stat with Store.Reader.
+func stat(st Store, hash Hash) (Type, int64, error) {
+	r, err := st.Reader(hash)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.Close()
+	return r.Type(), r.Len(), nil
 }
 
 // DiskStore implements Store for git repositories on disk.
@@ -34,8 +89,22 @@ type Store interface {
 type DiskStore string
 
 // Dir traverses tree backwards to locate git directory.
-// Typically used to create DiskStore.
+//
+// Deprecated: Dir panics if x is not within a git repository. Use Open.
 func Dir(x string) string {
+	d, err := FindDir(x)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// FindDir traverses tree backwards to locate git directory.
+// Typically used to create DiskStore. The returned error wraps
+// ErrNotRepository if no git directory is found.
+//
+// FindDir neither follows .git files nor honors GIT_DIR; Open does.
+func FindDir(x string) (string, error) {
 	exists := func(args ...string) bool {
 		for _, arg := range args {
 			if _, err := os.Stat(arg); os.IsNotExist(err) {
@@ -48,86 +117,204 @@ func Dir(x string) string {
 	d := x
 	for {
 		if exists(filepath.Join(d, ".git")) {
-			return filepath.Join(d, ".git")
+			return filepath.Join(d, ".git"), nil
 		}
 		// TODO probably not a very good check
 		if exists(filepath.Join(d, "config"), filepath.Join(d, "HEAD"), filepath.Join(d, "objects")) {
-			return d // bare
+			return d, nil // bare
 		}
 		x = filepath.Dir(d)
 		if x == d || x == "/" || x == "." {
-			panic("not a git repository")
+			return "", fmt.Errorf("%w: %s", ErrNotRepository, d)
 		}
 		d = x
 	}
 }
 
 // Object resolves hash to reader of underlying data.
-func (st DiskStore) Object(hash string) (io.Reader, error) {
-	d := filepath.Join(string(st), "objects", hash[:2])
-	s := filepath.Join(d, hash[2:])
-	if f, err := os.Open(s); !os.IsNotExist(err) {
-		return f, err
+func (st DiskStore) Object(hash Hash) (io.Reader, error) {
+	f, err := os.Open(st.path(hash))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrNotExist, hash)
 	}
-	dir, err := os.Open(d)
 	if err != nil {
 		return nil, err
 	}
+	return f, nil
+}
+
+// path returns the file of the loose object by hash. The zero Hash has
+// none, such that opening it reports the file does not exist.
+func (st DiskStore) path(hash Hash) string {
+	s := hash.String()
+	if s == "" {
+		return ""
+	}
+	return filepath.Join(string(st), "objects", s[:2], s[2:])
+}
+
+// ResolvePrefix implements PrefixResolver, listing a single directory of
+// loose objects if p has at least two digits.
+func (st DiskStore) ResolvePrefix(p Prefix) (Hash, error) {
+	if p.Len() < 2 {
+		return ResolvePrefix(struct{ Store }{st}, p)
+	}
+	s := p.String()
+	dir, err := os.Open(filepath.Join(string(st), "objects", s[:2]))
+	if os.IsNotExist(err) {
+		return Hash{}, fmt.Errorf("%w: %s", ErrNotExist, p)
+	}
+	if err != nil {
+		return Hash{}, err
+	}
 	ns, err := dir.Readdirnames(-1)
+	dir.Close()
 	if err != nil {
-		return nil, err
+		return Hash{}, err
 	}
-	var match string
-	for _, e := range ns {
-		if strings.HasPrefix(e, hash[2:]) {
-			if match != "" {
-				return nil, errors.New("ambigious hash " + hash)
+	return resolveMatches(p, func(fn func(Hash) error) error {
+		for _, n := range ns {
+			if h, err := ParseHash(s[:2] + n); err == nil {
+				fn(h)
 			}
-			match = e
 		}
-	}
-	if match == "" {
-		return nil, fmt.Errorf("object hash %s does not exist", hash)
-	}
-	return os.Open(filepath.Join(d, match))
+		return nil
+	})
 }
 
 // Reader returns a new Reader for the given object hash or error otherwise.
 // The object's type and length are immediately available.
 // Callers must call Reader.Close() when done.
-func (st DiskStore) Reader(hash string, options ...func(*Reader)) (*Reader, error) {
+func (st DiskStore) Reader(hash Hash, options ...func(*Reader)) (*Reader, error) {
 	r, err := st.Object(hash)
 	if err != nil {
 		return nil, err
 	}
-	return NewReader(r, options...)
+	// only trees read with options depend on the object format
+	if len(options) > 0 {
+		format, err := repositoryFormat(string(st))
+		if err != nil {
+			r.(io.Closer).Close()
+			return nil, err
+		}
+		options = append([]func(*Reader){FormatReader(format)}, options...)
+	}
+	g, err := NewReader(r, options...)
+	if err != nil {
+		r.(io.Closer).Close()
+		return nil, err
+	}
+	g.rc = r.(io.Closer)
+	return g, nil
+}
+
+// Has reports whether the object exists.
+func (st DiskStore) Has(hash Hash) (bool, error) {
+	_, err := os.Stat(st.path(hash))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Stat returns the object's type and length.
+func (st DiskStore) Stat(hash Hash) (Type, int64, error) { return stat(st, hash) }
+
+// ForEach calls fn with the hash of every loose object.
+func (st DiskStore) ForEach(fn func(hash Hash) error) error {
+	objects := filepath.Join(string(st), "objects")
+	ds, err := ioutil.ReadDir(objects)
+	if err != nil {
+		return err
+	}
+	for _, d := range ds {
+		if !d.IsDir() || len(d.Name()) != 2 || !isHex(d.Name()) {
+			continue
+		}
+		f, err := os.Open(filepath.Join(objects, d.Name()))
+		if err != nil {
+			return err
+		}
+		ns, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		sort.Strings(ns)
+		for _, n := range ns {
+			h, err := ParseHash(d.Name() + n)
+			if err != nil {
+				continue
+			}
+			if err := fn(h); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isHex reports whether s only contains lowercase hexadecimal digits.
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
 }
 
-// Writer provides a new Writer that buffers data to a temporary file.
-// Callers must call Writer.Close() to flush data to storage.
+// Writer provides a new Writer that buffers data to a temporary file within
+// the objects directory. Callers must call Writer.Close() to flush data to
+// storage. If the temporary file can not be created, the error is reported
+// by every method of the returned Writer.
 func (st DiskStore) Writer() Writer {
-	tmp, err := ioutil.TempFile("", "gitdiskstore")
+	f, err := loadRepoFormat(string(st))
 	if err != nil {
-		panic(err)
+		return errWriter{err}
 	}
-	return &diskCloser{NewWriter(tmp), st, tmp}
+	tmp, err := ioutil.TempFile(filepath.Join(string(st), "objects"), "tmp_obj_")
+	if err != nil {
+		return errWriter{err}
+	}
+	return &diskCloser{newWriter(tmp, f.format, f.checkCollisions), st, tmp}
+}
+
+// ObjectFormat returns the object format of the repository, as configured
+// by extensions.objectFormat. The config is read once unless it changes. If
+// it can not be read, SHA-1 is returned and Reader and Writer report the
+// error.
+func (st DiskStore) ObjectFormat() ObjectFormat {
+	f, _ := repositoryFormat(string(st))
+	return f
 }
 
 // TempStore provides a DiskStore in a temporary directory. Callers are responsible
 // for removing the directory when done.
 //
-// TempStore may not provide a valid git repository. See Init source for layout.
+// TempStore may not provide a valid git repository. See InitRepo source for layout.
 //
-//  store := git.TempStore()
+//  store, err := git.TempStore()
+//  if err != nil {
+//  	log.Fatal(err)
+//  }
 //  defer os.RemoveAll(string(store))
-func TempStore() DiskStore {
+func TempStore() (DiskStore, error) {
 	name, err := ioutil.TempDir("", "gittempstore")
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	Init(name, false)
-	// since not bare, call Dir
-	return DiskStore(Dir(name))
+	if err := InitRepo(name, false); err != nil {
+		os.RemoveAll(name)
+		return "", err
+	}
+	// since not bare, call FindDir
+	d, err := FindDir(name)
+	if err != nil {
+		os.RemoveAll(name)
+		return "", err
+	}
+	return DiskStore(d), nil
 }
 
 // diskCloser wraps a Writer delivered by DiskStore to finalize writing
@@ -138,67 +325,84 @@ type diskCloser struct {
 	f  *os.File
 }
 
-func (g *diskCloser) Close() error {
+// Close moves the temporary file into place once synced to disk. Since the
+// temporary file is on the same filesystem, the rename is atomic and a crash
+// never leaves a truncated object under its final name. Writing an object
+// that already exists succeeds without modifying storage, but for refreshing
+// its modification time so that GC does not prune it.
+func (g *diskCloser) Close() (err error) {
+	defer func() {
+		if err != nil {
+			g.f.Close()
+			os.Remove(g.f.Name())
+		}
+	}()
+
 	if err := g.Writer.Close(); err != nil {
 		return err
 	}
-	hash := g.Writer.Hash()
-	p := filepath.Join(string(g.st), "objects", hash[:2], hash[2:])
-	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+	if err := g.f.Sync(); err != nil {
 		return err
 	}
-
-	// TODO "invalid cross-device link" with this in random cases
-	// even when not on a different partition
-	// os.Rename(g.f.Name(), p)
-
-	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0444)
-	if err != nil {
+	if err := g.f.Close(); err != nil {
 		return err
 	}
-	defer f.Close()
 
-	g.f.Seek(0, 0)
-	if _, err := io.Copy(f, g.f); err != nil {
+	p := g.st.path(g.Writer.Hash())
+	if _, err := os.Stat(p); err == nil {
+		now := time.Now()
+		os.Chtimes(p, now, now) // best effort, as of objects of other users
+		return os.Remove(g.f.Name())
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
 		return err
 	}
+	if err := os.Chmod(g.f.Name(), 0444); err != nil {
+		return err
+	}
+	if err := os.Rename(g.f.Name(), p); err != nil {
+		// a concurrent writer may have won the race on platforms
+		// where rename does not replace existing files.
+		if _, serr := os.Stat(p); serr == nil {
+			return os.Remove(g.f.Name())
+		}
+		return err
+	}
+	return syncDir(filepath.Dir(p))
+}
 
-	g.f.Close()
-	os.Remove(g.f.Name())
-
-	return nil
+// syncDir commits directory entries of name to stable storage.
+func syncDir(name string) error {
+	d, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
 
-// MemStore implements Store in-memory. No guarantees are ensured with thread safety
-// as the implementation relies on the uniqueness of SHA1 hash, in so far as a hash
-// collision could break concurrent access.
+// MemStore implements Store in-memory. MemStore is safe for concurrent use
+// by multiple goroutines. Writing an object that already exists succeeds
+// without modifying storage.
 func MemStore() Store {
-	m := make(map[string][]byte)
-	return memStore(m)
+	return &memStore{m: make(map[Hash][]byte)}
 }
 
-type memStore map[string][]byte
+type memStore struct {
+	mu sync.RWMutex
+	m  map[Hash][]byte
+}
 
-func (st memStore) Object(hash string) (io.Reader, error) {
-	if b, ok := st[hash]; ok {
+func (st *memStore) Object(hash Hash) (io.Reader, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if b, ok := st.m[hash]; ok {
 		return bytes.NewReader(b), nil
 	}
-	var match string
-	for k := range st {
-		if strings.HasPrefix(k, hash) {
-			if match != "" {
-				return nil, errors.New("ambigious hash " + hash)
-			}
-			match = k
-		}
-	}
-	if match == "" {
-		return nil, fmt.Errorf("object hash %s does not exist", hash)
-	}
-	return bytes.NewReader(st[match]), nil
+	return nil, fmt.Errorf("%w: %s", ErrNotExist, hash)
 }
 
-func (st memStore) Reader(hash string, options ...func(*Reader)) (*Reader, error) {
+func (st *memStore) Reader(hash Hash, options ...func(*Reader)) (*Reader, error) {
 	r, err := st.Object(hash)
 	if err != nil {
 		return nil, err
@@ -206,7 +410,32 @@ func (st memStore) Reader(hash string, options ...func(*Reader)) (*Reader, error
 	return NewReader(r, options...)
 }
 
-func (st memStore) Writer() Writer {
+func (st *memStore) Has(hash Hash) (bool, error) {
+	st.mu.RLock()
+	_, ok := st.m[hash]
+	st.mu.RUnlock()
+	return ok, nil
+}
+
+func (st *memStore) Stat(hash Hash) (Type, int64, error) { return stat(st, hash) }
+
+func (st *memStore) ForEach(fn func(hash Hash) error) error {
+	st.mu.RLock()
+	hs := make([]Hash, 0, len(st.m))
+	for k := range st.m {
+		hs = append(hs, k)
+	}
+	st.mu.RUnlock()
+	sort.Slice(hs, func(i, j int) bool { return hs[i].Compare(hs[j]) < 0 })
+	for _, h := range hs {
+		if err := fn(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *memStore) Writer() Writer {
 	g := &memCloser{st: st}
 	g.Writer = NewWriter(&g.buf)
 	return g
@@ -214,7 +443,7 @@ func (st memStore) Writer() Writer {
 
 type memCloser struct {
 	Writer
-	st  memStore
+	st  *memStore
 	buf bytes.Buffer
 }
 
@@ -223,9 +452,10 @@ func (g *memCloser) Close() error {
 		return err
 	}
 	hash := g.Writer.Hash()
-	if _, ok := g.st[hash]; ok {
-		return fmt.Errorf("object with hash %s exists", hash)
+	g.st.mu.Lock()
+	defer g.st.mu.Unlock()
+	if _, ok := g.st.m[hash]; !ok {
+		g.st.m[hash] = g.buf.Bytes()
 	}
-	g.st[hash] = g.buf.Bytes()
 	return nil
 }
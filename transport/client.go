@@ -0,0 +1,265 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"dasa.cc/git"
+	"dasa.cc/git/pktline"
+)
+
+// conn is a client's connection to a service of a remote repository.
+type conn interface {
+	// request sends body and returns a reader of the response. Over
+	// stateful connections, a response must be read before the next
+	// request and closing it has no effect.
+	request(ctx context.Context, body io.Reader) (io.ReadCloser, error)
+
+	// stateless reports whether each request is served independently, as
+	// over HTTP, and so must repeat the state of negotiation.
+	stateless() bool
+
+	Close() error
+}
+
+// dial connects to service of the repository at url, returning its
+// advertisement. Remotes other than http and https URLs are connected to
+// with t, or by running git's commands for the path of url if t is nil.
+// Protocol version 2 is requested if version is 2.
+func dial(ctx context.Context, url, service string, version int, client *http.Client, t Transport) (conn, *advertisement, error) {
+	if t == nil && !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		t = &Exec{Path: strings.TrimPrefix(url, "file://")}
+	}
+	if t == nil {
+		c := &httpConn{client: client, url: strings.TrimSuffix(url, "/"), service: service}
+		if c.client == nil {
+			c.client = http.DefaultClient
+		}
+		adv, err := c.advertise(ctx, version)
+		if err != nil {
+			return nil, nil, err
+		}
+		return c, adv, nil
+	}
+
+	rwc, err := t.Connect(ctx, service, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &pipeConn{rwc: rwc}
+	adv, err := readAdvertisement(pktline.NewDecoder(rwc), service)
+	if err != nil {
+		rwc.Close()
+		return nil, nil, err
+	}
+	c.version = adv.version
+	return c, adv, nil
+}
+
+// advertisement is a remote's reference advertisement, or capability
+// advertisement of protocol v2.
+type advertisement struct {
+	version int
+	refs    []git.Ref
+	caps    capabilities
+}
+
+// readAdvertisement reads an advertisement of service up to a flush packet.
+// A leading service line, as sent over HTTP, is skipped.
+func readAdvertisement(dec *pktline.Decoder, service string) (*advertisement, error) {
+	adv := &advertisement{}
+	kind, line, err := readLine(dec)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(line, "# service=") {
+		if line != "# service="+service {
+			return nil, protocolf("unexpected service line %q", line)
+		}
+		if kind, _, err := dec.Decode(); err != nil || kind != pktline.Flush {
+			return nil, protocolf("expected flush after service line")
+		}
+		if kind, line, err = readLine(dec); err != nil {
+			return nil, err
+		}
+	}
+
+	switch line {
+	case "version 2":
+		adv.version = 2
+		for {
+			if kind, line, err = readLine(dec); err != nil {
+				return nil, err
+			}
+			if kind == pktline.Flush {
+				return adv, nil
+			}
+			adv.caps = append(adv.caps, line)
+		}
+	case "version 1":
+		adv.version = 1
+		if kind, line, err = readLine(dec); err != nil {
+			return nil, err
+		}
+	}
+
+	for ; kind != pktline.Flush; kind, line, err = readLine(dec) {
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, "ERR ") {
+			return nil, &pktline.RemoteError{Message: line[4:]}
+		}
+		if i := strings.IndexByte(line, 0); i != -1 {
+			adv.caps = parseCapabilities(line[i+1:])
+			line = line[:i]
+		}
+		fs := strings.Fields(line)
+		if len(fs) != 2 {
+			return nil, protocolf("invalid reference advertisement %q", line)
+		}
+		h, ok := parseHash(fs[0])
+		if !ok {
+			return nil, protocolf("invalid reference advertisement %q", line)
+		}
+		if fs[1] == "capabilities^{}" {
+			continue
+		}
+		adv.refs = append(adv.refs, git.Ref{Name: fs[1], Hash: h})
+	}
+
+	// symbolic references are advertised as capabilities
+	for _, c := range adv.caps {
+		if !strings.HasPrefix(c, "symref=") {
+			continue
+		}
+		kv := strings.SplitN(c[7:], ":", 2)
+		for i := range adv.refs {
+			if len(kv) == 2 && adv.refs[i].Name == kv[0] {
+				adv.refs[i].Target = kv[1]
+			}
+		}
+	}
+	return adv, nil
+}
+
+// httpConn makes stateless requests to a smart HTTP remote.
+type httpConn struct {
+	client  *http.Client
+	url     string
+	service string
+	version int
+}
+
+func (c *httpConn) do(req *http.Request, contentType string) (io.ReadCloser, error) {
+	req.Header.Set("User-Agent", "git/"+Agent)
+	if c.version == 2 {
+		req.Header.Set("Git-Protocol", "version=2")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("transport: %s %s: %s", req.Method, req.URL.Redacted(), resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != contentType {
+		resp.Body.Close()
+		return nil, fmt.Errorf("transport: %s: unexpected content type %q; not a smart HTTP server", req.URL.Redacted(), ct)
+	}
+	return resp.Body, nil
+}
+
+// advertise requests the advertisement of the service, in protocol v2 if
+// version is 2 and the remote supports it.
+func (c *httpConn) advertise(ctx context.Context, version int) (*advertisement, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url+"/info/refs?service="+c.service, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.version = version
+	body, err := c.do(req, "application/x-"+c.service+"-advertisement")
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	adv, err := readAdvertisement(pktline.NewDecoder(body), c.service)
+	if err != nil {
+		return nil, err
+	}
+	c.version = adv.version
+	return adv, nil
+}
+
+func (c *httpConn) request(ctx context.Context, body io.Reader) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url+"/"+c.service, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-"+c.service+"-request")
+	req.Header.Set("Accept", "application/x-"+c.service+"-result")
+	return c.do(req, "application/x-"+c.service+"-result")
+}
+
+func (c *httpConn) stateless() bool { return true }
+
+func (c *httpConn) Close() error { return nil }
+
+// pipeConn is a stateful connection to a service over a pair of pipes.
+// Requests are written concurrently with reading responses, as a service
+// may respond before reading all of a request.
+type pipeConn struct {
+	rwc     io.ReadWriteCloser
+	version int
+	sent    bool
+	closed  bool
+	done    chan error
+}
+
+// wait waits for the previous request to be written.
+func (c *pipeConn) wait() error {
+	if c.done == nil {
+		return nil
+	}
+	err := <-c.done
+	c.done = nil
+	return err
+}
+
+func (c *pipeConn) request(ctx context.Context, body io.Reader) (io.ReadCloser, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	c.sent = true
+	c.done = make(chan error, 1)
+	go func() {
+		_, err := io.Copy(c.rwc, body)
+		c.done <- err
+	}()
+	return ioutil.NopCloser(c.rwc), nil
+}
+
+func (c *pipeConn) stateless() bool { return false }
+
+// Close ends the session, first sending a flush packet if no request was
+// made, as the original protocol requires of clients that want nothing.
+func (c *pipeConn) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if !c.sent && c.version != 2 {
+		pktline.NewEncoder(c.rwc).Flush()
+	}
+	err := c.rwc.Close()
+	if werr := c.wait(); err == nil {
+		err = werr
+	}
+	return err
+}
@@ -0,0 +1,580 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"dasa.cc/git"
+	"dasa.cc/git/pktline"
+)
+
+// ErrNonFastForward is returned when fetching would rewind a local reference
+// without a forcing refspec. Other references are still updated.
+var ErrNonFastForward = errors.New("transport: non-fast-forward update rejected")
+
+// DefaultRefSpec is used by Fetch if no refspecs are given.
+const DefaultRefSpec = "+refs/heads/*:refs/remotes/origin/*"
+
+// FetchOptions configures Fetch. The zero value uses defaults.
+type FetchOptions struct {
+	// Progress receives progress messages sent by the remote. If nil,
+	// the remote is asked not to send progress.
+	Progress io.Writer
+
+	// HTTPClient is used for http and https URLs. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// ProtocolVersion is the wire protocol version requested: 1 for the
+	// original protocol or 2. If zero, version 2 is requested and the
+	// original protocol used with remotes that do not support it.
+	ProtocolVersion int
+
+	// Transport, if set, connects to the remote in place of url, such as
+	// to a Store served in process. Otherwise, remotes other than http
+	// and https URLs are local paths served by running git-upload-pack.
+	Transport Transport
+
+	// Shallow lists the shallow commits of a shallow local repository, as
+	// returned by git.ReadShallow, whose parents are not present.
+	Shallow []git.Hash
+
+	// Depth, if positive, limits history fetched to that many commits from
+	// the tips of wanted references, deepening or shortening history of
+	// a shallow repository.
+	Depth int
+
+	// ShallowSince, if set, limits history fetched to commits made since.
+	ShallowSince time.Time
+
+	// Filter omits objects for a partial clone. If st implements
+	// git.PackIndexer, the pack received is marked as from a promisor
+	// remote.
+	Filter git.Filter
+}
+
+// FetchResult reports the outcome of Fetch.
+type FetchResult struct {
+	// Refs are the references advertised by the remote. Symbolic
+	// references, such as HEAD, have their Target set.
+	Refs []git.Ref
+
+	// Updates are the changes applied to local references.
+	Updates []git.RefUpdate
+
+	// Shallow lists the shallow commits of the local repository after
+	// fetching, to be written with git.WriteShallow.
+	Shallow []git.Hash
+}
+
+// Fetch retrieves objects and references matching refspecs from the
+// repository at url, writing objects to st. Local references in refs are
+// used to negotiate objects in common and, for refspecs with a destination,
+// are updated. If refspecs is empty, DefaultRefSpec is used.
+//
+// Received packs are kept whole if st implements git.PackIndexer and
+// unpacked into st otherwise.
+func Fetch(ctx context.Context, url string, st git.Store, refs git.RefStore, refspecs []string, opts *FetchOptions) (*FetchResult, error) {
+	if len(refspecs) == 0 {
+		refspecs = []string{DefaultRefSpec}
+	}
+	specs, err := git.ParseRefSpecs(refspecs)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts == nil {
+		opts = &FetchOptions{}
+	}
+	c, adv, err := dialUploadPack(ctx, url, opts, refPrefixes(specs))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	res := &FetchResult{Refs: adv.refs, Shallow: opts.Shallow}
+
+	// wanted references and their local destinations; with protocol v2,
+	// exact names are requested by name to fetch their current value
+	refInWant := adv.version == 2 && adv.caps.feature("fetch", "ref-in-want")
+	var (
+		wants    []git.Hash
+		wantRefs []string
+		updates  []localUpdate
+		seen     = make(map[string]bool)
+		wanted   = make(map[git.Hash]bool)
+	)
+	for _, ref := range adv.refs {
+		if strings.HasSuffix(ref.Name, "^{}") || git.ExcludedRef(specs, ref.Name) {
+			continue
+		}
+		for _, spec := range specs {
+			dst, ok := spec.Match(ref.Name)
+			if !ok || spec.Negative {
+				continue
+			}
+			// symbolic references are fetched as the references they
+			// name, unless matched along with their targets
+			if _, ok := spec.Match(ref.Target); ok && ref.Target != "" {
+				continue
+			}
+			if dst != "" {
+				updates = append(updates, localUpdate{git.RefUpdate{Name: dst, New: ref.Hash}, ref.Name, spec.Force})
+			}
+			if seen[ref.Name] {
+				continue
+			}
+			seen[ref.Name] = true
+			// deepening history requires wanting objects already present
+			if ok, err := st.Has(ref.Hash); err != nil {
+				return nil, err
+			} else if ok && !opts.deepening() {
+				continue
+			}
+			if refInWant && ref.Target == "" && !strings.Contains(spec.Src, "*") {
+				wantRefs = append(wantRefs, ref.Name)
+			} else if !wanted[ref.Hash] {
+				wanted[ref.Hash] = true
+				wants = append(wants, ref.Hash)
+			}
+		}
+	}
+
+	if adv.version == 2 && (len(wants) > 0 || len(wantRefs) > 0) {
+		var wantedRefs map[string]git.Hash
+		wantedRefs, res.Shallow, err = fetchPackV2(ctx, c, adv.caps, wants, wantRefs, st, refs, opts)
+		if err != nil {
+			return nil, err
+		}
+		for i, u := range updates {
+			if h, ok := wantedRefs[u.src]; ok {
+				updates[i].New = h
+			}
+		}
+	} else if len(wants) > 0 {
+		if res.Shallow, err = fetchPack(ctx, c, adv.caps, wants, st, refs, opts); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Close(); err != nil {
+		return nil, err
+	}
+	if refs == nil {
+		return res, nil
+	}
+	res.Updates, err = applyUpdates(st, refs, updates)
+	return res, err
+}
+
+// ListRefs returns references of the repository at url with any of
+// prefixes, or every reference if prefixes is empty. With protocol v2,
+// references are filtered by the remote.
+func ListRefs(ctx context.Context, url string, prefixes []string, opts *FetchOptions) ([]git.Ref, error) {
+	if opts == nil {
+		opts = &FetchOptions{}
+	}
+	c, adv, err := dialUploadPack(ctx, url, opts, prefixes)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Close(); err != nil {
+		return nil, err
+	}
+	if adv.version == 2 || len(prefixes) == 0 {
+		return adv.refs, nil
+	}
+	var refs []git.Ref
+	for _, ref := range adv.refs {
+		for _, p := range prefixes {
+			if strings.HasPrefix(ref.Name, p) {
+				refs = append(refs, ref)
+				break
+			}
+		}
+	}
+	return refs, nil
+}
+
+// ObjectInfo returns sizes of objects in the repository at url without
+// fetching them. Sizes of objects the remote does not have are -1. The
+// remote must support the object-info command of protocol v2.
+func ObjectInfo(ctx context.Context, url string, hashes []git.Hash, opts *FetchOptions) ([]int64, error) {
+	if opts == nil {
+		opts = &FetchOptions{}
+	}
+	c, adv, err := dialUploadPack(ctx, url, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if adv.version != 2 || !adv.caps.has("object-info") {
+		return nil, fmt.Errorf("%w: object-info", ErrUnsupported)
+	}
+	sizes, err := objectInfo(ctx, c, adv.caps, hashes)
+	if err != nil {
+		return nil, err
+	}
+	return sizes, c.Close()
+}
+
+// dialUploadPack connects to git-upload-pack, listing references with
+// prefixes if the remote speaks protocol v2.
+func dialUploadPack(ctx context.Context, url string, opts *FetchOptions, prefixes []string) (conn, *advertisement, error) {
+	version := opts.ProtocolVersion
+	if version == 0 {
+		version = 2
+	}
+	c, adv, err := dial(ctx, url, "git-upload-pack", version, opts.HTTPClient, opts.Transport)
+	if err != nil {
+		return nil, nil, err
+	}
+	if adv.version == 2 {
+		if adv.refs, err = lsRefs(ctx, c, adv.caps, prefixes); err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+	}
+	return c, adv, nil
+}
+
+// refPrefixes returns prefixes of references matched by specs.
+func refPrefixes(specs []git.RefSpec) []string {
+	prefixes := []string{"HEAD"}
+	for _, spec := range specs {
+		if !spec.Negative {
+			prefixes = append(prefixes, strings.SplitN(spec.Src, "*", 2)[0])
+		}
+	}
+	return prefixes
+}
+
+// localUpdate is a local reference update that may be forced.
+type localUpdate struct {
+	git.RefUpdate
+	src   string
+	force bool
+}
+
+// applyUpdates applies fast-forward and forced updates atomically, reporting
+// ErrNonFastForward for others. References are not updated to objects
+// missing from st, as when the remote sent an incomplete pack.
+func applyUpdates(st git.Store, refs git.RefStore, updates []localUpdate) ([]git.RefUpdate, error) {
+	var (
+		apply    []git.RefUpdate
+		rejected []string
+	)
+	for _, u := range updates {
+		cur, err := refs.Ref(u.Name)
+		if err != nil && !errors.Is(err, git.ErrRefNotExist) {
+			return nil, err
+		}
+		if cur.Hash == u.New {
+			continue
+		}
+		if ok, err := st.Has(u.New); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, fmt.Errorf("%w: %s of %s was not received", git.ErrCorrupt, u.New, u.src)
+		}
+		u.Old = cur.Hash
+		if u.Old == (git.Hash{}) {
+			u.Old = u.New.ObjectFormat().ZeroHash()
+		} else if !u.force {
+			if ok, err := git.IsAncestor(st, u.Old, u.New); err != nil || !ok {
+				rejected = append(rejected, u.Name)
+				continue
+			}
+		}
+		apply = append(apply, u.RefUpdate)
+	}
+	if len(apply) > 0 {
+		if err := refs.UpdateRefs(apply...); err != nil {
+			return nil, err
+		}
+	}
+	if len(rejected) > 0 {
+		return apply, fmt.Errorf("%w: %s", ErrNonFastForward, strings.Join(rejected, ", "))
+	}
+	return apply, nil
+}
+
+// maxRounds limits negotiation before giving up on finding more in common.
+const maxRounds = 8
+
+// fetchPack negotiates objects in common and receives the pack sent in
+// response, returning the shallow commits after fetching. Over stateful
+// connections, wants are sent once and haves acknowledged in earlier rounds
+// are not repeated.
+func fetchPack(ctx context.Context, c conn, remote capabilities, wants []git.Hash, st git.Store, refs git.RefStore, opts *FetchOptions) ([]git.Hash, error) {
+	if err := checkShallow(opts, remote.has); err != nil {
+		return nil, err
+	}
+	progress := opts.Progress
+	caps := capabilities{"agent=" + Agent}
+	for _, c := range []string{"multi_ack_detailed", "ofs-delta"} {
+		if remote.has(c) {
+			caps = append(caps, c)
+		}
+	}
+	switch {
+	case remote.has("side-band-64k"):
+		caps = append(caps, "side-band-64k")
+	case remote.has("side-band"):
+		caps = append(caps, "side-band")
+	}
+	if progress == nil && remote.has("no-progress") {
+		caps = append(caps, "no-progress")
+	}
+	if len(opts.Shallow) > 0 || opts.Depth > 0 {
+		caps = append(caps, "shallow")
+	}
+	if !opts.ShallowSince.IsZero() {
+		caps = append(caps, "deepen-since")
+	}
+	if !opts.Filter.IsZero() {
+		caps = append(caps, "filter")
+	}
+
+	shallow := newShallowSet(opts.Shallow)
+	neg, err := newNegotiator(st, refs, shallow)
+	if err != nil {
+		return nil, err
+	}
+	// responses to requests with wants begin with a shallow update when
+	// deepening
+	sentWants, update := false, false
+	readUpdate := func(dec *pktline.Decoder) error {
+		if !update {
+			return nil
+		}
+		update = false
+		return readShallowUpdate(dec, shallow)
+	}
+	request := func(haves []git.Hash, done bool) io.Reader {
+		buf := new(bytes.Buffer)
+		enc := pktline.NewEncoder(buf)
+		if c.stateless() || !sentWants {
+			for i, h := range wants {
+				if i == 0 {
+					enc.Encodef("want %s %s\n", h, caps)
+				} else {
+					enc.Encodef("want %s\n", h)
+				}
+			}
+			for _, a := range shallowArgs(opts) {
+				enc.Encodef("%s\n", a)
+			}
+			enc.Flush()
+			sentWants, update = true, opts.deepening()
+		}
+		if c.stateless() {
+			for _, h := range neg.common {
+				enc.Encodef("have %s\n", h)
+			}
+		}
+		for _, h := range haves {
+			enc.Encodef("have %s\n", h)
+		}
+		if done {
+			enc.Encodef("done\n")
+		} else {
+			enc.Flush()
+		}
+		return buf
+	}
+
+	// negotiate rounds of haves while the remote acknowledges each
+	if remote.has("multi_ack_detailed") {
+		for round := 0; round < maxRounds && !neg.ready; round++ {
+			haves, err := neg.next(32 << uint(round))
+			if err != nil {
+				return nil, err
+			}
+			if len(haves) == 0 {
+				break
+			}
+			body, err := c.request(ctx, request(haves, false))
+			if err != nil {
+				return nil, err
+			}
+			dec := pktline.NewDecoder(body)
+			if err = readUpdate(dec); err == nil {
+				err = neg.readAcks(dec)
+			}
+			body.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var haves []git.Hash
+	if !remote.has("multi_ack_detailed") {
+		if haves, err = neg.next(256); err != nil {
+			return nil, err
+		}
+	}
+	body, err := c.request(ctx, request(haves, true))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	dec := pktline.NewDecoder(body)
+	if err := readUpdate(dec); err != nil {
+		return nil, err
+	}
+	if err := receivePack(dec, body, caps, st, opts); err != nil {
+		return nil, err
+	}
+	return shallow.list(), nil
+}
+
+// receivePack reads the final acknowledgement and the pack that follows
+// from r, read through dec.
+func receivePack(dec *pktline.Decoder, r io.Reader, caps capabilities, st git.Store, opts *FetchOptions) error {
+	for {
+		_, line, err := readLine(dec)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(line, "ERR ") {
+			return &pktline.RemoteError{Message: line[4:]}
+		}
+		if line == "NAK" || (strings.HasPrefix(line, "ACK ") && len(strings.Fields(line)) == 2) {
+			break
+		}
+		if !strings.HasPrefix(line, "ACK ") {
+			return protocolf("unexpected %q before pack", line)
+		}
+	}
+
+	var pack io.Reader = r
+	if caps.has("side-band-64k") || caps.has("side-band") {
+		pack = pktline.NewDemuxer(dec, opts.Progress)
+	}
+	return storePack(pack, st, opts)
+}
+
+// storePack reads a pack into st, indexing it whole if st is a
+// git.PackIndexer.
+func storePack(pack io.Reader, st git.Store, opts *FetchOptions) error {
+	if pi, ok := st.(git.PackIndexer); ok {
+		if err := pi.IndexPack(pack, !opts.Filter.IsZero()); err != nil {
+			return err
+		}
+	} else if _, err := git.UnpackObjects(pack, st); err != nil {
+		return err
+	}
+	// consume remainder such as the side-band flush
+	_, err := io.Copy(ioutil.Discard, pack)
+	return err
+}
+
+// negotiator enumerates local commits to offer as haves, skipping ancestors
+// of commits the remote has in common and of shallow commits.
+type negotiator struct {
+	st      git.Store
+	queue   []git.Hash
+	seen    map[git.Hash]bool
+	skip    map[git.Hash]bool
+	shallow shallowSet
+	common  []git.Hash
+	ready   bool
+}
+
+func newNegotiator(st git.Store, refs git.RefStore, shallow shallowSet) (*negotiator, error) {
+	n := &negotiator{st: st, seen: make(map[git.Hash]bool), skip: make(map[git.Hash]bool), shallow: shallow}
+	if refs == nil {
+		return n, nil
+	}
+	rs, err := refs.Refs()
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range rs {
+		if ok, _ := st.Has(ref.Hash); ok && !n.seen[ref.Hash] {
+			n.seen[ref.Hash] = true
+			n.queue = append(n.queue, ref.Hash)
+		}
+	}
+	return n, nil
+}
+
+// next returns up to max haves not yet offered.
+func (n *negotiator) next(max int) ([]git.Hash, error) {
+	var haves []git.Hash
+	for len(n.queue) > 0 && len(haves) < max {
+		h := n.queue[0]
+		n.queue = n.queue[1:]
+		skip := n.skip[h]
+		if !skip {
+			haves = append(haves, h)
+		}
+		h, t, err := git.Peel(n.st, h)
+		if err != nil {
+			return nil, err
+		}
+		if t != git.Commit || n.shallow[h] {
+			continue
+		}
+		c, err := git.LoadCommit(n.st, h)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range c.Parents {
+			if skip {
+				n.skip[p] = true
+			}
+			if !n.seen[p] {
+				n.seen[p] = true
+				n.queue = append(n.queue, p)
+			}
+		}
+	}
+	return haves, nil
+}
+
+// readAcks reads acknowledgements of a negotiation round up to NAK.
+func (n *negotiator) readAcks(dec *pktline.Decoder) error {
+	for {
+		_, line, err := readLine(dec)
+		if err != nil {
+			return err
+		}
+		if line == "NAK" {
+			return nil
+		}
+		if strings.HasPrefix(line, "ERR ") {
+			return &pktline.RemoteError{Message: line[4:]}
+		}
+		fs := strings.Fields(line)
+		if len(fs) < 2 || fs[0] != "ACK" {
+			return protocolf("unexpected %q during negotiation", line)
+		}
+		h, ok := parseHash(fs[1])
+		if !ok {
+			return protocolf("unexpected %q during negotiation", line)
+		}
+		if len(fs) == 3 && fs[2] == "ready" {
+			n.ready = true
+		}
+		n.ack(h)
+	}
+}
+
+// ack marks h in common so its ancestors are no longer offered.
+func (n *negotiator) ack(h git.Hash) {
+	for _, c := range n.common {
+		if c == h {
+			return
+		}
+	}
+	n.common = append(n.common, h)
+	n.skip[h] = true
+}
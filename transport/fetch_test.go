@@ -0,0 +1,326 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dasa.cc/git"
+)
+
+func TestFetch(t *testing.T) {
+	srvst, srvrefs := git.MemStore(), git.MemRefs()
+	c1 := commit(t, srvst, "first")
+	update(t, srvrefs, "refs/heads/master", git.ZeroHash, c1)
+	tag := &git.TagObject{
+		Object:  c1,
+		Type:    git.Commit,
+		Tag:     "v1",
+		Tagger:  "Gopher <gopher@example.com> 1500000000 +0000",
+		Message: "v1\n",
+	}
+	v1 := writeObject(t, srvst, git.Tag, tag.Bytes())
+	update(t, srvrefs, "refs/tags/v1", git.ZeroHash, v1)
+
+	srv := httptest.NewServer(&Handler{Store: srvst, Refs: srvrefs})
+	defer srv.Close()
+
+	ctx := context.Background()
+	st, refs := git.MemStore(), git.MemRefs()
+	progress := new(bytes.Buffer)
+	res, err := Fetch(ctx, srv.URL, st, refs, []string{DefaultRefSpec, "refs/tags/*:refs/tags/*"}, &FetchOptions{Progress: progress})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Refs) == 0 || res.Refs[0].Name != "HEAD" || res.Refs[0].Target != "refs/heads/master" {
+		t.Fatalf("Refs => %+v, want symbolic HEAD first", res.Refs)
+	}
+	if len(res.Updates) != 2 {
+		t.Fatalf("Updates => %+v, want 2", res.Updates)
+	}
+	if progress.Len() == 0 {
+		t.Fatal("no progress reported")
+	}
+	check := func(name string, want git.Hash) {
+		t.Helper()
+		ref, err := refs.Ref(name)
+		if err != nil || ref.Hash != want {
+			t.Fatalf("Ref(%s) => %+v, %v, want %s", name, ref, err, want)
+		}
+	}
+	check("refs/remotes/origin/master", c1)
+	check("refs/tags/v1", v1)
+	if _, err := git.Reachable(st, []git.Hash{v1}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// incremental fetch
+	c2 := commit(t, srvst, "second", c1)
+	update(t, srvrefs, "refs/heads/master", c1, c2)
+	if _, err := Fetch(ctx, srv.URL, st, refs, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	check("refs/remotes/origin/master", c2)
+	if _, err := git.Reachable(st, []git.Hash{c2}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing to fetch
+	res, err = Fetch(ctx, srv.URL, st, refs, nil, nil)
+	if err != nil || len(res.Updates) != 0 {
+		t.Fatalf("Fetch => %+v, %v, want no updates", res, err)
+	}
+
+	// rewound branches require force
+	c3 := commit(t, srvst, "third", c1)
+	update(t, srvrefs, "refs/heads/master", c2, c3)
+	update(t, srvrefs, "refs/heads/topic", git.ZeroHash, c3)
+	res, err = Fetch(ctx, srv.URL, st, refs, []string{"refs/heads/*:refs/remotes/origin/*"}, nil)
+	if !errors.Is(err, ErrNonFastForward) {
+		t.Fatalf("Fetch => %v, want ErrNonFastForward", err)
+	}
+	if len(res.Updates) != 1 || res.Updates[0].Name != "refs/remotes/origin/topic" {
+		t.Fatalf("Updates => %+v, want origin/topic only", res.Updates)
+	}
+	check("refs/remotes/origin/master", c2)
+	if _, err := Fetch(ctx, srv.URL, st, refs, []string{"+refs/heads/master:refs/remotes/origin/master"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	check("refs/remotes/origin/master", c3)
+
+	// negative refspecs exclude references
+	refs = git.MemRefs()
+	res, err = Fetch(ctx, srv.URL, st, refs, []string{"+refs/heads/*:refs/remotes/origin/*", "^refs/heads/topic"}, nil)
+	if err != nil || len(res.Updates) != 1 || res.Updates[0].Name != "refs/remotes/origin/master" {
+		t.Fatalf("Fetch => %+v, %v, want origin/master only", res, err)
+	}
+
+	// symbolic references are fetched as the references they name
+	for _, version := range []int{1, 2} {
+		st, refs := git.MemStore(), git.MemRefs()
+		res, err := Fetch(ctx, srv.URL, st, refs, []string{"HEAD:refs/remotes/origin/HEAD"}, &FetchOptions{ProtocolVersion: version})
+		if err != nil || len(res.Updates) != 1 {
+			t.Fatalf("v%d: Fetch(HEAD) => %+v, %v", version, res, err)
+		}
+		check := func(name string, want git.Hash) {
+			t.Helper()
+			ref, err := refs.Ref(name)
+			if err != nil || ref.Hash != want {
+				t.Fatalf("v%d: Ref(%s) => %+v, %v, want %s", version, name, ref, err, want)
+			}
+		}
+		check("refs/remotes/origin/HEAD", c3)
+		if _, err := git.Reachable(st, []git.Hash{c3}, nil); err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+	}
+
+	// references are not updated to objects not received
+	missing := commit(t, git.MemStore(), "missing")
+	u := localUpdate{git.RefUpdate{Name: "refs/remotes/origin/missing", New: missing}, "refs/heads/missing", false}
+	if _, err := applyUpdates(st, refs, []localUpdate{u}); !errors.Is(err, git.ErrCorrupt) {
+		t.Fatalf("applyUpdates(missing) => %v, want ErrCorrupt", err)
+	}
+	if _, err := refs.Ref(u.Name); !errors.Is(err, git.ErrRefNotExist) {
+		t.Fatalf("Ref(%s) => %v, want ErrRefNotExist", u.Name, err)
+	}
+
+	// new references are created from the zero hash of the object format
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	run(t, dir, "git", "init", "-q", "--bare", "--object-format=sha256")
+	u.New = writeObject(t, git.DiskStore(dir), git.Blob, []byte("sha256\n"))
+	up, err := applyUpdates(git.DiskStore(dir), git.MemRefs(), []localUpdate{u})
+	if err != nil || len(up) != 1 || up[0].Old != git.SHA256.ZeroHash() {
+		t.Fatalf("applyUpdates(sha256) => %+v, %v, want old %s", up, err, git.SHA256.ZeroHash())
+	}
+}
+
+func TestFetchDiskStore(t *testing.T) {
+	src := tempDir(t)
+	defer os.RemoveAll(src)
+	run(t, src, "git", "init", "-q")
+	for i := 0; i < 3; i++ {
+		ioutil.WriteFile(filepath.Join(src, "file.txt"), bytes.Repeat([]byte("data\n"), i+1), 0644)
+		run(t, src, "git", "add", "file.txt")
+		run(t, src, "git", "-c", "user.name=Gopher", "-c", "user.email=gopher@example.com", "commit", "-q", "-m", fmt.Sprint(i))
+	}
+	run(t, src, "git", "repack", "-q", "-a", "-d")
+	want := run(t, src, "git", "rev-parse", "HEAD")
+
+	gitdir := filepath.Join(src, ".git")
+	srv := httptest.NewServer(&Handler{Store: git.PackStore(gitdir), Refs: git.DiskRefs(gitdir)})
+	defer srv.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	run(t, dir, "git", "init", "-q", "--bare")
+	if _, err := Fetch(context.Background(), srv.URL, git.DiskStore(dir), git.DiskRefs(dir), []string{"refs/heads/*:refs/heads/*"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if have := run(t, dir, "git", "rev-parse", "master"); have != want {
+		t.Fatalf("master => %s, want %s", have, want)
+	}
+	run(t, dir, "git", "fsck", "--strict")
+}
+
+// gitBackend serves the repository at dir with git http-backend.
+func gitBackend(t *testing.T, dir string) *httptest.Server {
+	out, err := exec.Command("git", "--exec-path").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(&cgi.Handler{
+		Path: filepath.Join(strings.TrimSpace(string(out)), "git-http-backend"),
+		Env:  []string{"GIT_PROJECT_ROOT=" + dir, "GIT_HTTP_EXPORT_ALL=1"},
+	})
+}
+
+func TestFetchGitBackend(t *testing.T) {
+	src := tempDir(t)
+	defer os.RemoveAll(src)
+	gitc := func(args ...string) string {
+		return run(t, src, "git", append([]string{"-c", "user.name=Gopher", "-c", "user.email=gopher@example.com"}, args...)...)
+	}
+	gitc("init", "-q", "-b", "main")
+	gitc("config", "uploadpack.allowRefInWant", "true")
+	gitc("config", "transfer.advertiseObjectInfo", "true")
+	for i := 0; i < 3; i++ {
+		ioutil.WriteFile(filepath.Join(src, "file.txt"), bytes.Repeat([]byte("data\n"), i+1), 0644)
+		gitc("add", "file.txt")
+		gitc("commit", "-q", "-m", fmt.Sprint(i))
+		gitc("branch", fmt.Sprintf("topic%d", i))
+	}
+	gitc("tag", "-a", "-m", "v1", "v1")
+	head := gitc("rev-parse", "HEAD")
+
+	srv := gitBackend(t, src)
+	defer srv.Close()
+	ctx := context.Background()
+
+	for _, version := range []int{1, 2} {
+		st, refs := git.MemStore(), git.MemRefs()
+		opts := &FetchOptions{ProtocolVersion: version}
+		res, err := Fetch(ctx, srv.URL+"/.git", st, refs, []string{"refs/heads/main:refs/heads/main", "refs/tags/*:refs/tags/*"}, opts)
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if len(res.Updates) != 2 {
+			t.Fatalf("v%d: Updates => %+v, want 2", version, res.Updates)
+		}
+		if ref, err := refs.Ref("refs/heads/main"); err != nil || ref.Hash.String() != head {
+			t.Fatalf("v%d: main => %+v, %v, want %s", version, ref, err, head)
+		}
+		if _, err := git.Reachable(st, []git.Hash{mustHash(t, head)}, nil); err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+
+		refs2, err := ListRefs(ctx, srv.URL+"/.git", []string{"refs/heads/topic"}, opts)
+		if err != nil || len(refs2) != 3 {
+			t.Fatalf("v%d: ListRefs => %+v, %v, want 3 topics", version, refs2, err)
+		}
+	}
+
+	blob := gitc("rev-parse", "HEAD:file.txt")
+	sizes, err := ObjectInfo(ctx, srv.URL+"/.git", []git.Hash{mustHash(t, blob), mustHash(t, strings.Repeat("1", 40))}, nil)
+	if err != nil || len(sizes) != 2 || sizes[0] != 15 || sizes[1] != -1 {
+		t.Fatalf("ObjectInfo => %v, %v, want [15 -1]", sizes, err)
+	}
+	if _, err := ObjectInfo(ctx, srv.URL+"/.git", []git.Hash{mustHash(t, blob)}, &FetchOptions{ProtocolVersion: 1}); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("ObjectInfo v1 => %v, want ErrUnsupported", err)
+	}
+}
+
+func TestHandlerV2(t *testing.T) {
+	st, refs := git.MemStore(), git.MemRefs()
+	c1 := commit(t, st, "first")
+	update(t, refs, "refs/heads/master", git.ZeroHash, c1)
+	for i := 0; i < 3; i++ {
+		update(t, refs, fmt.Sprintf("refs/heads/topic%d", i), git.ZeroHash, commit(t, st, fmt.Sprint(i), c1))
+	}
+	srv := httptest.NewServer(&Handler{Store: st, Refs: refs})
+	defer srv.Close()
+	ctx := context.Background()
+
+	res, err := ListRefs(ctx, srv.URL, []string{"HEAD", "refs/heads/topic1"}, nil)
+	if err != nil || len(res) != 2 || res[0].Target != "refs/heads/master" || res[1].Name != "refs/heads/topic1" {
+		t.Fatalf("ListRefs => %+v, %v", res, err)
+	}
+	sizes, err := ObjectInfo(ctx, srv.URL, []git.Hash{c1, mustHash(t, strings.Repeat("1", 40))}, nil)
+	if err != nil || len(sizes) != 2 || sizes[1] != -1 {
+		t.Fatalf("ObjectInfo => %v, %v", sizes, err)
+	}
+	if _, n, _ := st.Stat(c1); sizes[0] != n {
+		t.Fatalf("ObjectInfo => %v, want size %v", sizes, n)
+	}
+	dangling := commit(t, st, "dangling")
+	if sizes, err := ObjectInfo(ctx, srv.URL, []git.Hash{dangling}, nil); err != nil || len(sizes) != 1 || sizes[0] != -1 {
+		t.Fatalf("ObjectInfo(unadvertised) => %v, %v, want [-1]", sizes, err)
+	}
+
+	// exact refspecs are fetched with want-ref
+	topic, _ := refs.Ref("refs/heads/topic2")
+	lst, lrefs := git.MemStore(), git.MemRefs()
+	if _, err := Fetch(ctx, srv.URL, lst, lrefs, []string{"refs/heads/topic2:refs/heads/topic2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ref, err := lrefs.Ref("refs/heads/topic2"); err != nil || ref.Hash != topic.Hash {
+		t.Fatalf("topic2 => %+v, %v, want %s", ref, err, topic.Hash)
+	}
+
+	// git fetches with ref-in-want and negotiates over v2
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	run(t, dir, "git", "-c", "protocol.version=2", "clone", "-q", "--bare", srv.URL, "clone.git")
+	clone := filepath.Join(dir, "clone.git")
+	c2 := commit(t, st, "second", c1)
+	update(t, refs, "refs/heads/master", c1, c2)
+	run(t, clone, "git", "-c", "protocol.version=2", "-c", "fetch.negotiationAlgorithm=consecutive", "fetch", "-q", "origin", "refs/heads/master:refs/heads/master")
+	if have := run(t, clone, "git", "rev-parse", "master"); have != c2.String() {
+		t.Fatalf("master => %s, want %s", have, c2)
+	}
+	run(t, clone, "git", "fsck", "--strict")
+	for _, v := range []string{"0", "1"} {
+		run(t, clone, "git", "-c", "protocol.version="+v, "fetch", "-q", "origin")
+	}
+}
+
+func TestNegotiationReady(t *testing.T) {
+	st := git.MemStore()
+	c1 := commit(t, st, "first")
+	c2 := commit(t, st, "second", c1)
+	c3 := commit(t, st, "third", c2)
+	other := commit(t, st, "other")
+
+	neg := &negotiation{reaches: make(map[git.Hash]bool)}
+	for _, tc := range []struct {
+		wants, common []git.Hash
+		want          bool
+	}{
+		{[]git.Hash{c3}, nil, false},
+		{[]git.Hash{c3, other}, []git.Hash{c1}, false},
+		{[]git.Hash{c3}, []git.Hash{c1}, true},
+		{[]git.Hash{c3, other}, []git.Hash{other}, true},
+	} {
+		if ok, err := neg.ready(st, tc.wants, tc.common); ok != tc.want || err != nil {
+			t.Fatalf("ready(%v, %v) => %v, %v, want %v", tc.wants, tc.common, ok, err, tc.want)
+		}
+	}
+	if !neg.reaches[c2] {
+		t.Fatalf("ready did not record %s reaching common", c2)
+	}
+
+	missing := mustHash(t, strings.Repeat("1", 40))
+	if _, err := neg.ready(st, []git.Hash{missing}, []git.Hash{c1}); !errors.Is(err, git.ErrNotExist) {
+		t.Fatalf("ready(missing) => %v, want ErrNotExist", err)
+	}
+}
@@ -0,0 +1,299 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+
+	"dasa.cc/git"
+	"dasa.cc/git/pktline"
+)
+
+// commandV2 encodes a protocol v2 request of cmd with args.
+func commandV2(cmd string, remote capabilities, args []string) io.Reader {
+	buf := new(bytes.Buffer)
+	enc := pktline.NewEncoder(buf)
+	enc.Encodef("command=%s\n", cmd)
+	enc.Encodef("agent=%s\n", Agent)
+	if v, ok := remote.value("object-format"); ok {
+		enc.Encodef("object-format=%s\n", v)
+	}
+	enc.Delim()
+	for _, a := range args {
+		enc.Encodef("%s\n", a)
+	}
+	enc.Flush()
+	return buf
+}
+
+// readSection calls fn with each line up to a delimiter or flush packet,
+// returning the kind of packet that ended the section.
+func readSection(dec *pktline.Decoder, fn func(line string) error) (pktline.Kind, error) {
+	for {
+		kind, line, err := readLine(dec)
+		if err != nil {
+			return kind, err
+		}
+		if kind != pktline.Data {
+			return kind, nil
+		}
+		if strings.HasPrefix(line, "ERR ") {
+			return kind, &pktline.RemoteError{Message: line[4:]}
+		}
+		if err := fn(line); err != nil {
+			return kind, err
+		}
+	}
+}
+
+// lsRefs lists references with any of prefixes. Annotated tags are followed
+// by the objects they peel to, named as in the original protocol.
+func lsRefs(ctx context.Context, c conn, remote capabilities, prefixes []string) ([]git.Ref, error) {
+	args := []string{"symrefs", "peel"}
+	for _, p := range prefixes {
+		args = append(args, "ref-prefix "+p)
+	}
+	body, err := c.request(ctx, commandV2("ls-refs", remote, args))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var refs []git.Ref
+	kind, err := readSection(pktline.NewDecoder(body), func(line string) error {
+		fs := strings.Fields(line)
+		if len(fs) < 2 {
+			return protocolf("invalid ls-refs line %q", line)
+		}
+		h, ok := parseHash(fs[0])
+		if !ok {
+			return protocolf("invalid ls-refs line %q", line)
+		}
+		ref := git.Ref{Name: fs[1], Hash: h}
+		var peeled git.Hash
+		for _, attr := range fs[2:] {
+			switch {
+			case strings.HasPrefix(attr, "symref-target:"):
+				ref.Target = attr[14:]
+			case strings.HasPrefix(attr, "peeled:"):
+				if peeled, ok = parseHash(attr[7:]); !ok {
+					return protocolf("invalid ls-refs line %q", line)
+				}
+			}
+		}
+		refs = append(refs, ref)
+		if peeled != (git.Hash{}) {
+			refs = append(refs, git.Ref{Name: ref.Name + "^{}", Hash: peeled})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if kind != pktline.Flush {
+		return nil, protocolf("unexpected %v after ls-refs", kind)
+	}
+	return refs, nil
+}
+
+// fetchPackV2 negotiates objects in common with fetch commands and receives
+// the pack sent in response, returning hashes of wanted references by name
+// and the shallow commits after fetching.
+func fetchPackV2(ctx context.Context, c conn, remote capabilities, wants []git.Hash, wantRefs []string, st git.Store, refs git.RefStore, opts *FetchOptions) (map[string]git.Hash, []git.Hash, error) {
+	// the shallow feature includes deepen-since
+	err := checkShallow(opts, func(f string) bool {
+		if f == "deepen-since" {
+			f = "shallow"
+		}
+		return remote.feature("fetch", f)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	shallow := newShallowSet(opts.Shallow)
+	neg, err := newNegotiator(st, refs, shallow)
+	if err != nil {
+		return nil, nil, err
+	}
+	// indexed packs can not be thin
+	_, indexed := st.(git.PackIndexer)
+	request := func(haves []git.Hash, done bool) io.Reader {
+		args := []string{"ofs-delta"}
+		if !indexed {
+			args = append(args, "thin-pack")
+		}
+		if opts.Progress == nil {
+			args = append(args, "no-progress")
+		}
+		for _, h := range wants {
+			args = append(args, "want "+h.String())
+		}
+		for _, name := range wantRefs {
+			args = append(args, "want-ref "+name)
+		}
+		args = append(args, shallowArgs(opts)...)
+		for _, h := range append(neg.common, haves...) {
+			args = append(args, "have "+h.String())
+		}
+		if done {
+			args = append(args, "done")
+		}
+		return commandV2("fetch", remote, args)
+	}
+
+	// the remote sends the pack without waiting for done once ready
+	for round := 0; round < maxRounds; round++ {
+		haves, err := neg.next(32 << uint(round))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(haves) == 0 {
+			break
+		}
+		body, err := c.request(ctx, request(haves, false))
+		if err != nil {
+			return nil, nil, err
+		}
+		wanted, ok, err := readFetchResponse(body, neg, st, opts)
+		body.Close()
+		if err != nil || ok {
+			return wanted, shallow.list(), err
+		}
+	}
+
+	body, err := c.request(ctx, request(nil, true))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+	wanted, ok, err := readFetchResponse(body, neg, st, opts)
+	if err == nil && !ok {
+		err = protocolf("no pack after done")
+	}
+	return wanted, shallow.list(), err
+}
+
+// readFetchResponse reads the sections of a fetch response, reporting
+// whether a pack was received.
+func readFetchResponse(r io.Reader, neg *negotiator, st git.Store, opts *FetchOptions) (map[string]git.Hash, bool, error) {
+	dec := pktline.NewDecoder(r)
+	wanted := make(map[string]git.Hash)
+	for {
+		kind, section, err := readLine(dec)
+		if err != nil {
+			return nil, false, err
+		}
+		if kind != pktline.Data {
+			return nil, false, protocolf("expected section, got %v", kind)
+		}
+
+		var fn func(line string) error
+		switch section {
+		case "acknowledgments":
+			fn = func(line string) error {
+				switch {
+				case line == "NAK":
+				case line == "ready":
+					neg.ready = true
+				case strings.HasPrefix(line, "ACK "):
+					h, ok := parseHash(line[4:])
+					if !ok {
+						return protocolf("unexpected acknowledgment %q", line)
+					}
+					neg.ack(h)
+				default:
+					return protocolf("unexpected acknowledgment %q", line)
+				}
+				return nil
+			}
+		case "wanted-refs":
+			fn = func(line string) error {
+				fs := strings.Fields(line)
+				if len(fs) != 2 {
+					return protocolf("invalid wanted-ref %q", line)
+				}
+				h, ok := parseHash(fs[0])
+				if !ok {
+					return protocolf("invalid wanted-ref %q", line)
+				}
+				wanted[fs[1]] = h
+				return nil
+			}
+		case "shallow-info":
+			fn = neg.shallow.update
+		case "packfile-uris":
+			// packfile URIs are never requested
+			fn = func(string) error { return nil }
+		case "packfile":
+			err := storePack(pktline.NewDemuxer(dec, opts.Progress), st, opts)
+			return wanted, err == nil, err
+		default:
+			if strings.HasPrefix(section, "ERR ") {
+				return nil, false, &pktline.RemoteError{Message: section[4:]}
+			}
+			return nil, false, protocolf("unexpected section %q", section)
+		}
+
+		kind, err = readSection(dec, fn)
+		if err != nil {
+			return nil, false, err
+		}
+		if kind == pktline.Flush {
+			// negotiation continues unless the remote is ready
+			if neg.ready {
+				return nil, false, protocolf("flush after ready")
+			}
+			return wanted, false, nil
+		}
+		if kind != pktline.Delim {
+			return nil, false, protocolf("unexpected %v after %s", kind, section)
+		}
+	}
+}
+
+// objectInfo requests sizes of objects, reporting -1 for those missing.
+func objectInfo(ctx context.Context, c conn, remote capabilities, hashes []git.Hash) ([]int64, error) {
+	args := []string{"size"}
+	for _, h := range hashes {
+		args = append(args, "oid "+h.String())
+	}
+	body, err := c.request(ctx, commandV2("object-info", remote, args))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	dec := pktline.NewDecoder(body)
+	if _, line, err := readLine(dec); err != nil {
+		return nil, err
+	} else if strings.HasPrefix(line, "ERR ") {
+		return nil, &pktline.RemoteError{Message: line[4:]}
+	} else if line != "size" {
+		return nil, protocolf("unexpected object-info attributes %q", line)
+	}
+	sizes := make([]int64, 0, len(hashes))
+	kind, err := readSection(dec, func(line string) error {
+		fs := strings.SplitN(line, " ", 2)
+		if len(fs) != 2 || len(sizes) == len(hashes) || fs[0] != hashes[len(sizes)].String() {
+			return protocolf("unexpected object-info %q", line)
+		}
+		n := int64(-1)
+		if fs[1] != "" {
+			var err error
+			if n, err = strconv.ParseInt(fs[1], 10, 64); err != nil {
+				return protocolf("invalid object size %q", fs[1])
+			}
+		}
+		sizes = append(sizes, n)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if kind != pktline.Flush || len(sizes) != len(hashes) {
+		return nil, protocolf("short object-info response")
+	}
+	return sizes, nil
+}
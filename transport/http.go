@@ -0,0 +1,149 @@
+package transport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"dasa.cc/git"
+	"dasa.cc/git/pktline"
+)
+
+// Handler serves a repository over git's smart HTTP protocol. Handler may be
+// mounted at any path, such as with http.StripPrefix, and responds to
+// requests for info/refs, git-upload-pack and git-receive-pack relative to
+// that path.
+//
+//  http.Handle("/repo.git/", &transport.Handler{Store: store, Refs: refs})
+type Handler struct {
+	Store git.Store
+	Refs  git.RefStore
+
+	// AllowPush enables git-receive-pack. Authentication is left to
+	// wrapping handlers; Hooks are called with the request's context.
+	AllowPush bool
+	Hooks     Hooks
+
+	// AllowReachable permits fetching objects reachable from references,
+	// as partial clones fetch missing objects, not only their tips.
+	AllowReachable bool
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/info/refs"):
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.serveInfoRefs(w, r)
+	case strings.HasSuffix(r.URL.Path, "/git-upload-pack"):
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.serveUploadPack(w, r)
+	case strings.HasSuffix(r.URL.Path, "/git-receive-pack"):
+		if !h.AllowPush {
+			http.Error(w, "service not enabled", http.StatusForbidden)
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.serveReceivePack(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Handler) serveInfoRefs(w http.ResponseWriter, r *http.Request) {
+	service := r.URL.Query().Get("service")
+	version := protocolVersion(r.Header.Get("Git-Protocol"))
+	var adv func(io.Writer) error
+	switch {
+	case service == "git-upload-pack":
+		adv = (&UploadPack{Store: h.Store, Refs: h.Refs, Version: version, AllowReachable: h.AllowReachable}).AdvertiseRefs
+	case service == "git-receive-pack" && h.AllowPush:
+		adv = (&ReceivePack{Store: h.Store, Refs: h.Refs}).AdvertiseRefs
+	default:
+		http.Error(w, "service not enabled", http.StatusForbidden)
+		return
+	}
+
+	// advertise to a buffer to report errors with status; protocol v2
+	// omits the service line
+	buf := new(bytes.Buffer)
+	if version != 2 || service != "git-upload-pack" {
+		enc := pktline.NewEncoder(buf)
+		enc.Encodef("# service=%s\n", service)
+		enc.Flush()
+	}
+	if err := adv(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	noCache(w)
+	w.Header().Set("Content-Type", "application/x-"+service+"-advertisement")
+	w.Write(buf.Bytes())
+}
+
+func (h *Handler) serveUploadPack(w http.ResponseWriter, r *http.Request) {
+	body, ok := h.rpc(w, r, "git-upload-pack")
+	if !ok {
+		return
+	}
+	defer body.Close()
+	u := &UploadPack{
+		Store:          h.Store,
+		Refs:           h.Refs,
+		StatelessRPC:   true,
+		Version:        protocolVersion(r.Header.Get("Git-Protocol")),
+		AllowReachable: h.AllowReachable,
+	}
+	u.Serve(r.Context(), body, w)
+}
+
+func (h *Handler) serveReceivePack(w http.ResponseWriter, r *http.Request) {
+	body, ok := h.rpc(w, r, "git-receive-pack")
+	if !ok {
+		return
+	}
+	defer body.Close()
+	rp := &ReceivePack{Store: h.Store, Refs: h.Refs, Hooks: h.Hooks, StatelessRPC: true}
+	rp.Serve(r.Context(), body, w)
+}
+
+// rpc validates a service request, returning its body and setting
+// response headers.
+func (h *Handler) rpc(w http.ResponseWriter, r *http.Request, service string) (io.ReadCloser, bool) {
+	if r.Header.Get("Content-Type") != "application/x-"+service+"-request" {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+	body, err := requestBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	noCache(w)
+	w.Header().Set("Content-Type", "application/x-"+service+"-result")
+	return body, true
+}
+
+// requestBody returns the request body, decompressed if gzip encoded.
+func requestBody(r *http.Request) (io.ReadCloser, error) {
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		return r.Body, nil
+	}
+	return gzip.NewReader(r.Body)
+}
+
+func noCache(w http.ResponseWriter) {
+	w.Header().Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+}
@@ -0,0 +1,260 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dasa.cc/git"
+)
+
+func run(t *testing.T, dir string, name string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s %s: %s\n%s", name, strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gittransport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// mustHash parses the object name s, as output by git.
+func mustHash(t *testing.T, s string) git.Hash {
+	t.Helper()
+	h, err := git.ParseHash(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// writeObject writes data of type typ to st, returning its hash.
+func writeObject(t *testing.T, st git.Store, typ git.Type, data []byte) git.Hash {
+	t.Helper()
+	w := st.Writer()
+	size := int64(len(data))
+	if typ == git.Tree {
+		size = -1
+	}
+	if _, err := w.WriteHeader(typ, size); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return w.Hash()
+}
+
+// commit writes a commit of a single file with content to st, returning its hash.
+func commit(t *testing.T, st git.Store, content string, parents ...git.Hash) git.Hash {
+	t.Helper()
+	blob := writeObject(t, st, git.Blob, []byte(content))
+	tree := writeObject(t, st, git.Tree, []byte(fmt.Sprintf("100644 blob %s\tfile.txt\n", blob)))
+	c := &git.CommitObject{
+		Tree:      tree,
+		Parents:   parents,
+		Author:    "Gopher <gopher@example.com> 1500000000 +0000",
+		Committer: "Gopher <gopher@example.com> 1500000000 +0000",
+		Message:   content + "\n",
+	}
+	return writeObject(t, st, git.Commit, c.Bytes())
+}
+
+func update(t *testing.T, refs git.RefStore, name string, old, new git.Hash) {
+	t.Helper()
+	if err := refs.UpdateRefs(git.RefUpdate{Name: name, Old: old, New: new}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandlerClone(t *testing.T) {
+	st, refs := git.MemStore(), git.MemRefs()
+	c1 := commit(t, st, "first")
+	update(t, refs, "refs/heads/master", git.ZeroHash, c1)
+	tag := &git.TagObject{
+		Object:  c1,
+		Type:    git.Commit,
+		Tag:     "v1",
+		Tagger:  "Gopher <gopher@example.com> 1500000000 +0000",
+		Message: "v1\n",
+	}
+	update(t, refs, "refs/tags/v1", git.ZeroHash, writeObject(t, st, git.Tag, tag.Bytes()))
+
+	srv := httptest.NewServer(&Handler{Store: st, Refs: refs})
+	defer srv.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	run(t, dir, "git", "clone", "-q", srv.URL+"/repo.git", "clone")
+	clone := filepath.Join(dir, "clone")
+	if have := run(t, clone, "git", "rev-parse", "HEAD"); have != c1.String() {
+		t.Fatalf("HEAD => %s, want %s", have, c1)
+	}
+	if have := run(t, clone, "git", "cat-file", "-p", "HEAD:file.txt"); have != "first" {
+		t.Fatalf("file.txt => %q, want %q", have, "first")
+	}
+	if have := run(t, clone, "git", "rev-parse", "v1^{commit}"); have != c1.String() {
+		t.Fatalf("v1 => %s, want %s", have, c1)
+	}
+	run(t, clone, "git", "fsck", "--strict")
+
+	// incremental fetch negotiates with haves
+	c2 := commit(t, st, "second", c1)
+	update(t, refs, "refs/heads/master", c1, c2)
+	run(t, clone, "git", "fetch", "-q", "origin")
+	if have := run(t, clone, "git", "rev-parse", "origin/master"); have != c2.String() {
+		t.Fatalf("origin/master => %s, want %s", have, c2)
+	}
+	run(t, clone, "git", "fsck", "--strict")
+}
+
+func TestHandlerDiskStore(t *testing.T) {
+	src := tempDir(t)
+	defer os.RemoveAll(src)
+	run(t, src, "git", "init", "-q")
+	for i := 0; i < 3; i++ {
+		ioutil.WriteFile(filepath.Join(src, "file.txt"), bytes.Repeat([]byte("data\n"), i+1), 0644)
+		run(t, src, "git", "add", "file.txt")
+		run(t, src, "git", "-c", "user.name=Gopher", "-c", "user.email=gopher@example.com", "commit", "-q", "-m", fmt.Sprint(i))
+	}
+	want := run(t, src, "git", "rev-parse", "HEAD")
+
+	gitdir := filepath.Join(src, ".git")
+	srv := httptest.NewServer(&Handler{Store: git.DiskStore(gitdir), Refs: git.DiskRefs(gitdir)})
+	defer srv.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	run(t, dir, "git", "clone", "-q", "--bare", srv.URL, "clone.git")
+	clone := filepath.Join(dir, "clone.git")
+	if have := run(t, clone, "git", "rev-parse", "HEAD"); have != want {
+		t.Fatalf("HEAD => %s, want %s", have, want)
+	}
+	run(t, clone, "git", "fsck", "--strict")
+
+	w := httptest.NewRecorder()
+	(&Handler{Store: git.DiskStore(gitdir), Refs: git.DiskRefs(gitdir)}).ServeHTTP(w, httptest.NewRequest("GET", "/info/refs", nil))
+	if w.Code != 403 {
+		t.Fatalf("dumb info/refs => %v, want 403", w.Code)
+	}
+
+	// the object format of the store is advertised
+	work := filepath.Join(dir, "sha256")
+	run(t, dir, "git", "init", "-q", "--object-format=sha256", work)
+	ioutil.WriteFile(filepath.Join(work, "file.txt"), []byte("data\n"), 0644)
+	run(t, work, "git", "add", "file.txt")
+	run(t, work, "git", "-c", "user.name=Gopher", "-c", "user.email=gopher@example.com", "commit", "-q", "-m", "sha256")
+	want = run(t, work, "git", "rev-parse", "HEAD")
+	sha256 := filepath.Join(work, ".git")
+	srv256 := httptest.NewServer(&Handler{Store: git.DiskStore(sha256), Refs: git.DiskRefs(sha256)})
+	defer srv256.Close()
+	for _, v := range []string{"0", "2"} {
+		run(t, dir, "git", "-c", "protocol.version="+v, "clone", "-q", "--bare", srv256.URL, "clone"+v+".git")
+		clone := filepath.Join(dir, "clone"+v+".git")
+		if have := run(t, clone, "git", "rev-parse", "HEAD"); have != want {
+			t.Fatalf("v%s sha256 HEAD => %s, want %s", v, have, want)
+		}
+		run(t, clone, "git", "fsck", "--strict")
+	}
+}
+
+func TestHandlerPush(t *testing.T) {
+	st, refs := git.MemStore(), git.MemRefs()
+	c1 := commit(t, st, "first")
+	update(t, refs, "refs/heads/master", git.ZeroHash, c1)
+
+	protect := func(ctx context.Context, u git.RefUpdate) error {
+		if u.Name != "refs/heads/master" {
+			return nil
+		}
+		if u.New == git.ZeroHash {
+			return errors.New("protected branch")
+		}
+		ok, err := git.IsAncestor(st, u.Old, u.New)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("non-fast-forward to protected branch")
+		}
+		return nil
+	}
+	srv := httptest.NewServer(&Handler{Store: st, Refs: refs, AllowPush: true, Hooks: Hooks{Update: protect}})
+	defer srv.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	run(t, dir, "git", "clone", "-q", srv.URL, "clone")
+	clone := filepath.Join(dir, "clone")
+	gitc := func(args ...string) string {
+		return run(t, clone, "git", append([]string{"-c", "user.name=Gopher", "-c", "user.email=gopher@example.com"}, args...)...)
+	}
+
+	for i := 0; i < 3; i++ {
+		ioutil.WriteFile(filepath.Join(clone, fmt.Sprintf("file%v.txt", i)), bytes.Repeat([]byte("push\n"), 100*(i+1)), 0644)
+		gitc("add", ".")
+		gitc("commit", "-q", "-m", fmt.Sprint(i))
+	}
+	gitc("tag", "-a", "-m", "v1", "v1")
+	gitc("push", "-q", "origin", "master", "v1", "master:refs/heads/topic")
+
+	head := gitc("rev-parse", "HEAD")
+	for name, want := range map[string]string{
+		"refs/heads/master": head,
+		"refs/heads/topic":  head,
+		"refs/tags/v1":      gitc("rev-parse", "v1"),
+	} {
+		ref, err := refs.Ref(name)
+		if err != nil || ref.Hash.String() != want {
+			t.Fatalf("Ref(%s) => %+v, %v, want %s", name, ref, err, want)
+		}
+	}
+	if _, err := git.Reachable(st, []git.Hash{mustHash(t, head)}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// non-fast-forward is rejected by hook, other branches are not protected
+	gitc("reset", "-q", "--hard", "HEAD~1")
+	gitc("commit", "-q", "--allow-empty", "-m", "diverge")
+	cmd := exec.Command("git", "push", "-f", "origin", "master")
+	cmd.Dir = clone
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "non-fast-forward to protected branch") {
+		t.Fatalf("git push -f => %v: %s", err, out)
+	}
+	if ref, _ := refs.Ref("refs/heads/master"); ref.Hash.String() != head {
+		t.Fatalf("master => %s, want %s", ref.Hash, head)
+	}
+	gitc("push", "-q", "-f", "origin", "master:topic")
+	gitc("push", "-q", "origin", ":topic")
+	if _, err := refs.Ref("refs/heads/topic"); !errors.Is(err, git.ErrRefNotExist) {
+		t.Fatalf("Ref(topic) => %v, want ErrRefNotExist", err)
+	}
+
+	w := httptest.NewRecorder()
+	(&Handler{Store: st, Refs: refs}).ServeHTTP(w, httptest.NewRequest("GET", "/info/refs?service=git-receive-pack", nil))
+	if w.Code != 403 {
+		t.Fatalf("receive-pack without AllowPush => %v, want 403", w.Code)
+	}
+}
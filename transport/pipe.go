@@ -0,0 +1,172 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"dasa.cc/git"
+)
+
+// Transport connects to the services of a remote repository over a pair of
+// pipes, as to the standard input and output of git-upload-pack.
+type Transport interface {
+	// Connect starts service, git-upload-pack or git-receive-pack, and
+	// returns a connection to it. Protocol version 2 is requested if
+	// version is 2. Close ends the service, returning any error it
+	// reported.
+	Connect(ctx context.Context, service string, version int) (io.ReadWriteCloser, error)
+}
+
+// Exec is a Transport running services as commands with the repository's
+// path as argument, such as "git-upload-pack path".
+type Exec struct {
+	// Path is the path of the repository. Paths beginning with - are
+	// refused, as they would be taken as options.
+	Path string
+
+	// Command, if set, prefixes the service command, such as
+	// []string{"ssh", "example.com"}. The path is then quoted for a shell,
+	// as ssh has the remote shell run its arguments.
+	Command []string
+
+	// Stderr receives the standard error of commands. If nil, standard
+	// error is included in errors returned by Close.
+	Stderr io.Writer
+}
+
+// Connect implements Transport.
+func (e *Exec) Connect(ctx context.Context, service string, version int) (io.ReadWriteCloser, error) {
+	if strings.HasPrefix(e.Path, "-") {
+		return nil, fmt.Errorf("transport: invalid repository path %q", e.Path)
+	}
+	path := e.Path
+	if len(e.Command) > 0 {
+		path = shellQuote(path)
+	}
+	args := append(append([]string{}, e.Command...), service, path)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if version == 2 {
+		cmd.Env = append(os.Environ(), "GIT_PROTOCOL=version=2")
+	}
+	c := &execConn{cmd: cmd, stderr: new(bytes.Buffer)}
+	cmd.Stderr = c.stderr
+	if e.Stderr != nil {
+		cmd.Stderr = e.Stderr
+	}
+	var err error
+	if c.w, err = cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if c.r, err = cmd.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// shellQuote quotes s for a POSIX shell, as by git's sq_quote. Quotes and
+// exclamation marks are escaped outside of single quotes.
+func shellQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('\'')
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '\'' || c == '!' {
+			b.WriteString("'\\")
+			b.WriteByte(c)
+			b.WriteByte('\'')
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+type execConn struct {
+	cmd    *exec.Cmd
+	r      io.ReadCloser
+	w      io.WriteCloser
+	stderr *bytes.Buffer
+}
+
+func (c *execConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *execConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+// Close closes the command's standard input and waits for it to exit,
+// discarding further output.
+func (c *execConn) Close() error {
+	c.w.Close()
+	io.Copy(ioutil.Discard, c.r)
+	if err := c.cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(c.stderr.String()); msg != "" {
+			return fmt.Errorf("transport: %s: %v: %s", c.cmd.Args[0], err, msg)
+		}
+		return fmt.Errorf("transport: %s: %v", c.cmd.Args[0], err)
+	}
+	return nil
+}
+
+// Local is a Transport serving a Store in process, as UploadPack and
+// ReceivePack would over a connection.
+type Local struct {
+	Store git.Store
+	Refs  git.RefStore
+	Hooks Hooks
+
+	// AllowReachable permits fetching objects reachable from references,
+	// not only their tips.
+	AllowReachable bool
+}
+
+// Connect implements Transport.
+func (l *Local) Connect(ctx context.Context, service string, version int) (io.ReadWriteCloser, error) {
+	var serve func(context.Context, io.Reader, io.Writer) error
+	switch service {
+	case "git-upload-pack":
+		serve = (&UploadPack{Store: l.Store, Refs: l.Refs, Version: version, AllowReachable: l.AllowReachable}).Serve
+	case "git-receive-pack":
+		serve = (&ReceivePack{Store: l.Store, Refs: l.Refs, Hooks: l.Hooks}).Serve
+	default:
+		return nil, fmt.Errorf("transport: unknown service %q", service)
+	}
+
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	c := &localConn{r: cr, w: cw, done: make(chan error, 1)}
+	go func() {
+		err := serve(ctx, sr, sw)
+		sw.CloseWithError(err)
+		sr.Close()
+		c.done <- err
+	}()
+	return c, nil
+}
+
+type localConn struct {
+	r    *io.PipeReader
+	w    *io.PipeWriter
+	done chan error
+}
+
+func (c *localConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *localConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+// Close waits for the service to end. Errors of a service interrupted by
+// Close are not reported.
+func (c *localConn) Close() error {
+	c.w.Close()
+	c.r.Close()
+	if err := <-c.done; err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"dasa.cc/git"
+)
+
+func TestLocal(t *testing.T) {
+	srvst, srvrefs := git.MemStore(), git.MemRefs()
+	c1 := commit(t, srvst, "first")
+	update(t, srvrefs, "refs/heads/master", git.ZeroHash, c1)
+	protect := func(ctx context.Context, u git.RefUpdate) error {
+		if u.Name == "refs/heads/protected" {
+			return errors.New("protected branch")
+		}
+		return nil
+	}
+	remote := &Local{Store: srvst, Refs: srvrefs, Hooks: Hooks{Update: protect}}
+	ctx := context.Background()
+
+	for _, version := range []int{1, 2} {
+		st, refs := git.MemStore(), git.MemRefs()
+		opts := &FetchOptions{Transport: remote, ProtocolVersion: version}
+		if _, err := Fetch(ctx, "", st, refs, []string{"refs/heads/*:refs/heads/*"}, opts); err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if ref, err := refs.Ref("refs/heads/master"); err != nil || ref.Hash != c1 {
+			t.Fatalf("v%d: master => %+v, %v, want %s", version, ref, err, c1)
+		}
+
+		// incremental fetch negotiates over a single connection
+		c2 := commit(t, srvst, fmt.Sprint("second", version), c1)
+		update(t, srvrefs, fmt.Sprintf("refs/heads/topic%d", version), git.ZeroHash, c2)
+		if _, err := Fetch(ctx, "", st, refs, []string{"refs/heads/*:refs/heads/*"}, opts); err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if _, err := git.Reachable(st, []git.Hash{c2}, nil); err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+
+		// nothing wanted
+		if _, err := Fetch(ctx, "", st, refs, []string{"refs/heads/*:refs/heads/*"}, opts); err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if refs, err := ListRefs(ctx, "", []string{"refs/heads/topic1"}, opts); err != nil || len(refs) != 1 {
+			t.Fatalf("v%d: ListRefs => %+v, %v", version, refs, err)
+		}
+	}
+
+	// push to the in-process remote
+	st, refs := git.MemStore(), git.MemRefs()
+	if _, err := Fetch(ctx, "", st, refs, []string{"refs/heads/*:refs/heads/*"}, &FetchOptions{Transport: remote}); err != nil {
+		t.Fatal(err)
+	}
+	c3 := commit(t, st, "third", c1)
+	update(t, refs, "refs/heads/master", c1, c3)
+	popts := &PushOptions{Transport: remote}
+	statuses, err := Push(ctx, "", st, refs, []string{"master", "master:new", "master:refs/heads/protected", ":refs/heads/topic1"}, popts)
+	if !errors.Is(err, ErrRejected) || len(statuses) != 4 || statuses[2].Err == nil {
+		t.Fatalf("Push => %+v, %v, want protected rejected", statuses, err)
+	}
+	for name, want := range map[string]git.Hash{"refs/heads/master": c3, "refs/heads/new": c3} {
+		if ref, err := srvrefs.Ref(name); err != nil || ref.Hash != want {
+			t.Fatalf("remote %s => %+v, %v, want %s", name, ref, err, want)
+		}
+	}
+	if _, err := srvrefs.Ref("refs/heads/topic1"); !errors.Is(err, git.ErrRefNotExist) {
+		t.Fatalf("remote topic1 => %v, want ErrRefNotExist", err)
+	}
+	if _, err := git.Reachable(srvst, []git.Hash{c3}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// rewinding requires force
+	c4 := commit(t, st, "fourth", c1)
+	if _, err := Push(ctx, "", st, refs, []string{c4Ref(t, refs, c4)}, popts); !errors.Is(err, ErrRejected) {
+		t.Fatalf("Push => %v, want ErrRejected", err)
+	}
+	if _, err := Push(ctx, "", st, refs, []string{"+refs/heads/rewind:refs/heads/master"}, popts); err != nil {
+		t.Fatal(err)
+	}
+	if ref, _ := srvrefs.Ref("refs/heads/master"); ref.Hash != c4 {
+		t.Fatalf("remote master => %s, want %s", ref.Hash, c4)
+	}
+
+	// nothing to push
+	if statuses, err := Push(ctx, "", st, refs, []string{"refs/heads/rewind:refs/heads/master"}, popts); err != nil || len(statuses) != 0 {
+		t.Fatalf("Push => %+v, %v, want nothing", statuses, err)
+	}
+}
+
+// c4Ref points refs/heads/rewind at h, returning a refspec pushing it to master.
+func c4Ref(t *testing.T, refs git.RefStore, h git.Hash) string {
+	update(t, refs, "refs/heads/rewind", git.ZeroHash, h)
+	return "refs/heads/rewind:refs/heads/master"
+}
+
+func TestExec(t *testing.T) {
+	src := tempDir(t)
+	defer os.RemoveAll(src)
+	gitc := func(dir string, args ...string) string {
+		return run(t, dir, "git", append([]string{"-c", "user.name=Gopher", "-c", "user.email=gopher@example.com"}, args...)...)
+	}
+	gitc(src, "init", "-q", "-b", "main")
+	for i := 0; i < 3; i++ {
+		ioutil.WriteFile(filepath.Join(src, "file.txt"), bytes.Repeat([]byte("data\n"), i+1), 0644)
+		gitc(src, "add", "file.txt")
+		gitc(src, "commit", "-q", "-m", fmt.Sprint(i))
+	}
+	head := gitc(src, "rev-parse", "HEAD")
+	ctx := context.Background()
+
+	for _, version := range []int{1, 2} {
+		st, refs := git.MemStore(), git.MemRefs()
+		opts := &FetchOptions{ProtocolVersion: version}
+		if _, err := Fetch(ctx, src, st, refs, nil, opts); err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if ref, err := refs.Ref("refs/remotes/origin/main"); err != nil || ref.Hash.String() != head {
+			t.Fatalf("v%d: origin/main => %+v, %v, want %s", version, ref, err, head)
+		}
+	}
+
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+	gitc(dst, "init", "-q", "--bare")
+	st, refs := git.MemStore(), git.MemRefs()
+	if _, err := Fetch(ctx, "file://"+src, st, refs, []string{"refs/heads/*:refs/heads/*"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Push(ctx, dst, st, refs, []string{"main"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if have := gitc(dst, "rev-parse", "main"); have != head {
+		t.Fatalf("main => %s, want %s", have, head)
+	}
+	gitc(dst, "fsck", "--strict")
+
+	c := commit(t, st, "gopher", mustHash(t, head))
+	update(t, refs, "refs/heads/main", mustHash(t, head), c)
+	if _, err := Push(ctx, dst, st, refs, []string{"main", "main:refs/heads/topic"}, &PushOptions{Atomic: true}); err != nil {
+		t.Fatal(err)
+	}
+	if have := gitc(dst, "rev-parse", "topic"); have != c.String() {
+		t.Fatalf("topic => %s, want %s", have, c)
+	}
+	gitc(dst, "fsck", "--strict")
+
+	if _, err := Fetch(ctx, filepath.Join(dst, "missing"), st, refs, nil, nil); err == nil {
+		t.Fatal("Fetch of missing repository succeeded")
+	}
+	if c, err := (&Exec{Path: "--upload-pack=touch"}).Connect(ctx, "git-upload-pack", 0); err == nil {
+		c.Close()
+		t.Fatal("Connect with option as path succeeded")
+	}
+
+	// commands are run by a shell, as by ssh, with the path quoted
+	odd := filepath.Join(src, "it's!; touch "+filepath.Join(src, "pwned"))
+	gitc(src, "clone", "-q", "--bare", src, odd)
+	opts := &FetchOptions{Transport: &Exec{Path: odd, Command: []string{"sh", "-c", `eval "$*"`, "sh"}}}
+	if _, err := Fetch(ctx, "", git.MemStore(), git.MemRefs(), nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(src, "pwned")); err == nil {
+		t.Fatal("path was run by the shell")
+	}
+}
@@ -0,0 +1,54 @@
+package transport
+
+import (
+	"context"
+	"time"
+
+	"dasa.cc/git"
+)
+
+// FetchObjects fetches objects by hashes, rather than references, from the
+// repository at url, writing them to st, as a partial clone fetches objects
+// missing from its promisor remote. The remote must permit wanting objects
+// that are not the tips of its references.
+//
+// Unless opts sets a Filter, blobs not wanted are omitted if the remote
+// supports filtering, and the pack is kept as a promisor pack if st
+// implements git.PackIndexer. Depth options are ignored.
+func FetchObjects(ctx context.Context, url string, st git.Store, hashes []git.Hash, opts *FetchOptions) error {
+	var o FetchOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.Depth, o.ShallowSince = 0, time.Time{}
+	c, adv, err := dialUploadPack(ctx, url, &o, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if o.Filter.IsZero() && (adv.caps.has("filter") || adv.version == 2 && adv.caps.feature("fetch", "filter")) {
+		o.Filter, _ = git.ParseFilter("blob:none")
+	}
+	if adv.version == 2 {
+		_, _, err = fetchPackV2(ctx, c, adv.caps, hashes, nil, st, nil, &o)
+	} else {
+		_, err = fetchPack(ctx, c, adv.caps, hashes, st, nil, &o)
+	}
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// Promisor is a git.Fetcher fetching objects missing from a partial clone
+// from the remote repository at URL.
+type Promisor struct {
+	URL     string
+	Options *FetchOptions
+}
+
+// FetchObjects implements git.Fetcher.
+func (p *Promisor) FetchObjects(st git.Store, hashes []git.Hash) error {
+	return FetchObjects(context.Background(), p.URL, st, hashes, p.Options)
+}
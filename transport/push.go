@@ -0,0 +1,311 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"dasa.cc/git"
+	"dasa.cc/git/pktline"
+)
+
+// ErrRejected is returned when a pushed reference update is rejected, either
+// locally as a non-fast-forward or by the remote.
+var ErrRejected = errors.New("transport: push rejected")
+
+// PushOptions configures Push. The zero value uses defaults.
+type PushOptions struct {
+	// Progress receives progress messages sent by the remote.
+	Progress io.Writer
+
+	// HTTPClient is used for http and https URLs. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Transport, if set, connects to the remote in place of url.
+	// Otherwise, remotes other than http and https URLs are local paths
+	// served by running git-receive-pack.
+	Transport Transport
+
+	// Atomic requests that either all updates are applied or none.
+	Atomic bool
+}
+
+// RefStatus reports the outcome of a pushed reference update.
+type RefStatus struct {
+	git.RefUpdate
+
+	// Err is the reason the update was rejected, or nil.
+	Err error
+}
+
+// Push updates references of the repository at url according to refspecs,
+// sending objects from st that the remote lacks. Sources of refspecs name
+// references in refs, such as "refs/heads/main" or "main"; an empty source
+// deletes the destination. Updates that are not fast-forwards are rejected
+// unless forced.
+//
+// The status of each update is returned. If any is rejected, the error
+// wraps ErrRejected.
+func Push(ctx context.Context, url string, st git.Store, refs git.RefStore, refspecs []string, opts *PushOptions) ([]RefStatus, error) {
+	if opts == nil {
+		opts = &PushOptions{}
+	}
+	c, adv, err := dial(ctx, url, "git-receive-pack", 0, opts.HTTPClient, opts.Transport)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if opts.Atomic && !adv.caps.has("atomic") {
+		return nil, fmt.Errorf("%w: atomic", ErrUnsupported)
+	}
+
+	statuses, err := pushUpdates(st, refs, adv.refs, refspecs)
+	if err != nil {
+		return nil, err
+	}
+	var cmds []*RefStatus
+	for i := range statuses {
+		if statuses[i].Err == nil {
+			cmds = append(cmds, &statuses[i])
+		}
+	}
+	if len(cmds) > 0 {
+		if err := sendPack(ctx, c, adv, st, cmds, opts); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Close(); err != nil {
+		return nil, err
+	}
+
+	var rejected []string
+	for _, s := range statuses {
+		if s.Err != nil {
+			rejected = append(rejected, fmt.Sprintf("%s (%v)", s.Name, s.Err))
+		}
+	}
+	if len(rejected) > 0 {
+		return statuses, fmt.Errorf("%w: %s", ErrRejected, strings.Join(rejected, ", "))
+	}
+	return statuses, nil
+}
+
+// pushUpdates matches refspecs against local references, rejecting updates
+// of remote references that are not fast-forwards.
+func pushUpdates(st git.Store, refs git.RefStore, remote []git.Ref, refspecs []string) ([]RefStatus, error) {
+	remoteHash := make(map[string]git.Hash)
+	for _, ref := range remote {
+		remoteHash[ref.Name] = ref.Hash
+	}
+	local, err := refs.Refs()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []RefStatus
+	add := func(spec git.RefSpec, dst string, hash git.Hash) {
+		old, ok := remoteHash[dst]
+		if !ok {
+			old = git.ZeroHash
+		}
+		if old == hash {
+			return
+		}
+		s := RefStatus{RefUpdate: git.RefUpdate{Name: dst, Old: old, New: hash}}
+		if !spec.Force && !old.IsZero() && !hash.IsZero() {
+			if ok, err := git.IsAncestor(st, old, hash); err != nil || !ok {
+				s.Err = errors.New("non-fast-forward")
+			}
+		}
+		statuses = append(statuses, s)
+	}
+
+	specs, err := git.ParseRefSpecs(refspecs)
+	if err != nil {
+		return nil, err
+	}
+	for i, spec := range specs {
+		switch {
+		case spec.Negative:
+		case spec.Src == "":
+			if spec.Dst == "" {
+				return nil, fmt.Errorf("git: invalid refspec %q", refspecs[i])
+			}
+			add(spec, spec.Dst, git.ZeroHash)
+		case strings.Contains(spec.Src, "*"):
+			for _, ref := range local {
+				if dst, ok := spec.Match(ref.Name); ok && !git.ExcludedRef(specs, ref.Name) {
+					if dst == "" {
+						dst = ref.Name
+					}
+					add(spec, dst, ref.Hash)
+				}
+			}
+		default:
+			ref, err := lookupRef(refs, spec.Src)
+			if err != nil {
+				return nil, err
+			}
+			add(spec, remoteName(spec.Dst, ref.Name, remoteHash), ref.Hash)
+		}
+	}
+	return statuses, nil
+}
+
+// remoteName returns the full name of dst, a reference of the remote to
+// update from src. A short name is of an existing branch or tag, or else
+// of the kind of src. An empty name is src.
+func remoteName(dst, src string, remote map[string]git.Hash) string {
+	if dst == "" {
+		return src
+	}
+	if dst == "HEAD" || strings.HasPrefix(dst, "refs/") {
+		return dst
+	}
+	for _, prefix := range []string{"refs/heads/", "refs/tags/"} {
+		if _, ok := remote[prefix+dst]; ok {
+			return prefix + dst
+		}
+	}
+	if strings.HasPrefix(src, "refs/tags/") {
+		return "refs/tags/" + dst
+	}
+	return "refs/heads/" + dst
+}
+
+// lookupRef finds a reference by full name, or by short name as a tag,
+// branch or remote-tracking branch. HEAD is named by the branch it refers to.
+func lookupRef(refs git.RefStore, name string) (git.Ref, error) {
+	names := []string{name}
+	if name != "HEAD" && !strings.HasPrefix(name, "refs/") {
+		names = []string{"refs/tags/" + name, "refs/heads/" + name, "refs/remotes/" + name}
+	}
+	for _, s := range names {
+		ref, err := refs.Ref(s)
+		if err == nil {
+			ref.Name = s
+			if ref.Target != "" {
+				ref.Name = ref.Target
+			}
+			return ref, nil
+		}
+		if !errors.Is(err, git.ErrRefNotExist) {
+			return git.Ref{}, err
+		}
+	}
+	return git.Ref{}, fmt.Errorf("%w: %s", git.ErrRefNotExist, name)
+}
+
+// sendPack sends update commands with a pack of objects the remote lacks,
+// then reads the remote's report into cmds.
+func sendPack(ctx context.Context, c conn, adv *advertisement, st git.Store, cmds []*RefStatus, opts *PushOptions) (err error) {
+	caps := capabilities{"report-status", "agent=" + Agent}
+	sideband := adv.caps.has("side-band-64k")
+	if sideband {
+		caps = append(caps, "side-band-64k")
+	}
+	if opts.Progress == nil && adv.caps.has("quiet") {
+		caps = append(caps, "quiet")
+	}
+	if opts.Atomic {
+		caps = append(caps, "atomic")
+	}
+
+	var tips, haves []git.Hash
+	for _, ref := range adv.refs {
+		if ok, err := st.Has(ref.Hash); err != nil {
+			return err
+		} else if ok {
+			haves = append(haves, ref.Hash)
+		}
+	}
+	head := new(bytes.Buffer)
+	enc := pktline.NewEncoder(head)
+	for i, cmd := range cmds {
+		if i == 0 {
+			enc.Encodef("%s %s %s\x00%s\n", cmd.Old, cmd.New, cmd.Name, caps)
+		} else {
+			enc.Encodef("%s %s %s\n", cmd.Old, cmd.New, cmd.Name)
+		}
+		if !cmd.New.IsZero() {
+			tips = append(tips, cmd.New)
+		}
+	}
+	enc.Flush()
+
+	// the pack is omitted if only deleting
+	body := io.Reader(head)
+	if len(tips) > 0 {
+		var objects []git.Hash
+		if objects, err = git.Reachable(st, tips, haves); err != nil {
+			return err
+		}
+		// the pack is read to its end unless the request fails
+		pr, pw := io.Pipe()
+		go func() { pw.CloseWithError(git.WritePack(pw, st, objects)) }()
+		defer func() {
+			if err != nil {
+				pr.CloseWithError(err)
+			}
+		}()
+		body = io.MultiReader(head, pr)
+	}
+	resp, err := c.request(ctx, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+
+	var r io.Reader = resp
+	if sideband {
+		r = pktline.NewDemuxer(pktline.NewDecoder(resp), opts.Progress)
+	}
+	return readReport(pktline.NewDecoder(r), cmds)
+}
+
+// readReport reads a report-status response, setting Err of rejected
+// commands.
+func readReport(dec *pktline.Decoder, cmds []*RefStatus) error {
+	_, line, err := readLine(dec)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "unpack ") {
+		return protocolf("unexpected %q in report", line)
+	}
+	if line != "unpack ok" {
+		return &pktline.RemoteError{Message: "unpack " + line[7:]}
+	}
+	for {
+		kind, line, err := readLine(dec)
+		if err != nil {
+			return err
+		}
+		if kind == pktline.Flush {
+			return nil
+		}
+		var name, reason string
+		switch {
+		case strings.HasPrefix(line, "ok "):
+			name = line[3:]
+		case strings.HasPrefix(line, "ng "):
+			kv := strings.SplitN(line[3:], " ", 2)
+			name, reason = kv[0], "rejected"
+			if len(kv) == 2 {
+				reason = kv[1]
+			}
+		default:
+			return protocolf("unexpected %q in report", line)
+		}
+		for _, cmd := range cmds {
+			if cmd.Name == name && reason != "" {
+				cmd.Err = errors.New(reason)
+			}
+		}
+	}
+}
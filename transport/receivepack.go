@@ -0,0 +1,252 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"dasa.cc/git"
+	"dasa.cc/git/pktline"
+)
+
+// Hooks are called by ReceivePack to enforce policy on pushes. Returned
+// errors are reported to the client.
+type Hooks struct {
+	// PreReceive is called with all reference updates of a push after
+	// objects are received and verified. Returning an error rejects
+	// every update.
+	PreReceive func(ctx context.Context, updates []git.RefUpdate) error
+
+	// Update is called for each reference update after PreReceive.
+	// Returning an error rejects the update.
+	Update func(ctx context.Context, u git.RefUpdate) error
+}
+
+// ReceivePack serves git-receive-pack, receiving objects from clients that
+// push and updating references.
+//
+// Received objects are written to Store before reference updates are
+// verified; objects of rejected pushes remain in Store until pruned.
+// Accepted reference updates are applied atomically.
+type ReceivePack struct {
+	Store git.Store
+	Refs  git.RefStore
+	Hooks Hooks
+
+	// StatelessRPC is set when the request is served independently of
+	// reference advertisement, as over HTTP.
+	StatelessRPC bool
+}
+
+func (rp *ReceivePack) capabilities() capabilities {
+	return capabilities{"report-status", "delete-refs", "side-band-64k", "quiet", "atomic", "ofs-delta", "object-format=" + objectFormat(rp.Store).String(), "agent=" + Agent}
+}
+
+// AdvertiseRefs writes the reference advertisement to w.
+func (rp *ReceivePack) AdvertiseRefs(w io.Writer) error {
+	refs, err := rp.Refs.Refs()
+	if err != nil {
+		return err
+	}
+	return advertise(pktline.NewEncoder(w), refs, rp.capabilities())
+}
+
+// command is a reference update requested by the client and its result.
+type command struct {
+	git.RefUpdate
+	err error
+}
+
+// Serve reads a client's push from r and writes the response to w. If
+// StatelessRPC is not set, references are advertised first.
+func (rp *ReceivePack) Serve(ctx context.Context, r io.Reader, w io.Writer) error {
+	enc := pktline.NewEncoder(ctxWriter{ctx, w})
+	dec := pktline.NewDecoder(r)
+	if !rp.StatelessRPC {
+		if err := rp.AdvertiseRefs(ctxWriter{ctx, w}); err != nil {
+			return err
+		}
+	}
+
+	var (
+		cmds []*command
+		caps capabilities
+	)
+	for {
+		kind, line, err := readLine(dec)
+		if err == io.EOF && len(cmds) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if kind == pktline.Flush {
+			break
+		}
+		if i := strings.IndexByte(line, 0); i != -1 {
+			caps = parseCapabilities(line[i+1:])
+			if err := caps.checkFormat(objectFormat(rp.Store)); err != nil {
+				return err
+			}
+			line = line[:i]
+		}
+		var u git.RefUpdate
+		fs := strings.Fields(line)
+		ok := len(fs) == 3
+		if ok {
+			u.Name = fs[2]
+			if u.Old, ok = parseHash(fs[0]); ok {
+				u.New, ok = parseHash(fs[1])
+			}
+		}
+		if !ok {
+			err := protocolf("invalid command %q", line)
+			enc.Encodef("ERR %s\n", err)
+			return err
+		}
+		cmds = append(cmds, &command{RefUpdate: u})
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	// report is buffered to be sent over side-band if requested
+	out := &bytes.Buffer{}
+	report := pktline.NewEncoder(out)
+
+	unpackErr := rp.unpack(r, cmds)
+	if unpackErr != nil {
+		report.Encodef("unpack %s\n", strings.Replace(unpackErr.Error(), "\n", " ", -1))
+		for _, c := range cmds {
+			if c.err == nil {
+				c.err = errors.New("unpacker error")
+			}
+		}
+	} else {
+		report.Encodef("unpack ok\n")
+		rp.update(ctx, cmds, caps.has("atomic"))
+	}
+	for _, c := range cmds {
+		if c.err != nil {
+			report.Encodef("ng %s %s\n", c.Name, strings.Replace(c.err.Error(), "\n", " ", -1))
+		} else {
+			report.Encodef("ok %s\n", c.Name)
+		}
+	}
+	report.Flush()
+
+	if !caps.has("report-status") {
+		return unpackErr
+	}
+	if caps.has("side-band-64k") {
+		if _, err := pktline.NewSidebandWriter(enc, pktline.BandData, pktline.Sideband64Max).Write(out.Bytes()); err != nil {
+			return err
+		}
+		if err := enc.Flush(); err != nil {
+			return err
+		}
+	} else if _, err := (ctxWriter{ctx, w}).Write(out.Bytes()); err != nil {
+		return err
+	}
+	return unpackErr
+}
+
+// unpack receives the pack if any command creates or updates a reference
+// and checks new values of references are connected.
+func (rp *ReceivePack) unpack(r io.Reader, cmds []*command) error {
+	var tips []git.Hash
+	for _, c := range cmds {
+		if !c.New.IsZero() {
+			tips = append(tips, c.New)
+		}
+	}
+	if len(tips) == 0 {
+		return nil
+	}
+	if _, err := git.UnpackObjects(r, rp.Store); err != nil {
+		return err
+	}
+
+	// every object reachable from new tips must exist
+	refs, err := rp.Refs.Refs()
+	if err != nil {
+		return err
+	}
+	var haves []git.Hash
+	for _, ref := range refs {
+		haves = append(haves, ref.Hash)
+	}
+	if _, err := git.Reachable(rp.Store, tips, haves); err != nil {
+		return fmt.Errorf("missing necessary objects: %v", err)
+	}
+	return nil
+}
+
+// update checks commands against hooks and applies accepted updates. If
+// atomic is set, all commands fail if any is rejected.
+func (rp *ReceivePack) update(ctx context.Context, cmds []*command, atomic bool) {
+	fail := func(err error) {
+		for _, c := range cmds {
+			if c.err == nil {
+				c.err = err
+			}
+		}
+	}
+
+	var updates []git.RefUpdate
+	for _, c := range cmds {
+		c.err = rp.check(c.RefUpdate)
+		updates = append(updates, c.RefUpdate)
+	}
+	if rp.Hooks.PreReceive != nil {
+		if err := rp.Hooks.PreReceive(ctx, updates); err != nil {
+			fail(fmt.Errorf("pre-receive hook declined: %v", err))
+			return
+		}
+	}
+
+	updates = updates[:0]
+	for _, c := range cmds {
+		if c.err == nil && rp.Hooks.Update != nil {
+			if err := rp.Hooks.Update(ctx, c.RefUpdate); err != nil {
+				c.err = fmt.Errorf("hook declined: %v", err)
+			}
+		}
+		if c.err == nil {
+			updates = append(updates, c.RefUpdate)
+		} else if atomic {
+			fail(errors.New("atomic push failure"))
+			return
+		}
+	}
+	if len(updates) == 0 {
+		return
+	}
+	if err := rp.Refs.UpdateRefs(updates...); err != nil {
+		if errors.Is(err, git.ErrRefConflict) {
+			err = errors.New("failed to lock")
+		}
+		fail(err)
+	}
+}
+
+// check validates a single reference update.
+func (rp *ReceivePack) check(u git.RefUpdate) error {
+	if !strings.HasPrefix(u.Name, "refs/") || !git.ValidRefName(u.Name) {
+		return errors.New("funny refname")
+	}
+	if u.New.IsZero() {
+		return nil
+	}
+	t, _, err := rp.Store.Stat(u.New)
+	if err != nil {
+		return errors.New("bad object")
+	}
+	if strings.HasPrefix(u.Name, "refs/heads/") && t != git.Commit {
+		return fmt.Errorf("non-commit object %s for branch", u.New)
+	}
+	return nil
+}
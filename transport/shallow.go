@@ -0,0 +1,258 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"dasa.cc/git"
+	"dasa.cc/git/pktline"
+)
+
+// shallowArg parses a request's line of shallow or filter arguments into
+// req, reporting whether line is one.
+func (req *request) shallowArg(line string) (bool, error) {
+	switch {
+	case strings.HasPrefix(line, "shallow "):
+		h, ok := parseHash(line[8:])
+		if !ok {
+			return true, protocolf("invalid shallow %q", line[8:])
+		}
+		req.shallows = append(req.shallows, h)
+	case strings.HasPrefix(line, "deepen "):
+		n, err := strconv.Atoi(line[7:])
+		if err != nil || n <= 0 {
+			return true, protocolf("invalid depth %q", line[7:])
+		}
+		req.depth = n
+	case strings.HasPrefix(line, "deepen-since "):
+		ts, err := strconv.ParseInt(line[13:], 10, 64)
+		if err != nil {
+			return true, protocolf("invalid deepen-since %q", line[13:])
+		}
+		req.since = time.Unix(ts, 0)
+	case strings.HasPrefix(line, "filter "):
+		f, err := git.ParseFilter(line[7:])
+		if err != nil {
+			return true, err
+		}
+		req.filter = f
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// deepening reports whether the client requested a change of its history's
+// depth.
+func (req *request) deepening() bool { return req.depth > 0 || !req.since.IsZero() }
+
+// deepen computes the boundary of history sent to the client. If the client
+// is deepening, commits made shallow and client's shallow commits made
+// complete are returned; the parents of the latter are added to wants.
+func (u *UploadPack) deepen(req *request) (shallow, unshallow []git.Hash, err error) {
+	req.boundary = append([]git.Hash{}, req.shallows...)
+	if !req.deepening() {
+		return nil, nil, nil
+	}
+	if req.depth > 0 && !req.since.IsZero() {
+		return nil, nil, errors.New("upload-pack: deepen and deepen-since cannot be used together")
+	}
+
+	client := make(map[git.Hash]bool)
+	for _, h := range req.shallows {
+		client[h] = true
+	}
+	depth := make(map[git.Hash]int)
+	var queue []git.Hash
+	for _, h := range req.wants {
+		h, t, err := git.Peel(u.Store, h)
+		if err != nil {
+			return nil, nil, err
+		}
+		if t == git.Commit && depth[h] == 0 {
+			depth[h] = 1
+			queue = append(queue, h)
+		}
+	}
+
+	// history is walked breadth first so commits are cut at their least
+	// depth
+	var (
+		parents  []git.Hash
+		selected int
+	)
+	for len(queue) > 0 {
+		h := queue[0]
+		queue = queue[1:]
+		c, err := git.LoadCommit(u.Store, h)
+		if err != nil {
+			return nil, nil, err
+		}
+		cut := req.depth > 0 && depth[h] >= req.depth && len(c.Parents) > 0
+		if !req.since.IsZero() {
+			if t, err := commitTime(c); err != nil {
+				return nil, nil, err
+			} else if t.Before(req.since) {
+				continue
+			}
+			selected++
+			for _, p := range c.Parents {
+				pc, err := git.LoadCommit(u.Store, p)
+				if err != nil {
+					return nil, nil, err
+				}
+				if t, err := commitTime(pc); err != nil {
+					return nil, nil, err
+				} else if t.Before(req.since) {
+					cut = true
+				}
+			}
+		}
+		if cut {
+			req.boundary = append(req.boundary, h)
+			if !client[h] {
+				shallow = append(shallow, h)
+			}
+			continue
+		}
+		if client[h] && len(c.Parents) > 0 {
+			unshallow = append(unshallow, h)
+			parents = append(parents, c.Parents...)
+		}
+		for _, p := range c.Parents {
+			if depth[p] == 0 {
+				depth[p] = depth[h] + 1
+				queue = append(queue, p)
+			}
+		}
+	}
+	if !req.since.IsZero() && selected == 0 {
+		return nil, nil, errors.New("upload-pack: no commits selected for shallow requests")
+	}
+	req.wants = append(req.wants, parents...)
+	return shallow, unshallow, nil
+}
+
+// writeShallow writes shallow and unshallow lines.
+func writeShallow(enc *pktline.Encoder, shallow, unshallow []git.Hash) error {
+	for _, h := range shallow {
+		if err := enc.Encodef("shallow %s\n", h); err != nil {
+			return err
+		}
+	}
+	for _, h := range unshallow {
+		if err := enc.Encodef("unshallow %s\n", h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitTime returns the time c was committed.
+func commitTime(c *git.CommitObject) (time.Time, error) {
+	fs := strings.Fields(c.Committer)
+	if len(fs) < 2 {
+		return time.Time{}, fmt.Errorf("%w: invalid committer %q", git.ErrCorrupt, c.Committer)
+	}
+	ts, err := strconv.ParseInt(fs[len(fs)-2], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: invalid committer %q", git.ErrCorrupt, c.Committer)
+	}
+	return time.Unix(ts, 0), nil
+}
+
+// checkShallow reports ErrUnsupported unless the remote supports the
+// shallow and filter arguments required by opts, as reported by has.
+func checkShallow(opts *FetchOptions, has func(string) bool) error {
+	switch {
+	case (len(opts.Shallow) > 0 || opts.Depth > 0) && !has("shallow"):
+		return fmt.Errorf("%w: shallow", ErrUnsupported)
+	case !opts.ShallowSince.IsZero() && !has("deepen-since"):
+		return fmt.Errorf("%w: deepen-since", ErrUnsupported)
+	case !opts.Filter.IsZero() && !has("filter"):
+		return fmt.Errorf("%w: filter", ErrUnsupported)
+	}
+	return nil
+}
+
+// shallowArgs returns arguments sent with wants to limit history and
+// objects as requested by opts.
+func shallowArgs(opts *FetchOptions) []string {
+	var args []string
+	for _, h := range opts.Shallow {
+		args = append(args, "shallow "+h.String())
+	}
+	if opts.Depth > 0 {
+		args = append(args, fmt.Sprintf("deepen %d", opts.Depth))
+	}
+	if !opts.ShallowSince.IsZero() {
+		args = append(args, fmt.Sprintf("deepen-since %d", opts.ShallowSince.Unix()))
+	}
+	if !opts.Filter.IsZero() {
+		args = append(args, "filter "+opts.Filter.String())
+	}
+	return args
+}
+
+// deepening reports whether opts change the depth of history.
+func (opts *FetchOptions) deepening() bool { return opts.Depth > 0 || !opts.ShallowSince.IsZero() }
+
+// shallowSet is a client's set of shallow commits.
+type shallowSet map[git.Hash]bool
+
+func newShallowSet(hashes []git.Hash) shallowSet {
+	s := make(shallowSet)
+	for _, h := range hashes {
+		s[h] = true
+	}
+	return s
+}
+
+// update applies a shallow or unshallow line sent by the remote.
+func (s shallowSet) update(line string) error {
+	var (
+		h  git.Hash
+		ok bool
+	)
+	switch {
+	case strings.HasPrefix(line, "shallow "):
+		if h, ok = parseHash(line[8:]); ok {
+			s[h] = true
+		}
+	case strings.HasPrefix(line, "unshallow "):
+		if h, ok = parseHash(line[10:]); ok {
+			delete(s, h)
+		}
+	}
+	if !ok {
+		return protocolf("unexpected %q in shallow update", line)
+	}
+	return nil
+}
+
+// list returns the shallow commits in sorted order.
+func (s shallowSet) list() []git.Hash {
+	hashes := make([]git.Hash, 0, len(s))
+	for h := range s {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i].Compare(hashes[j]) < 0 })
+	return hashes
+}
+
+// readShallowUpdate reads the shallow update of the original protocol,
+// ending with flush, into s.
+func readShallowUpdate(dec *pktline.Decoder, s shallowSet) error {
+	kind, err := readSection(dec, s.update)
+	if err != nil {
+		return err
+	}
+	if kind != pktline.Flush {
+		return protocolf("unexpected %v in shallow update", kind)
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"dasa.cc/git"
+)
+
+// history writes a chain of n commits to st, each made a second after its
+// parent, returning hashes from the root.
+func history(t *testing.T, st git.Store, n int) []git.Hash {
+	t.Helper()
+	var hashes []git.Hash
+	for i := 0; i < n; i++ {
+		blob := writeObject(t, st, git.Blob, []byte(fmt.Sprint("content ", i)))
+		tree := writeObject(t, st, git.Tree, []byte(fmt.Sprintf("100644 blob %s\tfile.txt\n", blob)))
+		sig := fmt.Sprintf("Gopher <gopher@example.com> %d +0000", 1500000000+i)
+		c := &git.CommitObject{Tree: tree, Author: sig, Committer: sig, Message: fmt.Sprint(i, "\n")}
+		if i > 0 {
+			c.Parents = []git.Hash{hashes[i-1]}
+		}
+		hashes = append(hashes, writeObject(t, st, git.Commit, c.Bytes()))
+	}
+	return hashes
+}
+
+func TestShallow(t *testing.T) {
+	srvst, srvrefs := git.MemStore(), git.MemRefs()
+	c := history(t, srvst, 5)
+	update(t, srvrefs, "refs/heads/master", git.ZeroHash, c[4])
+	srv := httptest.NewServer(&Handler{Store: srvst, Refs: srvrefs})
+	defer srv.Close()
+	ctx := context.Background()
+	specs := []string{"refs/heads/*:refs/heads/*"}
+
+	for _, tc := range []struct {
+		name string
+		opts FetchOptions
+	}{
+		{"local v1", FetchOptions{Transport: &Local{Store: srvst, Refs: srvrefs}, ProtocolVersion: 1}},
+		{"local v2", FetchOptions{Transport: &Local{Store: srvst, Refs: srvrefs}}},
+		{"http v1", FetchOptions{ProtocolVersion: 1}},
+		{"http v2", FetchOptions{}},
+	} {
+		has := func(st git.Store, want []bool) {
+			t.Helper()
+			for i, h := range c {
+				if ok, _ := st.Has(h); ok != want[i] {
+					t.Fatalf("%s: Has(c%d) => %v, want %v", tc.name, i, ok, want[i])
+				}
+			}
+		}
+
+		st, refs := git.MemStore(), git.MemRefs()
+		opts := tc.opts
+		opts.Depth = 2
+		res, err := Fetch(ctx, srv.URL, st, refs, specs, &opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(res.Shallow, []git.Hash{c[3]}) {
+			t.Fatalf("%s: Shallow => %v, want [c3]", tc.name, res.Shallow)
+		}
+		has(st, []bool{false, false, false, true, true})
+
+		// deepen the shallow repository
+		opts.Depth, opts.Shallow = 4, res.Shallow
+		if res, err = Fetch(ctx, srv.URL, st, refs, specs, &opts); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(res.Shallow, []git.Hash{c[1]}) {
+			t.Fatalf("%s: deepened Shallow => %v, want [c1]", tc.name, res.Shallow)
+		}
+		has(st, []bool{false, true, true, true, true})
+		if _, err := git.ReachableWith(st, []git.Hash{c[4]}, nil, git.ReachableOptions{Shallow: res.Shallow}); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		// new commits are fetched without deepening
+		opts.Depth, opts.Shallow = 0, res.Shallow
+		c5 := commit(t, srvst, tc.name, c[4])
+		update(t, srvrefs, "refs/heads/master", c[4], c5)
+		if res, err = Fetch(ctx, srv.URL, st, refs, specs, &opts); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(res.Shallow, []git.Hash{c[1]}) {
+			t.Fatalf("%s: Shallow => %v, want [c1]", tc.name, res.Shallow)
+		}
+		if ok, _ := st.Has(c5); !ok {
+			t.Fatalf("%s: new commit not fetched", tc.name)
+		}
+		update(t, srvrefs, "refs/heads/master", c5, c[4])
+
+		st, refs = git.MemStore(), git.MemRefs()
+		opts = tc.opts
+		opts.ShallowSince = time.Unix(1500000002, 0)
+		if res, err = Fetch(ctx, srv.URL, st, refs, specs, &opts); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(res.Shallow, []git.Hash{c[2]}) {
+			t.Fatalf("%s: since Shallow => %v, want [c2]", tc.name, res.Shallow)
+		}
+		has(st, []bool{false, false, true, true, true})
+
+		opts.ShallowSince = time.Unix(1600000000, 0)
+		if _, err := Fetch(ctx, srv.URL, git.MemStore(), git.MemRefs(), specs, &opts); err == nil {
+			t.Fatalf("%s: no commits since => nil error", tc.name)
+		}
+	}
+}
+
+func TestFetchFilter(t *testing.T) {
+	srvst, srvrefs := git.MemStore(), git.MemRefs()
+	blob := writeObject(t, srvst, git.Blob, bytes.Repeat([]byte("large\n"), 1000))
+	small := writeObject(t, srvst, git.Blob, []byte("small\n"))
+	sub := writeObject(t, srvst, git.Tree, []byte(fmt.Sprintf("100644 blob %s\tsmall.txt\n", small)))
+	tree := writeObject(t, srvst, git.Tree, []byte(fmt.Sprintf("100644 blob %s\tlarge.txt\n040000 tree %s\tsub\n", blob, sub)))
+	sig := "Gopher <gopher@example.com> 1500000000 +0000"
+	c1 := writeObject(t, srvst, git.Commit, (&git.CommitObject{Tree: tree, Author: sig, Committer: sig, Message: "filtered\n"}).Bytes())
+	update(t, srvrefs, "refs/heads/master", git.ZeroHash, c1)
+	remote := &Local{Store: srvst, Refs: srvrefs}
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		filter  string
+		version int
+		want    []git.Hash
+		missing []git.Hash
+	}{
+		{"blob:none", 1, []git.Hash{c1, tree, sub}, []git.Hash{blob, small}},
+		{"blob:none", 2, []git.Hash{c1, tree, sub}, []git.Hash{blob, small}},
+		{"blob:limit=1k", 2, []git.Hash{c1, tree, sub, small}, []git.Hash{blob}},
+		{"tree:0", 2, []git.Hash{c1}, []git.Hash{tree, sub, blob, small}},
+		{"tree:1", 1, []git.Hash{c1, tree}, []git.Hash{sub, blob, small}},
+	} {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		filter, err := git.ParseFilter(tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := git.PackStore(dir)
+		opts := &FetchOptions{Transport: remote, ProtocolVersion: tc.version, Filter: filter}
+		if _, err := Fetch(ctx, "", st, git.MemRefs(), nil, opts); err != nil {
+			t.Fatalf("%s v%d: %v", tc.filter, tc.version, err)
+		}
+		for _, h := range tc.want {
+			if ok, err := st.Has(h); !ok || err != nil {
+				t.Fatalf("%s v%d: Has(%s) => %v, %v", tc.filter, tc.version, h, ok, err)
+			}
+		}
+		for _, h := range tc.missing {
+			if _, err := st.Reader(h); !errors.Is(err, git.ErrPromised) || !errors.Is(err, git.ErrNotExist) {
+				t.Fatalf("%s v%d: Reader(%s) => %v, want ErrPromised", tc.filter, tc.version, h, err)
+			}
+		}
+		ps, _ := filepath.Glob(filepath.Join(dir, "objects", "pack", "*.promisor"))
+		if len(ps) != 1 {
+			t.Fatalf("%s v%d: promisor files %v", tc.filter, tc.version, ps)
+		}
+	}
+}
+
+func TestPromisor(t *testing.T) {
+	srvst, srvrefs := git.MemStore(), git.MemRefs()
+	c := history(t, srvst, 3)
+	update(t, srvrefs, "refs/heads/master", git.ZeroHash, c[2])
+	srv := httptest.NewServer(&Handler{Store: srvst, Refs: srvrefs, AllowReachable: true})
+	defer srv.Close()
+	ctx := context.Background()
+	filter, _ := git.ParseFilter("blob:none")
+
+	for _, tc := range []struct {
+		name string
+		opts FetchOptions
+	}{
+		{"local v1", FetchOptions{Transport: &Local{Store: srvst, Refs: srvrefs, AllowReachable: true}, ProtocolVersion: 1}},
+		{"local v2", FetchOptions{Transport: &Local{Store: srvst, Refs: srvrefs, AllowReachable: true}}},
+		{"http v1", FetchOptions{ProtocolVersion: 1}},
+		{"http v2", FetchOptions{}},
+	} {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		opts := tc.opts
+		opts.Filter = filter
+		if _, err := Fetch(ctx, srv.URL, git.PackStore(dir), git.MemRefs(), nil, &opts); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		opts.Filter = git.Filter{}
+		st := git.NewLazyStore(git.PackStore(dir), &Promisor{URL: srv.URL, Options: &opts})
+		tree, err := git.LoadTree(st, mustCommit(t, st, c[0]).Tree)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		blob := tree[0].Hash
+		if _, err := st.Store.Reader(blob); !errors.Is(err, git.ErrPromised) {
+			t.Fatalf("%s: Reader(blob) => %v, want ErrPromised", tc.name, err)
+		}
+		r, err := st.Reader(blob)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if b, _ := ioutil.ReadAll(r); string(b) != "content 0" {
+			t.Fatalf("%s: fetched %q, want %q", tc.name, b, "content 0")
+		}
+		r.Close()
+		if ok, err := st.Store.Has(blob); !ok || err != nil {
+			t.Fatalf("%s: fetched blob not kept: %v, %v", tc.name, ok, err)
+		}
+		// other blobs remain missing
+		tree, _ = git.LoadTree(st, mustCommit(t, st, c[1]).Tree)
+		if ok, _ := st.Store.Has(tree[0].Hash); ok {
+			t.Fatalf("%s: unwanted blob fetched", tc.name)
+		}
+	}
+
+	// objects not reachable from references are refused
+	missing := writeObject(t, git.MemStore(), git.Blob, []byte("unknown"))
+	err := FetchObjects(ctx, srv.URL, git.MemStore(), []git.Hash{missing}, nil)
+	if err == nil || !strings.Contains(err.Error(), "not our ref") {
+		t.Fatalf("FetchObjects(unreachable) => %v, want not our ref", err)
+	}
+	srv.Config.Handler = &Handler{Store: srvst, Refs: srvrefs}
+	if err := FetchObjects(ctx, srv.URL, git.MemStore(), []git.Hash{c[0]}, nil); err == nil {
+		t.Fatal("FetchObjects without AllowReachable => nil error")
+	}
+}
+
+// mustCommit loads commit h from st.
+func mustCommit(t *testing.T, st git.Store, h git.Hash) *git.CommitObject {
+	t.Helper()
+	c, err := git.LoadCommit(st, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestShallowGit(t *testing.T) {
+	srvst, srvrefs := git.MemStore(), git.MemRefs()
+	c := history(t, srvst, 4)
+	update(t, srvrefs, "refs/heads/master", git.ZeroHash, c[3])
+	srv := httptest.NewServer(&Handler{Store: srvst, Refs: srvrefs})
+	defer srv.Close()
+
+	// git clients of the handler
+	for _, version := range []string{"1", "2"} {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		gitc := func(args ...string) string {
+			return run(t, dir, "git", append([]string{"-c", "protocol.version=" + version}, args...)...)
+		}
+		gitc("clone", "-q", "--depth", "1", srv.URL, "shallow")
+		if n := gitc("-C", "shallow", "rev-list", "--count", "HEAD"); n != "1" {
+			t.Fatalf("v%s: clone --depth 1 has %s commits", version, n)
+		}
+		gitc("-C", "shallow", "fetch", "-q", "--depth", "3")
+		if n := gitc("-C", "shallow", "rev-list", "--count", "origin/master"); n != "3" {
+			t.Fatalf("v%s: fetch --depth 3 has %s commits", version, n)
+		}
+		gitc("-C", "shallow", "fsck")
+
+		gitc("clone", "-q", "--filter=blob:none", "--no-checkout", srv.URL, "partial")
+		missing := gitc("-C", "partial", "rev-list", "--objects", "--missing=print", "HEAD")
+		if n := strings.Count(missing, "?"); n != 4 {
+			t.Fatalf("v%s: clone --filter=blob:none missing %d blobs, want 4:\n%s", version, n, missing)
+		}
+	}
+
+	// fetching from git-upload-pack into a bare repository
+	src := tempDir(t)
+	defer os.RemoveAll(src)
+	gitc := func(args ...string) string {
+		return run(t, src, "git", append([]string{"-c", "user.name=Gopher", "-c", "user.email=gopher@example.com"}, args...)...)
+	}
+	gitc("init", "-q", "-b", "main")
+	gitc("config", "uploadpack.allowFilter", "true")
+	gitc("config", "uploadpack.allowReachableSHA1InWant", "true")
+	for i := 0; i < 3; i++ {
+		ioutil.WriteFile(filepath.Join(src, "file.txt"), bytes.Repeat([]byte("data\n"), i+1), 0644)
+		gitc("add", "file.txt")
+		gitc("commit", "-q", "-m", fmt.Sprint(i))
+	}
+	for _, version := range []int{1, 2} {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		run(t, dir, "git", "init", "-q", "--bare")
+		filter, _ := git.ParseFilter("blob:none")
+		opts := &FetchOptions{ProtocolVersion: version, Depth: 1, Filter: filter}
+		res, err := Fetch(context.Background(), src, git.PackStore(dir), git.DiskRefs(dir), []string{"refs/heads/main:refs/heads/main"}, opts)
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if err := git.WriteShallow(dir, res.Shallow); err != nil {
+			t.Fatal(err)
+		}
+		if shallow, err := git.ReadShallow(dir); err != nil || !reflect.DeepEqual(shallow, res.Shallow) {
+			t.Fatalf("v%d: ReadShallow => %v, %v, want %v", version, shallow, err, res.Shallow)
+		}
+		if n := run(t, dir, "git", "rev-list", "--count", "main"); n != "1" {
+			t.Fatalf("v%d: fetched %s commits, want 1", version, n)
+		}
+		run(t, dir, "git", "config", "remote.origin.url", src)
+		run(t, dir, "git", "config", "remote.origin.promisor", "true")
+		run(t, dir, "git", "config", "extensions.partialClone", "origin")
+		run(t, dir, "git", "fsck")
+
+		// missing blobs are fetched on demand
+		blob := mustHash(t, run(t, src, "git", "rev-parse", "main:file.txt"))
+		st := git.NewLazyStore(git.PackStore(dir), &Promisor{URL: src, Options: &FetchOptions{ProtocolVersion: version}})
+		if _, _, err := st.Stat(blob); err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if out := run(t, dir, "git", "cat-file", "-p", blob.String()); out != strings.TrimSpace(strings.Repeat("data\n", 3)) {
+			t.Fatalf("v%d: cat-file => %q", version, out)
+		}
+		run(t, dir, "git", "fsck")
+	}
+}
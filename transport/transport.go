@@ -0,0 +1,129 @@
+// Package transport implements git pack protocols for serving and fetching
+// repositories backed by any git.Store.
+package transport // import "dasa.cc/git/transport"
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"dasa.cc/git"
+	"dasa.cc/git/pktline"
+)
+
+// Agent identifies this implementation to peers.
+const Agent = "dasa.cc-git"
+
+// ErrProtocol is returned when a peer violates the protocol.
+var ErrProtocol = errors.New("transport: protocol error")
+
+// ErrUnsupported is returned when a remote lacks a required capability.
+var ErrUnsupported = errors.New("transport: unsupported by remote")
+
+// capabilities is a list of capabilities as sent after a NUL byte in a
+// reference advertisement or after the first want.
+type capabilities []string
+
+func parseCapabilities(s string) capabilities { return strings.Fields(s) }
+
+// has reports whether capability name is present, with or without a value.
+func (cs capabilities) has(name string) bool {
+	_, ok := cs.value(name)
+	return ok
+}
+
+// value returns the value of capability name=value.
+func (cs capabilities) value(name string) (string, bool) {
+	for _, c := range cs {
+		if c == name {
+			return "", true
+		}
+		if strings.HasPrefix(c, name+"=") {
+			return c[len(name)+1:], true
+		}
+	}
+	return "", false
+}
+
+// feature reports whether protocol v2 capability name=f1 f2... lists f.
+func (cs capabilities) feature(name, f string) bool {
+	v, _ := cs.value(name)
+	for _, s := range strings.Fields(v) {
+		if s == f {
+			return true
+		}
+	}
+	return false
+}
+
+func (cs capabilities) String() string { return strings.Join(cs, " ") }
+
+// checkFormat returns ErrProtocol if cs names an object format other than f.
+func (cs capabilities) checkFormat(f git.ObjectFormat) error {
+	if v, ok := cs.value("object-format"); ok && v != f.String() {
+		return protocolf("unsupported object-format=%s", v)
+	}
+	return nil
+}
+
+// objectFormat returns the object format of st, which is SHA-1 unless st
+// implements git.ObjectFormatter.
+func objectFormat(st git.Store) git.ObjectFormat {
+	if f, ok := st.(git.ObjectFormatter); ok {
+		return f.ObjectFormat()
+	}
+	return git.SHA1
+}
+
+// protocolVersion returns the version requested by a Git-Protocol header or
+// GIT_PROTOCOL variable, a colon-separated list of key=value parameters.
+func protocolVersion(s string) int {
+	v := 0
+	for _, p := range strings.Split(s, ":") {
+		if strings.HasPrefix(p, "version=") {
+			if n, err := strconv.Atoi(p[8:]); err == nil && n > v {
+				v = n
+			}
+		}
+	}
+	return v
+}
+
+// readLine decodes a data packet, trimming a trailing newline. Other packet
+// kinds return an empty line.
+func readLine(dec *pktline.Decoder) (pktline.Kind, string, error) {
+	kind, b, err := dec.Decode()
+	if err != nil {
+		return kind, "", err
+	}
+	return kind, string(bytes.TrimSuffix(b, []byte("\n"))), nil
+}
+
+// protocolf returns an error wrapping ErrProtocol.
+func protocolf(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrProtocol, fmt.Sprintf(format, a...))
+}
+
+// ctxWriter fails writes once ctx is done.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w ctxWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// parseHash parses a full hexadecimal object name, reporting whether s is
+// one.
+func parseHash(s string) (git.Hash, bool) {
+	h, err := git.ParseHash(s)
+	return h, err == nil
+}
@@ -0,0 +1,417 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"dasa.cc/git"
+	"dasa.cc/git/pktline"
+)
+
+// UploadPack serves git-upload-pack, sending objects of a Store to clients
+// that fetch or clone.
+type UploadPack struct {
+	Store git.Store
+	Refs  git.RefStore
+
+	// StatelessRPC is set when each request is served independently, as
+	// over HTTP, rather than on a single bidirectional connection.
+	StatelessRPC bool
+
+	// Version is the protocol version requested by the client. Version 2
+	// serves the ls-refs, fetch and object-info commands of protocol v2;
+	// other versions serve the original protocol.
+	Version int
+
+	// AllowReachable permits clients to want any object reachable from
+	// advertised references, as partial clones fetch missing objects,
+	// rather than only their tips.
+	AllowReachable bool
+}
+
+// advertised returns references as advertised to clients with HEAD first,
+// followed by annotated tags peeled as name^{}.
+func (u *UploadPack) advertised() ([]git.Ref, error) {
+	refs, err := u.Refs.Refs()
+	if err != nil {
+		return nil, err
+	}
+	var adv []git.Ref
+	if head, err := u.Refs.Ref("HEAD"); err == nil && head.Hash != (git.Hash{}) {
+		adv = append(adv, head)
+	}
+	for _, ref := range refs {
+		adv = append(adv, ref)
+		if !strings.HasPrefix(ref.Name, "refs/tags/") {
+			continue
+		}
+		h, _, err := git.Peel(u.Store, ref.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if h != ref.Hash {
+			adv = append(adv, git.Ref{Name: ref.Name + "^{}", Hash: h})
+		}
+	}
+	return adv, nil
+}
+
+// capabilities returns capabilities advertised for refs.
+func (u *UploadPack) capabilities(refs []git.Ref) capabilities {
+	caps := capabilities{"multi_ack_detailed", "multi_ack", "side-band-64k", "side-band", "no-progress", "include-tag", "shallow", "deepen-since", "filter"}
+	if u.AllowReachable {
+		caps = append(caps, "allow-reachable-sha1-in-want")
+	}
+	if len(refs) > 0 && refs[0].Name == "HEAD" && refs[0].Target != "" {
+		caps = append(caps, "symref=HEAD:"+refs[0].Target)
+	}
+	return append(caps, "object-format="+objectFormat(u.Store).String(), "agent="+Agent)
+}
+
+// AdvertiseRefs writes the reference advertisement to w, or the capability
+// advertisement if Version is 2.
+func (u *UploadPack) AdvertiseRefs(w io.Writer) error {
+	if u.Version == 2 {
+		return u.advertiseV2(pktline.NewEncoder(w))
+	}
+	refs, err := u.advertised()
+	if err != nil {
+		return err
+	}
+	return advertise(pktline.NewEncoder(w), refs, u.capabilities(refs))
+}
+
+// advertise writes refs with caps following the first, ending with flush.
+func advertise(enc *pktline.Encoder, refs []git.Ref, caps capabilities) error {
+	if len(refs) == 0 {
+		refs = []git.Ref{{Name: "capabilities^{}", Hash: git.ZeroHash}}
+	}
+	for i, ref := range refs {
+		var err error
+		if i == 0 {
+			err = enc.Encodef("%s %s\x00%s\n", ref.Hash, ref.Name, caps)
+		} else {
+			err = enc.Encodef("%s %s\n", ref.Hash, ref.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return enc.Flush()
+}
+
+// request is a client's upload-pack request.
+type request struct {
+	wants []git.Hash
+	caps  capabilities
+
+	// shallows are the client's shallow commits, whose history is deepened
+	// to depth commits or to commits since, if set.
+	shallows []git.Hash
+	depth    int
+	since    time.Time
+	filter   git.Filter
+
+	// boundary is the shallow history sent, as computed by deepen.
+	boundary []git.Hash
+}
+
+// readWants reads want lines, followed by shallow and filter arguments, up
+// to a flush packet.
+func readWants(dec *pktline.Decoder) (*request, error) {
+	req := &request{}
+	for {
+		kind, line, err := readLine(dec)
+		if err == io.EOF && len(req.wants) == 0 {
+			return req, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if kind == pktline.Flush {
+			return req, nil
+		}
+		if ok, err := req.shallowArg(line); ok {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !strings.HasPrefix(line, "want ") {
+			return nil, protocolf("expected want, got %q", line)
+		}
+		line = line[5:]
+		if i := strings.IndexByte(line, ' '); i != -1 {
+			if len(req.wants) == 0 {
+				req.caps = parseCapabilities(line[i+1:])
+			}
+			line = line[:i]
+		}
+		h, ok := parseHash(line)
+		if !ok {
+			return nil, protocolf("invalid want %q", line)
+		}
+		req.wants = append(req.wants, h)
+	}
+}
+
+// Serve reads a client's request from r and writes the response to w. If
+// StatelessRPC is not set, the request is read after first advertising
+// references and negotiation continues over multiple rounds.
+func (u *UploadPack) Serve(ctx context.Context, r io.Reader, w io.Writer) error {
+	enc := pktline.NewEncoder(ctxWriter{ctx, w})
+	dec := pktline.NewDecoder(r)
+
+	if u.Version == 2 {
+		if !u.StatelessRPC {
+			if err := u.advertiseV2(enc); err != nil {
+				return err
+			}
+		}
+		return u.serveV2(ctx, dec, enc, w)
+	}
+
+	refs, err := u.advertised()
+	if err != nil {
+		return err
+	}
+	if !u.StatelessRPC {
+		if err := advertise(enc, refs, u.capabilities(refs)); err != nil {
+			return err
+		}
+	}
+
+	req, err := readWants(dec)
+	if err == nil {
+		err = req.caps.checkFormat(objectFormat(u.Store))
+	}
+	if err != nil {
+		enc.Encodef("ERR %s\n", err)
+		return err
+	}
+	if len(req.wants) == 0 {
+		return nil
+	}
+	if err := u.checkWants(refs, req.wants); err != nil {
+		enc.Encodef("ERR %s\n", err)
+		return err
+	}
+
+	// a request to deepen is answered before negotiation
+	shallow, unshallow, err := u.deepen(req)
+	if err != nil {
+		enc.Encodef("ERR %s\n", err)
+		return err
+	}
+	if req.deepening() {
+		if err := writeShallow(enc, shallow, unshallow); err != nil {
+			return err
+		}
+		if err := enc.Flush(); err != nil {
+			return err
+		}
+	}
+
+	common, err := u.negotiate(dec, enc, req.caps)
+	if err != nil || common == nil {
+		return err
+	}
+	return u.sendPack(ctx, enc, w, req, refs, common)
+}
+
+// checkWants reports an error unless every want is the tip of a reference in
+// refs or, if AllowReachable is set, reachable from one.
+func (u *UploadPack) checkWants(refs []git.Ref, wants []git.Hash) error {
+	ours := u.ours(refs)
+	for _, h := range wants {
+		ok, err := ours(h)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("upload-pack: not our ref %s", h)
+		}
+	}
+	return nil
+}
+
+// ours returns a function reporting whether an object may be sent, being
+// the tip of a reference in refs or, if AllowReachable is set, reachable
+// from one. Reachable objects are walked once, on first use.
+func (u *UploadPack) ours(refs []git.Ref) func(git.Hash) (bool, error) {
+	tips := make(map[git.Hash]bool)
+	var hashes []git.Hash
+	for _, ref := range refs {
+		if !tips[ref.Hash] {
+			tips[ref.Hash] = true
+			hashes = append(hashes, ref.Hash)
+		}
+	}
+	var reachable map[git.Hash]bool
+	return func(h git.Hash) (bool, error) {
+		if tips[h] {
+			return true, nil
+		}
+		if u.AllowReachable && reachable == nil {
+			objects, err := git.Reachable(u.Store, hashes, nil)
+			if err != nil {
+				return false, err
+			}
+			reachable = make(map[git.Hash]bool, len(objects))
+			for _, o := range objects {
+				reachable[o] = true
+			}
+		}
+		return reachable[h], nil
+	}
+}
+
+// negotiate reads have lines, acknowledging those in common, until the client
+// is done. A nil slice is returned if the client is not done, as when a
+// stateless request ends in flush or, when deepening, ends after wants.
+func (u *UploadPack) negotiate(dec *pktline.Decoder, enc *pktline.Encoder, caps capabilities) ([]git.Hash, error) {
+	var (
+		common = []git.Hash{}
+		acked  = make(map[git.Hash]bool)
+		ack    string
+		first  = true
+	)
+	switch {
+	case caps.has("multi_ack_detailed"):
+		ack = " common"
+	case caps.has("multi_ack"):
+		ack = " continue"
+	}
+
+	for {
+		kind, line, err := readLine(dec)
+		if err == io.EOF && (!u.StatelessRPC || first) {
+			return nil, nil // client hung up
+		}
+		if err != nil {
+			return nil, err
+		}
+		first = false
+		switch {
+		case kind == pktline.Flush:
+			if len(common) == 0 || ack != "" {
+				if err := enc.Encodef("NAK\n"); err != nil {
+					return nil, err
+				}
+			}
+			if u.StatelessRPC {
+				return nil, nil
+			}
+		case line == "done":
+			if len(common) == 0 {
+				return common, enc.Encodef("NAK\n")
+			}
+			if ack != "" {
+				return common, enc.Encodef("ACK %s\n", common[len(common)-1])
+			}
+			return common, nil
+		case strings.HasPrefix(line, "have "):
+			h, ok := parseHash(line[5:])
+			if !ok {
+				return nil, protocolf("invalid have %q", line[5:])
+			}
+			if acked[h] {
+				continue
+			}
+			ok, err = u.Store.Has(h)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			acked[h] = true
+			common = append(common, h)
+			if ack != "" {
+				err = enc.Encodef("ACK %s%s\n", h, ack)
+			} else if len(common) == 1 {
+				err = enc.Encodef("ACK %s\n", h)
+			}
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, protocolf("unexpected %q during negotiation", line)
+		}
+	}
+}
+
+// sendPack writes the pack of objects wanted but not in common, multiplexed
+// over side-band if requested.
+func (u *UploadPack) sendPack(ctx context.Context, enc *pktline.Encoder, w io.Writer, req *request, refs []git.Ref, common []git.Hash) error {
+	var (
+		out      io.Writer = ctxWriter{ctx, w}
+		progress io.Writer
+	)
+	max := 0
+	switch {
+	case req.caps.has("side-band-64k"):
+		max = pktline.Sideband64Max
+	case req.caps.has("side-band"):
+		max = pktline.SidebandMax
+	}
+	if max != 0 {
+		out = pktline.NewSidebandWriter(enc, pktline.BandData, max)
+		if !req.caps.has("no-progress") {
+			progress = pktline.NewSidebandWriter(enc, pktline.BandProgress, max)
+		}
+	}
+	fail := func(err error) error {
+		if max != 0 {
+			pktline.NewSidebandWriter(enc, pktline.BandError, max).Write([]byte(err.Error() + "\n"))
+		}
+		return err
+	}
+
+	objects, err := git.ReachableWith(u.Store, req.wants, common, git.ReachableOptions{
+		Shallow: req.boundary,
+		Filter:  req.filter,
+	})
+	if err != nil {
+		return fail(err)
+	}
+	if req.caps.has("include-tag") {
+		objects = includeTags(objects, refs)
+	}
+	if progress != nil {
+		fmt.Fprintf(progress, "Enumerating objects: %v, done.\n", len(objects))
+	}
+	if err := git.WritePack(out, u.Store, objects); err != nil {
+		return fail(err)
+	}
+	if progress != nil {
+		fmt.Fprintf(progress, "Total %v (delta 0), reused 0 (delta 0)\n", len(objects))
+	}
+	if max != 0 {
+		return enc.Flush()
+	}
+	return nil
+}
+
+// includeTags appends annotated tags of refs that peel to objects.
+func includeTags(objects []git.Hash, refs []git.Ref) []git.Hash {
+	have := make(map[git.Hash]bool, len(objects))
+	for _, h := range objects {
+		have[h] = true
+	}
+	for i, ref := range refs {
+		// peeled refs follow the tag they peel
+		if i == 0 || !strings.HasSuffix(ref.Name, "^{}") {
+			continue
+		}
+		tag := refs[i-1]
+		if have[ref.Hash] && !have[tag.Hash] {
+			have[tag.Hash] = true
+			objects = append(objects, tag.Hash)
+		}
+	}
+	return objects
+}
@@ -0,0 +1,419 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"dasa.cc/git"
+	"dasa.cc/git/pktline"
+)
+
+// capabilitiesV2 returns capabilities advertised with protocol v2.
+func (u *UploadPack) capabilitiesV2() capabilities {
+	return capabilities{"agent=" + Agent, "ls-refs", "fetch=shallow filter ref-in-want", "object-info", "object-format=" + objectFormat(u.Store).String()}
+}
+
+// advertiseV2 writes the protocol v2 capability advertisement.
+func (u *UploadPack) advertiseV2(enc *pktline.Encoder) error {
+	if err := enc.Encodef("version 2\n"); err != nil {
+		return err
+	}
+	for _, c := range u.capabilitiesV2() {
+		if err := enc.Encodef("%s\n", c); err != nil {
+			return err
+		}
+	}
+	return enc.Flush()
+}
+
+// readCommand reads a protocol v2 request for objects of format f, returning
+// its command and arguments. A flush packet in place of a request returns an
+// empty command.
+func readCommand(dec *pktline.Decoder, f git.ObjectFormat) (string, []string, error) {
+	kind, line, err := readLine(dec)
+	if err != nil {
+		return "", nil, err
+	}
+	if kind == pktline.Flush {
+		return "", nil, nil
+	}
+	if !strings.HasPrefix(line, "command=") {
+		return "", nil, protocolf("expected command, got %q", line)
+	}
+	cmd := line[8:]
+
+	// of the client's capabilities, only the object format matters
+	for {
+		if kind, line, err = readLine(dec); err != nil {
+			return "", nil, err
+		}
+		if kind != pktline.Data {
+			break
+		}
+		if err := (capabilities{line}).checkFormat(f); err != nil {
+			return "", nil, err
+		}
+	}
+	if kind == pktline.Flush {
+		return cmd, nil, nil
+	}
+	if kind != pktline.Delim {
+		return "", nil, protocolf("unexpected %v in request", kind)
+	}
+
+	var args []string
+	for {
+		if kind, line, err = readLine(dec); err != nil {
+			return "", nil, err
+		}
+		if kind == pktline.Flush {
+			return cmd, args, nil
+		}
+		if kind != pktline.Data {
+			return "", nil, protocolf("unexpected %v in arguments", kind)
+		}
+		args = append(args, line)
+	}
+}
+
+// serveV2 serves protocol v2 commands until the client hangs up, or a
+// single command if StatelessRPC is set.
+func (u *UploadPack) serveV2(ctx context.Context, dec *pktline.Decoder, enc *pktline.Encoder, w io.Writer) error {
+	neg := &negotiation{reaches: make(map[git.Hash]bool)}
+	for {
+		cmd, args, err := readCommand(dec, objectFormat(u.Store))
+		if err == io.EOF && !u.StatelessRPC {
+			return nil // client hung up
+		}
+		if err != nil {
+			enc.Encodef("ERR %s\n", err)
+			return err
+		}
+		switch cmd {
+		case "":
+			return nil
+		case "ls-refs":
+			err = u.lsRefs(enc, args)
+		case "fetch":
+			err = u.fetch(ctx, enc, w, args, neg)
+		case "object-info":
+			err = u.objectInfo(enc, args)
+		default:
+			err = protocolf("unknown command %q", cmd)
+			enc.Encodef("ERR %s\n", err)
+		}
+		if err != nil || u.StatelessRPC {
+			return err
+		}
+	}
+}
+
+// lsRefs lists references with HEAD first, limited to those matching any
+// ref-prefix argument.
+func (u *UploadPack) lsRefs(enc *pktline.Encoder, args []string) error {
+	var (
+		symrefs, peel bool
+		prefixes      []string
+	)
+	for _, a := range args {
+		switch {
+		case a == "symrefs":
+			symrefs = true
+		case a == "peel":
+			peel = true
+		case strings.HasPrefix(a, "ref-prefix "):
+			prefixes = append(prefixes, a[11:])
+		case a == "unborn":
+			// unborn HEAD is not reported
+		default:
+			err := protocolf("unexpected ls-refs argument %q", a)
+			enc.Encodef("ERR %s\n", err)
+			return err
+		}
+	}
+	match := func(name string) bool {
+		for _, p := range prefixes {
+			if strings.HasPrefix(name, p) {
+				return true
+			}
+		}
+		return len(prefixes) == 0
+	}
+
+	refs, err := u.Refs.Refs()
+	if err != nil {
+		return err
+	}
+	if head, err := u.Refs.Ref("HEAD"); err == nil && head.Hash != (git.Hash{}) {
+		refs = append([]git.Ref{head}, refs...)
+	}
+	for _, ref := range refs {
+		if !match(ref.Name) {
+			continue
+		}
+		line := ref.Hash.String() + " " + ref.Name
+		if symrefs && ref.Target != "" {
+			line += " symref-target:" + ref.Target
+		}
+		if peel && strings.HasPrefix(ref.Name, "refs/tags/") {
+			h, _, err := git.Peel(u.Store, ref.Hash)
+			if err != nil {
+				return err
+			}
+			if h != ref.Hash {
+				line += " peeled:" + h.String()
+			}
+		}
+		if err := enc.Encodef("%s\n", line); err != nil {
+			return err
+		}
+	}
+	return enc.Flush()
+}
+
+// fetch negotiates and sends a pack in sections. The pack is sent once the
+// client is done or every want is reachable from objects in common.
+func (u *UploadPack) fetch(ctx context.Context, enc *pktline.Encoder, w io.Writer, args []string, neg *negotiation) error {
+	fail := func(err error) error {
+		enc.Encodef("ERR %s\n", err)
+		return err
+	}
+
+	var (
+		req      = &request{caps: capabilities{"side-band-64k"}}
+		haves    []git.Hash
+		wantRefs []git.Ref
+		done     bool
+	)
+	for _, a := range args {
+		switch {
+		case strings.HasPrefix(a, "want "):
+			h, ok := parseHash(a[5:])
+			if !ok {
+				return fail(protocolf("invalid want %q", a[5:]))
+			}
+			req.wants = append(req.wants, h)
+		case strings.HasPrefix(a, "want-ref "):
+			ref, err := u.Refs.Ref(a[9:])
+			if err != nil {
+				return fail(fmt.Errorf("upload-pack: unknown ref %s", a[9:]))
+			}
+			wantRefs = append(wantRefs, ref)
+			req.wants = append(req.wants, ref.Hash)
+		case strings.HasPrefix(a, "have "):
+			h, ok := parseHash(a[5:])
+			if !ok {
+				return fail(protocolf("invalid have %q", a[5:]))
+			}
+			haves = append(haves, h)
+		case a == "done":
+			done = true
+		case a == "no-progress" || a == "include-tag":
+			req.caps = append(req.caps, a)
+		case a == "thin-pack" || a == "ofs-delta" || strings.HasPrefix(a, "packfile-uris "):
+			// packs are never thin nor offloaded to URIs
+		default:
+			if ok, err := req.shallowArg(a); ok {
+				if err != nil {
+					return fail(err)
+				}
+				continue
+			}
+			return fail(protocolf("unexpected fetch argument %q", a))
+		}
+	}
+
+	refs, err := u.advertised()
+	if err != nil {
+		return err
+	}
+	if err := u.checkWants(refs, req.wants); err != nil {
+		return fail(err)
+	}
+	shallow, unshallow, err := u.deepen(req)
+	if err != nil {
+		return fail(err)
+	}
+
+	common := []git.Hash{}
+	acked := make(map[git.Hash]bool)
+	for _, h := range haves {
+		if acked[h] {
+			continue
+		}
+		ok, err := u.Store.Has(h)
+		if err != nil {
+			return err
+		}
+		if ok {
+			acked[h] = true
+			common = append(common, h)
+		}
+	}
+
+	if !done {
+		enc.Encodef("acknowledgments\n")
+		for _, h := range common {
+			enc.Encodef("ACK %s\n", h)
+		}
+		if len(common) == 0 {
+			enc.Encodef("NAK\n")
+		}
+		ready, err := neg.ready(u.Store, req.wants, common)
+		if err != nil {
+			return err
+		}
+		if !ready {
+			return enc.Flush()
+		}
+		enc.Encodef("ready\n")
+		enc.Delim()
+	}
+	if req.deepening() {
+		enc.Encodef("shallow-info\n")
+		writeShallow(enc, shallow, unshallow)
+		enc.Delim()
+	}
+	if len(wantRefs) > 0 {
+		enc.Encodef("wanted-refs\n")
+		for _, ref := range wantRefs {
+			enc.Encodef("%s %s\n", ref.Hash, ref.Name)
+		}
+		enc.Delim()
+	}
+	if err := enc.Encodef("packfile\n"); err != nil {
+		return err
+	}
+	return u.sendPack(ctx, enc, w, req, refs, common)
+}
+
+// negotiation holds what is learned while negotiating over the fetch
+// commands of a connection.
+type negotiation struct {
+	// reaches holds objects known to be, or to descend from, a common commit.
+	reaches map[git.Hash]bool
+}
+
+// ready reports whether every want is reachable from a commit in common, so
+// that negotiation may end. Wants are walked together, stopping at commits
+// known to reach common.
+func (n *negotiation) ready(st git.Store, wants, common []git.Hash) (bool, error) {
+	if len(common) == 0 {
+		return false, nil
+	}
+	for _, c := range common {
+		n.reaches[c] = true
+	}
+	// unreached holds commits walked this round without reaching common
+	unreached := make(map[git.Hash]bool)
+	for _, w := range wants {
+		if n.reaches[w] {
+			continue
+		}
+		h, t, err := git.Peel(st, w)
+		if err != nil {
+			return false, err
+		}
+		if t != git.Commit || unreached[h] {
+			return false, nil
+		}
+		ok, err := n.walk(st, h, unreached)
+		if err != nil || !ok {
+			return false, err
+		}
+		n.reaches[w] = true
+	}
+	return true, nil
+}
+
+// walk reports whether commit h reaches common, marking commits on the path
+// found in n.reaches, or every commit walked in unreached if none is found.
+func (n *negotiation) walk(st git.Store, h git.Hash, unreached map[git.Hash]bool) (bool, error) {
+	from := map[git.Hash]git.Hash{h: h} // commit walked to its child
+	queue := []git.Hash{h}
+	for len(queue) > 0 {
+		h := queue[0]
+		queue = queue[1:]
+		if n.reaches[h] {
+			for ; !n.reaches[from[h]]; h = from[h] {
+				n.reaches[from[h]] = true
+			}
+			return true, nil
+		}
+		c, err := git.LoadCommit(st, h)
+		if err != nil {
+			return false, err
+		}
+		for _, p := range c.Parents {
+			if _, ok := from[p]; !ok && !unreached[p] {
+				from[p] = h
+				queue = append(queue, p)
+			}
+		}
+	}
+	for h := range from {
+		unreached[h] = true
+	}
+	return false, nil
+}
+
+// objectInfo reports sizes of objects without sending them. Sizes of
+// objects that fetch would refuse to send, as are missing objects, are left
+// empty.
+func (u *UploadPack) objectInfo(enc *pktline.Encoder, args []string) error {
+	var (
+		size   bool
+		hashes []git.Hash
+	)
+	for _, a := range args {
+		switch {
+		case a == "size":
+			size = true
+		case strings.HasPrefix(a, "oid "):
+			if h, ok := parseHash(a[4:]); ok {
+				hashes = append(hashes, h)
+				continue
+			}
+			fallthrough
+		default:
+			err := protocolf("unexpected object-info argument %q", a)
+			enc.Encodef("ERR %s\n", err)
+			return err
+		}
+	}
+
+	refs, err := u.advertised()
+	if err != nil {
+		return err
+	}
+	ours := u.ours(refs)
+	if size {
+		enc.Encodef("size\n")
+	}
+	for _, h := range hashes {
+		line := h.String()
+		if size {
+			line += " "
+			ok, err := ours(h)
+			if err != nil {
+				return err
+			}
+			if ok {
+				_, n, err := u.Store.Stat(h)
+				if err != nil && !errors.Is(err, git.ErrNotExist) {
+					return err
+				}
+				if err == nil {
+					line += fmt.Sprint(n)
+				}
+			}
+		}
+		if err := enc.Encodef("%s\n", line); err != nil {
+			return err
+		}
+	}
+	return enc.Flush()
+}
@@ -16,27 +16,33 @@ func (t Type) String() string {
 		return "tree"
 	case Commit:
 		return "commit"
+	case Tag:
+		return "tag"
 	}
-	panic(fmt.Sprintf("missing type: %#v", t))
+	return fmt.Sprintf("Type(%d)", int(t))
 }
 
 // Header returns nul terminated header string for git object.
-func (t Type) Header(length int) []byte {
+func (t Type) Header(length int64) []byte {
 	return []byte(fmt.Sprintf("%s %v\x00", t, length))
 }
 
-// ParseType parses object type from bytes.
-func ParseType(q []byte) Type {
+// ParseType parses object type from bytes. The returned error wraps ErrCorrupt
+// if q does not name a known type.
+func ParseType(q []byte) (Type, error) {
 	if bytes.Equal(q, []byte("blob")) {
-		return Blob
+		return Blob, nil
 	}
 	if bytes.Equal(q, []byte("tree")) {
-		return Tree
+		return Tree, nil
 	}
 	if bytes.Equal(q, []byte("commit")) {
-		return Commit
+		return Commit, nil
 	}
-	panic(fmt.Sprintf("missing type: %q", q))
+	if bytes.Equal(q, []byte("tag")) {
+		return Tag, nil
+	}
+	return 0, fmt.Errorf("%w: unknown type %q", ErrCorrupt, q)
 }
 
 // Git Object Types
@@ -44,4 +50,5 @@ const (
 	Blob Type = iota
 	Tree
 	Commit
+	Tag
 )
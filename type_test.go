@@ -1,6 +1,11 @@
 package git
 
-import "testing"
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
 
 var header []byte
 
@@ -9,3 +14,130 @@ func BenchmarkTypeHeader(b *testing.B) {
 		header = Blob.Header(20048)
 	}
 }
+
+func TestParseType(t *testing.T) {
+	for _, typ := range []Type{Blob, Tree, Commit, Tag} {
+		have, err := ParseType([]byte(typ.String()))
+		if err != nil {
+			t.Fatalf("ParseType(%q) failed: %s", typ, err)
+		}
+		if have != typ {
+			t.Fatalf("ParseType(%q) => %s, want %s", typ, have, typ)
+		}
+	}
+	if _, err := ParseType([]byte("bogus")); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("ParseType(%q) => %v, want ErrCorrupt", "bogus", err)
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	for _, tc := range []struct {
+		spec       string
+		depth      int
+		size       int64
+		tree, blob bool
+	}{
+		{"", 1, 1, false, false},
+		{"blob:none", 5, 0, false, true},
+		{"blob:limit=1k", 1, 1023, false, false},
+		{"blob:limit=1k", 1, 1024, false, true},
+		{"blob:limit=2m", 1, 2 << 20, false, true},
+		{"tree:0", 0, 0, true, true},
+		{"tree:2", 1, 0, false, false},
+		{"tree:2", 2, 0, true, true},
+	} {
+		f, err := ParseFilter(tc.spec)
+		if err != nil {
+			t.Fatalf("ParseFilter(%q) failed: %s", tc.spec, err)
+		}
+		if f.String() != tc.spec || f.IsZero() != (tc.spec == "") {
+			t.Fatalf("ParseFilter(%q) => %q, IsZero %v", tc.spec, f, f.IsZero())
+		}
+		if tree := f.omitTree(tc.depth); tree != tc.tree {
+			t.Fatalf("%q: omitTree(%v) => %v, want %v", tc.spec, tc.depth, tree, tc.tree)
+		}
+		blob, _ := f.omitBlob(tc.depth, func() (int64, error) { return tc.size, nil })
+		if blob != tc.blob {
+			t.Fatalf("%q: omitBlob(%v, %v) => %v, want %v", tc.spec, tc.depth, tc.size, blob, tc.blob)
+		}
+	}
+	for _, spec := range []string{"blob", "blob:limit=", "blob:limit=-1", "blob:limit=1x", "tree:-1", "sparse:oid=HEAD"} {
+		if _, err := ParseFilter(spec); err == nil {
+			t.Fatalf("ParseFilter(%q) => nil error", spec)
+		}
+	}
+}
+
+func TestParseHash(t *testing.T) {
+	for _, s := range []string{
+		"8c01d89ae06311834ee4b1fab2f0414d35f01102",
+		"2b3ef9c7a1d0f4e5c6b7a8d9e0f1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3",
+	} {
+		h, err := ParseHash(s)
+		if err != nil {
+			t.Fatalf("ParseHash(%q) failed: %s", s, err)
+		}
+		if h.String() != s || h.ObjectFormat().HexSize() != len(s) || h.IsZero() {
+			t.Fatalf("ParseHash(%q) => %s, %v", s, h, h.ObjectFormat())
+		}
+		if NewHash(h.Bytes()) != h {
+			t.Fatalf("NewHash(%x) => %s, want %s", h.Bytes(), NewHash(h.Bytes()), h)
+		}
+		b, err := json.Marshal(map[Hash]Hash{h: h})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m map[Hash]Hash
+		if err := json.Unmarshal(b, &m); err != nil || m[h] != h {
+			t.Fatalf("json.Unmarshal(%s) => %v, %v", b, m, err)
+		}
+	}
+	for _, s := range []string{"", "8c01d89", strings.Repeat("g", 40), strings.ToUpper(ZeroHash.String() + "a")} {
+		if _, err := ParseHash(s); err == nil {
+			t.Fatalf("ParseHash(%q) => nil error", s)
+		}
+	}
+	if !ZeroHash.IsZero() || !SHA256.ZeroHash().IsZero() || !(Hash{}).IsZero() || (Hash{}).String() != "" {
+		t.Fatal("zero hashes not IsZero")
+	}
+	if ZeroHash == SHA256.ZeroHash() || ZeroHash == (Hash{}) {
+		t.Fatal("zero hashes of different formats are equal")
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	h, _ := ParseHash("8c01d89ae06311834ee4b1fab2f0414d35f01102")
+	o, _ := ParseHash("8c01e89ae06311834ee4b1fab2f0414d35f01102")
+	for _, tc := range []struct {
+		s    string
+		h, o bool
+		full bool
+	}{
+		{"8", true, true, false},
+		{"8c01", true, true, false},
+		{"8c01d", true, false, false},
+		{"8c01d8", true, false, false},
+		{"8c01d0", false, false, false},
+		{h.String(), true, false, true},
+	} {
+		p, err := ParsePrefix(tc.s)
+		if err != nil {
+			t.Fatalf("ParsePrefix(%q) failed: %s", tc.s, err)
+		}
+		if p.String() != tc.s || p.Len() != len(tc.s) {
+			t.Fatalf("ParsePrefix(%q) => %s", tc.s, p)
+		}
+		if p.Match(h) != tc.h || p.Match(o) != tc.o {
+			t.Fatalf("%s: Match => %v %v, want %v %v", p, p.Match(h), p.Match(o), tc.h, tc.o)
+		}
+		if full, ok := p.Hash(); ok != tc.full || ok && full != h {
+			t.Fatalf("%s: Hash() => %s, %v", p, full, ok)
+		}
+		if tc.h && h.Abbrev(p.Len()) != p {
+			t.Fatalf("Abbrev(%d) => %s, want %s", p.Len(), h.Abbrev(p.Len()), p)
+		}
+	}
+	if !(Prefix{}).Match(h) {
+		t.Fatal("zero Prefix does not match")
+	}
+}
@@ -0,0 +1,359 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// UnpackObjects reads a packfile from r and writes every object to st,
+// returning hashes of objects in pack order. The pack's checksum is verified
+// and commits, trees and tags are checked to be well formed.
+//
+// Deltas may refer to bases in st, such as sent in thin packs. Objects
+// written before an error is encountered remain in st. The pack is of the
+// object format of st.
+func UnpackObjects(r io.Reader, st Store) ([]Hash, error) {
+	format := formatOf(st)
+	cr := &countReader{br: bufio.NewReader(r), hh: format.New()}
+
+	hdr := make([]byte, 12)
+	if _, err := io.ReadFull(cr, hdr); err != nil {
+		return nil, corrupt(err)
+	}
+	if string(hdr[:4]) != "PACK" {
+		return nil, fmt.Errorf("%w: not a packfile", ErrCorrupt)
+	}
+	if v := binary.BigEndian.Uint32(hdr[4:]); v != 2 && v != 3 {
+		return nil, fmt.Errorf("%w: unsupported pack version %v", ErrCorrupt, v)
+	}
+	count := binary.BigEndian.Uint32(hdr[8:])
+
+	var (
+		hashes  = make([]Hash, 0, prealloc(count))
+		offsets = make(map[int64]Hash) // offset to hash of non-delta objects
+		deltas  []delta
+		byOfs   = make(map[int64][]int) // base offset to dependent deltas
+		byHash  = make(map[Hash][]int)  // base hash to dependent deltas
+		spool   *os.File                // compressed delta data
+		sw      *bufio.Writer
+		spooled int64
+	)
+	defer func() {
+		if spool != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+		}
+	}()
+	for i := uint32(0); i < count; i++ {
+		ofs := cr.n
+		typ, size, err := cr.objectHeader()
+		if err != nil {
+			return hashes, err
+		}
+		switch typ {
+		case packCommit, packTree, packBlob, packTag:
+			h, err := unpackObject(st, packTypes[typ], size, cr, format)
+			if err != nil {
+				return hashes, err
+			}
+			offsets[ofs] = h
+			hashes = append(hashes, h)
+		case packOfsDelta, packRefDelta:
+			d := delta{ofs: ofs, baseOfs: -1, size: size}
+			if typ == packOfsDelta {
+				rel, err := cr.offset()
+				if err != nil {
+					return hashes, err
+				}
+				if rel <= 0 || rel > ofs {
+					return hashes, fmt.Errorf("%w: invalid delta base offset", ErrCorrupt)
+				}
+				d.baseOfs = ofs - rel
+				byOfs[d.baseOfs] = append(byOfs[d.baseOfs], len(deltas))
+			} else {
+				sum := make([]byte, format.Size())
+				if _, err := io.ReadFull(cr, sum); err != nil {
+					return hashes, corrupt(err)
+				}
+				d.base = NewHash(sum)
+				byHash[d.base] = append(byHash[d.base], len(deltas))
+			}
+			if spool == nil {
+				if spool, err = ioutil.TempFile("", "gitunpack"); err != nil {
+					return hashes, err
+				}
+				sw = bufio.NewWriter(spool)
+			}
+			// keep compressed data only, to be inflated once the base is known
+			n0 := cr.n
+			cr.tee = sw
+			err = skipN(cr, size)
+			cr.tee = nil
+			if err != nil {
+				return hashes, err
+			}
+			d.data = spooled
+			spooled += cr.n - n0
+			deltas = append(deltas, d)
+		default:
+			return hashes, fmt.Errorf("%w: unknown pack object type %v", ErrCorrupt, typ)
+		}
+	}
+
+	sum := cr.hh.Sum(nil)
+	trailer := make([]byte, format.Size())
+	if _, err := io.ReadFull(cr.br, trailer); err != nil {
+		return hashes, corrupt(err)
+	}
+	if !bytes.Equal(sum, trailer) {
+		return hashes, fmt.Errorf("%w: pack checksum mismatch", ErrCorrupt)
+	}
+	if len(deltas) == 0 {
+		return hashes, nil
+	}
+	if err := sw.Flush(); err != nil {
+		return hashes, err
+	}
+
+	// resolve the dependents of each base as it becomes available, starting
+	// from non-delta objects and bases already in st
+	var stack []deltaBase
+	for _, d := range deltas {
+		if d.baseOfs >= 0 {
+			if h, ok := offsets[d.baseOfs]; ok {
+				stack = append(stack, deltaBase{hash: h, ofs: d.baseOfs})
+			}
+			continue
+		}
+		ok, err := st.Has(d.base)
+		if err != nil {
+			return hashes, err
+		}
+		if ok {
+			stack = append(stack, deltaBase{hash: d.base, ofs: -1})
+		}
+	}
+	resolved := 0
+	for len(stack) > 0 {
+		b := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		deps := append(byOfs[b.ofs], byHash[b.hash]...)
+		delete(byOfs, b.ofs)
+		delete(byHash, b.hash)
+		if len(deps) == 0 {
+			continue
+		}
+		if b.data == nil {
+			r, err := st.Reader(b.hash)
+			if err != nil {
+				return hashes, err
+			}
+			b.t = r.Type()
+			b.data, err = ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				return hashes, err
+			}
+		}
+		for _, i := range deps {
+			d := deltas[i]
+			patch, err := inflateN(bufio.NewReader(io.NewSectionReader(spool, d.data, spooled-d.data)), d.size)
+			if err != nil {
+				return hashes, err
+			}
+			data, err := applyDelta(b.data, patch)
+			if err != nil {
+				return hashes, err
+			}
+			h, err := unpackObject(st, b.t, int64(len(data)), bytes.NewReader(data), format)
+			if err != nil {
+				return hashes, err
+			}
+			hashes = append(hashes, h)
+			resolved++
+			if len(byOfs[d.ofs]) > 0 || len(byHash[h]) > 0 {
+				stack = append(stack, deltaBase{hash: h, ofs: d.ofs, t: b.t, data: data})
+			}
+		}
+	}
+	if resolved < len(deltas) {
+		return hashes, fmt.Errorf("%w: %v deltas with missing base", ErrCorrupt, len(deltas)-resolved)
+	}
+	return hashes, nil
+}
+
+// delta is a deltified object awaiting its base.
+type delta struct {
+	ofs     int64 // offset in the pack
+	base    Hash  // base of a ref delta
+	baseOfs int64 // offset of the base of an ofs delta, or -1
+	data    int64 // offset of compressed delta data in the spool
+	size    int64 // size of inflated delta data
+}
+
+// deltaBase is an object whose dependent deltas are to be resolved. data is
+// nil if the content is yet to be read.
+type deltaBase struct {
+	hash Hash
+	ofs  int64 // offset in the pack, or -1
+	t    Type
+	data []byte
+}
+
+// unpackObject writes object content to st, checking non-blob content is
+// well formed in object format f. If r is the pack's countReader, content
+// is inflated.
+func unpackObject(st Store, t Type, size int64, r io.Reader, f ObjectFormat) (Hash, error) {
+	var pr *packReader
+	if cr, ok := r.(*countReader); ok {
+		zr, err := zlib.NewReader(cr)
+		if err != nil {
+			return Hash{}, corrupt(err)
+		}
+		defer zr.Close()
+		pr = &packReader{io.LimitReader(zr, size), zr, size}
+		r = pr
+	}
+
+	if t != Blob {
+		// declared length is not trusted for preallocation
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return Hash{}, corrupt(err)
+		}
+		if err := checkObject(t, b, f); err != nil {
+			return Hash{}, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	w := st.Writer()
+	if _, err := w.WriteRawHeader(t, size); err != nil {
+		return Hash{}, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return Hash{}, err
+	}
+	if pr != nil {
+		if err := drain(pr.zr); err != nil {
+			return Hash{}, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return Hash{}, err
+	}
+	return w.Hash(), nil
+}
+
+// checkObject reports whether content b of type t is well formed, naming
+// objects in object format f.
+func checkObject(t Type, b []byte, f ObjectFormat) error {
+	var err error
+	switch t {
+	case Commit:
+		_, err = ReadCommit(bytes.NewReader(b))
+	case Tree:
+		var entries []TreeEntry
+		if entries, err = ReadTreeFormat(bytes.NewReader(b), f); err == nil {
+			for _, e := range entries {
+				if e.Name == "" || e.Name == "." || e.Name == ".." || bytes.ContainsAny([]byte(e.Name), "/\x00") {
+					return fmt.Errorf("%w: invalid tree entry name %q", ErrCorrupt, e.Name)
+				}
+			}
+		}
+	case Tag:
+		_, err = ReadTag(bytes.NewReader(b))
+	}
+	return err
+}
+
+// maxPrealloc bounds the capacity allocated up front for the objects of a
+// pack, whose count is read from an untrusted header.
+const maxPrealloc = 1 << 16
+
+// prealloc returns the capacity to allocate for count objects of a pack.
+func prealloc(count uint32) int {
+	if count > maxPrealloc {
+		return maxPrealloc
+	}
+	return int(count)
+}
+
+// countReader counts and hashes bytes read. countReader implements
+// io.ByteReader so inflating reads no further than the end of each object.
+type countReader struct {
+	br *bufio.Reader
+	hh hash.Hash
+	n  int64
+
+	// tee, if not nil, receives a copy of bytes read.
+	tee io.Writer
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.br.Read(p)
+	r.hh.Write(p[:n])
+	if r.tee != nil {
+		r.tee.Write(p[:n])
+	}
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *countReader) ReadByte() (byte, error) {
+	c, err := r.br.ReadByte()
+	if err == nil {
+		r.hh.Write([]byte{c})
+		if r.tee != nil {
+			r.tee.Write([]byte{c})
+		}
+		r.n++
+	}
+	return c, err
+}
+
+// objectHeader reads a pack object's type and size.
+func (r *countReader) objectHeader() (byte, int64, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, corrupt(err)
+	}
+	typ := (c >> 4) & 7
+	size := int64(c & 15)
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, 0, corrupt(err)
+		}
+		if shift > 56 {
+			return 0, 0, fmt.Errorf("%w: object size overflow", ErrCorrupt)
+		}
+		size |= int64(c&0x7f) << shift
+	}
+	return typ, size, nil
+}
+
+// offset reads the relative base offset of an ofs delta.
+func (r *countReader) offset() (int64, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, corrupt(err)
+	}
+	rel := int64(c & 0x7f)
+	for c&0x80 != 0 {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, corrupt(err)
+		}
+		if rel > 1<<55 {
+			return 0, fmt.Errorf("%w: offset overflow", ErrCorrupt)
+		}
+		rel = ((rel + 1) << 7) | int64(c&0x7f)
+	}
+	return rel, nil
+}
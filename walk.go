@@ -0,0 +1,277 @@
+package git
+
+import "errors"
+
+// Reachable returns hashes of all objects reachable from wants that are not
+// reachable from haves. Wants may name commits, trees, blobs or annotated
+// tags; haves that do not exist in st are ignored.
+//
+// Trees of commits bordering on history reachable from haves are excluded
+// rather than all objects reachable from haves, so the result may contain
+// objects also reachable from haves.
+func Reachable(st Store, wants, haves []Hash) ([]Hash, error) {
+	return ReachableWith(st, wants, haves, ReachableOptions{})
+}
+
+// ReachableOptions limit the history and objects walked by ReachableWith.
+type ReachableOptions struct {
+	// Shallow commits are walked without their parents, as the boundary
+	// of a shallow clone's history.
+	Shallow []Hash
+
+	// Filter omits trees and blobs other than those named by wants.
+	Filter Filter
+
+	// Promised objects, missing from a partial clone as reported by
+	// ErrPromised, bound the walk rather than failing it, being expected
+	// from the promisor remote along with the objects they reference.
+	Promised bool
+}
+
+// ReachableWith is like Reachable, limited by opts.
+func ReachableWith(st Store, wants, haves []Hash, opts ReachableOptions) ([]Hash, error) {
+	w := &walker{
+		st:       st,
+		seen:     make(map[Hash]bool),
+		exclude:  make(map[Hash]bool),
+		filter:   opts.Filter,
+		promised: opts.Promised,
+	}
+	shallow := make(map[Hash]bool)
+	for _, h := range opts.Shallow {
+		shallow[h] = true
+	}
+
+	// commits reachable from haves are uninteresting
+	uninteresting := make(map[Hash]bool)
+	var edges []Hash
+	queue := make([]Hash, 0, len(haves))
+	for _, h := range haves {
+		if ok, err := st.Has(h); err != nil || !ok {
+			continue
+		}
+		h, t, err := Peel(st, h)
+		if err != nil {
+			return nil, err
+		}
+		if t == Commit && !uninteresting[h] {
+			uninteresting[h] = true
+			queue = append(queue, h)
+			edges = append(edges, h)
+		}
+	}
+	for len(queue) > 0 {
+		c, err := LoadCommit(st, queue[0])
+		if w.isPromised(err) {
+			queue = queue[1:]
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if shallow[queue[0]] {
+			queue = queue[1:]
+			continue
+		}
+		queue = queue[1:]
+		for _, p := range c.Parents {
+			if !uninteresting[p] {
+				uninteresting[p] = true
+				queue = append(queue, p)
+			}
+		}
+	}
+
+	// walk commits from wants, noting objects to walk afterwards
+	var commits, roots, wanted []Hash
+	for _, h := range wants {
+		for !w.seen[h] {
+			t, _, err := st.Stat(h)
+			if w.isPromised(err) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if t == Commit {
+				if !uninteresting[h] {
+					queue = append(queue, h)
+				}
+				break
+			}
+			w.seen[h] = true
+			w.out = append(w.out, h)
+			if t == Tree {
+				wanted = append(wanted, h)
+				break
+			}
+			if t != Tag {
+				break
+			}
+			tag, err := LoadTag(st, h)
+			if w.isPromised(err) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			h = tag.Object
+		}
+	}
+	for len(queue) > 0 {
+		h := queue[0]
+		queue = queue[1:]
+		if w.seen[h] {
+			continue
+		}
+		w.seen[h] = true
+		c, err := LoadCommit(st, h)
+		if w.isPromised(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, h)
+		roots = append(roots, c.Tree)
+		if shallow[h] {
+			continue
+		}
+		for _, p := range c.Parents {
+			if uninteresting[p] {
+				edges = append(edges, p)
+			} else if !w.seen[p] {
+				queue = append(queue, p)
+			}
+		}
+	}
+	w.out = append(w.out, commits...)
+
+	// objects of bordering trees are excluded
+	for _, h := range edges {
+		c, err := LoadCommit(st, h)
+		if w.isPromised(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := w.tree(c.Tree, 0, w.exclude, nil); err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range roots {
+		if w.filter.omitTree(0) {
+			break
+		}
+		if err := w.tree(h, 0, w.seen, &w.out); err != nil {
+			return nil, err
+		}
+	}
+	// wanted trees are not omitted, though their entries may be
+	for _, h := range wanted {
+		if err := w.entries(h, 0, w.seen, &w.out); err != nil {
+			return nil, err
+		}
+	}
+	return w.out, nil
+}
+
+type walker struct {
+	st       Store
+	seen     map[Hash]bool
+	exclude  map[Hash]bool
+	filter   Filter
+	promised bool
+	out      []Hash
+}
+
+// isPromised reports whether err is ErrPromised and promised objects bound
+// the walk.
+func (w *walker) isPromised(err error) bool {
+	return w.promised && errors.Is(err, ErrPromised)
+}
+
+// tree marks tree h at depth and its entries in m, appending newly marked
+// hashes to out if not nil. The filter applies only to out.
+func (w *walker) tree(h Hash, depth int, m map[Hash]bool, out *[]Hash) error {
+	if m[h] || w.exclude[h] {
+		return nil
+	}
+	m[h] = true
+	if out != nil {
+		*out = append(*out, h)
+	}
+	return w.entries(h, depth, m, out)
+}
+
+// entries marks the entries of tree h at depth as tree does.
+func (w *walker) entries(h Hash, depth int, m map[Hash]bool, out *[]Hash) error {
+	entries, err := LoadTree(w.st, h)
+	if w.isPromised(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		switch e.Type() {
+		case Tree:
+			if out != nil && w.filter.omitTree(depth+1) {
+				continue
+			}
+			if err := w.tree(e.Hash, depth+1, m, out); err != nil {
+				return err
+			}
+		case Blob:
+			if m[e.Hash] || w.exclude[e.Hash] {
+				continue
+			}
+			if out != nil {
+				omit, err := w.filter.omitBlob(depth+1, func() (int64, error) {
+					_, n, err := w.st.Stat(e.Hash)
+					return n, err
+				})
+				if w.isPromised(err) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if omit {
+					continue
+				}
+			}
+			m[e.Hash] = true
+			if out != nil {
+				*out = append(*out, e.Hash)
+			}
+		}
+	}
+	return nil
+}
+
+// IsAncestor reports whether commit a is an ancestor of, or equal to,
+// commit b. Pushing b to a reference at a is then a fast-forward.
+func IsAncestor(st Store, a, b Hash) (bool, error) {
+	seen := map[Hash]bool{b: true}
+	queue := []Hash{b}
+	for len(queue) > 0 {
+		h := queue[0]
+		queue = queue[1:]
+		if h == a {
+			return true, nil
+		}
+		c, err := LoadCommit(st, h)
+		if err != nil {
+			return false, err
+		}
+		for _, p := range c.Parents {
+			if !seen[p] {
+				seen[p] = true
+				queue = append(queue, p)
+			}
+		}
+	}
+	return false, nil
+}
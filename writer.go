@@ -1,10 +1,8 @@
 package git
 
 import (
-	"bufio"
 	"bytes"
 	"compress/zlib"
-	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -15,34 +13,54 @@ import (
 )
 
 // Writer writes git object format for blobs, trees, and commits.
-//
-// TODO short writes on tree objects are likely to fail.
 type Writer interface {
 	// Write writes p to the underlying Writer. Write returns an error
-	// if caller has not first called WriteHeader.
+	// if caller has not first called WriteHeader or if more data is
+	// written than declared by WriteHeader.
 	//
 	// Close flushes written data. This does not close the original writer.
+	// Close returns an error if less data was written than declared, or
+	// ErrCollision if data was crafted by a SHA-1 collision attack and
+	// collisions are detected, as by Writers of a DiskStore setting
+	// dasa-git.checkCollisions.
 	io.WriteCloser
 
-	// WriteHeader must be called before writing any data. If you don't know
+	// WriteHeader must be called before writing any data. If size is known,
+	// data is streamed through without intermediary copies. If you don't know
 	// the size of data to be written, pass a negative integer; size is always
-	// ignored for tree types. In such cases, an intermediary file is used
-	// to determine size.
-	WriteHeader(t Type, size int) (int, error)
+	// ignored for tree types. In such cases, data is spooled to memory,
+	// spilling over to an intermediary file once it exceeds SpoolSize, to
+	// determine size.
+	//
+	// Trees are expected as formatted by PrettyReader.
+	WriteHeader(t Type, size int64) (int, error)
+
+	// WriteRawHeader is as WriteHeader, except trees are expected in git's
+	// tree format, as read from packs, and streamed if size is known.
+	WriteRawHeader(t Type, size int64) (int, error)
 
-	// Hash returns sha1 sum of data written.
-	Hash() string
+	// Hash returns the name of the object written, the sha1 sum of its
+	// data unless written in another object format.
+	Hash() Hash
 }
 
+// SpoolSize is the number of bytes a Writer buffers in memory for objects of
+// unknown size before spilling over to a temporary file.
+var SpoolSize = 1 << 20
+
 type writer struct {
 	io.Writer
-	zw *zlib.Writer
-	hh hash.Hash
+	zw     *zlib.Writer
+	hh     hash.Hash
+	format ObjectFormat
 
 	// used in case size is unknown
-	tmp *os.File
-	tw  *treeWriter
-	t   Type
+	sp *spool
+	tw *treeWriter
+	t  Type
+
+	// declared size and bytes written when size is known
+	size, n int64
 
 	wroteHeader bool
 	err         error
@@ -50,33 +68,57 @@ type writer struct {
 }
 
 // NewWriter returns a new Writer that writes to staging.
-func NewWriter(staging io.Writer) Writer {
+func NewWriter(staging io.Writer) Writer { return NewWriterFormat(staging, SHA1) }
+
+// NewWriterFormat returns a new Writer that writes to staging, naming the
+// object and tree entries in object format f.
+func NewWriterFormat(staging io.Writer, f ObjectFormat) Writer {
+	return newWriter(staging, f, false)
+}
+
+// newWriter returns a new Writer as NewWriterFormat, detecting SHA-1
+// collision attacks if detect is set.
+func newWriter(staging io.Writer, f ObjectFormat, detect bool) Writer {
 	// TODO need to insert treeWriter here, before zlib.NewWriter, also not sure about hh ???
 	// actually, maybe after WriteHeader is done.
 	g := &writer{
-		zw: zlib.NewWriter(staging),
-		hh: sha1.New(),
+		zw:     zlib.NewWriter(staging),
+		hh:     f.newObjectHash(detect),
+		format: f,
 	}
 	g.Writer = io.MultiWriter(g.zw, g.hh)
 	return g
 }
 
-func (g *writer) WriteHeader(t Type, s int) (n int, err error) {
+func (g *writer) WriteHeader(t Type, s int64) (int, error) {
+	return g.writeHeader(t, s, t == Tree)
+}
+
+func (g *writer) WriteRawHeader(t Type, s int64) (int, error) {
+	return g.writeHeader(t, s, false)
+}
+
+// writeHeader begins an object of type t and size s, parsing data written
+// as formatted by PrettyReader if pretty is set.
+func (g *writer) writeHeader(t Type, s int64, pretty bool) (n int, err error) {
 	if g.wroteHeader {
 		return 0, errors.New("Header already written.")
 	}
 	g.t = t
 	g.wroteHeader = true
-	if t == Tree || s < 0 {
-		g.tmp, err = ioutil.TempFile("", "gitwriter")
-		g.tw = &treeWriter{
-			Writer: g.tmp,
-			rbuf:   new(bytes.Buffer),
-			wbuf:   new(bytes.Buffer),
-			sum:    make([]byte, 20),
+	if s < 0 || pretty {
+		g.sp = &spool{}
+		if pretty {
+			g.tw = &treeWriter{
+				Writer: g.sp,
+				rbuf:   new(bytes.Buffer),
+				wbuf:   new(bytes.Buffer),
+				sum:    make([]byte, g.format.Size()),
+			}
 		}
 	} else {
-		n, err = g.Write(t.Header(s))
+		g.size = s
+		n, err = g.Writer.Write(t.Header(s))
 	}
 	return
 }
@@ -88,102 +130,162 @@ func (g *writer) Write(p []byte) (int, error) {
 	if g.tw != nil {
 		return g.tw.Write(p)
 	}
-	return g.Writer.Write(p)
+	if g.sp != nil {
+		return g.sp.Write(p)
+	}
+	if int64(len(p)) > g.size-g.n {
+		return 0, fmt.Errorf("write exceeds declared size %v", g.size)
+	}
+	n, err := g.Writer.Write(p)
+	g.n += int64(n)
+	return n, err
 }
 
 func (g *writer) Close() error {
 	if g.tw != nil {
-		defer g.tmp.Close()
-		defer os.Remove(g.tmp.Name())
-
-		fi, err := g.tmp.Stat()
-		if err != nil {
+		if err := g.tw.Close(); err != nil {
 			return err
 		}
-		size := int(fi.Size())
-		_, err = g.tmp.Seek(0, 0)
-		if err != nil {
+	}
+	if g.sp != nil {
+		defer g.sp.Close()
+		if _, err := g.Writer.Write(g.t.Header(g.sp.n)); err != nil {
 			return err
 		}
-		_, err = g.Writer.Write(g.t.Header(size))
+		r, err := g.sp.Reader()
 		if err != nil {
 			return err
 		}
-		_, err = io.Copy(g.Writer, g.tmp)
-		if err != nil {
+		if _, err := io.Copy(g.Writer, r); err != nil {
 			return err
 		}
+	} else if g.n != g.size {
+		return fmt.Errorf("short write: wrote %v of declared size %v", g.n, g.size)
 	}
 
 	if err := g.zw.Close(); err != nil {
 		return err
 	}
+	if err := checkCollision(g.hh); err != nil {
+		return err
+	}
 	if g.finalize != nil {
 		return g.finalize()
 	}
 	return nil
 }
 
-func (g *writer) Hash() string {
-	return fmt.Sprintf("%x", g.hh.Sum(nil))
+func (g *writer) Hash() Hash {
+	return NewHash(g.hh.Sum(nil))
+}
+
+// spool buffers writes in memory, spilling over to a temporary file once
+// SpoolSize is exceeded.
+type spool struct {
+	buf bytes.Buffer
+	tmp *os.File
+	n   int64
+}
+
+func (sp *spool) Write(p []byte) (n int, err error) {
+	if sp.tmp == nil && sp.buf.Len()+len(p) > SpoolSize {
+		if sp.tmp, err = ioutil.TempFile("", "gitwriter"); err != nil {
+			return 0, err
+		}
+		if _, err = sp.buf.WriteTo(sp.tmp); err != nil {
+			return 0, err
+		}
+	}
+	if sp.tmp != nil {
+		n, err = sp.tmp.Write(p)
+	} else {
+		n, err = sp.buf.Write(p)
+	}
+	sp.n += int64(n)
+	return n, err
+}
+
+// Reader returns a reader of all data written.
+func (sp *spool) Reader() (io.Reader, error) {
+	if sp.tmp == nil {
+		return &sp.buf, nil
+	}
+	if _, err := sp.tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return sp.tmp, nil
+}
+
+// Close removes the temporary file, if any.
+func (sp *spool) Close() error {
+	if sp.tmp == nil {
+		return nil
+	}
+	sp.tmp.Close()
+	return os.Remove(sp.tmp.Name())
 }
 
-// treeWriter handles PrettyReader formatted tree stream.
-// TODO this could use some work.
+// treeWriter converts PrettyReader formatted tree entries, one per line,
+// to git's tree format.
 type treeWriter struct {
 	io.Writer
 
 	rbuf *bytes.Buffer
 	wbuf *bytes.Buffer
 
-	// len 20
+	// length of binary object names
 	sum []byte
 }
 
-// TODO this is going to bomb on a short read
-func (g *treeWriter) Write(p []byte) (n int, err error) {
-	var mode, h, name []byte
-
+// Write buffers incomplete lines until completed by subsequent writes.
+func (g *treeWriter) Write(p []byte) (int, error) {
 	g.rbuf.Write(p)
-	r := bufio.NewReader(g.rbuf)
-
 	for {
-		mode, err = r.ReadBytes(' ')
-		if err != nil {
-			break
-		}
-		if mode[0] == '0' {
-			mode = mode[1:]
-		}
-
-		// discard type
-		_, err = r.ReadBytes(' ')
-		if err != nil {
+		i := bytes.IndexByte(g.rbuf.Bytes(), '\n')
+		if i == -1 {
 			break
 		}
-
-		h, err = r.ReadBytes('\t')
-		if err != nil {
-			break
+		if err := g.entry(g.rbuf.Next(i + 1)[:i]); err != nil {
+			return 0, err
 		}
-		h = h[:len(h)-1]
-		_, err = hex.Decode(g.sum, h)
-		if err != nil {
-			break
-		}
-
-		name, err = r.ReadBytes('\n')
-		if err != nil {
-			break
-		}
-		name[len(name)-1] = '\x00'
-
-		g.wbuf.Write(mode)
-		g.wbuf.Write(name)
-		g.wbuf.Write(g.sum)
 	}
+	if _, err := g.Writer.Write(g.wbuf.Bytes()); err != nil {
+		return 0, err
+	}
+	g.wbuf.Reset()
+	return len(p), nil
+}
 
-	n, _ = g.Writer.Write(g.wbuf.Next(len(p)))
+// entry converts a single line formatted as follows:
+// [mode] [type] [hexenc]\t[name]
+func (g *treeWriter) entry(line []byte) error {
+	tab := bytes.IndexByte(line, '\t')
+	if tab == -1 {
+		return fmt.Errorf("%w: tree entry %q missing name", ErrCorrupt, line)
+	}
+	fs := bytes.Fields(line[:tab])
+	if len(fs) != 3 || len(fs[2]) != 2*len(g.sum) {
+		return fmt.Errorf("%w: invalid tree entry %q", ErrCorrupt, line)
+	}
+	if _, err := hex.Decode(g.sum, fs[2]); err != nil {
+		return fmt.Errorf("%w: invalid tree entry %q", ErrCorrupt, line)
+	}
+	mode := fs[0]
+	if mode[0] == '0' {
+		mode = mode[1:]
+	}
+	g.wbuf.Write(mode)
+	g.wbuf.WriteByte(' ')
+	g.wbuf.Write(line[tab+1:])
+	g.wbuf.WriteByte('\x00')
+	g.wbuf.Write(g.sum)
+	return nil
+}
 
-	return n, err
+// Close returns an error if an incomplete line remains.
+func (g *treeWriter) Close() error {
+	if g.rbuf.Len() > 0 {
+		return fmt.Errorf("%w: incomplete tree entry %q", ErrCorrupt, g.rbuf.Bytes())
+	}
+	return nil
 }